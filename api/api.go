@@ -1,13 +1,19 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
 )
 
 // StorageInterface defines the methods the API needs from storage
@@ -18,11 +24,215 @@ type StorageInterface interface {
 	GetID() string
 }
 
+// Decommissioner is implemented by storage that can drain itself
+// before the node leaves the cluster
+type Decommissioner interface {
+	Decommission() error
+}
+
+// ClusterReporter is implemented by storage that can describe its node
+// and the node's view of the cluster
+type ClusterReporter interface {
+	ClusterStatus() (ClusterStatus, error)
+}
+
+// ClusterStatus describes a node, the members of its ring and the peers it
+// is connected to
+type ClusterStatus struct {
+	NodeID            string     `json:"node_id"`
+	Addr              string     `json:"addr"`
+	Draining          bool       `json:"draining"`
+	ReplicationFactor int        `json:"replication_factor"`
+	Ring              []string   `json:"ring"`
+	Peers             []PeerInfo `json:"peers"`
+}
+
+// ReadinessChecker is implemented by storage that can tell whether its node
+// is able to serve requests
+type ReadinessChecker interface {
+	CheckReadiness(ctx context.Context) []HealthCheck
+}
+
+// HealthCheck is the outcome of one readiness check, Error is empty when it
+// passed
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// PeerInfo is a connected peer, Addr is the address it listens on and is
+// empty until the peer announced it
+type PeerInfo struct {
+	Addr       string `json:"addr,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	InRing     bool   `json:"in_ring"`
+}
+
+// ErrPreconditionFailed is returned by ObjectStorage when the ETag of
+// a key doesn't satisfy the request's precondition
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrTooLarge is returned by ObjectStorage when an upload exceeds the size
+// limit of its namespace
+var ErrTooLarge = errors.New("object too large")
+
+// Precondition carries the ETags of If-Match and If-None-Match, "*" matches
+// any existing object
+type Precondition struct {
+	IfMatch     []string
+	IfNoneMatch []string
+}
+
+// PutOptions are the optional parts of an upload
+type PutOptions struct {
+	Precondition
+	// ExpiresAt, when set, lets the storage delete the object after it
+	ExpiresAt time.Time
+	// Size is the length of the upload if known, 0 otherwise
+	Size int64
+	// ContentType and UserMeta are kept with the object and returned on reads
+	ContentType string
+	UserMeta    map[string]string
+	// RequestID is the ID of the request that uploaded the object, it
+	// follows the upload to every node that stores it
+	RequestID string
+}
+
+// WriteResult describes the object an upload produced
+type WriteResult struct {
+	VersionID string
+	ETag      string
+}
+
+// ObjectStorage is implemented by storage that accepts upload options,
+// including ETag preconditions for optimistic concurrency on keys
+type ObjectStorage interface {
+	Put(key string, r io.Reader, opts PutOptions) (WriteResult, error)
+	DeleteIf(key string, cond Precondition) error
+}
+
+// VersionedStorage is implemented by storage that keeps the history of keys
+// in versioned namespaces
+type VersionedStorage interface {
+	StoreDataVersioned(key string, r io.Reader) (string, error)
+	GetVersion(key string, versionID string) (io.ReadCloser, error)
+	ListVersions(key string) ([]VersionInfo, error)
+	DeleteVersion(key string, versionID string) error
+}
+
+// VersionInfo is the metadata of one version of a key
+type VersionInfo struct {
+	VersionID    string    `json:"version_id"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	DeleteMarker bool      `json:"delete_marker,omitempty"`
+	IsLatest     bool      `json:"is_latest"`
+}
+
+// ConflictStorage is implemented by storage that keeps concurrent writes
+// to a key as siblings instead of picking a winner
+type ConflictStorage interface {
+	Siblings(key string) ([]SiblingInfo, error)
+}
+
+// SiblingInfo describes one of the concurrent writes held for a key
+type SiblingInfo struct {
+	Key     string            `json:"key"`
+	Origin  string            `json:"origin"`
+	Size    int64             `json:"size"`
+	Clock   map[string]uint64 `json:"clock"`
+	HLC     string            `json:"hlc"`
+	Current bool              `json:"current"`
+}
+
+// ErrNotFound is returned by ListingStorage for keys without a live object
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo is the metadata of a stored object
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ETag    string    `json:"etag,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+
+	ContentType string            `json:"content_type,omitempty"`
+	UserMeta    map[string]string `json:"metadata,omitempty"`
+}
+
+// ListingStorage is implemented by storage that can describe the objects
+// it holds and enumerate them by key prefix
+type ListingStorage interface {
+	Stat(key string) (ObjectInfo, error)
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// RangeStorage is implemented by storage that can read part of an object
+// without reading all of it, it returns the full size of the object along
+// with length bytes from offset (to the end if length is negative)
+type RangeStorage interface {
+	GetRange(key string, offset int64, length int64) (int64, io.ReadCloser, error)
+}
+
+// RangeContextStorage is implemented by RangeStorage whose ranged reads can
+// be cancelled, including reads that fetch the range from other nodes
+type RangeContextStorage interface {
+	GetRangeContext(ctx context.Context, key string, offset int64, length int64) (int64, io.ReadCloser, error)
+}
+
+// getRange reads part of key, through RangeContextStorage when the storage
+// supports it
+func getRange(ctx context.Context, rs RangeStorage, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	if cs, ok := rs.(RangeContextStorage); ok {
+		return cs.GetRangeContext(ctx, key, offset, length)
+	}
+	return rs.GetRange(key, offset, length)
+}
+
+// ContextStorage is implemented by storage whose reads can be cancelled,
+// including reads that fetch the object from other nodes
+type ContextStorage interface {
+	GetContext(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// ContextObjectStorage is implemented by ObjectStorage whose writes can be
+// traced as part of the request in ctx
+type ContextObjectStorage interface {
+	PutContext(ctx context.Context, key string, r io.Reader, opts PutOptions) (WriteResult, error)
+}
+
+// putContext writes key, through ContextObjectStorage when the storage
+// supports it
+func putContext(ctx context.Context, obj ObjectStorage, key string, r io.Reader, opts PutOptions) (WriteResult, error) {
+	if cs, ok := obj.(ContextObjectStorage); ok {
+		return cs.PutContext(ctx, key, r, opts)
+	}
+	return obj.Put(key, r, opts)
+}
+
+// getContext reads key, through ContextStorage when the storage supports it
+func getContext(ctx context.Context, storage StorageInterface, key string) (io.ReadCloser, error) {
+	if cs, ok := storage.(ContextStorage); ok {
+		return cs.GetContext(ctx, key)
+	}
+	return storage.Get(key)
+}
+
 // APIServer represents the API interface for the distributed storage system
 type APIServer struct {
 	storage StorageInterface
 	address string
 	mux     *http.ServeMux
+	routes  sync.Once
+	// auth, when set, authenticates every request and enforces ACLs
+	auth *Authenticator
+	// presignKey signs presigned URLs, they are refused while it is empty
+	presignKey []byte
+	// logger is where requests are logged, slog.Default() when nil
+	logger *slog.Logger
+	// certFile and keyFile, when set, serve HTTPS
+	certFile string
+	keyFile  string
 }
 
 // NewAPIServer creates a new API server
@@ -36,20 +246,102 @@ func NewAPIServer(storage StorageInterface, address string) *APIServer {
 
 // Response formats for the API
 type Response struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Key     string `json:"key,omitempty"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	Key       string `json:"key,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+	ETag      string `json:"etag,omitempty"`
+}
+
+// SiblingsResponse lists the concurrent writes held for a key
+type SiblingsResponse struct {
+	Success  bool          `json:"success"`
+	Key      string        `json:"key"`
+	Siblings []SiblingInfo `json:"siblings"`
+}
+
+// VersionsResponse lists the versions of a key
+type VersionsResponse struct {
+	Success  bool          `json:"success"`
+	Key      string        `json:"key"`
+	Versions []VersionInfo `json:"versions"`
+}
+
+// ClusterResponse carries the status of a node
+type ClusterResponse struct {
+	Success bool          `json:"success"`
+	Cluster ClusterStatus `json:"cluster"`
+}
+
+// HealthResponse reports whether the node is ready and the checks that
+// decided it
+type HealthResponse struct {
+	Success bool          `json:"success"`
+	Message string        `json:"message"`
+	Checks  []HealthCheck `json:"checks,omitempty"`
+}
+
+// ListResponse is a page of the objects under a prefix
+type ListResponse struct {
+	Success bool         `json:"success"`
+	Prefix  string       `json:"prefix"`
+	Objects []ObjectInfo `json:"objects"`
+	// NextStartAfter is set when more objects follow, pass it back as
+	// start_after for the next page
+	NextStartAfter string `json:"next_start_after,omitempty"`
+}
+
+// UseAuthenticator makes every request authenticate and pass the ACLs of
+// its principal, it must be called before Start
+func (a *APIServer) UseAuthenticator(auth *Authenticator) {
+	a.auth = auth
+}
+
+// UseLogger logs requests to l instead of slog.Default(), it must be called
+// before Start
+func (a *APIServer) UseLogger(l *slog.Logger) {
+	a.logger = l
+}
+
+// UseTLS serves HTTPS with the certificate and key in the PEM files, it
+// must be called before Start
+func (a *APIServer) UseTLS(certFile string, keyFile string) {
+	a.certFile, a.keyFile = certFile, keyFile
 }
 
 // Start initializes and starts the API server
 func (a *APIServer) Start() error {
+	orDefault(a.logger).Info("starting API server", "addr", a.address, "tls", a.certFile != "")
+	if a.certFile != "" {
+		return http.ListenAndServeTLS(a.address, a.certFile, a.keyFile, a.Handler())
+	}
+	return http.ListenAndServe(a.address, a.Handler())
+}
+
+// Handler returns the API's routes behind authentication, if configured,
+// with every request given an ID, logged and counted in the metrics
+func (a *APIServer) Handler() http.Handler {
+	a.routes.Do(a.registerRoutes)
+	if a.auth != nil {
+		return a.instrument(a.auth.Middleware(a.mux))
+	}
+	return a.instrument(a.mux)
+}
+
+func (a *APIServer) registerRoutes() {
 	a.mux.HandleFunc("/upload", a.handleUpload)
 	a.mux.HandleFunc("/get/", a.handleGet)
+	a.mux.HandleFunc("/objects/", a.handleObject)
 	a.mux.HandleFunc("/delete/", a.handleDelete)
+	a.mux.HandleFunc("/versions/", a.handleVersions)
+	a.mux.HandleFunc("/siblings/", a.handleSiblings)
+	a.mux.HandleFunc("/multipart/", a.handleMultipart)
+	a.mux.HandleFunc("/tus/", a.handleTus)
 	a.mux.HandleFunc("/health", a.handleHealth)
-
-	log.Printf("Starting API server on %s", a.address)
-	return http.ListenAndServe(a.address, a.mux)
+	a.mux.Handle("GET /metrics", metrics.Default.Handler())
+	a.mux.HandleFunc("/admin/decommission", a.handleDecommission)
+	a.mux.HandleFunc("/admin/cluster", a.handleCluster)
+	a.mux.HandleFunc("/presign", a.handlePresign)
 }
 
 func (a *APIServer) handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -60,34 +352,244 @@ func (a *APIServer) handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	r.Body = http.MaxBytesReader(w, r.Body, 100<<20)
 
+	// a presigned upload is bound to the key in its URL, not the form
+	var maxSize int64
+	signedKey := ""
+	if isPresigned(r) {
+		signedKey = r.URL.Query().Get("key")
+		var err error
+		if r, maxSize, err = a.verifyPresigned(r, http.MethodPost, signedKey, "key"); err != nil {
+			respondWithError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
 	key := r.FormValue("key")
+	if signedKey != "" {
+		if formKey := r.PostFormValue("key"); formKey != "" && formKey != signedKey {
+			respondWithError(w, http.StatusForbidden, "The form key does not match the presigned URL")
+			return
+		}
+		key = signedKey
+	}
 	if key == "" {
 		key = fmt.Sprintf("file_%d", time.Now().UnixNano())
 	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorize(w, r, ActionWrite, key) {
+		return
+	}
 
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Failed to get file from request: "+err.Error())
 		return
 	}
 	defer file.Close()
+	if maxSize > 0 && header.Size > maxSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File exceeds the %d bytes the presigned URL allows", maxSize))
+		return
+	}
 
-	err = a.storage.StoreData(key, file)
+	opts := PutOptions{
+		Precondition: parsePrecondition(r),
+		ContentType:  header.Header.Get("Content-Type"),
+		RequestID:    RequestID(r.Context()),
+	}
+	opts.ExpiresAt, err = parseExpiry(r.FormValue("ttl"), r.FormValue("expires_at"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.UserMeta, err = parseUserMeta(r.Header, metaPrefix)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var res WriteResult
+	if obj, ok := a.storage.(ObjectStorage); ok {
+		res, err = putContext(r.Context(), obj, key, file, opts)
+	} else if len(opts.IfMatch) > 0 || len(opts.IfNoneMatch) > 0 || !opts.ExpiresAt.IsZero() || len(opts.UserMeta) > 0 {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support upload options")
+		return
+	} else if vs, ok := a.storage.(VersionedStorage); ok {
+		res.VersionID, err = vs.StoreDataVersioned(key, file)
+	} else {
+		err = a.storage.StoreData(key, file)
+	}
+	if errors.Is(err, ErrPreconditionFailed) {
+		respondWithError(w, http.StatusPreconditionFailed, "Precondition failed for key: "+key)
+		return
+	}
+	if errors.Is(err, ErrTooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "File too large for key: "+key)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to store file: "+err.Error())
 		return
 	}
 
+	if res.ETag != "" {
+		w.Header().Set("ETag", quoteETag(res.ETag))
+	}
 	respondWithJSON(w, http.StatusOK, Response{
-		Success: true,
-		Message: "File uploaded successfully",
-		Key:     key,
+		Success:   true,
+		Message:   "File uploaded successfully",
+		Key:       key,
+		VersionID: res.VersionID,
+		ETag:      res.ETag,
+	})
+}
+
+// Handler for /objects/{key}, PUT streams the raw request body into storage
+// so uploads are neither buffered nor capped beyond the namespace limit,
+// GET and HEAD read the object back like /get/
+func (a *APIServer) handleObject(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	if key == "" && r.Method == http.MethodGet {
+		a.listObjects(w, r)
+		return
+	}
+	if key == "" {
+		respondWithError(w, http.StatusBadRequest, "No key provided")
+		return
+	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		a.putObject(w, r, key)
+	case http.MethodGet, http.MethodHead:
+		a.getObject(w, r, key)
+	default:
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET, HEAD and PUT methods are allowed")
+	}
+}
+
+// listObjects lists the objects under ?prefix= in key order, a page of
+// ?limit= at a time after ?start_after=. Objects the caller may not read
+// are left out.
+func (a *APIServer) listObjects(w http.ResponseWriter, r *http.Request) {
+	ls, ok := a.storage.(ListingStorage)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support listing")
+		return
+	}
+	query := r.URL.Query()
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+	}
+	prefix := query.Get("prefix")
+	objects, err := ls.List(prefix)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to list objects: "+err.Error())
+		return
+	}
+	page, next := pageObjects(objects, query.Get("start_after"), limit, func(key string) bool {
+		return a.auth.canRead(r.Context(), key)
+	})
+	if page == nil {
+		page = []ObjectInfo{}
+	}
+	respondWithJSON(w, http.StatusOK, ListResponse{
+		Success:        true,
+		Prefix:         prefix,
+		Objects:        page,
+		NextStartAfter: next,
+	})
+}
+
+// pageObjects returns up to limit (all if 0) of the objects, in key order,
+// that sort after startAfter and that readable allows, along with the last
+// key of the page if more are left
+func pageObjects(objects []ObjectInfo, startAfter string, limit int, readable func(key string) bool) ([]ObjectInfo, string) {
+	var page []ObjectInfo
+	for _, obj := range objects {
+		if obj.Key <= startAfter || !readable(obj.Key) {
+			continue
+		}
+		if limit > 0 && len(page) == limit {
+			return page, page[len(page)-1].Key
+		}
+		page = append(page, obj)
+	}
+	return page, ""
+}
+
+func (a *APIServer) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	if !a.authorize(w, r, ActionWrite, key) {
+		return
+	}
+	opts := PutOptions{
+		Precondition: parsePrecondition(r),
+		Size:         max(r.ContentLength, 0),
+		ContentType:  r.Header.Get("Content-Type"),
+		RequestID:    RequestID(r.Context()),
+	}
+	var err error
+	opts.ExpiresAt, err = parseExpiry(r.URL.Query().Get("ttl"), r.URL.Query().Get("expires_at"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.UserMeta, err = parseUserMeta(r.Header, metaPrefix)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var res WriteResult
+	if obj, ok := a.storage.(ObjectStorage); ok {
+		res, err = putContext(r.Context(), obj, key, r.Body, opts)
+	} else if len(opts.IfMatch) > 0 || len(opts.IfNoneMatch) > 0 || !opts.ExpiresAt.IsZero() || len(opts.UserMeta) > 0 {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support upload options")
+		return
+	} else {
+		err = a.storage.StoreData(key, r.Body)
+	}
+	switch {
+	case errors.Is(err, ErrPreconditionFailed):
+		respondWithError(w, http.StatusPreconditionFailed, "Precondition failed for key: "+key)
+		return
+	case errors.Is(err, ErrTooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Object too large for key: "+key)
+		return
+	case errors.Is(err, errBodyMismatch):
+		respondWithError(w, http.StatusBadRequest, "Body does not match its signed hash")
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "Failed to store object: "+err.Error())
+		return
+	}
+
+	if res.ETag != "" {
+		w.Header().Set("ETag", quoteETag(res.ETag))
+	}
+	respondWithJSON(w, http.StatusOK, Response{
+		Success:   true,
+		Message:   "Object stored successfully",
+		Key:       key,
+		VersionID: res.VersionID,
+		ETag:      res.ETag,
 	})
 }
 
 func (a *APIServer) handleGet(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET and HEAD methods are allowed")
 		return
 	}
 
@@ -96,20 +598,100 @@ func (a *APIServer) handleGet(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "No key provided")
 		return
 	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if isPresigned(r) {
+		var err error
+		if r, _, err = a.verifyPresigned(r, http.MethodGet, key); err != nil {
+			respondWithError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	a.getObject(w, r, key)
+}
 
-	reader, err := a.storage.Get(key)
+// getObject answers a GET or HEAD for key. When the storage can describe
+// the object its size, ETag, modification time, content type and user
+// metadata go in the headers and a HEAD is answered without reading data.
+func (a *APIServer) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	if !a.authorize(w, r, ActionRead, key) {
+		return
+	}
+	versionID := r.URL.Query().Get("version")
+	if versionID == "" {
+		handled, err := writeRangeResponse(w, r, a.storage, key)
+		switch {
+		case errors.Is(err, errRangeNotSatisfiable):
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Range not satisfiable for key: "+key)
+			return
+		case errors.Is(err, ErrNotFound):
+			respondWithError(w, http.StatusNotFound, "File not found: "+err.Error())
+			return
+		case err != nil:
+			respondWithError(w, http.StatusInternalServerError, "Failed to read range: "+err.Error())
+			return
+		}
+		if handled {
+			return
+		}
+	}
+
+	// the object may still be found on another node when it isn't held here
+	var obj *ObjectInfo
+	if ls, ok := a.storage.(ListingStorage); ok && versionID == "" {
+		info, err := ls.Stat(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			respondWithError(w, http.StatusInternalServerError, "Failed to stat file: "+err.Error())
+			return
+		}
+		if err == nil {
+			obj = &info
+		}
+	}
+	if r.Method == http.MethodHead && obj != nil {
+		a.setGetHeaders(w, key, obj)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var reader io.ReadCloser
+	var err error
+	if versionID != "" {
+		vs, ok := a.storage.(VersionedStorage)
+		if !ok {
+			respondWithError(w, http.StatusNotImplemented, "Storage does not support versioning")
+			return
+		}
+		reader, err = vs.GetVersion(key, versionID)
+	} else {
+		reader, err = getContext(r.Context(), a.storage, key)
+	}
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "File not found: "+err.Error())
 		return
 	}
 	defer reader.(io.Closer).Close()
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", key))
-	w.Header().Set("Content-Type", "application/octet-stream")
-
+	a.setGetHeaders(w, key, obj)
 	_, err = io.Copy(w, reader)
 	if err != nil {
-		log.Printf("Error streaming file to client: %v", err)
+		logger(r.Context()).Warn("streaming object to client failed", "key", key, "err", err)
+	}
+}
+
+// setGetHeaders sets the headers of a whole object response, obj is nil
+// when the storage can't describe the object
+func (a *APIServer) setGetHeaders(w http.ResponseWriter, key string, obj *ObjectInfo) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", key))
+	if obj != nil {
+		setObjectHeaders(w, *obj, metaPrefix)
+	} else {
+		w.Header().Set("Content-Type", defaultContentType)
+	}
+	if _, ok := a.storage.(RangeStorage); ok {
+		w.Header().Set("Accept-Ranges", "bytes")
 	}
 }
 
@@ -124,35 +706,273 @@ func (a *APIServer) handleDelete(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "No key provided")
 		return
 	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorize(w, r, ActionDelete, key) {
+		return
+	}
 
-	err := a.storage.Delete(a.storage.GetID(), key)
+	versionID := r.URL.Query().Get("version")
+	var err error
+	if versionID != "" {
+		vs, ok := a.storage.(VersionedStorage)
+		if !ok {
+			respondWithError(w, http.StatusNotImplemented, "Storage does not support versioning")
+			return
+		}
+		err = vs.DeleteVersion(key, versionID)
+	} else if cond := parsePrecondition(r); len(cond.IfMatch) > 0 || len(cond.IfNoneMatch) > 0 {
+		obj, ok := a.storage.(ObjectStorage)
+		if !ok {
+			respondWithError(w, http.StatusNotImplemented, "Storage does not support conditional deletes")
+			return
+		}
+		err = obj.DeleteIf(key, cond)
+	} else {
+		err = a.storage.Delete(a.storage.GetID(), key)
+	}
+	if errors.Is(err, ErrPreconditionFailed) {
+		respondWithError(w, http.StatusPreconditionFailed, "Precondition failed for key: "+key)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete file: "+err.Error())
 		return
 	}
 
+	respondWithJSON(w, http.StatusOK, Response{
+		Success:   true,
+		Message:   "File deleted successfully",
+		Key:       key,
+		VersionID: versionID,
+	})
+}
+
+// Handler for listing the versions of a key
+func (a *APIServer) handleVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/versions/")
+	if key == "" {
+		respondWithError(w, http.StatusBadRequest, "No key provided")
+		return
+	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorize(w, r, ActionRead, key) {
+		return
+	}
+
+	vs, ok := a.storage.(VersionedStorage)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support versioning")
+		return
+	}
+
+	versions, err := vs.ListVersions(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to list versions: "+err.Error())
+		return
+	}
+	if len(versions) == 0 {
+		respondWithError(w, http.StatusNotFound, "No versions found for key")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, VersionsResponse{
+		Success:  true,
+		Key:      key,
+		Versions: versions,
+	})
+}
+
+// Handler for listing the unresolved concurrent writes of a key
+func (a *APIServer) handleSiblings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/siblings/")
+	if key == "" {
+		respondWithError(w, http.StatusBadRequest, "No key provided")
+		return
+	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorize(w, r, ActionRead, key) {
+		return
+	}
+
+	cs, ok := a.storage.(ConflictStorage)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not keep siblings")
+		return
+	}
+
+	siblings, err := cs.Siblings(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to list siblings: "+err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, SiblingsResponse{
+		Success:  true,
+		Key:      key,
+		Siblings: siblings,
+	})
+}
+
+// Handler for draining this node, replies once all of its data has moved
+func (a *APIServer) handleDecommission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	if !a.authorizeAdmin(w, r) {
+		return
+	}
+
+	d, ok := a.storage.(Decommissioner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support decommissioning")
+		return
+	}
+
+	if err := d.Decommission(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to decommission node: "+err.Error())
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, Response{
 		Success: true,
-		Message: "File deleted successfully",
-		Key:     key,
+		Message: "Node decommissioned, safe to shut down",
 	})
 }
 
-// Handler for health check
+// Handler for the status of the node and its view of the cluster
+func (a *APIServer) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	if !a.authorizeAdmin(w, r) {
+		return
+	}
+
+	cr, ok := a.storage.(ClusterReporter)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not report cluster status")
+		return
+	}
+	status, err := cr.ClusterStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to get cluster status: "+err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ClusterResponse{Success: true, Cluster: status})
+}
+
+// Handler for health check, it answers 503 while any readiness check of
+// the storage fails so load balancers route around the node
 func (a *APIServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	respondWithJSON(w, http.StatusOK, Response{
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET and HEAD methods are allowed")
+		return
+	}
+
+	var checks []HealthCheck
+	if rc, ok := a.storage.(ReadinessChecker); ok {
+		checks = rc.CheckReadiness(r.Context())
+	}
+	for _, check := range checks {
+		if !check.OK {
+			respondWithJSON(w, http.StatusServiceUnavailable, HealthResponse{
+				Message: "API server is not ready: " + check.Name + ": " + check.Error,
+				Checks:  checks,
+			})
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, HealthResponse{
 		Success: true,
 		Message: "API server is running",
+		Checks:  checks,
 	})
 }
 
+// parsePrecondition reads the If-Match and If-None-Match headers
+func parsePrecondition(r *http.Request) Precondition {
+	return Precondition{
+		IfMatch:     parseETags(r.Header.Get("If-Match")),
+		IfNoneMatch: parseETags(r.Header.Get("If-None-Match")),
+	}
+}
+
+// parseETags splits an ETag list header, dropping quotes and weak markers
+func parseETags(header string) []string {
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		etag = strings.TrimPrefix(etag, "W/")
+		etag = strings.Trim(etag, `"`)
+		if etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// parseExpiry turns a ttl (a Go duration or whole seconds) or an RFC 3339
+// expires_at into an absolute expiry, zero if neither is set
+func parseExpiry(ttl string, expiresAt string) (time.Time, error) {
+	switch {
+	case ttl != "" && expiresAt != "":
+		return time.Time{}, errors.New("only one of ttl and expires_at may be set")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			secs, serr := strconv.ParseInt(ttl, 10, 64)
+			if serr != nil {
+				return time.Time{}, fmt.Errorf("invalid ttl %q", ttl)
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("ttl must be positive, got %q", ttl)
+		}
+		return time.Now().Add(d), nil
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expires_at %q, want RFC 3339", expiresAt)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
+
 // Helper function to send JSON responses
 func respondWithJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		slog.Error("encoding response failed", "err", err)
 	}
 }
 
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/tracing/tracingtest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHandleObjectPutStreams(t *testing.T) {
+	storage := newMemStorage()
+	a := NewAPIServer(storage, "")
+
+	// a body of unknown length arrives with chunked transfer encoding
+	body := strings.Repeat("streamed data ", 10000)
+	r := httptest.NewRequest(http.MethodPut, "/objects/docs/big.txt", io.NopCloser(strings.NewReader(body)))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	a.handleObject(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200 have %d %s", w.Code, w.Body.String())
+	}
+
+	reader, err := storage.Get("docs/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(reader); string(b) != body {
+		t.Errorf("want %d bytes stored have %d", len(body), len(b))
+	}
+
+	w = httptest.NewRecorder()
+	a.handleObject(w, httptest.NewRequest(http.MethodPost, "/objects/docs/big.txt", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want 405 for POST have %d", w.Code)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	storage := newMemUploads()
+	handler := NewAPIServer(storage, "").Handler()
+
+	// the markers storage appends to keys arrive escaped in the path
+	for _, req := range []struct{ method, target string }{
+		{http.MethodPut, "/objects/docs/a.txt%3Fversion=1"},
+		{http.MethodPut, "/objects/docs/a.txt%3Fshard=1.0"},
+		{http.MethodGet, "/get/docs/a.txt%3Fsibling=1-node"},
+		{http.MethodPost, "/multipart/docs/a.txt%3Fupload=1"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(req.method, req.target, strings.NewReader("x")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: want 400 have %d", req.method, req.target, w.Code)
+		}
+	}
+	if len(storage.uploads) > 0 || len(storage.objects) > 0 {
+		t.Error("want nothing stored under a reserved key")
+	}
+}
+
+func TestHeadObjectMetadata(t *testing.T) {
+	storage := newMemStorage()
+	a := NewAPIServer(storage, "")
+
+	r := httptest.NewRequest(http.MethodPut, "/objects/media/cat.jpg", strings.NewReader("meow"))
+	r.Header.Set("Content-Type", "image/jpeg")
+	r.Header.Set("X-Meta-Owner", "alice")
+	r.Header.Set("x-meta-camera", "pinhole")
+	w := httptest.NewRecorder()
+	a.handleObject(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200 have %d %s", w.Code, w.Body.String())
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"/get/media/cat.jpg":     a.handleGet,
+		"/objects/media/cat.jpg": a.handleObject,
+	}
+	for target, handler := range handlers {
+		for _, method := range []string{http.MethodHead, http.MethodGet} {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(method, target, nil))
+			h := w.Header()
+			if w.Code != http.StatusOK || h.Get("Content-Length") != "4" || h.Get("Content-Type") != "image/jpeg" ||
+				h.Get("ETag") == "" || h.Get("Last-Modified") == "" {
+				t.Errorf("want object described by %s %s have %d %v", method, target, w.Code, h)
+			}
+			if h.Get("X-Meta-Owner") != "alice" || h.Get("X-Meta-Camera") != "pinhole" {
+				t.Errorf("want user metadata from %s %s have %v", method, target, h)
+			}
+			if body := w.Body.String(); (method == http.MethodHead) != (body == "") {
+				t.Errorf("want a body only for GET, %s returned %q", method, body)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	a.handleGet(w, httptest.NewRequest(http.MethodHead, "/get/media/missing.jpg", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404 for a missing key have %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/objects/media/big-meta", strings.NewReader("x"))
+	r.Header.Set("X-Meta-Notes", strings.Repeat("n", maxUserMetaSize))
+	w = httptest.NewRecorder()
+	a.handleObject(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want oversized metadata rejected have %d", w.Code)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	storage := newMemStorage()
+	for _, key := range []string{"docs/a", "docs/b", "docs/c", "media/d"} {
+		storage.StoreData(key, strings.NewReader(key))
+	}
+	a := NewAPIServer(storage, "")
+
+	list := func(target string) ListResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.handleObject(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("want 200 for %s have %d %s", target, w.Code, w.Body.String())
+		}
+		var res ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	page := list("/objects/?prefix=docs/&limit=2")
+	if len(page.Objects) != 2 || page.Objects[0].Key != "docs/a" || page.NextStartAfter != "docs/b" {
+		t.Fatalf("want a first page of two have %+v", page)
+	}
+	page = list("/objects/?prefix=docs/&limit=2&start_after=" + page.NextStartAfter)
+	if len(page.Objects) != 1 || page.Objects[0].Key != "docs/c" || page.NextStartAfter != "" {
+		t.Errorf("want the last page have %+v", page)
+	}
+	if page := list("/objects/"); len(page.Objects) != 4 {
+		t.Errorf("want every object without a prefix have %d", len(page.Objects))
+	}
+}
+
+// unreadyStorage fails the peers readiness check
+type unreadyStorage struct {
+	*memStorage
+}
+
+func (unreadyStorage) CheckReadiness(ctx context.Context) []HealthCheck {
+	return []HealthCheck{{Name: "disk", OK: true}, {Name: "peers", Error: "no peers connected"}}
+}
+
+func TestHandleHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewAPIServer(newMemStorage(), "").handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("want 200 from storage without readiness checks have %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	NewAPIServer(unreadyStorage{newMemStorage()}, "").handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("want 503 with a failing check have %d", w.Code)
+	}
+	var res HealthResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Success || len(res.Checks) != 2 || res.Checks[1].OK || !strings.Contains(res.Message, "peers") {
+		t.Errorf("want the failing check reported have %+v", res)
+	}
+}
+
+func TestRequestSpan(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	h := NewAPIServer(newMemStorage(), "trace-test").Handler()
+	req := httptest.NewRequest(http.MethodGet, "/get/missing.txt", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("want one span have %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /get/" || span.SpanKind != trace.SpanKindServer {
+		t.Errorf("want a server span named after the route have %q %v", span.Name, span.SpanKind)
+	}
+	if span.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Error("want the span to continue the trace of the caller")
+	}
+	var status int64
+	for _, kv := range span.Attributes {
+		if kv.Key == "http.response.status_code" {
+			status = kv.Value.AsInt64()
+		}
+	}
+	if status != http.StatusNotFound {
+		t.Errorf("want the status recorded have %d", status)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	a := NewAPIServer(newMemStorage(), "metrics-test")
+	h := a.Handler()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/get/missing.txt", nil))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200 from /metrics have %d", w.Code)
+	}
+	body := w.Body.String()
+	want := `dfs_http_requests_total{server="metrics-test",route="/get/",method="GET",code="404"} 1`
+	if !strings.Contains(body, want) {
+		t.Errorf("want the request counted by route\n%s\nhave\n%s", want, body)
+	}
+	if !strings.Contains(body, `dfs_http_request_seconds_count{server="metrics-test",route="/get/",method="GET"} 1`) {
+		t.Errorf("want the request timed have\n%s", body)
+	}
+}
@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	hmacAlgorithm  = "DV-HMAC-SHA256"
+	hmacDateHeader = "X-Dv-Date"
+	hmacBodyHeader = "X-Dv-Content-Sha256"
+)
+
+// Action is what a request does to the keys it touches
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+)
+
+var (
+	errUnauthenticated   = errors.New("missing credentials")
+	errInvalidCredential = errors.New("invalid credentials")
+	errSignatureMismatch = errors.New("signature does not match")
+	errRequestExpired    = errors.New("request date is missing or outside the allowed clock skew")
+	errBodyMismatch      = errors.New("body does not match its signed hash")
+)
+
+// Grant allows Actions on every key starting with Prefix, an empty prefix
+// covers all keys
+type Grant struct {
+	Prefix  string   `json:"prefix"`
+	Actions []Action `json:"actions"`
+}
+
+// Principal is a caller of the API. It authenticates with one of its API
+// keys, kept as hex sha256 hashes so the credential file holds no usable
+// keys, or by signing requests with its secret key.
+type Principal struct {
+	Name      string   `json:"name"`
+	APIKeys   []string `json:"api_keys,omitempty"`
+	AccessKey string   `json:"access_key,omitempty"`
+	SecretKey string   `json:"secret_key,omitempty"`
+	// Admin allows the /admin/ endpoints
+	Admin  bool    `json:"admin,omitempty"`
+	Grants []Grant `json:"grants"`
+}
+
+// Allowed reports whether one of the principal's grants covers action on key
+func (p *Principal) Allowed(action Action, key string) bool {
+	for _, grant := range p.Grants {
+		if !strings.HasPrefix(key, grant.Prefix) {
+			continue
+		}
+		for _, allowed := range grant.Actions {
+			if allowed == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticator checks requests against a local credential store and
+// writes every rejected request to its audit log
+type Authenticator struct {
+	byName      map[string]*Principal
+	byAPIKey    map[string]*Principal
+	byAccessKey map[string]*Principal
+	audit       *log.Logger
+	now         func() time.Time
+}
+
+// NewAuthenticator builds an Authenticator over principals, audit entries
+// go to audit
+func NewAuthenticator(principals []Principal, audit io.Writer) (*Authenticator, error) {
+	au := &Authenticator{
+		byName:      make(map[string]*Principal),
+		byAPIKey:    make(map[string]*Principal),
+		byAccessKey: make(map[string]*Principal),
+		audit:       log.New(audit, "audit: ", log.LstdFlags|log.LUTC),
+		now:         time.Now,
+	}
+	for i := range principals {
+		p := &principals[i]
+		if _, ok := au.byName[p.Name]; ok || p.Name == "" {
+			return nil, fmt.Errorf("principal names must be unique and not empty, have %q", p.Name)
+		}
+		au.byName[p.Name] = p
+		for _, hash := range p.APIKeys {
+			hash = strings.ToLower(hash)
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("principal %q: api key hash %q is not a hex sha256", p.Name, hash)
+			}
+			if _, ok := au.byAPIKey[hash]; ok {
+				return nil, fmt.Errorf("principal %q: api key is already in use", p.Name)
+			}
+			au.byAPIKey[hash] = p
+		}
+		if p.AccessKey != "" {
+			if p.SecretKey == "" {
+				return nil, fmt.Errorf("principal %q: access key %q has no secret", p.Name, p.AccessKey)
+			}
+			if _, ok := au.byAccessKey[p.AccessKey]; ok {
+				return nil, fmt.Errorf("principal %q: access key %q is already in use", p.Name, p.AccessKey)
+			}
+			au.byAccessKey[p.AccessKey] = p
+		}
+	}
+	return au, nil
+}
+
+// LoadAuthenticator reads principals from a JSON credential file of the
+// form {"principals": [...]}
+func LoadAuthenticator(path string, audit io.Writer) (*Authenticator, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Principals []Principal `json:"principals"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return NewAuthenticator(file.Principals, audit)
+}
+
+// HashAPIKey is the form an API key is stored in
+func HashAPIKey(key string) string {
+	return hexSHA256([]byte(key))
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the principal a request was authenticated as
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// canRead reports whether the principal in ctx may read key, anyone may
+// when au is nil
+func (au *Authenticator) canRead(ctx context.Context, key string) bool {
+	if au == nil {
+		return true
+	}
+	p, ok := PrincipalFrom(ctx)
+	return ok && p.Allowed(ActionRead, key)
+}
+
+// Middleware rejects requests that don't authenticate as a known principal
+// with a 401 and hands the rest to next with the principal in their context.
+// /health and /metrics stay open for load balancer probes and scrapers, and
+// presigned URLs are left to the handlers that accept them.
+func (au *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" || isPresigned(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := au.authenticate(r)
+		if err != nil {
+			au.audit.Printf("unauthenticated %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", hmacAlgorithm+`, Bearer realm="distvault"`)
+			respondWithError(w, http.StatusUnauthorized, "Authentication failed: "+err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authenticate accepts an API key in X-Api-Key or as a bearer token, or a
+// request signed with an access key
+func (au *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+	authorization := r.Header.Get("Authorization")
+	key := r.Header.Get("X-Api-Key")
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		key = strings.TrimSpace(token)
+	}
+	switch {
+	case key != "":
+		p, ok := au.byAPIKey[HashAPIKey(key)]
+		if !ok {
+			return nil, errInvalidCredential
+		}
+		return p, nil
+	case strings.HasPrefix(authorization, hmacAlgorithm+" "):
+		return au.verifySignature(r)
+	}
+	return nil, errUnauthenticated
+}
+
+// verifySignature checks an Authorization header of the form
+//
+//	DV-HMAC-SHA256 Credential=<access key>,SignedHeaders=host;x-dv-date,Signature=<hex>
+//
+// The signature is the HMAC-SHA256, keyed with the secret key, of
+//
+//	DV-HMAC-SHA256\n<X-Dv-Date>\n<hex sha256 of the canonical request>
+//
+// where the canonical request is built as SigV4 builds it, over the hex
+// sha256 of the body given in X-Dv-Content-Sha256 or UNSIGNED-PAYLOAD.
+// A signed body is checked as the handler reads it.
+func (au *Authenticator) verifySignature(r *http.Request) (*Principal, error) {
+	f, err := parseAuthorization(r.Header.Get("Authorization"), hmacAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := au.byAccessKey[f.credential]
+	if !ok {
+		return nil, errInvalidCredential
+	}
+	date := r.Header.Get(hmacDateHeader)
+	signedAt, err := time.Parse(sigV4TimeFormat, date)
+	now := au.now()
+	if err != nil || now.Sub(signedAt) > maxClockSkew || signedAt.Sub(now) > maxClockSkew {
+		return nil, errRequestExpired
+	}
+	if !containsString(f.signedHeaders, "host") || !containsString(f.signedHeaders, strings.ToLower(hmacDateHeader)) {
+		return nil, fmt.Errorf("host and %s must be signed", strings.ToLower(hmacDateHeader))
+	}
+
+	payloadHash := r.Header.Get(hmacBodyHeader)
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+	if !hmac.Equal([]byte(hmacSignature(r, p.SecretKey, f.signedHeaders, payloadHash, date)), []byte(f.signature)) {
+		return nil, errSignatureMismatch
+	}
+	if payloadHash != unsignedPayload {
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", hmacBodyHeader)
+		}
+		r.Body = io.NopCloser(&digestReader{r: r.Body, h: sha256.New(), want: want, err: errBodyMismatch})
+	}
+	return p, nil
+}
+
+func hmacSignature(r *http.Request, secret string, signedHeaders []string, payloadHash string, date string) string {
+	canonical := canonicalRequest(r, signedHeaders, payloadHash, false)
+	stringToSign := hmacAlgorithm + "\n" + date + "\n" + hexSHA256([]byte(canonical))
+	return hex.EncodeToString(hmacSHA256([]byte(secret), stringToSign))
+}
+
+// SignRequest signs r for an Authenticator with accessKey and secretKey.
+// body is the request body to sign, nil leaves it unsigned.
+func SignRequest(r *http.Request, accessKey string, secretKey string, body []byte, now time.Time) {
+	date := now.UTC().Format(sigV4TimeFormat)
+	r.Header.Set(hmacDateHeader, date)
+	payloadHash := unsignedPayload
+	if body != nil {
+		payloadHash = hexSHA256(body)
+	}
+	r.Header.Set(hmacBodyHeader, payloadHash)
+
+	signed := []string{"host", strings.ToLower(hmacBodyHeader), strings.ToLower(hmacDateHeader)}
+	signature := hmacSignature(r, secretKey, signed, payloadHash, date)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s,SignedHeaders=%s,Signature=%s",
+		hmacAlgorithm, accessKey, strings.Join(signed, ";"), signature))
+}
+
+// authorize replies 403 and reports false unless the request's principal
+// may do action on key, or carries a presigned URL for it. Without an
+// Authenticator every request is allowed.
+func (a *APIServer) authorize(w http.ResponseWriter, r *http.Request, action Action, key string) bool {
+	if a.auth == nil || presignAllows(r, action, key) {
+		return true
+	}
+	p, ok := PrincipalFrom(r.Context())
+	if ok && p.Allowed(action, key) {
+		return true
+	}
+	name := "<none>"
+	if ok {
+		name = p.Name
+	}
+	a.auth.audit.Printf("denied %s %s of (%s) to %s from %s", r.Method, action, key, name, r.RemoteAddr)
+	respondWithError(w, http.StatusForbidden, fmt.Sprintf("Not allowed to %s %s", action, key))
+	return false
+}
+
+// authorizeAdmin is authorize for the /admin/ endpoints
+func (a *APIServer) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if a.auth == nil {
+		return true
+	}
+	p, ok := PrincipalFrom(r.Context())
+	if ok && p.Admin {
+		return true
+	}
+	name := "<none>"
+	if ok {
+		name = p.Name
+	}
+	a.auth.audit.Printf("denied %s %s to %s from %s", r.Method, r.URL.Path, name, r.RemoteAddr)
+	respondWithError(w, http.StatusForbidden, "Admin access required")
+	return false
+}
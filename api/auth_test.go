@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticator(t *testing.T) {
+	var audit bytes.Buffer
+	auth, err := NewAuthenticator([]Principal{
+		{
+			Name:    "reader",
+			APIKeys: []string{HashAPIKey("reader-key")},
+			Grants:  []Grant{{Prefix: "docs/", Actions: []Action{ActionRead}}},
+		},
+		{
+			Name:      "writer",
+			AccessKey: "AKWRITER",
+			SecretKey: "writer-secret",
+			Grants:    []Grant{{Prefix: "docs/", Actions: []Action{ActionRead, ActionWrite}}},
+		},
+	}, &audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+
+	a := NewAPIServer(newMemStorage(), "")
+	a.UseAuthenticator(auth)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	do := func(method, path string, body string, prepare func(r *http.Request)) int {
+		t.Helper()
+		r, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prepare != nil {
+			prepare(r)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	apiKey := func(key string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("X-Api-Key", key) }
+	}
+	signed := func(secret string, body []byte, at time.Time) func(*http.Request) {
+		return func(r *http.Request) { SignRequest(r, "AKWRITER", secret, body, at) }
+	}
+
+	if code := do(http.MethodGet, "/health", "", nil); code != http.StatusOK {
+		t.Errorf("want /health open have %d", code)
+	}
+	if code := do(http.MethodGet, "/get/docs/a.txt", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("want 401 without credentials have %d", code)
+	}
+	if code := do(http.MethodGet, "/get/docs/a.txt", "", apiKey("wrong-key")); code != http.StatusUnauthorized {
+		t.Errorf("want 401 for an unknown api key have %d", code)
+	}
+
+	if code := do(http.MethodPut, "/objects/docs/a.txt", "hello", signed("writer-secret", []byte("hello"), now)); code != http.StatusOK {
+		t.Errorf("want signed write allowed have %d", code)
+	}
+	if code := do(http.MethodPut, "/objects/docs/a.txt", "hellO", signed("writer-secret", []byte("hello"), now)); code != http.StatusBadRequest {
+		t.Errorf("want a body that doesn't match its signed hash rejected have %d", code)
+	}
+	if code := do(http.MethodPut, "/objects/docs/a.txt", "hello", signed("guessed", []byte("hello"), now)); code != http.StatusUnauthorized {
+		t.Errorf("want 401 for a wrong secret have %d", code)
+	}
+	if code := do(http.MethodPut, "/objects/docs/a.txt", "hello", signed("writer-secret", nil, now.Add(-time.Hour))); code != http.StatusUnauthorized {
+		t.Errorf("want 401 for a stale signature have %d", code)
+	}
+	if code := do(http.MethodPut, "/objects/media/a.txt", "hello", signed("writer-secret", nil, now)); code != http.StatusForbidden {
+		t.Errorf("want 403 outside the granted prefix have %d", code)
+	}
+
+	if code := do(http.MethodGet, "/get/docs/a.txt", "", apiKey("reader-key")); code != http.StatusOK {
+		t.Errorf("want read allowed have %d", code)
+	}
+	if code := do(http.MethodGet, "/get/docs/a.txt", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") }); code != http.StatusOK {
+		t.Errorf("want bearer token accepted have %d", code)
+	}
+	if code := do(http.MethodDelete, "/delete/docs/a.txt", "", apiKey("reader-key")); code != http.StatusForbidden {
+		t.Errorf("want delete denied to a reader have %d", code)
+	}
+	if code := do(http.MethodPost, "/admin/decommission", "", apiKey("reader-key")); code != http.StatusForbidden {
+		t.Errorf("want admin endpoint denied have %d", code)
+	}
+
+	log := audit.String()
+	for _, want := range []string{"unauthenticated GET /get/docs/a.txt", "denied PUT write of (media/a.txt) to writer", "denied DELETE delete of (docs/a.txt) to reader"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("want %q in the audit log have\n%s", want, log)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package api
+
+//go:generate protoc -I storagepb --go_out=storagepb --go_opt=paths=source_relative --go-grpc_out=storagepb --go-grpc_opt=paths=source_relative storage.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api/storagepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// defaultGRPCTimeout bounds calls that arrive without a deadline
+	defaultGRPCTimeout = 10 * time.Minute
+	grpcChunkSize      = 64 << 10
+)
+
+// GRPCServer serves the storagepb.Storage service over the same storage
+// as the HTTP API, for internal services that would rather stream than
+// post forms
+type GRPCServer struct {
+	storagepb.UnimplementedStorageServer
+	storage StorageInterface
+	address string
+	auth    *Authenticator
+	logger  *slog.Logger
+	creds   credentials.TransportCredentials
+}
+
+// NewGRPCServer creates a new gRPC server
+func NewGRPCServer(storage StorageInterface, address string) *GRPCServer {
+	return &GRPCServer{
+		storage: storage,
+		address: address,
+	}
+}
+
+// UseAuthenticator requires an API key on every call, sent as x-api-key or
+// as a bearer token in the authorization metadata
+func (g *GRPCServer) UseAuthenticator(auth *Authenticator) {
+	g.auth = auth
+}
+
+// UseLogger logs calls to l instead of slog.Default(), it must be called
+// before Start
+func (g *GRPCServer) UseLogger(l *slog.Logger) {
+	g.logger = l
+}
+
+// UseTLS serves TLS with the certificate and key in the PEM files, it must
+// be called before Start
+func (g *GRPCServer) UseTLS(certFile string, keyFile string) error {
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	g.creds = creds
+	return nil
+}
+
+// Server returns a grpc.Server with the service registered
+func (g *GRPCServer) Server() *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(g.unaryInterceptor),
+		grpc.StreamInterceptor(g.streamInterceptor),
+	}
+	if g.creds != nil {
+		opts = append(opts, grpc.Creds(g.creds))
+	}
+	s := grpc.NewServer(opts...)
+	storagepb.RegisterStorageServer(s, g)
+	return s
+}
+
+// Start serves the service on its address
+func (g *GRPCServer) Start() error {
+	lis, err := net.Listen("tcp", g.address)
+	if err != nil {
+		return err
+	}
+	orDefault(g.logger).Info("starting gRPC server", "addr", g.address)
+	return g.Server().Serve(lis)
+}
+
+func (g *GRPCServer) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, cancel := withDefaultDeadline(ctx)
+	defer cancel()
+	ctx = withLogger(grpcRequestID(ctx), g.logger)
+	ctx, err := g.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *GRPCServer) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, cancel := withDefaultDeadline(ss.Context())
+	defer cancel()
+	ctx = withLogger(grpcRequestID(ctx), g.logger)
+	ctx, err := g.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextStream replaces the context of a stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func withDefaultDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, defaultGRPCTimeout)
+}
+
+// authenticate looks up the API key of a call and returns ctx with the
+// principal in it
+func (g *GRPCServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if g.auth == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		key = values[0]
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		if token, ok := strings.CutPrefix(values[0], "Bearer "); ok {
+			key = strings.TrimSpace(token)
+		}
+	}
+	err := errUnauthenticated
+	if key != "" {
+		if p, ok := g.auth.byAPIKey[HashAPIKey(key)]; ok {
+			return context.WithValue(ctx, principalKey{}, p), nil
+		}
+		err = errInvalidCredential
+	}
+	g.auth.audit.Printf("unauthenticated %s from %s: %v", method, peerAddr(ctx), err)
+	return nil, status.Error(codes.Unauthenticated, "authentication failed: "+err.Error())
+}
+
+// authorize returns a PermissionDenied error unless the caller may perform
+// action on key, denials are audit logged
+func (g *GRPCServer) authorize(ctx context.Context, action Action, key string) error {
+	if g.auth == nil {
+		return nil
+	}
+	p, _ := PrincipalFrom(ctx)
+	if p != nil && p.Allowed(action, key) {
+		return nil
+	}
+	name := "anonymous"
+	if p != nil {
+		name = p.Name
+	}
+	method, _ := grpc.Method(ctx)
+	g.auth.audit.Printf("denied %s %s of (%s) to %s from %s", method, action, key, name, peerAddr(ctx))
+	return status.Errorf(codes.PermissionDenied, "%s access to %s denied", action, key)
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// grpcError maps storage errors to status codes
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrPreconditionFailed):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrTooLarge):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Put stores the data that follows a header message
+func (g *GRPCServer) Put(stream storagepb.Storage_PutServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "no header sent")
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	header := first.GetHeader()
+	if header == nil || header.Key == "" {
+		return status.Error(codes.InvalidArgument, "the first message must be a header with a key")
+	}
+	if err := checkKey(header.Key); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := g.authorize(stream.Context(), ActionWrite, header.Key); err != nil {
+		return err
+	}
+
+	// user metadata gets the same checks as X-Meta-* headers
+	h := make(http.Header)
+	for name, value := range header.Metadata {
+		h.Set(metaPrefix+name, value)
+	}
+	userMeta, err := parseUserMeta(h, metaPrefix)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	opts := PutOptions{
+		Precondition: Precondition{IfMatch: header.IfMatch, IfNoneMatch: header.IfNoneMatch},
+		Size:         header.Size,
+		ContentType:  header.ContentType,
+		UserMeta:     userMeta,
+		RequestID:    RequestID(stream.Context()),
+	}
+	if header.ExpiresAt != nil {
+		opts.ExpiresAt = header.ExpiresAt.AsTime()
+	}
+
+	body := &chunkReader{next: func() ([]byte, error) {
+		msg, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if msg.GetHeader() != nil {
+			return nil, status.Error(codes.InvalidArgument, "only the first message may be a header")
+		}
+		return msg.GetChunk(), nil
+	}}
+
+	var res WriteResult
+	if obj, ok := g.storage.(ObjectStorage); ok {
+		res, err = putContext(stream.Context(), obj, header.Key, body, opts)
+	} else if opts.Size == 0 && opts.ContentType == "" && len(opts.UserMeta) == 0 && opts.ExpiresAt.IsZero() &&
+		len(opts.IfMatch) == 0 && len(opts.IfNoneMatch) == 0 {
+		err = g.storage.StoreData(header.Key, body)
+	} else {
+		return status.Error(codes.Unimplemented, "storage does not support upload options")
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&storagepb.PutResponse{
+		Key:       header.Key,
+		Etag:      res.ETag,
+		VersionId: res.VersionID,
+	})
+}
+
+// chunkReader reads the chunks returned by next as one stream
+type chunkReader struct {
+	next func() ([]byte, error)
+	buf  []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		chunk, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = chunk
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Get streams an object, or the range of it asked for
+func (g *GRPCServer) Get(req *storagepb.GetRequest, stream storagepb.Storage_GetServer) error {
+	ctx := stream.Context()
+	if req.Key == "" {
+		return status.Error(codes.InvalidArgument, "no key provided")
+	}
+	if err := checkKey(req.Key); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.Offset < 0 || req.Length < 0 {
+		return status.Error(codes.InvalidArgument, "offset and length must not be negative")
+	}
+	if err := g.authorize(ctx, ActionRead, req.Key); err != nil {
+		return err
+	}
+
+	// the object may still be found on another node when it isn't held here
+	var obj *ObjectInfo
+	if ls, ok := g.storage.(ListingStorage); ok && req.VersionId == "" {
+		info, err := ls.Stat(req.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return grpcError(err)
+		}
+		if err == nil {
+			obj = &info
+		}
+	}
+	if obj != nil && req.Offset > obj.Size {
+		return status.Errorf(codes.OutOfRange, "offset %d is past the end of %s", req.Offset, req.Key)
+	}
+	ranged := req.Offset > 0 || req.Length > 0
+
+	var reader io.ReadCloser
+	var err error
+	rs, ok := g.storage.(RangeStorage)
+	switch {
+	case req.VersionId != "":
+		vs, ok := g.storage.(VersionedStorage)
+		if !ok {
+			return status.Error(codes.Unimplemented, "storage does not support versioning")
+		}
+		reader, err = vs.GetVersion(req.Key, req.VersionId)
+	case ranged && ok && obj != nil:
+		length := obj.Size - req.Offset
+		if req.Length > 0 && req.Length < length {
+			length = req.Length
+		}
+		_, reader, err = getRange(ctx, rs, req.Key, req.Offset, length)
+		ranged = false
+	default:
+		reader, err = getContext(ctx, g.storage, req.Key)
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	defer reader.Close()
+
+	var r io.Reader = reader
+	if ranged {
+		// the storage can't read a range, so skip to it
+		if _, err := io.CopyN(io.Discard, reader, req.Offset); err != nil && err != io.EOF {
+			return grpcError(err)
+		}
+		if req.Length > 0 {
+			r = io.LimitReader(reader, req.Length)
+		}
+	}
+
+	if obj != nil {
+		if err := stream.Send(&storagepb.GetResponse{Msg: &storagepb.GetResponse_Info{Info: objectInfoProto(*obj)}}); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&storagepb.GetResponse{Msg: &storagepb.GetResponse_Chunk{Chunk: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return grpcError(err)
+		}
+	}
+}
+
+// Delete removes an object or one of its versions
+func (g *GRPCServer) Delete(ctx context.Context, req *storagepb.DeleteRequest) (*storagepb.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "no key provided")
+	}
+	if err := checkKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := g.authorize(ctx, ActionDelete, req.Key); err != nil {
+		return nil, err
+	}
+	var err error
+	if req.VersionId != "" {
+		vs, ok := g.storage.(VersionedStorage)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "storage does not support versioning")
+		}
+		err = vs.DeleteVersion(req.Key, req.VersionId)
+	} else if len(req.IfMatch) > 0 || len(req.IfNoneMatch) > 0 {
+		obj, ok := g.storage.(ObjectStorage)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "storage does not support conditional deletes")
+		}
+		err = obj.DeleteIf(req.Key, Precondition{IfMatch: req.IfMatch, IfNoneMatch: req.IfNoneMatch})
+	} else {
+		err = g.storage.Delete(g.storage.GetID(), req.Key)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &storagepb.DeleteResponse{}, nil
+}
+
+// Stat describes an object
+func (g *GRPCServer) Stat(ctx context.Context, req *storagepb.StatRequest) (*storagepb.ObjectInfo, error) {
+	ls, ok := g.storage.(ListingStorage)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "storage does not support stat")
+	}
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "no key provided")
+	}
+	if err := checkKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := g.authorize(ctx, ActionRead, req.Key); err != nil {
+		return nil, err
+	}
+	obj, err := ls.Stat(req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return objectInfoProto(obj), nil
+}
+
+// List returns the objects under a prefix in key order, a page at a time
+// when page_size is set. Objects the caller may not read are left out.
+func (g *GRPCServer) List(ctx context.Context, req *storagepb.ListRequest) (*storagepb.ListResponse, error) {
+	ls, ok := g.storage.(ListingStorage)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "storage does not support listing")
+	}
+	if req.PageSize < 0 {
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	}
+	objects, err := ls.List(req.Prefix)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	page, next := pageObjects(objects, req.PageToken, int(req.PageSize), func(key string) bool {
+		return g.auth.canRead(ctx, key)
+	})
+	res := &storagepb.ListResponse{NextPageToken: next}
+	for _, obj := range page {
+		res.Objects = append(res.Objects, objectInfoProto(obj))
+	}
+	return res, nil
+}
+
+func objectInfoProto(obj ObjectInfo) *storagepb.ObjectInfo {
+	return &storagepb.ObjectInfo{
+		Key:         obj.Key,
+		Size:        obj.Size,
+		Etag:        obj.ETag,
+		ModTime:     timestamppb.New(obj.ModTime),
+		ContentType: obj.ContentType,
+		Metadata:    obj.UserMeta,
+	}
+}
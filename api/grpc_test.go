@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api/storagepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// slowStorage is a memStorage whose reads of "slow/" keys block until the
+// context of the read is done, like a fetch from an unresponsive peer
+type slowStorage struct {
+	*memStorage
+	cancelled chan error
+}
+
+func (s *slowStorage) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(key, "slow/") {
+		return s.Get(key)
+	}
+	<-ctx.Done()
+	s.cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func dialGRPC(t *testing.T, g *GRPCServer) storagepb.StorageClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := g.Server()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return storagepb.NewStorageClient(conn)
+}
+
+func grpcPut(ctx context.Context, client storagepb.StorageClient, header *storagepb.PutHeader, chunks ...string) (*storagepb.PutResponse, error) {
+	stream, err := client.Put(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&storagepb.PutRequest{Msg: &storagepb.PutRequest_Header{Header: header}}); err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if err := stream.Send(&storagepb.PutRequest{Msg: &storagepb.PutRequest_Chunk{Chunk: []byte(chunk)}}); err != nil {
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func grpcGet(ctx context.Context, client storagepb.StorageClient, req *storagepb.GetRequest) (*storagepb.ObjectInfo, string, error) {
+	stream, err := client.Get(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	var info *storagepb.ObjectInfo
+	var data bytes.Buffer
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return info, data.String(), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if res.GetInfo() != nil {
+			info = res.GetInfo()
+		}
+		data.Write(res.GetChunk())
+	}
+}
+
+func TestGRPCServer(t *testing.T) {
+	storage := &slowStorage{memStorage: newMemStorage(), cancelled: make(chan error, 1)}
+	client := dialGRPC(t, NewGRPCServer(storage, ""))
+	ctx := context.Background()
+
+	res, err := grpcPut(ctx, client, &storagepb.PutHeader{
+		Key:         "docs/a.txt",
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"Owner": "ops"},
+	}, "hello ", "grpc ", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Etag == "" {
+		t.Error("want an ETag for the upload")
+	}
+	storage.StoreData("docs/b.txt", strings.NewReader("b"))
+	storage.StoreData("docs/c.txt", strings.NewReader("c"))
+
+	info, data, err := grpcGet(ctx, client, &storagepb.GetRequest{Key: "docs/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "hello grpc world" {
+		t.Errorf("want the chunks put have %q", data)
+	}
+	if info == nil || info.Size != 16 || info.ContentType != "text/plain" || info.Metadata["owner"] != "ops" {
+		t.Errorf("want the object described first have %v", info)
+	}
+	if _, data, err := grpcGet(ctx, client, &storagepb.GetRequest{Key: "docs/a.txt", Offset: 6, Length: 4}); err != nil || data != "grpc" {
+		t.Errorf("want the range have %q %v", data, err)
+	}
+	if _, _, err := grpcGet(ctx, client, &storagepb.GetRequest{Key: "docs/a.txt", Offset: 17}); status.Code(err) != codes.OutOfRange {
+		t.Errorf("want OutOfRange past the end have %v", err)
+	}
+
+	if info, err := client.Stat(ctx, &storagepb.StatRequest{Key: "docs/b.txt"}); err != nil || info.Size != 1 {
+		t.Errorf("want b described have %v %v", info, err)
+	}
+	if _, err := grpcPut(ctx, client, &storagepb.PutHeader{Key: "docs/a.txt?sibling=1"}, "x"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("want a key naming a sibling rejected have %v", err)
+	}
+	page, err := client.List(ctx, &storagepb.ListRequest{Prefix: "docs/", PageSize: 2})
+	if err != nil || len(page.Objects) != 2 || page.NextPageToken != "docs/b.txt" {
+		t.Fatalf("want a first page of two have %v %v", page, err)
+	}
+	page, err = client.List(ctx, &storagepb.ListRequest{Prefix: "docs/", PageSize: 2, PageToken: page.NextPageToken})
+	if err != nil || len(page.Objects) != 1 || page.Objects[0].Key != "docs/c.txt" || page.NextPageToken != "" {
+		t.Errorf("want the last page have %v %v", page, err)
+	}
+
+	if _, err := client.Delete(ctx, &storagepb.DeleteRequest{Key: "docs/a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := grpcGet(ctx, client, &storagepb.GetRequest{Key: "docs/a.txt"}); status.Code(err) != codes.NotFound {
+		t.Errorf("want NotFound after delete have %v", err)
+	}
+	if _, err := client.Stat(ctx, &storagepb.StatRequest{Key: "docs/a.txt"}); status.Code(err) != codes.NotFound {
+		t.Errorf("want NotFound from Stat have %v", err)
+	}
+
+	// the deadline of the call reaches the read that is waiting on peers
+	deadline, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := grpcGet(deadline, client, &storagepb.GetRequest{Key: "slow/x"}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("want DeadlineExceeded have %v", err)
+	}
+	select {
+	case err := <-storage.cancelled:
+		if err == nil {
+			t.Error("want the read's context done")
+		}
+	case <-time.After(time.Second):
+		t.Error("want the read cancelled with the call")
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	auth, err := NewAuthenticator([]Principal{{
+		Name:    "reader",
+		APIKeys: []string{HashAPIKey("reader-key")},
+		Grants:  []Grant{{Prefix: "docs/", Actions: []Action{ActionRead}}},
+	}}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := newMemStorage()
+	storage.StoreData("docs/a.txt", strings.NewReader("a"))
+	storage.StoreData("private/b.txt", strings.NewReader("b"))
+	g := NewGRPCServer(storage, "")
+	g.UseAuthenticator(auth)
+	client := dialGRPC(t, g)
+
+	if _, err := client.Stat(context.Background(), &storagepb.StatRequest{Key: "docs/a.txt"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("want Unauthenticated without a key have %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer reader-key")
+	if _, err := client.Stat(ctx, &storagepb.StatRequest{Key: "docs/a.txt"}); err != nil {
+		t.Errorf("want read allowed have %v", err)
+	}
+	if _, err := grpcPut(ctx, client, &storagepb.PutHeader{Key: "docs/new.txt"}, "x"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("want PermissionDenied for a write have %v", err)
+	}
+	if page, err := client.List(ctx, &storagepb.ListRequest{}); err != nil || len(page.Objects) != 1 {
+		t.Errorf("want only readable keys listed have %v %v", page, err)
+	}
+}
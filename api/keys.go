@@ -0,0 +1,21 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reservedKeyMarkers are what storage appends to a key to name the
+// versions, upload parts, siblings and erasure shards it keeps for it. A
+// user key holding one would collide with those objects.
+var reservedKeyMarkers = []string{"?version=", "?upload=", "?sibling=", "?shard="}
+
+// checkKey refuses keys that hold a reserved marker
+func checkKey(key string) error {
+	for _, marker := range reservedKeyMarkers {
+		if strings.Contains(key, marker) {
+			return fmt.Errorf("key must not contain %q", marker)
+		}
+	}
+	return nil
+}
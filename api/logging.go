@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDHeader carries the ID of a request, an ID the client or a load
+// balancer in front already gave it is kept
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+type loggerKey struct{}
+
+// WithRequestID returns ctx carrying the request ID id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request ctx belongs to, "" outside of one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID keeps IDs sent by clients short and printable, they end
+// up in logs and in messages to other nodes
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns id when it is valid and a new ID otherwise
+func requestIDFrom(id string) string {
+	if validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// grpcRequestID returns ctx carrying the x-request-id of the call, or a
+// new ID when it has none
+func grpcRequestID(ctx context.Context) context.Context {
+	var id string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("x-request-id"); len(values) > 0 {
+		id = values[0]
+	}
+	return WithRequestID(ctx, requestIDFrom(id))
+}
+
+// orDefault returns l, or slog.Default() when it is nil
+func orDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// withLogger returns ctx carrying base with the request ID of ctx on every
+// record, base is slog.Default() when nil
+func withLogger(ctx context.Context, base *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, orDefault(base).With("request_id", RequestID(ctx)))
+}
+
+// logger returns the logger of the request ctx belongs to
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	storage := newMemStorage()
+	a := NewAPIServer(storage, "")
+	var logs bytes.Buffer
+	a.UseLogger(slog.New(slog.NewJSONHandler(&logs, nil)))
+	h := a.Handler()
+
+	put := func(key string, id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/objects/"+key, strings.NewReader("data"))
+		if id != "" {
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := put("a.txt", "upload-1")
+	if got := w.Header().Get(RequestIDHeader); got != "upload-1" {
+		t.Errorf("want the client's request ID kept have %q", got)
+	}
+	if got := storage.opts["a.txt"].RequestID; got != "upload-1" {
+		t.Errorf("want the request ID passed to storage have %q", got)
+	}
+	if !strings.Contains(logs.String(), `"request_id":"upload-1"`) {
+		t.Errorf("want the request logged with its ID have %s", logs.String())
+	}
+
+	for _, id := range []string{"", "bad id\n"} {
+		w := put("b.txt", id)
+		got := w.Header().Get(RequestIDHeader)
+		if got == "" || got == id {
+			t.Errorf("want a new request ID for %q have %q", id, got)
+		}
+		if storage.opts["b.txt"].RequestID != got {
+			t.Errorf("want storage to get the new ID %q have %q", got, storage.opts["b.txt"].RequestID)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// metaPrefix marks user metadata headers on the native API,
+	// s3MetaPrefix on the S3 gateway
+	metaPrefix   = "X-Meta-"
+	s3MetaPrefix = "X-Amz-Meta-"
+
+	// maxUserMetaSize caps the names and values of user metadata together,
+	// the same limit S3 applies
+	maxUserMetaSize = 2 << 10
+
+	defaultContentType = "application/octet-stream"
+)
+
+// parseUserMeta collects the headers starting with prefix, names are
+// lowercased and stored without the prefix
+func parseUserMeta(h http.Header, prefix string) (map[string]string, error) {
+	var meta map[string]string
+	size := 0
+	for name, values := range h {
+		canonical := http.CanonicalHeaderKey(name)
+		if !strings.HasPrefix(canonical, prefix) || len(canonical) == len(prefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		name = strings.ToLower(canonical[len(prefix):])
+		value := strings.Join(values, ",")
+		meta[name] = value
+		size += len(name) + len(value)
+	}
+	if size > maxUserMetaSize {
+		return nil, fmt.Errorf("user metadata is %d bytes, the limit is %d", size, maxUserMetaSize)
+	}
+	return meta, nil
+}
+
+// setObjectHeaders describes obj in the response headers, user metadata
+// is sent back under prefix
+func setObjectHeaders(w http.ResponseWriter, obj ObjectInfo, prefix string) {
+	w.Header().Set("Content-Type", contentType(obj))
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.Header().Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+	if obj.ETag != "" {
+		w.Header().Set("ETag", quoteETag(obj.ETag))
+	}
+	for name, value := range obj.UserMeta {
+		w.Header().Set(prefix+name, value)
+	}
+}
+
+func contentType(obj ObjectInfo) string {
+	if obj.ContentType == "" {
+		return defaultContentType
+	}
+	return obj.ContentType
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	httpRequests = metrics.Default.Counter("dfs_http_requests_total",
+		"HTTP requests served by the API, by route, method and status code.", "server", "route", "method", "code")
+	httpRequestSeconds = metrics.Default.Histogram("dfs_http_request_seconds",
+		"Time to serve an HTTP request to the API.", nil, "server", "route", "method")
+)
+
+// instrument gives every request next serves an ID and a span, continuing
+// the trace of the caller if it sent one, logs it, and counts and times it
+// by the pattern of the route it matched so object keys don't become labels
+func (a *APIServer) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestIDFrom(r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, id)
+		ctx := tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, "HTTP "+r.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		base := a.logger
+		if sc := span.SpanContext(); sc.IsValid() {
+			base = orDefault(base).With("trace_id", sc.TraceID().String())
+		}
+		ctx = withLogger(WithRequestID(ctx, id), base)
+		r = r.WithContext(ctx)
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		_, route := a.mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.Inc(a.address, route, r.Method, strconv.Itoa(sw.code))
+		httpRequestSeconds.ObserveSince(start, a.address, route, r.Method)
+
+		// spans are named method and route, as patterns with a method are
+		if strings.Contains(route, " ") {
+			span.SetName(route)
+		} else {
+			span.SetName(r.Method + " " + route)
+		}
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", sw.code),
+			attribute.String("dfs.request_id", id),
+		)
+		if sw.code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.code))
+		}
+
+		// probes and scrapes would drown everything else
+		level := slog.LevelInfo
+		if route == "/health" || route == "GET /metrics" {
+			level = slog.LevelDebug
+		}
+		logger(ctx).Log(ctx, level, "request", "method", r.Method, "path", r.URL.Path,
+			"status", sw.code, "duration", time.Since(start))
+	})
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.code = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
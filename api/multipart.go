@@ -0,0 +1,349 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+var (
+	// ErrNoSuchUpload is returned by MultipartStorage for unknown upload ids
+	ErrNoSuchUpload = errors.New("no such upload")
+	// ErrInvalidPart is returned for part numbers out of range and for
+	// completions naming parts that weren't uploaded
+	ErrInvalidPart = errors.New("invalid part")
+)
+
+// MultipartStorage is implemented by storage that accepts an object in
+// parts, so a large upload over a flaky link resumes instead of restarting.
+// InitiateUpload keeps the Size, ContentType and UserMeta of its options
+// for the object the upload completes
+type MultipartStorage interface {
+	InitiateUpload(key string, opts PutOptions) (string, error)
+	UploadPart(uploadID string, number int, r io.Reader) (PartInfo, error)
+	GetUpload(uploadID string) (UploadInfo, error)
+	CompleteUpload(uploadID string, parts []CompletedPart, opts PutOptions) (WriteResult, error)
+	AbortUpload(uploadID string) error
+}
+
+// UploadInfo describes a multipart upload in progress
+type UploadInfo struct {
+	UploadID  string     `json:"upload_id"`
+	Key       string     `json:"key"`
+	Size      int64      `json:"size,omitempty"`
+	Initiated time.Time  `json:"initiated"`
+	Parts     []PartInfo `json:"parts"`
+}
+
+// Offset is the number of bytes uploaded so far
+func (u UploadInfo) Offset() int64 {
+	var n int64
+	for _, part := range u.Parts {
+		n += part.Size
+	}
+	return n
+}
+
+// PartInfo describes one uploaded part
+type PartInfo struct {
+	PartNumber int       `json:"part_number"`
+	Size       int64     `json:"size"`
+	ETag       string    `json:"etag"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+// CompletedPart picks a part for the assembled object, the ETag is optional
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag,omitempty"`
+}
+
+// UploadResponse reports the state of a multipart upload
+type UploadResponse struct {
+	Success bool       `json:"success"`
+	Message string     `json:"message,omitempty"`
+	Upload  UploadInfo `json:"upload"`
+}
+
+// PartResponse reports an uploaded part
+type PartResponse struct {
+	Success bool     `json:"success"`
+	Part    PartInfo `json:"part"`
+}
+
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNoSuchUpload):
+		respondWithError(w, http.StatusNotFound, "Upload not found")
+	case errors.Is(err, ErrInvalidPart):
+		respondWithError(w, http.StatusBadRequest, "Invalid part")
+	case errors.Is(err, ErrTooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload exceeds the namespace size limit")
+	case errors.Is(err, ErrPreconditionFailed):
+		respondWithError(w, http.StatusPreconditionFailed, "Precondition failed")
+	case errors.Is(err, errBodyMismatch):
+		respondWithError(w, http.StatusBadRequest, "Body does not match its signed hash")
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Upload failed: "+err.Error())
+	}
+}
+
+// Handler for /multipart/{key}, the upload is picked by ?upload_id=
+//
+//	POST   /multipart/{key}                     initiate
+//	PUT    /multipart/{key}?upload_id=&part=N   upload part N
+//	GET    /multipart/{key}?upload_id=          list parts
+//	POST   /multipart/{key}?upload_id=          complete, with an optional JSON list of parts
+//	DELETE /multipart/{key}?upload_id=          abort
+func (a *APIServer) handleMultipart(w http.ResponseWriter, r *http.Request) {
+	ms, ok := a.storage.(MultipartStorage)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support multipart uploads")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/multipart/")
+	if key == "" {
+		respondWithError(w, http.StatusBadRequest, "No key provided")
+		return
+	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// reading the parts of an upload is part of writing it
+	if !a.authorize(w, r, ActionWrite, key) {
+		return
+	}
+
+	uploadID := r.URL.Query().Get("upload_id")
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusBadRequest, "No upload_id provided")
+			return
+		}
+		size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		userMeta, err := parseUserMeta(r.Header, metaPrefix)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		uploadID, err := ms.InitiateUpload(key, PutOptions{
+			Size:        size,
+			ContentType: r.Header.Get("Content-Type"),
+			UserMeta:    userMeta,
+		})
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, UploadResponse{
+			Success: true,
+			Message: "Upload initiated",
+			Upload:  UploadInfo{UploadID: uploadID, Key: key, Size: size},
+		})
+		return
+	}
+
+	upload, err := ms.GetUpload(uploadID)
+	if err == nil && upload.Key != key {
+		err = ErrNoSuchUpload
+	}
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(r.URL.Query().Get("part"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid part number")
+			return
+		}
+		part, err := ms.UploadPart(uploadID, number, r.Body)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		w.Header().Set("ETag", quoteETag(part.ETag))
+		respondWithJSON(w, http.StatusOK, PartResponse{Success: true, Part: part})
+
+	case http.MethodGet:
+		respondWithJSON(w, http.StatusOK, UploadResponse{Success: true, Upload: upload})
+
+	case http.MethodPost:
+		var body struct {
+			Parts []CompletedPart `json:"parts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			respondWithError(w, http.StatusBadRequest, "Invalid list of parts: "+err.Error())
+			return
+		}
+		res, err := ms.CompleteUpload(uploadID, body.Parts, PutOptions{
+			Precondition: parsePrecondition(r),
+			RequestID:    RequestID(r.Context()),
+		})
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		w.Header().Set("ETag", quoteETag(res.ETag))
+		respondWithJSON(w, http.StatusOK, Response{
+			Success:   true,
+			Message:   "Upload completed",
+			Key:       key,
+			VersionID: res.VersionID,
+			ETag:      res.ETag,
+		})
+
+	case http.MethodDelete:
+		if err := ms.AbortUpload(uploadID); err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, Response{Success: true, Message: "Upload aborted", Key: key})
+
+	default:
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// Handler for the tus.io resumable upload protocol (core, creation and
+// termination) under /tus/. Every PATCH is kept as one part of a multipart
+// upload, the object is assembled once Upload-Length bytes have arrived.
+// The key comes from the "key" or "filename" entry of Upload-Metadata, the
+// content type from "filetype".
+func (a *APIServer) handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	ms, ok := a.storage.(MultipartStorage)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage does not support resumable uploads")
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return
+	}
+
+	uploadID := strings.TrimPrefix(r.URL.Path, "/tus/")
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Only POST creates uploads")
+			return
+		}
+		a.createTusUpload(w, r, ms)
+		return
+	}
+
+	upload, err := ms.GetUpload(uploadID)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+	if !a.authorize(w, r, ActionWrite, upload.Key) {
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset(), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset() {
+			respondWithError(w, http.StatusConflict, "Upload-Offset does not match the upload")
+			return
+		}
+		part, err := ms.UploadPart(uploadID, len(upload.Parts)+1, io.LimitReader(r.Body, upload.Size-offset))
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		offset += part.Size
+		if offset == upload.Size {
+			if _, err := ms.CompleteUpload(uploadID, nil, PutOptions{RequestID: RequestID(r.Context())}); err != nil {
+				respondWithUploadError(w, err)
+				return
+			}
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := ms.AbortUpload(uploadID); err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (a *APIServer) createTusUpload(w http.ResponseWriter, r *http.Request, ms MultipartStorage) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length must be a positive number")
+		return
+	}
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	key := metadata["key"]
+	if key == "" {
+		key = metadata["filename"]
+	}
+	if key == "" {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must carry a key or filename")
+		return
+	}
+	if err := checkKey(key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorize(w, r, ActionWrite, key) {
+		return
+	}
+
+	uploadID, err := ms.InitiateUpload(key, PutOptions{Size: size, ContentType: metadata["filetype"]})
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/tus/"+uploadID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// parseTusMetadata decodes Upload-Metadata, comma separated pairs of a key
+// and a base64 value
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if name == "" || err != nil {
+			continue
+		}
+		metadata[name] = string(decoded)
+	}
+	return metadata
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandleMultipart(t *testing.T) {
+	storage := newMemUploads()
+	a := NewAPIServer(storage, "")
+
+	do := func(method, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.handleMultipart(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/multipart/videos/cat.mp4", nil)
+	r.Header.Set("Content-Type", "video/mp4")
+	r.Header.Set(metaPrefix+"Camera", "front")
+	w := httptest.NewRecorder()
+	a.handleMultipart(w, r)
+	var initiated UploadResponse
+	if err := json.NewDecoder(w.Body).Decode(&initiated); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("want upload initiated have %d %v", w.Code, err)
+	}
+	target := "/multipart/videos/cat.mp4?upload_id=" + initiated.Upload.UploadID
+	if opts := storage.initiated[initiated.Upload.UploadID]; opts.ContentType != "video/mp4" || opts.UserMeta["camera"] != "front" {
+		t.Errorf("want the content type and metadata passed on initiate have %+v", opts)
+	}
+
+	// parts may arrive out of order and be retried
+	for _, part := range []struct{ n, data string }{{"2", "world"}, {"1", "HELLO "}, {"1", "hello "}} {
+		if w := do(http.MethodPut, target+"&part="+part.n, part.data); w.Code != http.StatusOK {
+			t.Fatalf("want part %s stored have %d %s", part.n, w.Code, w.Body.String())
+		}
+	}
+	if w := do(http.MethodPut, target+"&part=0", "x"); w.Code != http.StatusBadRequest {
+		t.Errorf("want part 0 rejected have %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/multipart/other?upload_id="+initiated.Upload.UploadID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("want upload hidden under another key have %d", w.Code)
+	}
+
+	var listed UploadResponse
+	json.NewDecoder(do(http.MethodGet, target, "").Body).Decode(&listed)
+	if len(listed.Upload.Parts) != 2 || listed.Upload.Offset() != int64(len("hello world")) {
+		t.Fatalf("want 2 parts listed have %+v", listed.Upload)
+	}
+
+	if w := do(http.MethodPost, target, `{"parts":[{"part_number":2},{"part_number":1}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("want parts out of order rejected have %d", w.Code)
+	}
+	if w := do(http.MethodPost, target, ""); w.Code != http.StatusOK {
+		t.Fatalf("want upload completed have %d %s", w.Code, w.Body.String())
+	}
+	reader, err := storage.Get("videos/cat.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(reader); string(b) != "hello world" {
+		t.Errorf("want parts assembled have %q", b)
+	}
+	if w := do(http.MethodGet, target, ""); w.Code != http.StatusNotFound {
+		t.Errorf("want completed upload gone have %d", w.Code)
+	}
+}
+
+func TestHandleTus(t *testing.T) {
+	storage := newMemUploads()
+	a := NewAPIServer(storage, "")
+
+	do := func(method, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		a.handleTus(w, r)
+		return w
+	}
+
+	w := do(http.MethodOptions, "/tus/", nil, nil)
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Extension") != "creation,termination" {
+		t.Errorf("want capabilities advertised have %d %v", w.Code, w.Header())
+	}
+
+	w = do(http.MethodPost, "/tus/", nil, map[string]string{
+		"Upload-Length": "10",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("docs/notes.txt")) +
+			",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain")),
+	})
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || !strings.HasPrefix(location, "/tus/") {
+		t.Fatalf("want upload created have %d %q", w.Code, location)
+	}
+	if opts := storage.initiated[strings.TrimPrefix(location, "/tus/")]; opts.ContentType != "text/plain" {
+		t.Errorf("want the filetype passed as the content type have %+v", opts)
+	}
+
+	patch := func(offset, data string) *httptest.ResponseRecorder {
+		return do(http.MethodPatch, location, []byte(data), map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		})
+	}
+	if w := patch("0", "01234"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("want first chunk accepted have %d %v", w.Code, w.Header())
+	}
+	if w := patch("0", "01234"); w.Code != http.StatusConflict {
+		t.Errorf("want stale offset rejected have %d", w.Code)
+	}
+	// a client that lost the response asks where to resume
+	if w := do(http.MethodHead, location, nil, nil); w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("want offset 5 of 10 have %v", w.Header())
+	}
+	if _, err := storage.Get("docs/notes.txt"); err != ErrNotFound {
+		t.Errorf("want no object before the last chunk have %v", err)
+	}
+	if w := patch("5", "56789"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("want last chunk accepted have %d %v", w.Code, w.Header())
+	}
+	reader, err := storage.Get("docs/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(reader); string(b) != "0123456789" {
+		t.Errorf("want chunks assembled have %q", b)
+	}
+
+	r := httptest.NewRequest(http.MethodHead, location, nil)
+	w = httptest.NewRecorder()
+	a.handleTus(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("want request without Tus-Resumable rejected have %d", w.Code)
+	}
+}
+
+// memUploads adds multipart uploads to memStorage, parts are kept in memory
+type memUploads struct {
+	*memStorage
+	mu      sync.Mutex
+	next    int
+	uploads map[string]*UploadInfo
+	// initiated keeps the options each upload was initiated with
+	initiated map[string]PutOptions
+	data      map[string]map[int][]byte
+}
+
+func newMemUploads() *memUploads {
+	return &memUploads{
+		memStorage: newMemStorage(),
+		uploads:    make(map[string]*UploadInfo),
+		initiated:  make(map[string]PutOptions),
+		data:       make(map[string]map[int][]byte),
+	}
+}
+
+func (m *memUploads) InitiateUpload(key string, opts PutOptions) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	uploadID := hex.EncodeToString([]byte{byte(m.next)})
+	m.uploads[uploadID] = &UploadInfo{UploadID: uploadID, Key: key, Size: opts.Size}
+	m.initiated[uploadID] = opts
+	m.data[uploadID] = make(map[int][]byte)
+	return uploadID, nil
+}
+
+func (m *memUploads) UploadPart(uploadID string, number int, r io.Reader) (PartInfo, error) {
+	if number < 1 {
+		return PartInfo{}, ErrInvalidPart
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return PartInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upload, ok := m.uploads[uploadID]
+	if !ok {
+		return PartInfo{}, ErrNoSuchUpload
+	}
+	sum := md5.Sum(b)
+	part := PartInfo{PartNumber: number, Size: int64(len(b)), ETag: hex.EncodeToString(sum[:])}
+	if _, replaced := m.data[uploadID][number]; replaced {
+		for i := range upload.Parts {
+			if upload.Parts[i].PartNumber == number {
+				upload.Parts[i] = part
+			}
+		}
+	} else {
+		upload.Parts = append(upload.Parts, part)
+	}
+	m.data[uploadID][number] = b
+	return part, nil
+}
+
+func (m *memUploads) GetUpload(uploadID string) (UploadInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upload, ok := m.uploads[uploadID]
+	if !ok {
+		return UploadInfo{}, ErrNoSuchUpload
+	}
+	return *upload, nil
+}
+
+func (m *memUploads) CompleteUpload(uploadID string, parts []CompletedPart, opts PutOptions) (WriteResult, error) {
+	m.mu.Lock()
+	upload, ok := m.uploads[uploadID]
+	data := m.data[uploadID]
+	m.mu.Unlock()
+	if !ok {
+		return WriteResult{}, ErrNoSuchUpload
+	}
+	if len(parts) == 0 {
+		for n := 1; n <= len(data); n++ {
+			parts = append(parts, CompletedPart{PartNumber: n})
+		}
+	}
+	var buf bytes.Buffer
+	for i, part := range parts {
+		b, ok := data[part.PartNumber]
+		if !ok || (i > 0 && part.PartNumber <= parts[i-1].PartNumber) {
+			return WriteResult{}, ErrInvalidPart
+		}
+		buf.Write(b)
+	}
+	if err := m.StoreData(upload.Key, &buf); err != nil {
+		return WriteResult{}, err
+	}
+	return WriteResult{}, m.AbortUpload(uploadID)
+}
+
+func (m *memUploads) AbortUpload(uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.uploads[uploadID]; !ok {
+		return ErrNoSuchUpload
+	}
+	delete(m.uploads, uploadID)
+	delete(m.data, uploadID)
+	return nil
+}
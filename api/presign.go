@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	presignExpiresParam   = "X-Dv-Expires"
+	presignMaxSizeParam   = "X-Dv-Max-Size"
+	presignPrincipalParam = "X-Dv-Principal"
+	presignSignatureParam = "X-Dv-Signature"
+
+	defaultPresignExpiry = 15 * time.Minute
+)
+
+var errPresignInvalid = errors.New("invalid or expired presigned URL")
+
+// PresignRequest asks for a URL that lets its holder download (GET) or
+// upload (POST) one key until it expires
+type PresignRequest struct {
+	Key    string `json:"key"`
+	Method string `json:"method"`
+	// ExpiresIn is a Go duration or whole seconds, 15 minutes if empty
+	ExpiresIn string `json:"expires_in,omitempty"`
+	// MaxSize caps the size of an upload
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// PresignResponse carries a presigned URL
+type PresignResponse struct {
+	Success   bool      `json:"success"`
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// presignedKey marks a request context as carrying a verified presigned URL
+type presignedKey struct{}
+
+type presignGrant struct {
+	action Action
+	key    string
+}
+
+// UsePresignKey enables presigned URLs signed with key, every node behind
+// the same load balancer needs the same key
+func (a *APIServer) UsePresignKey(key []byte) {
+	a.presignKey = key
+}
+
+// Handler for issuing presigned URLs, the caller must itself be allowed
+// what the URL allows
+func (a *APIServer) handlePresign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	if len(a.presignKey) == 0 {
+		respondWithError(w, http.StatusNotImplemented, "Presigned URLs are not configured")
+		return
+	}
+
+	var req PresignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid presign request: "+err.Error())
+		return
+	}
+	if req.Key == "" {
+		respondWithError(w, http.StatusBadRequest, "No key provided")
+		return
+	}
+	if err := checkKey(req.Key); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var action Action
+	var path string
+	switch req.Method {
+	case http.MethodGet:
+		action, path = ActionRead, "/get/"+req.Key
+		if req.MaxSize != 0 {
+			respondWithError(w, http.StatusBadRequest, "max_size only applies to uploads")
+			return
+		}
+	case http.MethodPost:
+		action, path = ActionWrite, "/upload"
+	default:
+		respondWithError(w, http.StatusBadRequest, "method must be GET or POST")
+		return
+	}
+	expiry := defaultPresignExpiry
+	if req.ExpiresIn != "" {
+		expiresAt, err := parseExpiry(req.ExpiresIn, "")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		expiry = time.Until(expiresAt).Round(time.Second)
+	}
+	if expiry > maxPresignExpiry {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("expires_in may be at most %s", maxPresignExpiry))
+		return
+	}
+	if req.MaxSize < 0 {
+		respondWithError(w, http.StatusBadRequest, "max_size must not be negative")
+		return
+	}
+	if !a.authorize(w, r, action, req.Key) {
+		return
+	}
+
+	var principal string
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		principal = p.Name
+	}
+	expiresAt := time.Now().Add(expiry).Truncate(time.Second)
+	query := url.Values{}
+	if req.Method == http.MethodPost {
+		query.Set("key", req.Key)
+	}
+	query.Set(presignExpiresParam, strconv.FormatInt(expiresAt.Unix(), 10))
+	if req.MaxSize > 0 {
+		query.Set(presignMaxSizeParam, strconv.FormatInt(req.MaxSize, 10))
+	}
+	if principal != "" {
+		query.Set(presignPrincipalParam, principal)
+	}
+	query.Set(presignSignatureParam, a.presignSignature(req.Method, req.Key, query))
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: path, RawQuery: query.Encode()}
+	respondWithJSON(w, http.StatusOK, PresignResponse{
+		Success:   true,
+		URL:       u.String(),
+		Method:    req.Method,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// presignSignature signs method, key and the presign parameters of query
+func (a *APIServer) presignSignature(method string, key string, query url.Values) string {
+	stringToSign := method + "\n" + key + "\n" +
+		query.Get(presignExpiresParam) + "\n" +
+		query.Get(presignMaxSizeParam) + "\n" +
+		query.Get(presignPrincipalParam)
+	return hex.EncodeToString(hmacSHA256(a.presignKey, stringToSign))
+}
+
+// isPresigned reports whether r claims to carry a presigned URL
+func isPresigned(r *http.Request) bool {
+	return r.URL.Query().Has(presignSignatureParam)
+}
+
+// verifyPresigned checks the presigned URL of r for method on key and
+// returns r with the grant in its context, which authorize then honours.
+// A URL stops working once it expires, and once its issuer loses access.
+// Parameters that aren't signed, other than allowed, are refused.
+func (a *APIServer) verifyPresigned(r *http.Request, method string, key string, allowed ...string) (*http.Request, int64, error) {
+	if len(a.presignKey) == 0 {
+		return nil, 0, errPresignInvalid
+	}
+	query := r.URL.Query()
+	for name := range query {
+		switch name {
+		case presignExpiresParam, presignMaxSizeParam, presignPrincipalParam, presignSignatureParam:
+		default:
+			if !containsString(allowed, name) {
+				return nil, 0, errPresignInvalid
+			}
+		}
+	}
+	expected := a.presignSignature(method, key, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(presignSignatureParam))) {
+		return nil, 0, errPresignInvalid
+	}
+	expires, err := strconv.ParseInt(query.Get(presignExpiresParam), 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return nil, 0, errPresignInvalid
+	}
+	maxSize, _ := strconv.ParseInt(query.Get(presignMaxSizeParam), 10, 64)
+
+	action := ActionRead
+	if method != http.MethodGet {
+		action = ActionWrite
+	}
+	if a.auth != nil {
+		p, ok := a.auth.byName[query.Get(presignPrincipalParam)]
+		if !ok || !p.Allowed(action, key) {
+			return nil, 0, errPresignInvalid
+		}
+	}
+	ctx := context.WithValue(r.Context(), presignedKey{}, presignGrant{action: action, key: key})
+	return r.WithContext(ctx), maxSize, nil
+}
+
+// presignAllows reports whether r carries a verified presigned URL for
+// action on key
+func presignAllows(r *http.Request, action Action, key string) bool {
+	grant, ok := r.Context().Value(presignedKey{}).(presignGrant)
+	return ok && grant.action == action && grant.key == key
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPresignedURLs(t *testing.T) {
+	auth, err := NewAuthenticator([]Principal{{
+		Name:    "app",
+		APIKeys: []string{HashAPIKey("app-key")},
+		Grants:  []Grant{{Prefix: "shared/", Actions: []Action{ActionRead, ActionWrite}}},
+	}}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := newMemStorage()
+	storage.StoreData("shared/report.pdf", strings.NewReader("report"))
+	a := NewAPIServer(storage, "")
+	a.UseAuthenticator(auth)
+	a.UsePresignKey([]byte("cluster presign key"))
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	presign := func(req PresignRequest) (int, string) {
+		t.Helper()
+		b, _ := json.Marshal(req)
+		r, _ := http.NewRequest(http.MethodPost, srv.URL+"/presign", bytes.NewReader(b))
+		r.Header.Set("X-Api-Key", "app-key")
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out PresignResponse
+		json.NewDecoder(res.Body).Decode(&out)
+		return res.StatusCode, out.URL
+	}
+	upload := func(target string, formKey string, data string) int {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		if formKey != "" {
+			mw.WriteField("key", formKey)
+		}
+		fw, _ := mw.CreateFormFile("file", "upload.bin")
+		fw.Write([]byte(data))
+		mw.Close()
+		res, err := http.Post(target, mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	code, download := presign(PresignRequest{Key: "shared/report.pdf", Method: http.MethodGet, ExpiresIn: "1h"})
+	if code != http.StatusOK {
+		t.Fatalf("want a download URL have %d", code)
+	}
+	res, err := http.Get(download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(b) != "report" {
+		t.Errorf("want the object through the URL alone have %d %q", res.StatusCode, b)
+	}
+
+	// the URL only opens the key it was signed for, and only as it was signed
+	u, _ := url.Parse(download)
+	for _, tampered := range []func(*url.URL){
+		func(u *url.URL) { u.Path = "/get/shared/other.pdf" },
+		func(u *url.URL) { q := u.Query(); q.Set(presignExpiresParam, "9999999999"); u.RawQuery = q.Encode() },
+		func(u *url.URL) { q := u.Query(); q.Set("version", "1"); u.RawQuery = q.Encode() },
+	} {
+		c := *u
+		tampered(&c)
+		res, err := http.Get(c.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("want %s refused have %d", c.String(), res.StatusCode)
+		}
+	}
+
+	r, _ := http.NewRequest(http.MethodDelete, strings.Replace(download, "/get/", "/delete/", 1), nil)
+	res, err = http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("want a download URL useless for deletes have %d", res.StatusCode)
+	}
+
+	if code, _ := presign(PresignRequest{Key: "private/x", Method: http.MethodGet}); code != http.StatusForbidden {
+		t.Errorf("want no URL for a key the caller can't read have %d", code)
+	}
+	if code, _ := presign(PresignRequest{Key: "shared/x", Method: http.MethodGet, ExpiresIn: "720h"}); code != http.StatusBadRequest {
+		t.Errorf("want expiries over a week refused have %d", code)
+	}
+
+	code, uploadURL := presign(PresignRequest{Key: "shared/in.bin", Method: http.MethodPost, MaxSize: 8})
+	if code != http.StatusOK {
+		t.Fatalf("want an upload URL have %d", code)
+	}
+	if code := upload(uploadURL, "", "too large for the limit"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("want uploads over max_size refused have %d", code)
+	}
+	if code := upload(uploadURL, "shared/elsewhere", "small"); code != http.StatusForbidden {
+		t.Errorf("want a form key other than the signed one refused have %d", code)
+	}
+	if code := upload(uploadURL, "", "small"); code != http.StatusOK {
+		t.Errorf("want upload through the URL have %d", code)
+	}
+	if r, err := storage.Get("shared/in.bin"); err != nil {
+		t.Errorf("want uploaded object stored have %v", err)
+	} else if b, _ := io.ReadAll(r); string(b) != "small" {
+		t.Errorf("want uploaded data have %q", b)
+	}
+
+	// revoking the issuer's access revokes its URLs
+	auth.byName["app"].Grants = nil
+	res, err = http.Get(download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("want URL dead once its issuer lost access have %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRangeNotSatisfiable is returned when none of the requested ranges
+// overlap the object
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// httpRange is a byte range of an object, resolved against its size
+type httpRange struct {
+	start  int64
+	length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header against an object of size bytes. Ranges
+// that don't overlap the object are dropped, if none is left the header is
+// unsatisfiable. A header that isn't a valid byte range is ignored as
+// RFC 9110 requires, which parseRange reports as no ranges.
+func parseRange(header string, size int64) ([]httpRange, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return nil, nil
+	}
+	var ranges []httpRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, nil
+		}
+		var r httpRange
+		if first == "" {
+			// suffix range, the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = httpRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = httpRange{start: start, length: end - start + 1}
+		}
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the If-Range precondition, if any, still
+// holds for obj. A strong ETag or the exact Last-Modified date must match.
+func ifRangeMatches(r *http.Request, obj ObjectInfo) bool {
+	ifRange := r.Header.Get("If-Range")
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`):
+		return obj.ETag != "" && ifRange == quoteETag(obj.ETag)
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && obj.ModTime.Truncate(time.Second).Equal(t)
+}
+
+// writeRangeResponse answers the Range header of a GET for key with a 206
+// and reports whether it did. It returns false, leaving the caller to send
+// the whole object, when there is no usable Range header, If-Range no longer
+// holds, or the storage can't read ranges. errRangeNotSatisfiable leaves the
+// caller to reply 416, the Content-Range header is already set.
+func writeRangeResponse(w http.ResponseWriter, r *http.Request, storage StorageInterface, key string) (bool, error) {
+	header := r.Header.Get("Range")
+	rs, ok := storage.(RangeStorage)
+	ls, ok2 := storage.(ListingStorage)
+	if header == "" || !ok || !ok2 {
+		return false, nil
+	}
+	obj, err := ls.Stat(key)
+	if err != nil {
+		return true, err
+	}
+	if !ifRangeMatches(r, obj) {
+		return false, nil
+	}
+	ranges, err := parseRange(header, obj.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", obj.Size))
+		return true, err
+	}
+	var total int64
+	for _, rng := range ranges {
+		total += rng.length
+	}
+	if len(ranges) == 0 || total > obj.Size {
+		// overlapping ranges would cost more than the object, send it whole
+		return false, nil
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+	if obj.ETag != "" {
+		w.Header().Set("ETag", quoteETag(obj.ETag))
+	}
+
+	if len(ranges) == 1 {
+		rng := ranges[0]
+		_, reader, err := getRange(r.Context(), rs, key, rng.start, rng.length)
+		if err != nil {
+			return true, err
+		}
+		defer reader.Close()
+		w.Header().Set("Content-Type", contentType(obj))
+		w.Header().Set("Content-Range", rng.contentRange(obj.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(rng.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if _, err := io.Copy(w, reader); err != nil {
+			logger(r.Context()).Warn("streaming range to client failed", "key", key, "err", err)
+		}
+		return true, nil
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	for _, rng := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType(obj)},
+			"Content-Range": {rng.contentRange(obj.Size)},
+		})
+		if err != nil {
+			return true, nil
+		}
+		_, reader, err := getRange(r.Context(), rs, key, rng.start, rng.length)
+		if err != nil {
+			// the status is out already, all that's left is to cut the body short
+			logger(r.Context()).Warn("reading range failed", "key", key, "err", err)
+			return true, nil
+		}
+		_, err = io.Copy(part, reader)
+		reader.Close()
+		if err != nil {
+			logger(r.Context()).Warn("streaming range to client failed", "key", key, "err", err)
+			return true, nil
+		}
+	}
+	mw.Close()
+	return true, nil
+}
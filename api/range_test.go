@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []httpRange
+		err    error
+	}{
+		{"bytes=0-9", []httpRange{{0, 10}}, nil},
+		{"bytes=90-", []httpRange{{90, 10}}, nil},
+		{"bytes=-5", []httpRange{{95, 5}}, nil},
+		{"bytes=-500", []httpRange{{0, 100}}, nil},
+		{"bytes=50-500", []httpRange{{50, 50}}, nil},
+		{"bytes=0-0, 10-19", []httpRange{{0, 1}, {10, 10}}, nil},
+		{"bytes=200-300, 0-1", []httpRange{{0, 2}}, nil},
+		{"bytes=200-300", nil, errRangeNotSatisfiable},
+		{"bytes=9-5", nil, nil},
+		{"items=0-5", nil, nil},
+	}
+	for _, test := range tests {
+		have, err := parseRange(test.header, 100)
+		if err != test.err || len(have) != len(test.want) {
+			t.Errorf("%s: want %v %v have %v %v", test.header, test.want, test.err, have, err)
+			continue
+		}
+		for i := range have {
+			if have[i] != test.want[i] {
+				t.Errorf("%s: want %v have %v", test.header, test.want, have)
+			}
+		}
+	}
+}
+
+func TestHandleGetRange(t *testing.T) {
+	storage := newMemStorage()
+	data := []byte("0123456789abcdefghij")
+	storage.StoreData("docs/file", bytes.NewReader(data))
+	a := NewAPIServer(storage, "")
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/get/docs/file", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		a.handleGet(w, r)
+		return w
+	}
+
+	w := get(map[string]string{"Range": "bytes=5-9"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "56789" || w.Header().Get("Content-Range") != "bytes 5-9/20" {
+		t.Errorf("want bytes 5-9 have %d %q %s", w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+	}
+
+	w = get(map[string]string{"Range": "bytes=100-"})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */20" {
+		t.Errorf("want 416 have %d %s", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	w = get(map[string]string{"Range": "bytes=0-1,-2"})
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil {
+		t.Fatalf("want multipart 206 have %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []string{"01", "ij"} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(part); string(b) != want {
+			t.Errorf("want part %q have %q", want, b)
+		}
+	}
+
+	info, _ := storage.Stat("docs/file")
+	w = get(map[string]string{"Range": "bytes=0-1", "If-Range": quoteETag(info.ETag)})
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("want range served for a matching If-Range have %d", w.Code)
+	}
+	w = get(map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`})
+	if w.Code != http.StatusOK || w.Body.String() != string(data) {
+		t.Errorf("want whole object for a stale If-Range have %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,569 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+	defaultS3Region   = "us-east-1"
+	defaultMaxKeys    = 1000
+	maxS3PutSize      = 5 << 30
+	s3LastModifiedFmt = "2006-01-02T15:04:05.000Z"
+)
+
+// s3Error is an S3 error code and the HTTP status it is sent with
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string { return e.Code + ": " + e.Message }
+
+var (
+	errS3AccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records."}
+	errS3SignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errS3TimeSkewed        = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errS3AuthMalformed     = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errS3InvalidRequest    = &s3Error{http.StatusBadRequest, "InvalidRequest", "Invalid request."}
+	errS3InvalidArgument   = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errS3SHA256Mismatch    = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errS3BadDigest         = &s3Error{http.StatusBadRequest, "BadDigest", "The checksum you specified did not match what we received."}
+	errS3IncompleteBody    = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is malformed or incomplete."}
+	errS3TooLarge          = &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size."}
+	errS3MetadataTooLarge  = &s3Error{http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size."}
+	errS3NoSuchKey         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3InvalidRange      = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable."}
+	errS3BucketNotEmpty    = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty."}
+	errS3MethodNotAllowed  = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errS3Precondition      = &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold."}
+	errS3NotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errS3Internal          = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+// s3Errorf returns a copy of base with a more specific message
+func s3Errorf(base *s3Error, format string, args ...any) *s3Error {
+	return &s3Error{base.Status, base.Code, fmt.Sprintf(format, args...)}
+}
+
+// S3Gateway serves the S3 REST API on top of StorageInterface so that
+// S3 clients and SDKs can be pointed at a node. Buckets map to namespaces,
+// object "photos/cat.jpg" in bucket "media" is stored under key
+// "media/photos/cat.jpg". Only path-style addressing is supported and every
+// request must carry a SigV4 signature from one of the configured keys.
+type S3Gateway struct {
+	storage     StorageInterface
+	address     string
+	region      string
+	credentials map[string]string
+	now         func() time.Time
+	logger      *slog.Logger
+	certFile    string
+	keyFile     string
+}
+
+// NewS3Gateway creates an S3 gateway, credentials maps access key ids to
+// secret keys and region defaults to us-east-1
+func NewS3Gateway(storage StorageInterface, address string, region string, credentials map[string]string) *S3Gateway {
+	if region == "" {
+		region = defaultS3Region
+	}
+	return &S3Gateway{
+		storage:     storage,
+		address:     address,
+		region:      region,
+		credentials: credentials,
+		now:         time.Now,
+	}
+}
+
+// UseLogger logs requests to l instead of slog.Default(), it must be called
+// before Start
+func (g *S3Gateway) UseLogger(l *slog.Logger) {
+	g.logger = l
+}
+
+// UseTLS serves HTTPS with the certificate and key in the PEM files, it
+// must be called before Start
+func (g *S3Gateway) UseTLS(certFile string, keyFile string) {
+	g.certFile, g.keyFile = certFile, keyFile
+}
+
+// Start serves the gateway on its address
+func (g *S3Gateway) Start() error {
+	orDefault(g.logger).Info("starting S3 gateway", "addr", g.address, "tls", g.certFile != "")
+	if g.certFile != "" {
+		return http.ListenAndServeTLS(g.address, g.certFile, g.keyFile, g)
+	}
+	return http.ListenAndServe(g.address, g)
+}
+
+// S3 XML documents
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestIDFrom(r.Header.Get(RequestIDHeader))
+	w.Header().Set("x-amz-request-id", requestID)
+	r = r.WithContext(withLogger(WithRequestID(r.Context(), requestID), g.logger))
+	w.Header().Set("Server", "DistVault")
+
+	auth, err := g.verifySigV4(r)
+	if err == nil {
+		err = g.route(w, r, auth)
+	}
+	if err != nil {
+		writeS3Error(w, r, requestID, err)
+	}
+}
+
+// route dispatches a path-style request, "/" is the service,
+// "/bucket" the bucket and "/bucket/key" an object.
+func (g *S3Gateway) route(w http.ResponseWriter, r *http.Request, auth *sigV4Auth) error {
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			return errS3MethodNotAllowed
+		}
+		return g.listBuckets(w)
+	case object == "":
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Has("location") {
+				return writeXML(w, http.StatusOK, locationConstraint{Xmlns: s3Namespace, Region: g.region})
+			}
+			return g.listObjectsV2(w, r, bucket)
+		case http.MethodHead, http.MethodPut:
+			// namespaces need no creating, every bucket exists
+			w.WriteHeader(http.StatusOK)
+			return nil
+		case http.MethodDelete:
+			return g.deleteBucket(w, bucket)
+		}
+		return errS3MethodNotAllowed
+	}
+
+	key := bucket + "/" + object
+	if err := checkKey(key); err != nil {
+		return s3Errorf(errS3InvalidArgument, "%v", err)
+	}
+	switch r.Method {
+	case http.MethodPut:
+		return g.putObject(w, r, auth, key)
+	case http.MethodGet:
+		return g.getObject(w, r, key)
+	case http.MethodHead:
+		return g.headObject(w, key)
+	case http.MethodDelete:
+		return g.deleteObject(w, r, key)
+	}
+	return errS3MethodNotAllowed
+}
+
+func (g *S3Gateway) listing() (ListingStorage, error) {
+	ls, ok := g.storage.(ListingStorage)
+	if !ok {
+		return nil, s3Errorf(errS3NotImplemented, "storage does not support listing objects")
+	}
+	return ls, nil
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter) error {
+	ls, err := g.listing()
+	if err != nil {
+		return err
+	}
+	objects, err := ls.List("")
+	if err != nil {
+		return err
+	}
+
+	// a bucket exists while any key lives in its namespace
+	created := make(map[string]time.Time)
+	for _, obj := range objects {
+		bucket, _, found := strings.Cut(obj.Key, "/")
+		if !found || bucket == "" {
+			continue
+		}
+		if first, ok := created[bucket]; !ok || obj.ModTime.Before(first) {
+			created[bucket] = obj.ModTime
+		}
+	}
+	res := listAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: g.storage.GetID(), DisplayName: g.storage.GetID()},
+	}
+	for name, at := range created {
+		res.Buckets = append(res.Buckets, s3Bucket{Name: name, CreationDate: at.UTC().Format(s3LastModifiedFmt)})
+	}
+	sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].Name < res.Buckets[j].Name })
+	return writeXML(w, http.StatusOK, res)
+}
+
+func (g *S3Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) error {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		return s3Errorf(errS3NotImplemented, "only ListObjectsV2 (list-type=2) is supported")
+	}
+	ls, err := g.listing()
+	if err != nil {
+		return err
+	}
+
+	res := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           defaultMaxKeys,
+	}
+	if v := query.Get("max-keys"); v != "" {
+		res.MaxKeys, err = strconv.Atoi(v)
+		if err != nil || res.MaxKeys < 0 {
+			return s3Errorf(errS3InvalidArgument, "invalid max-keys %q", v)
+		}
+		res.MaxKeys = min(res.MaxKeys, defaultMaxKeys)
+	}
+	if res.EncodingType != "" && res.EncodingType != "url" {
+		return s3Errorf(errS3InvalidArgument, "invalid encoding-type %q", res.EncodingType)
+	}
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			return s3Errorf(errS3InvalidArgument, "invalid continuation-token")
+		}
+		after = string(b)
+	}
+
+	namespace := bucket + "/"
+	objects, err := ls.List(namespace + res.Prefix)
+	if err != nil {
+		return err
+	}
+	encode := func(s string) string {
+		if res.EncodingType == "url" {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+
+	// objects come sorted, keys under the same common prefix are adjacent
+	var last string
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, namespace)
+		entry := name
+		if res.Delimiter != "" {
+			rest := strings.TrimPrefix(name, res.Prefix)
+			if i := strings.Index(rest, res.Delimiter); i >= 0 {
+				entry = res.Prefix + rest[:i+len(res.Delimiter)]
+			}
+		}
+		if entry <= after || entry == last {
+			continue
+		}
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		last = entry
+		res.KeyCount++
+		if entry != name {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+			continue
+		}
+		res.Contents = append(res.Contents, s3Object{
+			Key:          encode(name),
+			LastModified: obj.ModTime.UTC().Format(s3LastModifiedFmt),
+			ETag:         quoteETag(obj.ETag),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	res.Prefix = encode(res.Prefix)
+	res.Delimiter = encode(res.Delimiter)
+	res.StartAfter = encode(res.StartAfter)
+	return writeXML(w, http.StatusOK, res)
+}
+
+func (g *S3Gateway) deleteBucket(w http.ResponseWriter, bucket string) error {
+	ls, err := g.listing()
+	if err != nil {
+		return err
+	}
+	objects, err := ls.List(bucket + "/")
+	if err != nil {
+		return err
+	}
+	if len(objects) > 0 {
+		return errS3BucketNotEmpty
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// putObject spools the verified body to a temporary file first, so a body
+// that fails its signature or checksum never reaches storage
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, auth *sigV4Auth, key string) error {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return s3Errorf(errS3NotImplemented, "CopyObject is not supported")
+	}
+	body, err := auth.signedBody(r)
+	if err != nil {
+		return err
+	}
+
+	spool, err := os.CreateTemp("", "s3-put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(spool, hash), io.LimitReader(body, maxS3PutSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxS3PutSize {
+		return errS3TooLarge
+	}
+	if want := r.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+		return errS3BadDigest
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	userMeta, err := parseUserMeta(r.Header, s3MetaPrefix)
+	if err != nil {
+		return s3Errorf(errS3MetadataTooLarge, "%v", err)
+	}
+	res := WriteResult{ETag: hex.EncodeToString(hash.Sum(nil))}
+	opts := PutOptions{
+		Precondition: parsePrecondition(r),
+		Size:         n,
+		ContentType:  r.Header.Get("Content-Type"),
+		UserMeta:     userMeta,
+		RequestID:    RequestID(r.Context()),
+	}
+	if obj, ok := g.storage.(ObjectStorage); ok {
+		var stored WriteResult
+		stored, err = putContext(r.Context(), obj, key, spool, opts)
+		if stored.ETag != "" {
+			res = stored
+		}
+	} else if len(opts.IfMatch) > 0 || len(opts.IfNoneMatch) > 0 || len(userMeta) > 0 {
+		return s3Errorf(errS3NotImplemented, "storage does not support conditional writes or metadata")
+	} else {
+		err = g.storage.StoreData(key, spool)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", quoteETag(res.ETag))
+	if res.VersionID != "" {
+		w.Header().Set("x-amz-version-id", res.VersionID)
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// setObjectHeaders describes obj in the headers of a GetObject or HeadObject reply
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	handled, err := writeRangeResponse(w, r, g.storage, key)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		return errS3InvalidRange
+	}
+	if handled || err != nil {
+		return err
+	}
+
+	var obj *ObjectInfo
+	if ls, ok := g.storage.(ListingStorage); ok {
+		info, err := ls.Stat(key)
+		if err != nil {
+			return err
+		}
+		obj = &info
+	}
+
+	reader, err := g.storage.Get(key)
+	if err != nil {
+		return errS3NoSuchKey
+	}
+	defer reader.Close()
+	if obj != nil {
+		setObjectHeaders(w, *obj, s3MetaPrefix)
+	}
+	if _, ok := g.storage.(RangeStorage); ok {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, reader); err != nil {
+		logger(r.Context()).Warn("streaming object to S3 client failed", "key", key, "err", err)
+	}
+	return nil
+}
+
+func (g *S3Gateway) headObject(w http.ResponseWriter, key string) error {
+	ls, err := g.listing()
+	if err != nil {
+		return err
+	}
+	obj, err := ls.Stat(key)
+	if err != nil {
+		return err
+	}
+	setObjectHeaders(w, obj, s3MetaPrefix)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deleteObject succeeds for missing keys too, as S3 does
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, r *http.Request, key string) error {
+	var err error
+	if cond := parsePrecondition(r); len(cond.IfMatch) > 0 || len(cond.IfNoneMatch) > 0 {
+		obj, ok := g.storage.(ObjectStorage)
+		if !ok {
+			return s3Errorf(errS3NotImplemented, "storage does not support conditional deletes")
+		}
+		err = obj.DeleteIf(key, cond)
+	} else {
+		err = g.storage.Delete(g.storage.GetID(), key)
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+	return nil
+}
+
+// writeS3Error replies with err as an S3 error document, errors that
+// aren't S3 errors already are mapped from the storage errors
+func writeS3Error(w http.ResponseWriter, r *http.Request, requestID string, err error) {
+	var s3err *s3Error
+	switch {
+	case errors.As(err, &s3err):
+	case errors.Is(err, ErrNotFound):
+		s3err = errS3NoSuchKey
+	case errors.Is(err, ErrPreconditionFailed):
+		s3err = errS3Precondition
+	case errors.Is(err, ErrTooLarge):
+		s3err = errS3TooLarge
+	default:
+		logger(r.Context()).Error("S3 request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		s3err = errS3Internal
+	}
+	if r.Method == http.MethodHead {
+		// HEAD replies carry no body
+		w.WriteHeader(s3err.Status)
+		return
+	}
+	writeXML(w, s3err.Status, s3ErrorResponse{
+		Code:      s3err.Code,
+		Message:   s3err.Message,
+		Resource:  r.URL.Path,
+		RequestID: requestID,
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,497 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4ChunkAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4TimeFormat     = "20060102T150405Z"
+
+	unsignedPayload        = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrail = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptyPayloadHash       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+	maxChunkHeader   = 4096
+)
+
+// sigV4Auth is what a verified signature leaves behind for checking the body.
+type sigV4Auth struct {
+	accessKey   string
+	signingKey  []byte
+	amzDate     string
+	scope       string
+	signature   string
+	payloadHash string
+}
+
+// sigV4Fields are the parts of a signature, from the Authorization header
+// or from the query string of a presigned URL.
+type sigV4Fields struct {
+	credential    string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	presigned     bool
+	expires       time.Duration
+}
+
+func parseAuthorization(header string, want string) (sigV4Fields, error) {
+	var f sigV4Fields
+	algorithm, params, _ := strings.Cut(header, " ")
+	if algorithm != want {
+		return f, errors.New("unsupported signature algorithm")
+	}
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "Credential":
+			f.credential = value
+		case "SignedHeaders":
+			f.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			f.signature = value
+		}
+	}
+	if f.credential == "" || len(f.signedHeaders) == 0 || f.signature == "" {
+		return f, errors.New("authorization header is missing Credential, SignedHeaders or Signature")
+	}
+	return f, nil
+}
+
+func parsePresigned(query url.Values) (sigV4Fields, error) {
+	f := sigV4Fields{
+		credential:    query.Get("X-Amz-Credential"),
+		signature:     query.Get("X-Amz-Signature"),
+		amzDate:       query.Get("X-Amz-Date"),
+		signedHeaders: strings.Split(query.Get("X-Amz-SignedHeaders"), ";"),
+		presigned:     true,
+	}
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return f, errors.New("unsupported signature algorithm")
+	}
+	if f.credential == "" || f.signature == "" || f.amzDate == "" {
+		return f, errors.New("presigned URL is missing X-Amz-Credential, X-Amz-Date or X-Amz-Signature")
+	}
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds < 0 {
+		return f, errors.New("invalid X-Amz-Expires")
+	}
+	f.expires = time.Duration(seconds) * time.Second
+	if f.expires > maxPresignExpiry {
+		return f, errors.New("X-Amz-Expires must be less than a week")
+	}
+	return f, nil
+}
+
+// verifySigV4 checks the AWS Signature Version 4 of r against the gateway's
+// access keys. The payload itself is checked later by signedBody.
+func (g *S3Gateway) verifySigV4(r *http.Request) (*sigV4Auth, error) {
+	var f sigV4Fields
+	var err error
+	query := r.URL.Query()
+	switch {
+	case r.Header.Get("Authorization") != "":
+		f, err = parseAuthorization(r.Header.Get("Authorization"), sigV4Algorithm)
+		f.amzDate = r.Header.Get("X-Amz-Date")
+	case query.Has("X-Amz-Signature"):
+		f, err = parsePresigned(query)
+	default:
+		return nil, errS3AccessDenied
+	}
+	if err != nil {
+		return nil, s3Errorf(errS3AuthMalformed, "%s", err)
+	}
+
+	// Credential is <access key>/<yyyymmdd>/<region>/s3/aws4_request
+	parts := strings.Split(f.credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return nil, s3Errorf(errS3AuthMalformed, "malformed credential %q", f.credential)
+	}
+	accessKey, date, region := parts[0], parts[1], parts[2]
+	secret, ok := g.credentials[accessKey]
+	if !ok {
+		return nil, errS3InvalidAccessKey
+	}
+	if region != g.region {
+		return nil, s3Errorf(errS3AuthMalformed, "the region %q is wrong, expecting %q", region, g.region)
+	}
+
+	signedAt, err := time.Parse(sigV4TimeFormat, f.amzDate)
+	if err != nil || !strings.HasPrefix(f.amzDate, date) {
+		return nil, s3Errorf(errS3AccessDenied, "missing or invalid X-Amz-Date")
+	}
+	now := g.now()
+	if f.presigned {
+		if now.Before(signedAt.Add(-maxClockSkew)) || now.After(signedAt.Add(f.expires)) {
+			return nil, s3Errorf(errS3AccessDenied, "request has expired")
+		}
+	} else if now.Sub(signedAt) > maxClockSkew || signedAt.Sub(now) > maxClockSkew {
+		return nil, errS3TimeSkewed
+	}
+	if !containsString(f.signedHeaders, "host") {
+		return nil, s3Errorf(errS3AuthMalformed, "the host header must be signed")
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if f.presigned {
+		payloadHash = unsignedPayload
+	} else if payloadHash == "" {
+		return nil, s3Errorf(errS3InvalidRequest, "missing required header x-amz-content-sha256")
+	}
+
+	auth := &sigV4Auth{
+		accessKey:   accessKey,
+		signingKey:  sigV4SigningKey(secret, date, region, "s3"),
+		amzDate:     f.amzDate,
+		scope:       strings.Join(parts[1:], "/"),
+		signature:   f.signature,
+		payloadHash: payloadHash,
+	}
+	canonical := canonicalRequest(r, f.signedHeaders, payloadHash, f.presigned)
+	stringToSign := sigV4Algorithm + "\n" + auth.amzDate + "\n" + auth.scope + "\n" + hexSHA256([]byte(canonical))
+	expected := hex.EncodeToString(hmacSHA256(auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(f.signature)) {
+		return nil, errS3SignatureMismatch
+	}
+	return auth, nil
+}
+
+// canonicalRequest builds the SigV4 canonical form of r.
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string, presigned bool) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	path := sigV4Escape(r.URL.Path, false)
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path + "\n")
+
+	query := r.URL.Query()
+	if presigned {
+		query.Del("X-Amz-Signature")
+	}
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, sigV4Escape(name, true)+"="+sigV4Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	b.WriteString(strings.Join(pairs, "&") + "\n")
+
+	for _, name := range signedHeaders {
+		b.WriteString(name + ":" + canonicalHeaderValue(r, name) + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.Join(signedHeaders, ";") + "\n")
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		// the server keeps the length on the request, not always in the header
+		values = []string{strconv.FormatInt(r.ContentLength, 10)}
+	case "transfer-encoding":
+		values = r.TransferEncoding
+	default:
+		values = r.Header.Values(name)
+	}
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// sigV4Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, which is the encoding SigV4 signs. Slashes are kept in paths.
+func sigV4Escape(s string, escapeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// signedBody returns the decoded payload of r, failing on read with an
+// S3 error once it doesn't match what the client signed or checksummed.
+func (a *sigV4Auth) signedBody(r *http.Request) (io.Reader, error) {
+	var body io.Reader = r.Body
+	switch a.payloadHash {
+	case unsignedPayload:
+	case streamingSignedPayload:
+		body = &awsChunkedReader{r: bufio.NewReader(r.Body), auth: a, prevSignature: a.signature}
+	case streamingUnsignedTrail:
+		cr := &awsChunkedReader{r: bufio.NewReader(r.Body), trailer: r.Header.Get("X-Amz-Trailer")}
+		if cr.trailer != "" {
+			cr.checksum = newChecksum(cr.trailer)
+			if cr.checksum == nil {
+				return nil, s3Errorf(errS3InvalidRequest, "unsupported trailer %q", cr.trailer)
+			}
+		}
+		body = cr
+	default:
+		want, err := hex.DecodeString(a.payloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return nil, s3Errorf(errS3NotImplemented, "unsupported x-amz-content-sha256 %q", a.payloadHash)
+		}
+		body = &digestReader{r: body, h: sha256.New(), want: want, err: errS3SHA256Mismatch}
+	}
+
+	// a checksum header covers the decoded payload whatever the signing mode
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-amz-checksum-") || name == "x-amz-checksum-type" {
+			continue
+		}
+		h := newChecksum(name)
+		want, err := base64.StdEncoding.DecodeString(r.Header.Get(name))
+		if h == nil || err != nil {
+			return nil, s3Errorf(errS3InvalidRequest, "invalid %s header", name)
+		}
+		body = &digestReader{r: body, h: h, want: want, err: errS3BadDigest}
+	}
+	return body, nil
+}
+
+var crc64NVME = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+// newChecksum returns the hash behind an x-amz-checksum-* name, nil if unknown.
+func newChecksum(name string) hash.Hash {
+	switch strings.TrimPrefix(strings.ToLower(name), "x-amz-checksum-") {
+	case "crc32":
+		return crc32.NewIEEE()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "crc64nvme":
+		return crc64.New(crc64NVME)
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// digestReader fails with err at EOF if the data read doesn't hash to want.
+type digestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+	err  error
+}
+
+func (d *digestReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	d.h.Write(b[:n])
+	if err == io.EOF && !bytes.Equal(d.h.Sum(nil), d.want) {
+		return n, d.err
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding. With auth set
+// every chunk signature is verified against the previous one, with a
+// checksum set the trailer is verified against the decoded data.
+type awsChunkedReader struct {
+	r             *bufio.Reader
+	auth          *sigV4Auth
+	prevSignature string
+	trailer       string
+	checksum      hash.Hash
+
+	remaining      int64
+	chunkHash      hash.Hash
+	chunkSignature string
+	done           bool
+}
+
+func (c *awsChunkedReader) Read(b []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.remaining -= int64(n)
+	c.chunkHash.Write(b[:n])
+	if c.checksum != nil {
+		c.checksum.Write(b[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.remaining == 0 {
+		// data chunks end with CRLF
+		if err = c.verifyChunk(); err == nil {
+			if line, lerr := c.readLine(); lerr != nil || line != "" {
+				err = s3Errorf(errS3IncompleteBody, "malformed chunk")
+			}
+		}
+	}
+	return n, err
+}
+
+// nextChunk reads a "<hex size>[;chunk-signature=<sig>]" line, the
+// zero-sized chunk is followed by the trailer.
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return s3Errorf(errS3IncompleteBody, "malformed chunk header")
+	}
+	c.remaining = size
+	c.chunkSignature = strings.TrimPrefix(ext, "chunk-signature=")
+	c.chunkHash = sha256.New()
+	if size > 0 {
+		return nil
+	}
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	return c.readTrailer()
+}
+
+// verifyChunk checks the signature of the chunk just read, which chains
+// on the signature of the one before it.
+func (c *awsChunkedReader) verifyChunk() error {
+	if c.auth == nil {
+		return nil
+	}
+	stringToSign := sigV4ChunkAlgorithm + "\n" + c.auth.amzDate + "\n" + c.auth.scope + "\n" +
+		c.prevSignature + "\n" + emptyPayloadHash + "\n" + hex.EncodeToString(c.chunkHash.Sum(nil))
+	expected := hex.EncodeToString(hmacSHA256(c.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(c.chunkSignature)) {
+		return errS3SignatureMismatch
+	}
+	c.prevSignature = c.chunkSignature
+	return nil
+}
+
+// readTrailer reads the trailing headers up to the final empty line.
+func (c *awsChunkedReader) readTrailer() error {
+	c.done = true
+	var checksum string
+	for {
+		line, err := c.readLine()
+		if err == io.EOF && c.trailer == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), c.trailer) {
+			checksum = strings.TrimSpace(value)
+		}
+	}
+	if c.checksum == nil {
+		return nil
+	}
+	want, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil || !bytes.Equal(want, c.checksum.Sum(nil)) {
+		return errS3BadDigest
+	}
+	return nil
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxChunkHeader {
+			return "", s3Errorf(errS3IncompleteBody, "chunk header too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package client is the Go SDK for the HTTP API of the storage nodes.
+//
+//	c, err := client.New([]string{"http://127.0.0.1:8080"})
+//	c.UseAPIKey(os.Getenv("DV_API_KEY"))
+//	res, err := c.Put(ctx, "docs/report.pdf", f, &client.PutOptions{ContentType: "application/pdf"})
+//
+// Requests go to the endpoints in turn and are retried with backoff on
+// network errors and on responses that say a node is unavailable.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+)
+
+// RetryPolicy says how often and how patiently a request is retried
+type RetryPolicy struct {
+	// Attempts is the total number of tries, 1 disables retries
+	Attempts int
+	// Backoff is the wait before the first retry, it doubles with every
+	// retry up to MaxBackoff and a random part of it is waited
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy tries a request 4 times over about 2 seconds
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   4,
+	Backoff:    250 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+// Client talks to one or more API servers, or to the load balancer in
+// front of them. It is safe for concurrent use.
+type Client struct {
+	endpoints  []*url.URL
+	next       atomic.Uint64
+	httpClient *http.Client
+	retry      RetryPolicy
+
+	apiKey    string
+	accessKey string
+	secretKey string
+}
+
+// New creates a client for endpoints, base URLs such as
+// http://127.0.0.1:8081
+func New(endpoints []string) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("client: no endpoints")
+	}
+	c := &Client{
+		httpClient: http.DefaultClient,
+		retry:      DefaultRetryPolicy,
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("client: endpoint %q: %w", endpoint, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("client: endpoint %q must be an http or https URL", endpoint)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		c.endpoints = append(c.endpoints, u)
+	}
+	return c, nil
+}
+
+// UseHTTPClient sends requests through hc instead of http.DefaultClient
+func (c *Client) UseHTTPClient(hc *http.Client) {
+	c.httpClient = hc
+}
+
+// UseRetryPolicy replaces DefaultRetryPolicy
+func (c *Client) UseRetryPolicy(p RetryPolicy) {
+	if p.Attempts < 1 {
+		p.Attempts = 1
+	}
+	c.retry = p
+}
+
+// UseAPIKey authenticates requests with an API key
+func (c *Client) UseAPIKey(key string) {
+	c.apiKey = key
+}
+
+// UseAccessKey authenticates requests by signing them with an access key,
+// bodies are sent unsigned
+func (c *Client) UseAccessKey(accessKey string, secretKey string) {
+	c.accessKey = accessKey
+	c.secretKey = secretKey
+}
+
+// request describes a call to the API, body is replayed for retries when
+// it can seek and only tried once otherwise
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   io.Reader
+	// size is the length of body, -1 if unknown
+	size int64
+}
+
+// do sends req to the endpoints in turn until one answers with something
+// other than an error worth retrying. Responses with an error status are
+// returned as *Error.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	seeker, replayable := req.body.(io.Seeker)
+	attempts := c.retry.Attempts
+	if req.body != nil && !replayable {
+		attempts = 1
+	}
+	var start int64
+	if replayable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+
+	first := c.next.Add(1) - 1
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+			if replayable {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+		}
+		endpoint := c.endpoints[(first+uint64(attempt))%uint64(len(c.endpoints))]
+		res, err := c.send(ctx, endpoint, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+		lastErr = decodeError(res, req)
+		if !retryable(res.StatusCode) {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *Client) send(ctx context.Context, endpoint *url.URL, req request) (*http.Response, error) {
+	u := *endpoint
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+	r, err := http.NewRequestWithContext(ctx, req.method, u.String(), req.body)
+	if err != nil {
+		return nil, err
+	}
+	if req.body != nil && req.size >= 0 {
+		r.ContentLength = req.size
+	}
+	if req.body != nil {
+		// the body is the caller's, retries need it back
+		r.Body = io.NopCloser(req.body)
+		r.GetBody = nil
+	}
+	for name, values := range req.header {
+		r.Header[name] = values
+	}
+	switch {
+	case c.apiKey != "":
+		r.Header.Set("X-Api-Key", c.apiKey)
+	case c.accessKey != "":
+		api.SignRequest(r, c.accessKey, c.secretKey, nil, time.Now())
+	}
+	return c.httpClient.Do(r)
+}
+
+// sleep waits out the backoff before retry number attempt
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	backoff := c.retry.Backoff << (attempt - 1)
+	if backoff > c.retry.MaxBackoff || backoff <= 0 {
+		backoff = c.retry.MaxBackoff
+	}
+	if backoff > 0 {
+		backoff = backoff/2 + rand.N(backoff/2+1)
+	}
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryable reports whether another node, or the same one a bit later,
+// may answer differently
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
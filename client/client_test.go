@@ -0,0 +1,180 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+	"github.com/arpbansal/distributed_storage_system/internal/apitest"
+)
+
+var testRetryPolicy = RetryPolicy{Attempts: 4, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func TestClient(t *testing.T) {
+	storage := apitest.NewStorage()
+	srv := httptest.NewServer(api.NewAPIServer(storage, "").Handler())
+	defer srv.Close()
+	c, err := New([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	res, err := c.Put(ctx, "docs/hello world.txt", strings.NewReader("hello, world"), &PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"Owner": "ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := md5.Sum([]byte("hello, world")); res.ETag != hex.EncodeToString(sum[:]) {
+		t.Errorf("want the md5 ETag have %q", res.ETag)
+	}
+
+	r, err := c.Get(ctx, "docs/hello world.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "hello, world" {
+		t.Errorf("want the object have %q %v", b, err)
+	}
+
+	r, err = c.GetRange(ctx, "docs/hello world.txt", 7, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(r)
+	r.Close()
+	if string(b) != "world" {
+		t.Errorf("want the range have %q", b)
+	}
+
+	info, err := c.Stat(ctx, "docs/hello world.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 12 || info.ContentType != "text/plain" || info.UserMeta["owner"] != "ops" || info.ETag != res.ETag {
+		t.Errorf("want the object described have %+v", info)
+	}
+
+	storage.StoreData("docs/other.txt", strings.NewReader("other"))
+	storage.StoreData("media/cat.jpg", strings.NewReader("meow"))
+	objects, err := c.List(ctx, "docs/")
+	if err != nil || len(objects) != 2 || objects[0].Key != "docs/hello world.txt" {
+		t.Errorf("want the two docs listed have %+v %v", objects, err)
+	}
+
+	_, err = c.Put(ctx, "docs/other.txt", strings.NewReader("again"), &PutOptions{IfNoneMatch: "*"})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("want ErrPreconditionFailed have %v", err)
+	}
+
+	if err := c.Delete(ctx, "docs/other.txt"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(ctx, "docs/other.txt")
+	var apiErr *Error
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("want a not found *Error have %v", err)
+	}
+	if _, err := c.Stat(ctx, "docs/other.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound from Stat have %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	storage := apitest.NewStorage()
+	handler := api.NewAPIServer(storage, "").Handler()
+
+	// the first endpoint is down and the second fails its first request
+	down := httptest.NewServer(handler)
+	down.Close()
+	var requests atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			io.Copy(io.Discard, r.Body)
+			http.Error(w, `{"success":false,"message":"overloaded"}`, http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	c, err := New([]string{down.URL, flaky.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UseRetryPolicy(testRetryPolicy)
+	ctx := context.Background()
+
+	// dead, then 503, then stored, with the body replayed every time
+	if _, err := c.Put(ctx, "docs/a.txt", bytes.NewReader([]byte("retried")), nil); err != nil {
+		t.Fatalf("want the put retried onto a working endpoint have %v", err)
+	}
+	if r, err := storage.Get("docs/a.txt"); err != nil {
+		t.Fatal(err)
+	} else if b, _ := io.ReadAll(r); string(b) != "retried" {
+		t.Errorf("want the whole body stored have %q", b)
+	}
+
+	requests.Store(0)
+	c.next.Store(1)
+	_, err = c.Put(ctx, "docs/b.txt", io.MultiReader(strings.NewReader("once")), nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "overloaded" {
+		t.Errorf("want a body that can't be replayed sent once have %v", err)
+	}
+
+	c.UseRetryPolicy(RetryPolicy{Attempts: 1})
+	c.next.Store(0)
+	if _, err := c.Stat(ctx, "docs/a.txt"); err == nil {
+		t.Error("want no retry with a single attempt")
+	}
+}
+
+func TestClientChecksums(t *testing.T) {
+	storage := apitest.NewStorage()
+	storage.StoreData("docs/a.txt", strings.NewReader("the original data"))
+	handler := api.NewAPIServer(storage, "").Handler()
+
+	// flip a byte of every object on the way out
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		body := rec.Body.Bytes()
+		if r.Method == http.MethodGet && len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		for name, values := range rec.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	c, err := New([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Get(context.Background(), "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("want ErrChecksumMismatch have %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+)
+
+// EndpointHealth is the result of a health check of one endpoint
+type EndpointHealth struct {
+	Endpoint string
+	Latency  time.Duration
+	// Err is nil for a healthy endpoint
+	Err error
+}
+
+// Health checks every endpoint once, without retries
+func (c *Client) Health(ctx context.Context) []EndpointHealth {
+	results := make([]EndpointHealth, len(c.endpoints))
+	for i, endpoint := range c.endpoints {
+		start := time.Now()
+		res, err := c.send(ctx, endpoint, request{method: http.MethodGet, path: "/health"})
+		if err == nil {
+			if res.StatusCode != http.StatusOK {
+				err = decodeError(res, request{method: http.MethodGet, path: "/health"})
+			} else {
+				res.Body.Close()
+			}
+		}
+		results[i] = EndpointHealth{Endpoint: endpoint.String(), Latency: time.Since(start), Err: err}
+	}
+	return results
+}
+
+// Cluster returns the status of the node a request lands on and its view
+// of the cluster, it needs an admin principal when authentication is on
+func (c *Client) Cluster(ctx context.Context) (api.ClusterStatus, error) {
+	res, err := c.do(ctx, request{method: http.MethodGet, path: "/admin/cluster"})
+	if err != nil {
+		return api.ClusterStatus{}, err
+	}
+	defer res.Body.Close()
+	var out api.ClusterResponse
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return api.ClusterStatus{}, fmt.Errorf("decoding cluster status: %w", err)
+	}
+	return out.Cluster, nil
+}
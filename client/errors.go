@@ -0,0 +1,74 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+)
+
+var (
+	// ErrNotFound, ErrPreconditionFailed and ErrTooLarge are the errors of
+	// the api package, so errors.Is matches either
+	ErrNotFound           = api.ErrNotFound
+	ErrPreconditionFailed = api.ErrPreconditionFailed
+	ErrTooLarge           = api.ErrTooLarge
+
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden")
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+	// ErrChecksumMismatch is returned when data doesn't hash to the ETag
+	// the server gave for it
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Error is an error response from the API, its message comes from the
+// api.Response in the body. errors.Is matches it against the sentinel
+// errors of this package that its status stands for.
+type Error struct {
+	StatusCode int
+	Message    string
+	Method     string
+	Path       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusPreconditionFailed:
+		return target == ErrPreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return target == ErrTooLarge
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusRequestedRangeNotSatisfiable:
+		return target == ErrRangeNotSatisfiable
+	}
+	return false
+}
+
+// decodeError reads and closes the body of an error response
+func decodeError(res *http.Response, req request) error {
+	defer res.Body.Close()
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Method:     req.method,
+		Path:       req.path,
+		Message:    http.StatusText(res.StatusCode),
+	}
+	var body api.Response
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&body); err == nil && body.Message != "" {
+		e.Message = body.Message
+	}
+	return e
+}
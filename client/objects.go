@@ -0,0 +1,297 @@
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+)
+
+const (
+	metaPrefix   = "X-Meta-"
+	listPageSize = 1000
+)
+
+// PutOptions are the optional parts of an upload
+type PutOptions struct {
+	ContentType string
+	// Metadata is kept with the object, names are case insensitive
+	Metadata map[string]string
+	// IfMatch and IfNoneMatch make the write conditional on the ETag the
+	// key has, "*" matches any object
+	IfMatch     string
+	IfNoneMatch string
+	// TTL lets the storage delete the object once it has passed
+	TTL time.Duration
+}
+
+// PutResult describes a stored object
+type PutResult struct {
+	Key       string
+	ETag      string
+	VersionID string
+}
+
+// Put stores the data of r under key. The data is checked against the
+// ETag the server returns. Only readers that can seek, such as files, are
+// retried, other readers are sent once.
+func (c *Client) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (*PutResult, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	header := make(http.Header)
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	for name, value := range opts.Metadata {
+		header.Set(metaPrefix+name, value)
+	}
+	if opts.IfMatch != "" {
+		header.Set("If-Match", quoteETag(opts.IfMatch))
+	}
+	if opts.IfNoneMatch != "" {
+		header.Set("If-None-Match", quoteETag(opts.IfNoneMatch))
+	}
+	query := url.Values{}
+	if opts.TTL > 0 {
+		query.Set("ttl", opts.TTL.String())
+	}
+
+	size, err := remaining(r)
+	if err != nil {
+		return nil, err
+	}
+	body, sum := newChecksumReader(r)
+	res, err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   "/objects/" + key,
+		query:  query,
+		header: header,
+		body:   body,
+		size:   size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var out api.Response
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if out.ETag != "" && out.ETag != sum() {
+		return nil, fmt.Errorf("%w: sent %s, stored %s", ErrChecksumMismatch, sum(), out.ETag)
+	}
+	return &PutResult{Key: key, ETag: out.ETag, VersionID: out.VersionID}, nil
+}
+
+// Get reads the object under key, the caller must close it. Reading it to
+// the end fails with ErrChecksumMismatch if it doesn't match its ETag.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, request{method: http.MethodGet, path: "/objects/" + key})
+	if err != nil {
+		return nil, err
+	}
+	etag := unquoteETag(res.Header.Get("ETag"))
+	if etag == "" || strings.Contains(etag, "-") {
+		// not an md5 of the content, or the storage couldn't describe it
+		return res.Body, nil
+	}
+	return &verifyingReader{ReadCloser: res.Body, h: md5.New(), etag: etag}, nil
+}
+
+// GetRange reads length bytes of the object under key from offset, to the
+// end if length is negative
+func (c *Client) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length == 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	res, err := c.do(ctx, request{
+		method: http.MethodGet,
+		path:   "/objects/" + key,
+		header: http.Header{"Range": {rng}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		return res.Body, nil
+	}
+
+	// the server sent the whole object, cut the range out of it
+	if _, err := io.CopyN(io.Discard, res.Body, offset); err != nil {
+		res.Body.Close()
+		if err == io.EOF {
+			return nil, ErrRangeNotSatisfiable
+		}
+		return nil, err
+	}
+	if length < 0 {
+		return res.Body, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(res.Body, length), res.Body}, nil
+}
+
+// Delete removes the object under key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	res, err := c.do(ctx, request{method: http.MethodDelete, path: "/delete/" + key})
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Stat describes the object under key without reading it
+func (c *Client) Stat(ctx context.Context, key string) (api.ObjectInfo, error) {
+	res, err := c.do(ctx, request{method: http.MethodHead, path: "/objects/" + key})
+	if err != nil {
+		return api.ObjectInfo{}, err
+	}
+	res.Body.Close()
+
+	info := api.ObjectInfo{
+		Key:         key,
+		Size:        res.ContentLength,
+		ETag:        unquoteETag(res.Header.Get("ETag")),
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	info.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	for name, values := range res.Header {
+		if meta, ok := strings.CutPrefix(name, metaPrefix); ok && meta != "" {
+			if info.UserMeta == nil {
+				info.UserMeta = make(map[string]string)
+			}
+			info.UserMeta[strings.ToLower(meta)] = strings.Join(values, ",")
+		}
+	}
+	return info, nil
+}
+
+// List returns the objects whose keys start with prefix, in key order
+func (c *Client) List(ctx context.Context, prefix string) ([]api.ObjectInfo, error) {
+	var objects []api.ObjectInfo
+	startAfter := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("limit", strconv.Itoa(listPageSize))
+		if startAfter != "" {
+			query.Set("start_after", startAfter)
+		}
+		res, err := c.do(ctx, request{method: http.MethodGet, path: "/objects/", query: query})
+		if err != nil {
+			return nil, err
+		}
+		var page api.ListResponse
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding listing: %w", err)
+		}
+		objects = append(objects, page.Objects...)
+		if page.NextStartAfter == "" {
+			return objects, nil
+		}
+		startAfter = page.NextStartAfter
+	}
+}
+
+// remaining returns the bytes left in r, -1 if it can't tell
+func remaining(r io.Reader) (int64, error) {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return -1, nil
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+// checksumReader hashes what is sent through it
+type checksumReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (c *checksumReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.h.Write(b[:n])
+	return n, err
+}
+
+// seekingChecksumReader starts the hash over when a retry seeks back
+type seekingChecksumReader struct {
+	*checksumReader
+}
+
+func (c seekingChecksumReader) Seek(offset int64, whence int) (int64, error) {
+	c.h.Reset()
+	return c.r.(io.Seeker).Seek(offset, whence)
+}
+
+// newChecksumReader wraps r, keeping it seekable if it is, sum returns the
+// hex md5 of what was read
+func newChecksumReader(r io.Reader) (body io.Reader, sum func() string) {
+	c := &checksumReader{r: r, h: md5.New()}
+	sum = func() string { return hex.EncodeToString(c.h.Sum(nil)) }
+	if _, ok := r.(io.Seeker); ok {
+		return seekingChecksumReader{c}, sum
+	}
+	return c, sum
+}
+
+// verifyingReader fails the read that reaches EOF if the data doesn't
+// hash to etag
+type verifyingReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	etag string
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.ReadCloser.Read(b)
+	v.h.Write(b[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.etag {
+			return n, fmt.Errorf("%w: received %s, want %s", ErrChecksumMismatch, sum, v.etag)
+		}
+	}
+	return n, err
+}
+
+func quoteETag(etag string) string {
+	if etag == "*" || strings.HasPrefix(etag, `"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+func unquoteETag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// VectorClock counts the writes each node made to an object, node id => counter.
+type VectorClock map[string]uint64
+
+type ClockOrdering int
+
+const (
+	ClockEqual ClockOrdering = iota
+	ClockBefore
+	ClockAfter
+	ClockConcurrent
+)
+
+// Increment returns a copy of the clock with node's counter bumped.
+func (vc VectorClock) Increment(node string) VectorClock {
+	next := vc.Merge(nil)
+	next[node]++
+	return next
+}
+
+// Merge returns the pairwise maximum of both clocks.
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(vc)+len(other))
+	for node, n := range vc {
+		merged[node] = n
+	}
+	for node, n := range other {
+		if n > merged[node] {
+			merged[node] = n
+		}
+	}
+	return merged
+}
+
+// Compare tells whether vc happened before, after or concurrently with other.
+func (vc VectorClock) Compare(other VectorClock) ClockOrdering {
+	var less, greater bool
+	for node, n := range vc {
+		if n > other[node] {
+			greater = true
+		}
+	}
+	for node, n := range other {
+		if n > vc[node] {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return ClockConcurrent
+	case less:
+		return ClockBefore
+	case greater:
+		return ClockAfter
+	}
+	return ClockEqual
+}
+
+// HLCTimestamp is a hybrid logical clock reading: wall time in nanoseconds
+// plus a logical counter ordering events within the same wall time.
+type HLCTimestamp struct {
+	Wall    int64
+	Logical uint32
+}
+
+func (t HLCTimestamp) Less(other HLCTimestamp) bool {
+	if t.Wall != other.Wall {
+		return t.Wall < other.Wall
+	}
+	return t.Logical < other.Logical
+}
+
+func (t HLCTimestamp) String() string {
+	return fmt.Sprintf("%016x.%08x", t.Wall, t.Logical)
+}
+
+type hybridClock struct {
+	mu   sync.Mutex
+	last HLCTimestamp
+}
+
+// Now returns a timestamp greater than any this clock produced or observed.
+func (c *hybridClock) Now() HLCTimestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := time.Now().UnixNano()
+	if pt > c.last.Wall {
+		c.last = HLCTimestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update folds a timestamp received from another node into the clock.
+func (c *hybridClock) Update(remote HLCTimestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := time.Now().UnixNano()
+	wall := max(pt, c.last.Wall, remote.Wall)
+	switch {
+	case wall == c.last.Wall && wall == remote.Wall:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	case wall == c.last.Wall:
+		c.last.Logical++
+	case wall == remote.Wall:
+		c.last.Logical = remote.Logical + 1
+	default:
+		c.last.Logical = 0
+	}
+	c.last.Wall = wall
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVectorClockCompare(t *testing.T) {
+	a := VectorClock{}.Increment("a")
+	b := a.Increment("b")
+	c := a.Increment("c")
+
+	cases := []struct {
+		x, y VectorClock
+		want ClockOrdering
+	}{
+		{a, a, ClockEqual},
+		{a, b, ClockBefore},
+		{b, a, ClockAfter},
+		{b, c, ClockConcurrent},
+		{b.Merge(c), c, ClockAfter},
+		{nil, a, ClockBefore},
+	}
+	for _, tc := range cases {
+		if got := tc.x.Compare(tc.y); got != tc.want {
+			t.Errorf("%v vs %v: want %d have %d", tc.x, tc.y, tc.want, got)
+		}
+	}
+}
+
+func TestHybridClockMonotonic(t *testing.T) {
+	var c hybridClock
+	prev := c.Now()
+	// a remote clock far ahead pulls ours forward
+	ahead := HLCTimestamp{Wall: prev.Wall + 1e12, Logical: 7}
+	c.Update(ahead)
+	next := c.Now()
+	if !ahead.Less(next) || !prev.Less(next) {
+		t.Errorf("clock went backwards: prev %v ahead %v next %v", prev, ahead, next)
+	}
+}
+
+// TestConcurrentWritesAcrossNodes has two nodes write the same key before
+// they know of each other, then join them.
+func TestConcurrentWritesAcrossNodes(t *testing.T) {
+	content := func(s *Server) string {
+		r, err := s.Get("k")
+		if err != nil {
+			return ""
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return string(b)
+	}
+	write := func(s *Server, data string) {
+		t.Helper()
+		if err := s.StoreData("k", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("last writer wins", func(t *testing.T) {
+		a := startTestNode(t, ServerOpts{})
+		b := startTestNode(t, ServerOpts{})
+		write(a, "from a")
+		write(b, "from b")
+		connectNodes(t, a, b)
+
+		eventually(t, "both nodes to keep the later write", func() bool {
+			return content(a) == "from b" && content(b) == "from b"
+		})
+		meta, err := a.store.ReadMeta(a.ID, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Clock[a.ID] != 1 || meta.Clock[b.ID] != 1 {
+			t.Errorf("clock of the winning copy should cover both writes, have %v", meta.Clock)
+		}
+
+		// a write now descends from both and replaces the copy on b
+		write(a, "again")
+		eventually(t, "b to take the next write", func() bool { return content(b) == "again" })
+	})
+
+	t.Run("keep siblings", func(t *testing.T) {
+		a := startTestNode(t, ServerOpts{ConflictPolicy: ConflictKeepSiblings})
+		b := startTestNode(t, ServerOpts{ConflictPolicy: ConflictKeepSiblings})
+		write(a, "from a")
+		write(b, "from b")
+		connectNodes(t, a, b)
+
+		for _, s := range []*Server{a, b} {
+			eventually(t, "the conflict to be kept", func() bool {
+				conflicted, err := s.Siblings("k")
+				return err == nil && len(conflicted) == 1 && len(conflicted[0].Siblings) == 1
+			})
+		}
+
+		// a write on a covers its copy and the sibling, which resolves both nodes
+		write(a, "resolved")
+		for _, s := range []*Server{a, b} {
+			eventually(t, "the conflict to be resolved", func() bool {
+				conflicted, err := s.Siblings("k")
+				return err == nil && len(conflicted) == 0 && content(s) == "resolved"
+			})
+		}
+	})
+}
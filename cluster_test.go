@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+)
+
+// testClusterKey is the encryption key every node of a test cluster shares
+var testClusterKey = newEncryptionkey()
+
+// startTestNode runs a server on a free local port until the test ends.
+func startTestNode(t *testing.T, opts ServerOpts) *Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	transport := peer2peer.NewTCPtransport(peer2peer.TCPtransportOps{
+		ListenAddr:    addr,
+		HandshakeFunc: peer2peer.NOPHandshakeFunc,
+		Decoder:       peer2peer.DefaultDecoder{},
+	})
+	opts.StorageRoot = t.TempDir()
+	opts.PathTransformFunc = CASPathTransformFunc
+	opts.Transport = transport
+	opts.Enckey = testClusterKey
+	s := NewServer(opts)
+	transport.OnPeer = s.OnPeer
+	transport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Start()
+	}()
+	// the temp dir goes once the node is done writing to it
+	t.Cleanup(func() {
+		s.Stop()
+		<-stopped
+	})
+	return s
+}
+
+// connectNodes dials b from a and waits until each has the other on its ring.
+func connectNodes(t *testing.T, a, b *Server) {
+	t.Helper()
+	// b may not be listening yet
+	eventually(t, "dialing "+b.Transport.Addr(), func() bool {
+		return a.Transport.Dial(b.Transport.Addr()) == nil
+	})
+	eventually(t, "nodes joining each other", func() bool {
+		return a.ring.Has(b.Transport.Addr()) && b.ring.Has(a.Transport.Addr())
+	})
+}
+
+// eventually polls cond until it holds, failing the test after a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// keyOwnedBy returns a key whose first owner is s.
+func keyOwnedBy(t *testing.T, s *Server, prefix string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%s-%d", prefix, i)
+		if s.owners(key)[0] == s.Transport.Addr() {
+			return key
+		}
+	}
+	t.Fatalf("no key owned by %s", s.Transport.Addr())
+	return ""
+}
+
+// TestFetchDuringReplication reads a key off its owner while the owner
+// streams other writes the other way, over the same connection.
+func TestFetchDuringReplication(t *testing.T) {
+	a := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	b := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	connectNodes(t, a, b)
+
+	remote := keyOwnedBy(t, b, "remote")
+	want := strings.Repeat("b", 64<<10)
+	if err := b.StoreData(remote, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		// b holds none of these, every write is streamed to a
+		for i := range 20 {
+			key := keyOwnedBy(t, a, fmt.Sprintf("local%d", i))
+			if err := b.StoreData(key, strings.NewReader(strings.Repeat("a", 64<<10))); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for range 20 {
+		r, err := a.Get(remote)
+		if got := readAll(t, r, err); got != want {
+			t.Fatalf("fetched %d bytes that aren't the object", len(got))
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReplicasEncryptedAtRest keeps the copies pushed to other owners
+// encrypted on disk and reads ranges of them without decrypting the rest.
+func TestReplicasEncryptedAtRest(t *testing.T) {
+	opts := ServerOpts{ReplicationFactor: 2}
+	nodes := []*Server{startTestNode(t, opts), startTestNode(t, opts), startTestNode(t, opts)}
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			connectNodes(t, a, b)
+		}
+	}
+	lead := nodes[0]
+	key := keyOwnedBy(t, lead, "secret")
+	want := strings.Repeat("attack at dawn ", 1000)
+	if err := lead.StoreData(key, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	var replica, other *Server
+	for _, s := range nodes[1:] {
+		if slices.Contains(lead.owners(key), s.Transport.Addr()) {
+			replica = s
+		} else {
+			other = s
+		}
+	}
+	eventually(t, "object replicated", func() bool { return replica.store.Has(replica.ID, key) })
+	raw, err := os.ReadFile(replica.store.Root + "/" + replica.ID + "/" + CASPathTransformFunc(key).FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "attack at dawn") {
+		t.Error("want the replica encrypted on disk")
+	}
+	if meta, _ := replica.store.ReadMeta(replica.ID, key); !meta.Encrypted || meta.Size != int64(len(want)) {
+		t.Errorf("want an encrypted copy of the plaintext size have %+v", meta)
+	}
+
+	// with the lead's copy gone the range comes from the replica
+	if err := lead.store.Delete(lead.ID, key); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Server{replica, other} {
+		for _, offset := range []int64{0, 7, 16, 4099} {
+			size, r, err := s.GetRange(key, offset, 100)
+			if got := readAll(t, r, err); got != want[offset:offset+100] || size != int64(len(want)) {
+				t.Errorf("%s: wrong range at %d of %d: %q", s.Transport.Addr(), offset, size, got)
+			}
+		}
+	}
+}
+
+// TestThrottledTransferHoldsUpOnlyItsPeer keeps writing to and reading from
+// one node while a rate limited transfer to another is under way.
+func TestThrottledTransferHoldsUpOnlyItsPeer(t *testing.T) {
+	a := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	b := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	c := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	connectNodes(t, a, b)
+	connectNodes(t, a, c)
+	connectNodes(t, b, c)
+
+	// two seconds worth of data at the rate
+	a.RebalanceRate = 32 << 10
+	if _, err := a.store.Write(a.ID, "slow", strings.NewReader(strings.Repeat("s", 64<<10))); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := a.store.ReadMeta(a.ID, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.sendObject(obj, b.Transport.Addr()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	key := keyOwnedBy(t, c, "fast")
+	if err := a.StoreData(key, strings.NewReader("quick")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := a.Get(key)
+	if got := readAll(t, r, err); got != "quick" {
+		t.Errorf("want the object back from c have %q", got)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("writing to and reading from c waited %v behind the transfer to b", took)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !b.store.Has(b.ID, "slow") {
+		t.Error("want the object transferred to b")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func (cl *cli) status(ctx context.Context, args []string) error {
+	fs := cl.flags("status", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	status, err := cl.client.Cluster(ctx)
+	if err != nil {
+		return err
+	}
+	state := "serving"
+	if status.Draining {
+		state = "draining"
+	}
+	inRing := 0
+	for _, peer := range status.Peers {
+		if peer.InRing {
+			inRing++
+		}
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "node:\t%s (%s)\n", status.Addr, status.NodeID)
+	fmt.Fprintf(tw, "state:\t%s\n", state)
+	fmt.Fprintf(tw, "replication factor:\t%d\n", status.ReplicationFactor)
+	fmt.Fprintf(tw, "ring:\t%s\n", strings.Join(status.Ring, ", "))
+	fmt.Fprintf(tw, "peers:\t%d connected, %d in the ring\n", len(status.Peers), inRing)
+	return tw.Flush()
+}
+
+func (cl *cli) peers(ctx context.Context, args []string) error {
+	fs := cl.flags("peers", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	status, err := cl.client.Cluster(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDR\tREMOTE ADDR\tIN RING")
+	for _, peer := range status.Peers {
+		addr := peer.Addr
+		if addr == "" {
+			addr = "(not announced)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\n", addr, peer.RemoteAddr, peer.InRing)
+	}
+	return tw.Flush()
+}
+
+func (cl *cli) health(ctx context.Context, args []string) error {
+	fs := cl.flags("health", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	unhealthy := 0
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	for _, h := range cl.client.Health(ctx) {
+		if h.Err != nil {
+			unhealthy++
+			fmt.Fprintf(tw, "%s\tdown\t%v\n", h.Endpoint, h.Err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tok\t%s\n", h.Endpoint, h.Latency.Round(time.Millisecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if unhealthy > 0 {
+		return fmt.Errorf("%d endpoints unhealthy", unhealthy)
+	}
+	return nil
+}
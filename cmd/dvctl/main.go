@@ -0,0 +1,146 @@
+// Command dvctl is the command-line client of the storage cluster, it talks
+// to the HTTP API of the nodes or of the load balancer in front of them.
+//
+//	dvctl put report.pdf docs/report.pdf
+//	dvctl get docs/report.pdf
+//	dvctl ls -l docs/
+//	dvctl sync ./photos photos/
+//	dvctl status
+//
+// Endpoints and credentials come from -endpoint and -api-key, or from the
+// DV_ENDPOINTS, DV_API_KEY, DV_ACCESS_KEY and DV_SECRET_KEY variables.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/arpbansal/distributed_storage_system/client"
+)
+
+const defaultEndpoint = "http://127.0.0.1:8080"
+
+// errUsage marks errors caused by how dvctl was invoked
+var errUsage = errors.New("usage")
+
+const usage = `usage: dvctl [-endpoint url,...] [-api-key key] <command> [arguments]
+
+objects:
+  put [-r] [-content-type type] [-meta name=value] [-ttl duration] <file|dir|-> <key|prefix>
+  get [-r] <key|prefix> [file|dir|-]
+  rm [-r] <key|prefix>...
+  ls [-l] [prefix]
+  stat <key>
+  sync [-delete] [-dry-run] <dir> <prefix>
+
+cluster:
+  status    the node's view of the cluster
+  peers     the peers of the node
+  health    health of every endpoint
+`
+
+type cli struct {
+	client *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command in args and returns the exit status, 2 for
+// usage errors
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dvctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	endpoints := fs.String("endpoint", envOr("DV_ENDPOINTS", defaultEndpoint), "comma separated API or load balancer URLs")
+	apiKey := fs.String("api-key", os.Getenv("DV_API_KEY"), "API key")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c, err := client.New(strings.Split(*endpoints, ","))
+	if err != nil {
+		fmt.Fprintln(stderr, "dvctl:", err)
+		return 2
+	}
+	switch {
+	case *apiKey != "":
+		c.UseAPIKey(*apiKey)
+	case os.Getenv("DV_ACCESS_KEY") != "":
+		c.UseAccessKey(os.Getenv("DV_ACCESS_KEY"), os.Getenv("DV_SECRET_KEY"))
+	}
+	cl := &cli{client: c, stdin: stdin, stdout: stdout, stderr: stderr}
+
+	commands := map[string]func(context.Context, []string) error{
+		"put":    cl.put,
+		"get":    cl.get,
+		"rm":     cl.rm,
+		"ls":     cl.ls,
+		"stat":   cl.stat,
+		"sync":   cl.sync,
+		"status": cl.status,
+		"peers":  cl.peers,
+		"health": cl.health,
+	}
+	name := fs.Arg(0)
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "dvctl: unknown command %q\n\n", name)
+		fs.Usage()
+		return 2
+	}
+	if err := command(ctx, fs.Args()[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		fmt.Fprintf(stderr, "dvctl %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// flags returns a flag set for a command, whose errors go to stderr
+func (cl *cli) flags(name string, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(cl.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(cl.stderr, "usage: dvctl %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses args into fs and checks the number of positional arguments
+func parse(fs *flag.FlagSet, args []string, min int, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
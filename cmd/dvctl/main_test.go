@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+	"github.com/arpbansal/distributed_storage_system/internal/apitest"
+)
+
+func TestDvctl(t *testing.T) {
+	storage := apitest.NewStorage()
+	storage.Status = api.ClusterStatus{
+		NodeID:            "node-1",
+		Addr:              ":3000",
+		ReplicationFactor: 2,
+		Ring:              []string{":3000", ":4000"},
+		Peers:             []api.PeerInfo{{Addr: ":4000", RemoteAddr: "127.0.0.1:51234", InRing: true}},
+	}
+	srv := httptest.NewServer(api.NewAPIServer(storage, "").Handler())
+	defer srv.Close()
+
+	dvctl := func(args ...string) (string, int) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		code := run(context.Background(), append([]string{"-endpoint", srv.URL}, args...), nil, &stdout, &stderr)
+		if code != 0 {
+			t.Logf("dvctl %v: %s", args, stderr.String())
+		}
+		return stdout.String(), code
+	}
+
+	dir := t.TempDir()
+	write := func(name string, data string) {
+		t.Helper()
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "a")
+	write("sub/b.txt", "b")
+	storage.StoreData("backup/stale.txt", strings.NewReader("stale"))
+
+	out, code := dvctl("sync", "-delete", dir, "backup")
+	if code != 0 || !strings.Contains(out, "2 uploaded, 0 unchanged, 1 deleted") {
+		t.Fatalf("want both files uploaded and the stale one deleted have %d %q", code, out)
+	}
+
+	// only what changed is sent again
+	write("a.txt", "changed")
+	writes := storage.Writes()
+	out, code = dvctl("sync", dir, "backup/")
+	if code != 0 || !strings.Contains(out, "upload backup/a.txt") || !strings.Contains(out, "1 uploaded, 1 unchanged") {
+		t.Errorf("want only the changed file uploaded have %d %q", code, out)
+	}
+	if storage.Writes() != writes+1 {
+		t.Errorf("want one write have %d", storage.Writes()-writes)
+	}
+
+	if out, _ := dvctl("ls", "backup/"); out != "backup/a.txt\nbackup/sub/b.txt\n" {
+		t.Errorf("want the synced keys listed have %q", out)
+	}
+
+	dest := t.TempDir()
+	if _, code := dvctl("get", "-r", "backup/", dest); code != 0 {
+		t.Fatal("want recursive download")
+	}
+	if b, err := os.ReadFile(filepath.Join(dest, "sub", "b.txt")); err != nil || string(b) != "b" {
+		t.Errorf("want sub/b.txt downloaded have %q %v", b, err)
+	}
+
+	if out, code := dvctl("status"); code != 0 || !strings.Contains(out, ":3000 (node-1)") || !strings.Contains(out, "1 connected, 1 in the ring") {
+		t.Errorf("want the node's status have %d %q", code, out)
+	}
+	if _, code := dvctl("stat", "backup/missing.txt"); code != 1 {
+		t.Errorf("want exit status 1 for a missing key have %d", code)
+	}
+	if _, code := dvctl("frobnicate"); code != 2 {
+		t.Errorf("want exit status 2 for an unknown command have %d", code)
+	}
+}
+
+func TestSyncAcrossNodes(t *testing.T) {
+	nodes := apitest.NewCluster(2)
+	var endpoints []string
+	for _, node := range nodes {
+		srv := httptest.NewServer(api.NewAPIServer(node, "").Handler())
+		defer srv.Close()
+		endpoints = append(endpoints, srv.URL)
+	}
+	sync := func(endpoint string, args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), append([]string{"-endpoint", endpoint, "sync"}, args...), nil, &stdout, &stderr); code != 0 {
+			t.Fatalf("dvctl sync %v: %s", args, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	dir := t.TempDir()
+	var names []string
+	for i := range 8 {
+		name := fmt.Sprintf("f%d.txt", i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	nodes[1].StoreData("backup/stale-0.txt", strings.NewReader("stale"))
+	nodes[1].StoreData("backup/stale-1.txt", strings.NewReader("stale"))
+
+	out := sync(endpoints[0], "-delete", dir, "backup")
+	if !strings.Contains(out, "8 uploaded, 0 unchanged, 2 deleted") {
+		t.Fatalf("want every file uploaded and the stale ones deleted have %q", out)
+	}
+	var held [2]int
+	for _, name := range names {
+		for i, node := range nodes {
+			if node.Holds("backup/" + name) {
+				held[i]++
+			}
+		}
+	}
+	if held[0] == 0 || held[1] == 0 {
+		t.Fatalf("want the files spread over both nodes have %v", held)
+	}
+
+	// either node compares against the objects of both
+	for i, endpoint := range endpoints {
+		if out := sync(endpoint, "-delete", dir, "backup"); !strings.Contains(out, "0 uploaded, 8 unchanged, 0 deleted") {
+			t.Errorf("node %d: want nothing to do have %q", i, out)
+		}
+	}
+}
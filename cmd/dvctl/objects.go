@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/client"
+)
+
+// metaFlags collects repeated -meta name=value flags
+type metaFlags map[string]string
+
+func (m metaFlags) String() string { return fmt.Sprint(map[string]string(m)) }
+
+func (m metaFlags) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("want name=value, have %q", s)
+	}
+	m[name] = value
+	return nil
+}
+
+func (cl *cli) put(ctx context.Context, args []string) error {
+	fs := cl.flags("put", "[-r] [flags] <file|dir|-> <key|prefix>")
+	recursive := fs.Bool("r", false, "upload a directory under a prefix")
+	contentType := fs.String("content-type", "", "content type, guessed from the file name if empty")
+	ttl := fs.Duration("ttl", 0, "delete the object after this long")
+	meta := metaFlags{}
+	fs.Var(meta, "meta", "user metadata as name=value, may be repeated")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	src, dst := fs.Arg(0), fs.Arg(1)
+	opts := client.PutOptions{ContentType: *contentType, Metadata: meta, TTL: *ttl}
+
+	if *recursive {
+		files, err := localFiles(src)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return errors.New("no files under " + src)
+		}
+		for _, rel := range files {
+			key := joinKey(dst, rel)
+			if err := cl.putFile(ctx, filepath.Join(src, filepath.FromSlash(rel)), key, opts); err != nil {
+				return err
+			}
+			fmt.Fprintf(cl.stdout, "uploaded %s\n", key)
+		}
+		return nil
+	}
+	if src == "-" {
+		res, err := cl.client.Put(ctx, dst, cl.stdin, &opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cl.stdout, "uploaded %s %s\n", dst, res.ETag)
+		return nil
+	}
+	return cl.putFile(ctx, src, dst, opts)
+}
+
+func (cl *cli) putFile(ctx context.Context, name string, key string, opts client.PutOptions) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if opts.ContentType == "" {
+		opts.ContentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	_, err = cl.client.Put(ctx, key, f, &opts)
+	return err
+}
+
+func (cl *cli) get(ctx context.Context, args []string) error {
+	fs := cl.flags("get", "[-r] <key|prefix> [file|dir|-]")
+	recursive := fs.Bool("r", false, "download every object under a prefix into a directory")
+	if err := parse(fs, args, 1, 2); err != nil {
+		return err
+	}
+	src, dst := fs.Arg(0), fs.Arg(1)
+
+	if *recursive {
+		if dst == "" {
+			dst = "."
+		}
+		objects, err := cl.client.List(ctx, src)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			rel := strings.TrimPrefix(strings.TrimPrefix(obj.Key, src), "/")
+			if !filepath.IsLocal(filepath.FromSlash(rel)) {
+				fmt.Fprintf(cl.stderr, "skipping %s, it would land outside %s\n", obj.Key, dst)
+				continue
+			}
+			if err := cl.getFile(ctx, obj.Key, filepath.Join(dst, filepath.FromSlash(rel))); err != nil {
+				return err
+			}
+			fmt.Fprintf(cl.stdout, "downloaded %s\n", obj.Key)
+		}
+		return nil
+	}
+	if dst == "" {
+		dst = path.Base(src)
+	}
+	if dst == "-" {
+		r, err := cl.client.Get(ctx, src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(cl.stdout, r)
+		return err
+	}
+	return cl.getFile(ctx, src, dst)
+}
+
+// getFile downloads key to a temporary file next to name and renames it
+// into place once the checksum is verified
+func (cl *cli) getFile(ctx context.Context, key string, name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	r, err := cl.client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (cl *cli) rm(ctx context.Context, args []string) error {
+	fs := cl.flags("rm", "[-r] <key|prefix>...")
+	recursive := fs.Bool("r", false, "remove every object under each prefix")
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	for _, arg := range fs.Args() {
+		keys := []string{arg}
+		if *recursive {
+			objects, err := cl.client.List(ctx, arg)
+			if err != nil {
+				return err
+			}
+			keys = keys[:0]
+			for _, obj := range objects {
+				keys = append(keys, obj.Key)
+			}
+		}
+		for _, key := range keys {
+			if err := cl.client.Delete(ctx, key); err != nil {
+				return err
+			}
+			fmt.Fprintf(cl.stdout, "removed %s\n", key)
+		}
+	}
+	return nil
+}
+
+func (cl *cli) ls(ctx context.Context, args []string) error {
+	fs := cl.flags("ls", "[-l] [prefix]")
+	long := fs.Bool("l", false, "show size, modification time and ETag")
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	objects, err := cl.client.List(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !*long {
+		for _, obj := range objects {
+			fmt.Fprintln(cl.stdout, obj.Key)
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for _, obj := range objects {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t\n", obj.Size, obj.ModTime.Local().Format(time.DateTime), obj.ETag, obj.Key)
+	}
+	return tw.Flush()
+}
+
+func (cl *cli) stat(ctx context.Context, args []string) error {
+	fs := cl.flags("stat", "<key>")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	info, err := cl.client.Stat(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "key:\t%s\n", info.Key)
+	fmt.Fprintf(tw, "size:\t%d\n", info.Size)
+	fmt.Fprintf(tw, "etag:\t%s\n", info.ETag)
+	fmt.Fprintf(tw, "modified:\t%s\n", info.ModTime.Local().Format(time.RFC3339))
+	fmt.Fprintf(tw, "content type:\t%s\n", info.ContentType)
+	for _, name := range slices.Sorted(maps.Keys(info.UserMeta)) {
+		fmt.Fprintf(tw, "meta %s:\t%s\n", name, info.UserMeta[name])
+	}
+	return tw.Flush()
+}
+
+// localFiles returns the regular files under dir, as slash separated paths
+// relative to it
+func localFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(name string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// joinKey puts rel under prefix, which is taken as a directory
+func joinKey(prefix string, rel string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefix + rel
+	}
+	return prefix + "/" + rel
+}
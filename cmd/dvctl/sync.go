@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arpbansal/distributed_storage_system/client"
+)
+
+// sync uploads the files of a directory whose md5 differs from the ETag of
+// their key, like rsync with checksums. Unchanged files are not sent.
+func (cl *cli) sync(ctx context.Context, args []string) error {
+	fs := cl.flags("sync", "[-delete] [-dry-run] <dir> <prefix>")
+	del := fs.Bool("delete", false, "remove objects under the prefix that have no local file")
+	dryRun := fs.Bool("dry-run", false, "only print what would change")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	dir, prefix := fs.Arg(0), fs.Arg(1)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	files, err := localFiles(dir)
+	if err != nil {
+		return err
+	}
+	objects, err := cl.client.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]string, len(objects))
+	for _, obj := range objects {
+		remote[obj.Key] = obj.ETag
+	}
+
+	var uploaded, unchanged, removed int
+	for _, rel := range files {
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		key := prefix + rel
+		etag, ok := remote[key]
+		delete(remote, key)
+		if ok {
+			sum, err := fileMD5(name)
+			if err != nil {
+				return err
+			}
+			if sum == etag {
+				unchanged++
+				continue
+			}
+		}
+		fmt.Fprintf(cl.stdout, "upload %s\n", key)
+		if !*dryRun {
+			if err := cl.putFile(ctx, name, key, client.PutOptions{}); err != nil {
+				return err
+			}
+		}
+		uploaded++
+	}
+	if *del {
+		for key := range remote {
+			fmt.Fprintf(cl.stdout, "delete %s\n", key)
+			if !*dryRun {
+				if err := cl.client.Delete(ctx, key); err != nil {
+					return err
+				}
+			}
+			removed++
+		}
+	}
+	fmt.Fprintf(cl.stdout, "%d uploaded, %d unchanged, %d deleted\n", uploaded, unchanged, removed)
+	return nil
+}
+
+// fileMD5 returns the hex md5 of a file, which is what ETags are
+func fileMD5(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
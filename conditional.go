@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errPreconditionFailed = errors.New("precondition failed")
+	errObjectTooLarge     = errors.New("object exceeds the namespace size limit")
+)
+
+// Precondition guards a write or delete against the current ETag of a key,
+// "*" matches any existing object.
+type Precondition struct {
+	// IfMatch lets the call through only if the key exists with one of these ETags
+	IfMatch []string
+	// IfNoneMatch lets the call through only if the key has none of these ETags
+	IfNoneMatch []string
+}
+
+func etagIn(etags []string, etag string) bool {
+	for _, candidate := range etags {
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Precondition) empty() bool {
+	return len(p.IfMatch) == 0 && len(p.IfNoneMatch) == 0
+}
+
+func (p Precondition) check(etag string, exists bool) error {
+	if len(p.IfMatch) > 0 && (!exists || !etagIn(p.IfMatch, etag)) {
+		return errPreconditionFailed
+	}
+	if len(p.IfNoneMatch) > 0 && exists && etagIn(p.IfNoneMatch, etag) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// PutOpts are the optional parts of a write.
+type PutOpts struct {
+	Precondition
+	// ExpiresAt lets the lifecycle worker delete the object once it passes
+	ExpiresAt time.Time
+	// Size is the length of the data when known up front, which lets a
+	// write over the namespace size limit fail before any of it is read
+	Size int64
+	// ContentType is the media type of the data, UserMeta holds arbitrary
+	// name/value pairs, both are stored alongside the object
+	ContentType string
+	UserMeta    map[string]string
+	// RequestID is the ID of the client request behind the write
+	RequestID string
+
+	// parts makes the object the assembly of these upload parts, the data
+	// written is empty
+	parts []ObjectPart
+}
+
+// writeAttrs travel with a write to every copy of the object.
+type writeAttrs struct {
+	ExpiresAt   time.Time
+	ContentType string
+	UserMeta    map[string]string
+	RequestID   string
+	// ETag and ModTime, when set, are kept instead of those of the data
+	// written, for objects whose data lives in upload parts or shards
+	ETag    string
+	ModTime time.Time
+	Parts   []ObjectPart
+	Erasure *ErasureMeta
+}
+
+// WriteResult describes the object a write produced.
+type WriteResult struct {
+	VersionID string
+	ETag      string
+}
+
+// lockKey serialises writes and deletes of a key through this node. The
+// conditional ones are all made by the first owner of the key, so a
+// precondition checked under the lock still holds when the write lands.
+func (s *Server) lockKey(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &s.keyLocks[h.Sum32()%uint32(len(s.keyLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// currentETag returns the ETag of the live object behind key.
+func (s *Server) currentETag(ctx context.Context, key string) (string, bool, error) {
+	if s.namespaceOpts(key).Versioning {
+		latest, err := s.latestVersion(ctx, key)
+		if errors.Is(err, errNoSuchVersion) {
+			return "", false, nil
+		}
+		if err != nil || latest.DeleteMarker {
+			return "", false, err
+		}
+		return latest.ETag, true, nil
+	}
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return meta.ETag, true, nil
+}
+
+// Put stores key with opts, failing with errPreconditionFailed if the
+// precondition doesn't hold for its current ETag.
+func (s *Server) Put(key string, r io.Reader, opts PutOpts) (WriteResult, error) {
+	return s.PutContext(context.Background(), key, r, opts)
+}
+
+// PutContext is Put as part of the trace in ctx, if any.
+func (s *Server) PutContext(ctx context.Context, key string, r io.Reader, opts PutOpts) (res WriteResult, err error) {
+	ctx, span := tracing.Start(ctx, "Server.StoreData", trace.WithAttributes(
+		attribute.String("dfs.key", key),
+		attribute.String("dfs.node", s.Transport.Addr()),
+	))
+	defer func() {
+		span.SetAttributes(attribute.String("dfs.etag", res.ETag))
+		tracing.End(span, err)
+	}()
+
+	if limit := s.namespaceOpts(key).MaxObjectSize; limit > 0 {
+		if opts.Size > limit {
+			return WriteResult{}, errObjectTooLarge
+		}
+		r = &sizeLimitedReader{r: r, n: limit}
+	}
+	if lead := s.conditionLead(key, opts.Precondition); lead != "" {
+		return s.forwardPut(ctx, lead, key, r, opts)
+	}
+	return s.put(ctx, key, r, opts)
+}
+
+// put is PutContext checking the precondition against the local copy.
+func (s *Server) put(ctx context.Context, key string, r io.Reader, opts PutOpts) (WriteResult, error) {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	if !opts.Precondition.empty() {
+		etag, exists, err := s.currentETag(ctx, key)
+		if err != nil {
+			return WriteResult{}, err
+		}
+		if err := opts.check(etag, exists); err != nil {
+			return WriteResult{}, err
+		}
+	}
+	attrs := writeAttrs{
+		ExpiresAt:   opts.ExpiresAt,
+		ContentType: opts.ContentType,
+		UserMeta:    opts.UserMeta,
+		RequestID:   opts.RequestID,
+		Parts:       opts.parts,
+	}
+	if opts.parts != nil {
+		attrs.ETag = partsETag(opts.parts)
+	}
+
+	// uploads and shards are never versioned, whatever their namespace
+	if !s.namespaceOpts(key).Versioning || isUploadKey(key) || isShardKey(key) {
+		etag, err := s.storeData(ctx, key, r, attrs)
+		return WriteResult{ETag: etag}, err
+	}
+	versionID, etag, err := s.storeVersion(ctx, key, r, attrs)
+	return WriteResult{VersionID: versionID, ETag: etag}, err
+}
+
+// DeleteIf deletes key only if cond holds for its current ETag.
+func (s *Server) DeleteIf(key string, cond Precondition) error {
+	if lead := s.conditionLead(key, cond); lead != "" {
+		return s.forwardDelete(context.Background(), lead, key, cond)
+	}
+	return s.deleteIf(key, cond)
+}
+
+// deleteIf is DeleteIf checking cond against the local copy.
+func (s *Server) deleteIf(key string, cond Precondition) error {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	if !cond.empty() {
+		etag, exists, err := s.currentETag(context.Background(), key)
+		if err != nil {
+			return err
+		}
+		if err := cond.check(etag, exists); err != nil {
+			return err
+		}
+	}
+	return s.delete(key)
+}
+
+// conditionLead returns the node a write or delete of key under cond has
+// to be checked on, empty when that is this node. The first owner checks
+// them all, the copies of the other nodes may lag behind or have diverged.
+func (s *Server) conditionLead(key string, cond Precondition) string {
+	if cond.empty() {
+		return ""
+	}
+	owners := s.owners(key)
+	if len(owners) == 0 || owners[0] == s.Transport.Addr() {
+		return ""
+	}
+	return owners[0]
+}
+
+// forwardPut hands a conditional write to lead and returns what it made of it.
+func (s *Server) forwardPut(ctx context.Context, lead string, key string, r io.Reader, opts PutOpts) (WriteResult, error) {
+	s.peerLock.Lock()
+	_, peer, ok := s.peerForNode(lead)
+	s.peerLock.Unlock()
+	if !ok {
+		return WriteResult{}, fmt.Errorf("no connection to node (%s)", lead)
+	}
+
+	// the size goes on the wire ahead of the data, so the data is spooled first
+	spool, err := os.CreateTemp("", "dfs-put-*")
+	if err != nil {
+		return WriteResult{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return WriteResult{}, err
+	}
+
+	s.requestLogger(opts.RequestID).Info("forwarding conditional write to the first owner", "key", key, "owner", lead)
+	id, replies := s.expectReply()
+	defer s.dropReply(id)
+	unlock := s.lockSend(peer)
+	err = s.send(ctx, peer, &Message{
+		Payload: MessagePutFile{
+			Key:          key,
+			Size:         size + 16, // Add 16 bytes due to encryption
+			Precondition: opts.Precondition,
+			ExpiresAt:    opts.ExpiresAt,
+			ContentType:  opts.ContentType,
+			UserMeta:     opts.UserMeta,
+			Parts:        opts.parts,
+		},
+		RequestID: opts.RequestID,
+		CallID:    id,
+	})
+	if err == nil {
+		time.Sleep(time.Millisecond * 5)
+		peer.Send([]byte{peer2peer.IncomingStream})
+		_, err = EncryptCopy(s.Enckey, spool, peer)
+	}
+	unlock()
+	if err != nil {
+		return WriteResult{}, err
+	}
+
+	reply, err := s.awaitReply(ctx, replies)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	ack, _ := reply.(MessageStoreAck)
+	return WriteResult{VersionID: ack.VersionID, ETag: ack.ETag}, ack.err()
+}
+
+// storeOnOwner writes key on its first owner, which replicates it, and
+// returns its ETag once it is stored there. Upload records, parts and
+// shards are written this way, so the next request finds them whichever
+// node it reaches.
+func (s *Server) storeOnOwner(ctx context.Context, key string, r io.Reader) (string, error) {
+	if owners := s.owners(key); len(owners) > 0 && owners[0] != s.Transport.Addr() {
+		res, err := s.forwardPut(ctx, owners[0], key, r, PutOpts{})
+		return res.ETag, err
+	}
+	return s.storeData(ctx, key, r, writeAttrs{})
+}
+
+// forwardDelete hands a conditional delete to lead.
+func (s *Server) forwardDelete(ctx context.Context, lead string, key string, cond Precondition) error {
+	s.peerLock.Lock()
+	_, peer, ok := s.peerForNode(lead)
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("no connection to node (%s)", lead)
+	}
+	reply, err := s.call(ctx, peer, &Message{Payload: MessageDeleteIf{Key: key, Precondition: cond}})
+	if err != nil {
+		return err
+	}
+	ack, _ := reply.(MessageStoreAck)
+	return ack.err()
+}
+
+// handlePutFile applies a conditional write forwarded by another node,
+// whichever node this one takes to lead the key.
+func (s *Server) handlePutFile(ctx context.Context, from string, call *Message, msg *MessagePutFile) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+	stream := io.LimitReader(peer, msg.Size)
+	defer func() {
+		io.Copy(io.Discard, stream)
+		peer.CloseStream()
+	}()
+
+	var res WriteResult
+	plain, err := decryptReader(s.Enckey, stream)
+	if err == nil {
+		res, err = s.put(ctx, msg.Key, plain, PutOpts{
+			Precondition: msg.Precondition,
+			ExpiresAt:    msg.ExpiresAt,
+			ContentType:  msg.ContentType,
+			UserMeta:     msg.UserMeta,
+			RequestID:    call.RequestID,
+			parts:        msg.Parts,
+		})
+	}
+	s.reply(ctx, peer, call, MessageStoreAck{Key: msg.Key, ETag: res.ETag, VersionID: res.VersionID, Err: errString(err)})
+	if errors.Is(err, errPreconditionFailed) {
+		return nil
+	}
+	return err
+}
+
+// handleDeleteIf applies a conditional delete forwarded by another node.
+func (s *Server) handleDeleteIf(ctx context.Context, from string, call *Message, msg *MessageDeleteIf) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+	err = s.deleteIf(msg.Key, msg.Precondition)
+	s.reply(ctx, peer, call, MessageStoreAck{Key: msg.Key, Err: errString(err)})
+	if errors.Is(err, errPreconditionFailed) {
+		return nil
+	}
+	return err
+}
+
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func newETagReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: md5.New()}
+}
+
+func (h *hashingReader) Read(b []byte) (int, error) {
+	n, err := h.r.Read(b)
+	h.h.Write(b[:n])
+	return n, err
+}
+
+// ETag is the hex md5 of everything read so far, the same value S3 uses.
+func (h *hashingReader) ETag() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
+
+// sizeLimitedReader fails with errObjectTooLarge once more than n bytes are read.
+type sizeLimitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitedReader) Read(b []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errObjectTooLarge
+	}
+	if int64(len(b)) > l.n+1 {
+		b = b[:l.n+1]
+	}
+	n, err := l.r.Read(b)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errObjectTooLarge
+	}
+	return n, err
+}
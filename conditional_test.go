@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPutPrecondition(t *testing.T) {
+	s := newTestServer(t, nil)
+	key := "config.json"
+
+	res, err := s.Put(key, bytes.NewReader([]byte("v1")), PutOpts{Precondition: Precondition{IfNoneMatch: []string{"*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ETag != hashKeymd5("v1") {
+		t.Errorf("want md5 etag have %s", res.ETag)
+	}
+
+	// create-only write must not replace the existing key
+	if _, err := s.Put(key, bytes.NewReader([]byte("v2")), PutOpts{Precondition: Precondition{IfNoneMatch: []string{"*"}}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure have %v", err)
+	}
+	if _, err := s.Put(key, bytes.NewReader([]byte("v2")), PutOpts{Precondition: Precondition{IfMatch: []string{"stale"}}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure have %v", err)
+	}
+	r, err := s.Get(key)
+	if got := readAll(t, r, err); got != "v1" {
+		t.Errorf("failed precondition changed the data: %s", got)
+	}
+
+	res, err = s.Put(key, bytes.NewReader([]byte("v2")), PutOpts{Precondition: Precondition{IfMatch: []string{res.ETag}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteIf(key, Precondition{IfMatch: []string{hashKeymd5("v1")}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure have %v", err)
+	}
+	if err := s.DeleteIf(key, Precondition{IfMatch: []string{res.ETag}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteIf(key, Precondition{IfMatch: []string{"*"}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure on missing key have %v", err)
+	}
+}
+
+func TestPutPreconditionVersioned(t *testing.T) {
+	s := newTestServer(t, map[string]NamespaceOpts{"docs": {Versioning: true}})
+	key := "docs/a.txt"
+
+	first, err := s.Put(key, bytes.NewReader([]byte("one")), PutOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(key, bytes.NewReader([]byte("two")), PutOpts{Precondition: Precondition{IfMatch: []string{first.ETag}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(key, bytes.NewReader([]byte("three")), PutOpts{Precondition: Precondition{IfMatch: []string{first.ETag}}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure against old version have %v", err)
+	}
+}
+
+func TestPutSizeLimit(t *testing.T) {
+	s := newTestServer(t, map[string]NamespaceOpts{"small": {MaxObjectSize: 10}})
+	key := "small/file"
+
+	if _, err := s.Put(key, bytes.NewReader([]byte("0123456789")), PutOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(key, bytes.NewReader(nil), PutOpts{Size: 11}); err != errObjectTooLarge {
+		t.Errorf("want declared size rejected have %v", err)
+	}
+	// an undeclared size is only caught while streaming
+	if _, err := s.Put(key, bytes.NewReader([]byte("0123456789a")), PutOpts{}); !errors.Is(err, errObjectTooLarge) {
+		t.Errorf("want streamed size rejected have %v", err)
+	}
+	r, err := s.Get(key)
+	if got := readAll(t, r, err); got != "0123456789" {
+		t.Errorf("rejected write changed the data: %s", got)
+	}
+
+	if _, err := s.Put("other/file", bytes.NewReader([]byte("0123456789a")), PutOpts{}); err != nil {
+		t.Errorf("want other namespaces unlimited have %v", err)
+	}
+}
+
+// TestPreconditionCheckedOnOwner makes conditional writes through a node
+// that doesn't lead the key, so the first owner has to check them.
+func TestPreconditionCheckedOnOwner(t *testing.T) {
+	a := startTestNode(t, ServerOpts{})
+	b := startTestNode(t, ServerOpts{})
+	connectNodes(t, a, b)
+
+	key := keyOwnedBy(t, b, "key")
+	content := func(s *Server) string {
+		r, err := s.Get(key)
+		if err != nil {
+			return ""
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return string(b)
+	}
+
+	v1, err := b.Put(key, strings.NewReader("v1"), PutOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a to hold v1", func() bool { return content(a) == "v1" })
+
+	if _, err := a.Put(key, strings.NewReader("v2"), PutOpts{Precondition: Precondition{IfMatch: []string{"stale"}}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure from the owner have %v", err)
+	}
+	v2, err := a.Put(key, strings.NewReader("v2"), PutOpts{Precondition: Precondition{IfMatch: []string{v1.ETag}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.ETag != hashKeymd5("v2") {
+		t.Errorf("want the etag of v2 have %s", v2.ETag)
+	}
+	if got := content(b); got != "v2" {
+		t.Errorf("owner should hold the write once it is acked, have %q", got)
+	}
+	eventually(t, "a to hold v2", func() bool { return content(a) == "v2" })
+
+	if err := a.DeleteIf(key, Precondition{IfMatch: []string{v1.ETag}}); err != errPreconditionFailed {
+		t.Errorf("want precondition failure on delete have %v", err)
+	}
+	if err := a.DeleteIf(key, Precondition{IfMatch: []string{v2.ETag}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the key to be gone", func() bool { return content(a) == "" && content(b) == "" })
+
+	// create-only writes racing through both nodes, only one may win
+	errs := make(chan error, 2)
+	for _, s := range []*Server{a, b} {
+		go func() {
+			_, err := s.Put(key, strings.NewReader("from "+s.Transport.Addr()), PutOpts{Precondition: Precondition{IfNoneMatch: []string{"*"}}})
+			errs <- err
+		}()
+	}
+	var won, lost int
+	for range 2 {
+		switch err := <-errs; err {
+		case nil:
+			won++
+		case errPreconditionFailed:
+			lost++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if won != 1 || lost != 1 {
+		t.Errorf("want one create to win have %d won %d lost", won, lost)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/erasure"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is how `dfs serve` runs a node. It is read from a YAML file, then
+// the environment variables named by the env tags, all starting DFS_,
+// override it, so secrets and per-host settings can stay out of the file.
+// Lists in variables are comma separated. Namespaces and lifecycle rules
+// only come from the file.
+type Config struct {
+	Node         NodeConfig                 `yaml:"node"`
+	TLS          TLSConfig                  `yaml:"tls"`
+	Replication  ReplicationConfig          `yaml:"replication"`
+	Namespaces   map[string]NamespaceConfig `yaml:"namespaces"`
+	Lifecycle    LifecycleConfig            `yaml:"lifecycle"`
+	API          APIConfig                  `yaml:"api"`
+	S3           S3Config                   `yaml:"s3"`
+	LoadBalancer LoadBalancerConfig         `yaml:"load_balancer"`
+	Consul       ConsulConfig               `yaml:"consul"`
+	Log          LogConfig                  `yaml:"log"`
+}
+
+type NodeConfig struct {
+	// ID is kept in StorageRoot when empty, so a node is the same node
+	// across restarts
+	ID string `yaml:"id" env:"DFS_NODE_ID"`
+	// Listen is the address peers connect to
+	Listen      string   `yaml:"listen" env:"DFS_LISTEN"`
+	StorageRoot string   `yaml:"storage_root" env:"DFS_STORAGE_ROOT"`
+	Bootstrap   []string `yaml:"bootstrap" env:"DFS_BOOTSTRAP"`
+	// KeyFile holds the hex encoded encryption key, it is created when
+	// missing. Objects are encrypted with it on their way between nodes
+	// and replicas stay encrypted on disk, so every node of a cluster
+	// needs a copy of the same file.
+	KeyFile string `yaml:"key_file" env:"DFS_KEY_FILE"`
+}
+
+// TLSConfig is the certificate of the node, verified against CA at start,
+// the API, gRPC and S3 servers serve it when set
+type TLSConfig struct {
+	Cert string `yaml:"cert" env:"DFS_TLS_CERT"`
+	Key  string `yaml:"key" env:"DFS_TLS_KEY"`
+	CA   string `yaml:"ca" env:"DFS_TLS_CA"`
+}
+
+type ReplicationConfig struct {
+	// Factor is how many nodes own each key, 0 replicates to every node
+	Factor int `yaml:"factor" env:"DFS_REPLICATION_FACTOR"`
+	// RebalanceRate caps the bytes/sec streamed while rebalancing
+	RebalanceRate int64 `yaml:"rebalance_rate" env:"DFS_REBALANCE_RATE"`
+	// ConflictPolicy is last-writer-wins or keep-siblings
+	ConflictPolicy string `yaml:"conflict_policy" env:"DFS_CONFLICT_POLICY"`
+}
+
+// NamespaceConfig sets the options of the keys under one namespace, the
+// part of a key before its first slash
+type NamespaceConfig struct {
+	Versioning bool `yaml:"versioning"`
+	// MaxObjectSize is in bytes, 0 is no limit
+	MaxObjectSize int64 `yaml:"max_object_size"`
+}
+
+// LifecycleConfig is what the lifecycle worker of the node does with old
+// objects and idle uploads
+type LifecycleConfig struct {
+	// Interval is how often the worker runs, a minute when 0
+	Interval time.Duration `yaml:"interval" env:"DFS_LIFECYCLE_INTERVAL"`
+	// UploadExpiry is how long a multipart upload may sit idle, a day when 0
+	UploadExpiry time.Duration `yaml:"upload_expiry" env:"DFS_UPLOAD_EXPIRY"`
+	// ErasureData and ErasureParity are the shards of an object in the
+	// erasure-coded tier, 4 and 2 when 0
+	ErasureData   int                   `yaml:"erasure_data" env:"DFS_ERASURE_DATA"`
+	ErasureParity int                   `yaml:"erasure_parity" env:"DFS_ERASURE_PARITY"`
+	Rules         []LifecycleRuleConfig `yaml:"rules"`
+}
+
+// LifecycleRuleConfig deletes or tiers the objects under Prefix by age
+type LifecycleRuleConfig struct {
+	Prefix      string        `yaml:"prefix"`
+	ExpireAfter time.Duration `yaml:"expire_after"`
+	TierAfter   time.Duration `yaml:"tier_after"`
+}
+
+type APIConfig struct {
+	Listen string `yaml:"listen" env:"DFS_API_LISTEN"`
+	// GRPCListen is off when empty
+	GRPCListen  string `yaml:"grpc_listen" env:"DFS_GRPC_LISTEN"`
+	Credentials string `yaml:"credentials" env:"DFS_API_CREDENTIALS"`
+	AuditLog    string `yaml:"audit_log" env:"DFS_API_AUDIT_LOG"`
+	PresignKey  string `yaml:"presign_key" env:"DFS_API_PRESIGN_KEY"`
+}
+
+// S3Config starts the S3 gateway once an access key is set
+type S3Config struct {
+	Listen          string `yaml:"listen" env:"DFS_S3_LISTEN"`
+	Region          string `yaml:"region" env:"DFS_S3_REGION"`
+	AccessKeyID     string `yaml:"access_key_id" env:"DFS_S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `yaml:"secret_access_key" env:"DFS_S3_SECRET_ACCESS_KEY"`
+}
+
+// LoadBalancerConfig runs a load balancer in the node when Listen is set.
+// It starts with Backends, then DiscoveryFile, DiscoverySRV or else Consul,
+// the first one set, keeps them up to date.
+type LoadBalancerConfig struct {
+	Listen      string `yaml:"listen" env:"DFS_LB_LISTEN"`
+	AdminListen string `yaml:"admin_listen" env:"DFS_LB_ADMIN_LISTEN"`
+	Strategy    string `yaml:"strategy" env:"DFS_LB_STRATEGY"`
+	// Weights are url=weight pairs for weighted-round-robin
+	Weights       string   `yaml:"weights" env:"DFS_LB_WEIGHTS"`
+	Backends      []string `yaml:"backends" env:"DFS_LB_BACKENDS"`
+	DiscoveryFile string   `yaml:"discovery_file" env:"DFS_LB_DISCOVERY_FILE"`
+	DiscoverySRV  string   `yaml:"discovery_srv" env:"DFS_LB_DISCOVERY_SRV"`
+}
+
+// ConsulConfig registers the API with Consul when Address is set
+type ConsulConfig struct {
+	Address string `yaml:"address" env:"DFS_CONSUL_ADDRESS"`
+	Service string `yaml:"service" env:"DFS_CONSUL_SERVICE"`
+	// Advertise is the host the API is registered with
+	Advertise string `yaml:"advertise" env:"DFS_ADVERTISE"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"DFS_LOG_LEVEL"`
+	Format string `yaml:"format" env:"DFS_LOG_FORMAT"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Node: NodeConfig{
+			Listen:      ":3000",
+			StorageRoot: "dfs_data",
+		},
+		API: APIConfig{
+			Listen:     ":8081",
+			GRPCListen: ":50051",
+		},
+		S3: S3Config{Listen: ":9000"},
+		LoadBalancer: LoadBalancerConfig{
+			AdminListen: "127.0.0.1:8090",
+		},
+		Consul: ConsulConfig{
+			Service:   "api-server",
+			Advertise: "127.0.0.1",
+		},
+	}
+}
+
+// loadConfig reads the config at path over the defaults, unknown keys are
+// refused so a typo doesn't silently fall back to a default
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the fields of c with the variables getenv returns,
+// those that are empty are left alone
+func (c *Config) applyEnv(getenv func(string) string) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), getenv)
+}
+
+func applyEnv(v reflect.Value, getenv func(string) string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, getenv); err != nil {
+				return err
+			}
+			continue
+		}
+		name := t.Field(i).Tag.Get("env")
+		value := getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Int64:
+			if field.Type() != reflect.TypeOf(time.Duration(0)) {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				field.SetInt(n)
+				break
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetInt(int64(d))
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetInt(n)
+		case reflect.Slice:
+			field.Set(reflect.ValueOf(splitList(value)))
+		default:
+			panic("config: no env support for " + field.Kind().String())
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Config) validate() error {
+	if c.Node.Listen == "" {
+		return errors.New("node.listen is required")
+	}
+	if c.Node.StorageRoot == "" {
+		return errors.New("node.storage_root is required")
+	}
+	if c.Replication.Factor < 0 || c.Replication.RebalanceRate < 0 {
+		return errors.New("replication settings can't be negative")
+	}
+	if _, err := c.conflictPolicy(); err != nil {
+		return err
+	}
+	for name, ns := range c.Namespaces {
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("namespace %q: a namespace is the part of a key before its first slash", name)
+		}
+		if ns.MaxObjectSize < 0 {
+			return fmt.Errorf("namespace %q: max_object_size can't be negative", name)
+		}
+	}
+	if err := c.Lifecycle.validate(); err != nil {
+		return err
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls.cert and tls.key go together")
+	}
+	if c.TLS.CA != "" && c.TLS.Cert == "" {
+		return errors.New("tls.ca needs tls.cert to verify")
+	}
+	lb := c.LoadBalancer
+	if lb.Listen != "" && len(lb.Backends) == 0 && lb.DiscoveryFile == "" && lb.DiscoverySRV == "" && c.Consul.Address == "" {
+		return errors.New("load_balancer needs backends, a discovery source or consul")
+	}
+	return nil
+}
+
+func (l *LifecycleConfig) validate() error {
+	if l.Interval < 0 || l.UploadExpiry < 0 {
+		return errors.New("lifecycle durations can't be negative")
+	}
+	if l.ErasureData < 0 || l.ErasureParity < 0 {
+		return errors.New("lifecycle shard counts can't be negative")
+	}
+	if _, err := erasure.New(cmp.Or(l.ErasureData, defaultErasureData), cmp.Or(l.ErasureParity, defaultErasureParity)); err != nil {
+		return fmt.Errorf("lifecycle: %w", err)
+	}
+	for _, rule := range l.Rules {
+		if rule.ExpireAfter < 0 || rule.TierAfter < 0 {
+			return fmt.Errorf("lifecycle rule %q: durations can't be negative", rule.Prefix)
+		}
+		if rule.ExpireAfter == 0 && rule.TierAfter == 0 {
+			return fmt.Errorf("lifecycle rule %q: needs expire_after or tier_after", rule.Prefix)
+		}
+		if rule.ExpireAfter > 0 && rule.TierAfter >= rule.ExpireAfter {
+			return fmt.Errorf("lifecycle rule %q: objects expire before they are tiered", rule.Prefix)
+		}
+	}
+	return nil
+}
+
+// namespaces are the namespace options of the node
+func (c *Config) namespaces() map[string]NamespaceOpts {
+	if len(c.Namespaces) == 0 {
+		return nil
+	}
+	opts := make(map[string]NamespaceOpts, len(c.Namespaces))
+	for name, ns := range c.Namespaces {
+		opts[name] = NamespaceOpts{Versioning: ns.Versioning, MaxObjectSize: ns.MaxObjectSize}
+	}
+	return opts
+}
+
+// lifecycleRules are the lifecycle rules of the node
+func (c *Config) lifecycleRules() []LifecycleRule {
+	var rules []LifecycleRule
+	for _, rule := range c.Lifecycle.Rules {
+		rules = append(rules, LifecycleRule(rule))
+	}
+	return rules
+}
+
+func (c *Config) conflictPolicy() (ConflictPolicy, error) {
+	switch c.Replication.ConflictPolicy {
+	case "", "last-writer-wins":
+		return ConflictLastWriterWins, nil
+	case "keep-siblings":
+		return ConflictKeepSiblings, nil
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q", c.Replication.ConflictPolicy)
+}
+
+// keyFile is the configured key file, or one in the storage root
+func (c *Config) keyFile() string {
+	if c.Node.KeyFile != "" {
+		return c.Node.KeyFile
+	}
+	return filepath.Join(c.Node.StorageRoot, "encryption.key")
+}
+
+// loadOrCreate returns the hex encoded bytes kept in path, writing those of
+// create there first if it doesn't exist yet
+func loadOrCreate(path string, create func() []byte) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		b = []byte(hex.EncodeToString(create()))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, append(b, '\n'), 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return decoded, nil
+}
+
+// encryptionKey loads the key file, creating it with a new key
+func (c *Config) encryptionKey() ([]byte, error) {
+	key, err := loadOrCreate(c.keyFile(), newEncryptionkey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s: want a 32 byte key have %d bytes", c.keyFile(), len(key))
+	}
+	return key, nil
+}
+
+// nodeID is the configured ID, or the one kept in the storage root
+func (c *Config) nodeID() (string, error) {
+	if c.Node.ID != "" {
+		return c.Node.ID, nil
+	}
+	id, err := loadOrCreate(filepath.Join(c.Node.StorageRoot, "node.id"), func() []byte {
+		b, _ := hex.DecodeString(generateID())
+		return b
+	})
+	return hex.EncodeToString(id), err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dfs.yaml")
+	os.WriteFile(path, []byte(`
+node:
+  listen: ":4000"
+  bootstrap: [":3000"]
+replication:
+  factor: 2
+api:
+  grpc_listen: ""
+`), 0644)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Node.Listen != ":4000" || !slices.Equal(cfg.Node.Bootstrap, []string{":3000"}) || cfg.Replication.Factor != 2 {
+		t.Errorf("want the file applied have %+v", cfg)
+	}
+	if cfg.Node.StorageRoot != "dfs_data" || cfg.API.Listen != ":8081" || cfg.API.GRPCListen != "" {
+		t.Errorf("want defaults for what the file leaves out have %+v", cfg)
+	}
+
+	env := map[string]string{
+		"DFS_LISTEN":             ":5000",
+		"DFS_BOOTSTRAP":          ":3000, :4000,",
+		"DFS_REPLICATION_FACTOR": "3",
+		"DFS_S3_ACCESS_KEY_ID":   "key",
+	}
+	if err := cfg.applyEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Node.Listen != ":5000" || !slices.Equal(cfg.Node.Bootstrap, []string{":3000", ":4000"}) ||
+		cfg.Replication.Factor != 3 || cfg.S3.AccessKeyID != "key" {
+		t.Errorf("want the environment over the file have %+v", cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Error(err)
+	}
+
+	env = map[string]string{"DFS_REBALANCE_RATE": "fast"}
+	if err := cfg.applyEnv(func(name string) string { return env[name] }); err == nil {
+		t.Error("want a malformed number refused")
+	}
+
+	os.WriteFile(path, []byte("node:\n  listn: \":4000\"\n"), 0644)
+	if _, err := loadConfig(path); err == nil {
+		t.Error("want an unknown key refused")
+	}
+}
+
+func TestLoadNamespacesAndLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dfs.yaml")
+	os.WriteFile(path, []byte(`
+namespaces:
+  docs:
+    versioning: true
+  uploads:
+    max_object_size: 1024
+lifecycle:
+  upload_expiry: 12h
+  rules:
+    - prefix: tmp/
+      expire_after: 168h
+    - prefix: logs/
+      tier_after: 720h
+      expire_after: 8760h
+`), 0644)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"DFS_LIFECYCLE_INTERVAL": "30s", "DFS_ERASURE_PARITY": "3"}
+	if err := cfg.applyEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Node.StorageRoot = t.TempDir()
+	s, err := newNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Namespaces["docs"].Versioning || s.Namespaces["uploads"].MaxObjectSize != 1024 {
+		t.Errorf("want the namespaces on the node have %+v", s.Namespaces)
+	}
+	wantRules := []LifecycleRule{
+		{Prefix: "tmp/", ExpireAfter: 168 * time.Hour},
+		{Prefix: "logs/", ExpireAfter: 8760 * time.Hour, TierAfter: 720 * time.Hour},
+	}
+	if !slices.Equal(s.LifecycleRules, wantRules) {
+		t.Errorf("want the lifecycle rules on the node have %+v", s.LifecycleRules)
+	}
+	if s.UploadExpiry != 12*time.Hour || s.LifecycleInterval != 30*time.Second || s.ErasureParity != 3 {
+		t.Errorf("want the lifecycle settings on the node have %v %v %d", s.UploadExpiry, s.LifecycleInterval, s.ErasureParity)
+	}
+
+	env = map[string]string{"DFS_UPLOAD_EXPIRY": "a day"}
+	if err := cfg.applyEnv(func(name string) string { return env[name] }); err == nil {
+		t.Error("want a malformed duration refused")
+	}
+}
+
+// TestEnvPrefix keeps every variable of the config under one prefix
+func TestEnvPrefix(t *testing.T) {
+	var check func(reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				check(field.Type)
+			}
+			if name := field.Tag.Get("env"); name != "" && !strings.HasPrefix(name, "DFS_") {
+				t.Errorf("%s.%s: want %s to start with DFS_", typ.Name(), field.Name, name)
+			}
+		}
+	}
+	check(reflect.TypeOf(Config{}))
+}
+
+func TestExampleConfig(t *testing.T) {
+	cfg, err := loadConfig("dfs.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"no listen":        func(c *Config) { c.Node.Listen = "" },
+		"negative factor":  func(c *Config) { c.Replication.Factor = -1 },
+		"unknown policy":   func(c *Config) { c.Replication.ConflictPolicy = "newest" },
+		"cert without key": func(c *Config) { c.TLS.Cert = "node.crt" },
+		"lb without backends": func(c *Config) {
+			c.LoadBalancer.Listen = ":8080"
+		},
+		"namespace with a slash": func(c *Config) {
+			c.Namespaces = map[string]NamespaceConfig{"docs/v1": {Versioning: true}}
+		},
+		"negative quota": func(c *Config) {
+			c.Namespaces = map[string]NamespaceConfig{"docs": {MaxObjectSize: -1}}
+		},
+		"rule doing nothing": func(c *Config) {
+			c.Lifecycle.Rules = []LifecycleRuleConfig{{Prefix: "tmp/"}}
+		},
+		"tier after expiry": func(c *Config) {
+			c.Lifecycle.Rules = []LifecycleRuleConfig{{Prefix: "logs/", ExpireAfter: time.Hour, TierAfter: 2 * time.Hour}}
+		},
+		"too many shards": func(c *Config) { c.Lifecycle.ErasureData = 300 },
+	} {
+		cfg := defaultConfig()
+		mutate(&cfg)
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: want the config refused", name)
+		}
+	}
+}
+
+func TestNodeKeepsIdentity(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Node.StorageRoot = t.TempDir()
+
+	id, err := cfg.nodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := cfg.encryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := cfg.nodeID()
+	sameKey, _ := cfg.encryptionKey()
+	if id != again || !bytes.Equal(key, sameKey) {
+		t.Error("want the ID and key kept across restarts")
+	}
+	if info, err := os.Stat(cfg.keyFile()); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("want the key file private have %v %v", info.Mode(), err)
+	}
+
+	os.WriteFile(cfg.keyFile(), []byte("abcd\n"), 0600)
+	if _, err := cfg.encryptionKey(); err == nil {
+		t.Error("want a short key refused")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// ConflictPolicy decides what a replica does with a concurrent write.
+type ConflictPolicy int
+
+const (
+	// ConflictLastWriterWins keeps the write with the highest HLC timestamp
+	ConflictLastWriterWins ConflictPolicy = iota
+	// ConflictKeepSiblings keeps both writes, the later one as a sibling
+	ConflictKeepSiblings
+)
+
+type resolution int
+
+const (
+	resolveOverwrite resolution = iota
+	resolveDiscard
+	resolveSibling
+)
+
+// resolveWrite decides how an incoming replica write is applied on top of
+// the copy already on disk.
+func resolveWrite(existing ObjectMeta, incoming MessageStoreFile, policy ConflictPolicy) resolution {
+	switch incoming.Clock.Compare(existing.Clock) {
+	case ClockAfter:
+		return resolveOverwrite
+	case ClockBefore, ClockEqual:
+		return resolveDiscard
+	}
+	if policy == ConflictKeepSiblings {
+		return resolveSibling
+	}
+	if existing.HLC.Less(incoming.HLC) ||
+		(existing.HLC == incoming.HLC && existing.Origin < incoming.Origin) {
+		return resolveOverwrite
+	}
+	return resolveDiscard
+}
+
+// siblingKey is where a concurrent write kept by ConflictKeepSiblings is stored.
+func siblingKey(key string, hlc HLCTimestamp, origin string) string {
+	return key + "?sibling=" + hlc.String() + "-" + origin
+}
+
+// storeSibling stores a concurrent replica write, encrypted as it came in,
+// next to the existing copy and records it in that copy's metadata.
+func (s *Server) storeSibling(msg *MessageStoreFile, r io.Reader) (int64, error) {
+	key := siblingKey(msg.Key, msg.HLC, msg.Origin)
+	n, err := s.store.WriteCiphertext(context.Background(), s.ID, key, r)
+	if err != nil {
+		return n, err
+	}
+	// the sibling carries its own order, so it is resolved again wherever
+	// it is handed on to
+	err = s.store.UpdateMeta(s.ID, key, func(meta *ObjectMeta) {
+		meta.Origin = msg.Origin
+		meta.Clock = msg.Clock
+		meta.HLC = msg.HLC
+		meta.ETag = msg.ETag
+		meta.ContentType = msg.ContentType
+		meta.UserMeta = msg.UserMeta
+		meta.setLayout(msg.Parts, msg.Erasure)
+	})
+	if err != nil {
+		return n, err
+	}
+	if msg.Parts != nil || msg.Erasure != nil {
+		n = partsSize(msg.Parts)
+		if msg.Erasure != nil {
+			n = msg.Erasure.Size
+		}
+	}
+	err = s.store.UpdateMeta(s.ID, msg.Key, func(meta *ObjectMeta) {
+		meta.Siblings = append(meta.Siblings, SiblingMeta{
+			Key:    key,
+			Origin: msg.Origin,
+			Size:   n,
+			ETag:   msg.ETag,
+			Clock:  msg.Clock,
+			HLC:    msg.HLC,
+		})
+	})
+	return n, err
+}
+
+// pruneSiblings drops the siblings a write with clock supersedes, along
+// with their data.
+func (s *Server) pruneSiblings(clock VectorClock, siblings []SiblingMeta) []SiblingMeta {
+	var kept []SiblingMeta
+	for _, sib := range siblings {
+		if clock.Compare(sib.Clock) == ClockAfter {
+			s.deleteLocal(sib.Key)
+			continue
+		}
+		kept = append(kept, sib)
+	}
+	return kept
+}
+
+// Siblings returns the local copy of key if it has unresolved concurrent
+// writes.
+func (s *Server) Siblings(key string) ([]ObjectMeta, error) {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(meta.Siblings) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []ObjectMeta{meta}, nil
+}
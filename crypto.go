@@ -88,10 +88,72 @@ func decryptCopy(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	// Read the IV from given io.Reader, in our case it's
 	// block.BlockSize() bytes we read.
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 	var stream = cipher.NewCTR(block, iv)
 
 	return copyStream(stream, block.BlockSize(), src, dst)
 }
+
+// newCTRAt returns the CTR keystream of iv advanced to byte offset of the
+// plaintext, so part of a file can be decrypted without reading what
+// precedes it.
+func newCTRAt(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	blockSize := int64(block.BlockSize())
+	ctr := make([]byte, len(iv))
+	copy(ctr, iv)
+	// the counter is the whole iv read as a big-endian number
+	carry := uint64(offset / blockSize)
+	for i := len(ctr) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ctr[i]) + carry&0xff
+		ctr[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, ctr)
+	skip := make([]byte, offset%blockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+// encryptCopyAt encrypts src, the plaintext from byte offset on, with a
+// new iv written ahead of it. The keystream is that of the iv advanced to
+// offset, so the output decrypts with decryptCopyAt like a range of a
+// copy encrypted with EncryptCopy.
+func encryptCopyAt(key []byte, offset int64, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(iv); err != nil {
+		return 0, err
+	}
+	return copyStream(newCTRAt(block, iv, offset), block.BlockSize(), src, dst)
+}
+
+// decryptCopyAt decrypts src, the ciphertext starting at plaintext byte
+// offset of a file encrypted with iv, into dst.
+func decryptCopyAt(key []byte, iv []byte, offset int64, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	return copyStream(newCTRAt(block, iv, offset), 0, src, dst)
+}
+
+// decryptReader decrypts what EncryptCopy wrote to r as it is read.
+func decryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return nil, err
+	}
+	return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}, nil
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestEncryptDecryptcopy(t *testing.T) {
@@ -27,3 +32,62 @@ func TestEncryptDecryptcopy(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestDecryptCopyAt(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	key := newEncryptionkey()
+
+	// an iv that carries through several bytes of the counter
+	iv := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	iv[0] = 0x42
+	block, _ := aes.NewCipher(key)
+	ciphertext := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, data)
+
+	for _, offset := range []int64{0, 1, 15, 16, 17, 500, 999} {
+		out := new(bytes.Buffer)
+		if _, err := decryptCopyAt(key, iv, offset, bytes.NewReader(ciphertext[offset:]), out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data[offset:]) {
+			t.Errorf("wrong plaintext decrypting from offset %d", offset)
+		}
+
+		// a range encrypted on its own decrypts the same way
+		sent := new(bytes.Buffer)
+		if _, err := encryptCopyAt(key, offset, bytes.NewReader(data[offset:]), sent); err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		if _, err := decryptCopyAt(key, sent.Next(aes.BlockSize), offset, sent, out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data[offset:]) {
+			t.Errorf("wrong plaintext of a range encrypted from offset %d", offset)
+		}
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	key := newEncryptionkey()
+	ciphertext := new(bytes.Buffer)
+	if _, err := EncryptCopy(key, bytes.NewReader(data), ciphertext); err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection hands the iv over in pieces
+	r, err := decryptReader(key, iotest.OneByteReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("wrong plaintext")
+	}
+}
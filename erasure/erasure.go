@@ -0,0 +1,205 @@
+// Package erasure splits data into data and parity shards with a systematic
+// Reed-Solomon code over GF(2^8). Any Data of the shards rebuild the data.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the most shards a Code can have.
+const MaxShards = 256
+
+var ErrTooFewShards = errors.New("erasure: too few shards to rebuild the data")
+
+// GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// Code is a Reed-Solomon code of Data data shards and Parity parity shards.
+type Code struct {
+	Data   int
+	Parity int
+	// rows of the encoding matrix below the identity, a Cauchy matrix so
+	// that any Data rows of the whole matrix can be inverted
+	parity [][]byte
+}
+
+// New returns the code with data data shards and parity parity shards.
+func New(data, parity int) (*Code, error) {
+	if data < 1 || parity < 0 || data+parity > MaxShards {
+		return nil, fmt.Errorf("erasure: invalid code %d+%d", data, parity)
+	}
+	c := &Code{Data: data, Parity: parity, parity: make([][]byte, parity)}
+	for i := range c.parity {
+		c.parity[i] = make([]byte, data)
+		for j := range c.parity[i] {
+			c.parity[i][j] = inv(byte(data+i) ^ byte(j))
+		}
+	}
+	return c, nil
+}
+
+// row returns row i of the encoding matrix.
+func (c *Code) row(i int) []byte {
+	if i >= c.Data {
+		return c.parity[i-c.Data]
+	}
+	row := make([]byte, c.Data)
+	row[i] = 1
+	return row
+}
+
+// Split cuts b into Data shards of equal size, the last one padded with
+// zeros, and appends the Parity shards computed from them.
+func (c *Code) Split(b []byte) [][]byte {
+	size := max((len(b)+c.Data-1)/c.Data, 1)
+	shards := make([][]byte, c.Data+c.Parity)
+	for i := range c.Data {
+		shards[i] = make([]byte, size)
+		if start := i * size; start < len(b) {
+			copy(shards[i], b[start:])
+		}
+	}
+	for i, row := range c.parity {
+		shards[c.Data+i] = combine(row, shards[:c.Data], size)
+	}
+	return shards
+}
+
+// Join rebuilds the first size bytes of the data split into shards. A nil
+// shard is one that was lost, at least Data of them must be present.
+func (c *Code) Join(shards [][]byte, size int64) ([]byte, error) {
+	if len(shards) != c.Data+c.Parity {
+		return nil, fmt.Errorf("erasure: have %d shards, want %d", len(shards), c.Data+c.Parity)
+	}
+	var present []int
+	for i, shard := range shards {
+		if shard != nil && len(present) < c.Data {
+			present = append(present, i)
+		}
+	}
+	if len(present) < c.Data {
+		return nil, ErrTooFewShards
+	}
+	shardSize := len(shards[present[0]])
+	for _, i := range present {
+		if len(shards[i]) != shardSize {
+			return nil, errors.New("erasure: shards differ in size")
+		}
+	}
+	if size > int64(shardSize)*int64(c.Data) {
+		return nil, errors.New("erasure: shards hold less than size")
+	}
+
+	data := shards[:c.Data]
+	if present[c.Data-1] >= c.Data {
+		// some data shards are lost, they are the present shards times
+		// the inverse of the rows that made them
+		m := make([][]byte, c.Data)
+		in := make([][]byte, c.Data)
+		for t, i := range present {
+			m[t] = c.row(i)
+			in[t] = shards[i]
+		}
+		decode, err := invert(m)
+		if err != nil {
+			return nil, err
+		}
+		data = make([][]byte, c.Data)
+		for j := range data {
+			if shards[j] != nil {
+				data[j] = shards[j]
+				continue
+			}
+			data[j] = combine(decode[j], in, shardSize)
+		}
+	}
+
+	out := make([]byte, 0, size)
+	for _, shard := range data {
+		out = append(out, shard[:min(int64(len(shard)), size-int64(len(out)))]...)
+	}
+	return out, nil
+}
+
+// combine returns the sum of shards each multiplied by its coefficient.
+func combine(coefs []byte, shards [][]byte, size int) []byte {
+	out := make([]byte, size)
+	for j, coef := range coefs {
+		if coef == 0 {
+			continue
+		}
+		t := &mulTable[coef]
+		for i, b := range shards[j] {
+			out[i] ^= t[b]
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan
+// elimination, m is left unchanged.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	out := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		out[i] = make([]byte, n)
+		out[i][i] = 1
+	}
+	for col := range n {
+		pivot := col
+		for pivot < n && a[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("erasure: singular matrix")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		out[col], out[pivot] = out[pivot], out[col]
+
+		scale := inv(a[col][col])
+		for j := range n {
+			a[col][j] = mulTable[scale][a[col][j]]
+			out[col][j] = mulTable[scale][out[col][j]]
+		}
+		for row := range n {
+			if row == col || a[row][col] == 0 {
+				continue
+			}
+			f := a[row][col]
+			for j := range n {
+				a[row][j] ^= mulTable[f][a[col][j]]
+				out[row][j] ^= mulTable[f][out[col][j]]
+			}
+		}
+	}
+	return out, nil
+}
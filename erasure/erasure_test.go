@@ -0,0 +1,55 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestJoinAfterLosingShards(t *testing.T) {
+	c, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1001)
+	rand.New(rand.NewSource(1)).Read(data)
+	shards := c.Split(data)
+	if len(shards) != 6 || len(shards[0]) != 251 {
+		t.Fatalf("want 6 shards of 251 bytes have %d of %d", len(shards), len(shards[0]))
+	}
+
+	// every way of losing two shards
+	for a := range shards {
+		for b := a + 1; b < len(shards); b++ {
+			lost := append([][]byte(nil), shards...)
+			lost[a], lost[b] = nil, nil
+			got, err := c.Join(lost, int64(len(data)))
+			if err != nil {
+				t.Fatalf("lost %d and %d: %v", a, b, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("lost %d and %d: want the data back", a, b)
+			}
+		}
+	}
+
+	lost := append([][]byte(nil), shards...)
+	lost[0], lost[3], lost[5] = nil, nil, nil
+	if _, err := c.Join(lost, int64(len(data))); err != ErrTooFewShards {
+		t.Errorf("want ErrTooFewShards with three shards lost have %v", err)
+	}
+}
+
+func TestSplitSmall(t *testing.T) {
+	c, _ := New(3, 1)
+	for _, data := range []string{"", "ab", "abcdefg"} {
+		shards := c.Split([]byte(data))
+		shards[1] = nil
+		if got, err := c.Join(shards, int64(len(data))); err != nil || string(got) != data {
+			t.Errorf("want %q have %q %v", data, got, err)
+		}
+	}
+	if _, err := New(200, 57); err == nil {
+		t.Error("want more than 256 shards rejected")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+	loadbalancer "github.com/arpbansal/distributed_storage_system/load_balancer"
+	"github.com/arpbansal/distributed_storage_system/metrics"
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// runExamples is the demo: three nodes, their APIs and a load balancer on
+// fixed local ports, registered with a local Consul agent, and 20 objects
+// written and read back through the third node. Every run generates new
+// node IDs and encryption keys, use serve for a node that keeps its data.
+func runExamples() {
+	// DFS_LOG_LEVEL is debug, info, warn or error and DFS_LOG_FORMAT text or json
+	logger, err := newLogger(os.Stderr, os.Getenv("DFS_LOG_LEVEL"), os.Getenv("DFS_LOG_FORMAT"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// spans are exported over OTLP when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	shutdownTracing, err := tracing.Setup(context.Background(), "distvault")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	consulConfig := consulapi.DefaultConfig()
+	consulClient, err := consulapi.NewClient(consulConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	time.Sleep(time.Second * 5)
+	s1 := makeServer(":3000", "")
+	s2 := makeServer(":4000", ":3000")
+	s3 := makeServer(":5000", ":3000", ":4000")
+
+	go func() { log.Fatal(s1.Start()) }()
+	time.Sleep(time.Second * 2)
+	go func() { log.Fatal(s2.Start()) }()
+	time.Sleep(time.Second * 2)
+	go s3.Start()
+	time.Sleep(time.Second * 2)
+
+	serverAdapter1 := NewServerAdapter(s1)
+	serverAdapter2 := NewServerAdapter(s2)
+	serverAdapter3 := NewServerAdapter(s3)
+
+	apiServer1 := api.NewAPIServer(serverAdapter1, ":8081")
+	apiServer2 := api.NewAPIServer(serverAdapter2, ":8082")
+	apiServer3 := api.NewAPIServer(serverAdapter3, ":8083")
+	grpcServers := []*api.GRPCServer{
+		api.NewGRPCServer(serverAdapter1, ":50051"),
+		api.NewGRPCServer(serverAdapter2, ":50052"),
+		api.NewGRPCServer(serverAdapter3, ":50053"),
+	}
+	// requests are logged with the node that serves them
+	for i, s := range []*Server{s1, s2, s3} {
+		[]*api.APIServer{apiServer1, apiServer2, apiServer3}[i].UseLogger(s.logger)
+		grpcServers[i].UseLogger(s.logger)
+	}
+
+	if err := registerWithConsul(consulClient, "api-server-1", "api-server", "127.0.0.1", 8081); err != nil {
+		slog.Error("registering with Consul failed", "service", "api-server-1", "err", err)
+	}
+	if err := registerWithConsul(consulClient, "api-server-2", "api-server", "127.0.0.1", 8082); err != nil {
+		slog.Error("registering with Consul failed", "service", "api-server-2", "err", err)
+	}
+	if err := registerWithConsul(consulClient, "api-server-3", "api-server", "127.0.0.1", 8083); err != nil {
+		slog.Error("registering with Consul failed", "service", "api-server-3", "err", err)
+	}
+
+	// with a credential file every API request needs an API key or signature
+	if path := os.Getenv("DFS_API_CREDENTIALS"); path != "" {
+		audit := io.Writer(os.Stderr)
+		if auditPath := os.Getenv("DFS_API_AUDIT_LOG"); auditPath != "" {
+			f, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			audit = f
+		}
+		auth, err := api.LoadAuthenticator(path, audit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, apiServer := range []*api.APIServer{apiServer1, apiServer2, apiServer3} {
+			apiServer.UseAuthenticator(auth)
+		}
+		for _, grpcServer := range grpcServers {
+			grpcServer.UseAuthenticator(auth)
+		}
+	}
+
+	// presigned URLs verify on any node, so every node shares the key
+	if presignKey := os.Getenv("DFS_API_PRESIGN_KEY"); presignKey != "" {
+		for _, apiServer := range []*api.APIServer{apiServer1, apiServer2, apiServer3} {
+			apiServer.UsePresignKey([]byte(presignKey))
+		}
+	}
+
+	go func() { log.Fatal(apiServer1.Start()) }()
+	go func() { log.Fatal(apiServer2.Start()) }()
+	go func() { log.Fatal(apiServer3.Start()) }()
+	for _, grpcServer := range grpcServers {
+		go func() { log.Fatal(grpcServer.Start()) }()
+	}
+
+	// S3 clients can talk to the first node once an access key is configured
+	if accessKey := os.Getenv("DFS_S3_ACCESS_KEY_ID"); accessKey != "" {
+		s3Gateway := api.NewS3Gateway(serverAdapter1, ":9000", os.Getenv("DFS_S3_REGION"), map[string]string{
+			accessKey: os.Getenv("DFS_S3_SECRET_ACCESS_KEY"),
+		})
+		s3Gateway.UseLogger(s1.logger)
+		go func() { log.Fatal(s3Gateway.Start()) }()
+	}
+
+	time.Sleep(time.Second * 3)
+
+	backendURLs, err := getAPIServersFromConsul(consulClient, "api-server")
+	if err != nil || len(backendURLs) == 0 {
+		slog.Warn("no backends found in Consul, using defaults", "err", err)
+		backendURLs = []string{
+			"http://127.0.0.1:8081",
+			"http://127.0.0.1:8082",
+			"http://127.0.0.1:8083",
+		}
+	}
+
+	strategy, err := lbStrategy(os.Getenv("DFS_LB_STRATEGY"), os.Getenv("DFS_LB_WEIGHTS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	lb, err := loadbalancer.NewLoadBalancerWithStrategy(backendURLs, strategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// backends come and go with the instances discovery finds
+	var discovery loadbalancer.Discovery = loadbalancer.NewConsulDiscovery(consulClient, "api-server")
+	if path := os.Getenv("DFS_LB_DISCOVERY_FILE"); path != "" {
+		discovery = loadbalancer.NewFileDiscovery(path)
+	} else if name := os.Getenv("DFS_LB_DISCOVERY_SRV"); name != "" {
+		discovery = loadbalancer.NewDNSSRVDiscovery("http", "tcp", name)
+	}
+	go lb.Watch(context.Background(), discovery)
+
+	lb.StartHealthCheck()
+	lb.RegisterMetrics(metrics.Default)
+	slog.Info("load balancer started", "addr", ":8080")
+	go func() {
+		log.Fatal(http.ListenAndServe(":8080", lb))
+	}()
+
+	// the admin handler has no authentication, keep it on loopback
+	adminAddr := os.Getenv("DFS_LB_ADMIN_LISTEN")
+	if adminAddr == "" {
+		adminAddr = "127.0.0.1:8090"
+	}
+	slog.Info("load balancer admin started", "addr", adminAddr)
+	go func() {
+		log.Fatal(http.ListenAndServe(adminAddr, lb.AdminHandler()))
+	}()
+
+	time.Sleep(time.Second * 2)
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("coolPicture_%d.jpg", i)
+		data := bytes.NewReader([]byte("my big data file here!!"))
+		err := s3.StoreData(key, data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := s3.store.Delete(s3.ID, key); err != nil {
+			log.Fatal(err)
+		}
+
+		r, err := s3.Get(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("read back object", "key", key, "data", string(b))
+	}
+	time.Sleep(time.Second * 5)
+
+	select {}
+}
+
+func makeServer(listenAddr string, nodes ...string) *Server {
+	id := generateID()
+	tcptransportopts := peer2peer.TCPtransportOps{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: peer2peer.NOPHandshakeFunc,
+		Decoder:       peer2peer.DefaultDecoder{},
+		Logger:        slog.Default().With("node", id, "addr", listenAddr),
+	}
+	tcpTransport := peer2peer.NewTCPtransport(tcptransportopts)
+	fileserveropts := ServerOpts{
+		StorageRoot:       listenAddr + "_network",
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         tcpTransport,
+		BootstrapNodes:    nodes,
+		Enckey:            newEncryptionkey(),
+		ID:                id,
+	}
+	s := NewServer(fileserveropts)
+
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	return s
+
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoPeers = errors.New("no peers connected")
+
+// ReadinessCheck is the outcome of one check of whether the node can serve
+// requests, Err is nil when it passed
+type ReadinessCheck struct {
+	Name string
+	Err  error
+}
+
+// Readiness checks that the node can write to its disk, that it reached the
+// cluster if it was given nodes to join, and that it is not draining.
+func (s *Server) Readiness() []ReadinessCheck {
+	checks := []ReadinessCheck{{Name: "disk", Err: s.store.CheckWritable()}}
+
+	var peersErr error
+	if len(s.BootstrapNodes) > 0 {
+		s.peerLock.Lock()
+		if len(s.peers) == 0 {
+			peersErr = errNoPeers
+		}
+		s.peerLock.Unlock()
+	}
+	checks = append(checks, ReadinessCheck{Name: "peers", Err: peersErr})
+
+	var drainingErr error
+	if s.draining.Load() {
+		drainingErr = errDecommissioned
+	}
+	return append(checks, ReadinessCheck{Name: "draining", Err: drainingErr})
+}
+
+// CheckWritable writes, syncs and removes a file under the root of the
+// store, catching full or read-only disks before a write does
+func (s *Store) CheckWritable() error {
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.Root, ".health-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	s := newTestServer(t, nil)
+	failed := func() map[string]error {
+		errs := make(map[string]error)
+		for _, check := range s.Readiness() {
+			if check.Err != nil {
+				errs[check.Name] = check.Err
+			}
+		}
+		return errs
+	}
+
+	if errs := failed(); len(errs) != 0 {
+		t.Fatalf("want a standalone node ready have %v", errs)
+	}
+	if entries, _ := os.ReadDir(s.StorageRoot); len(entries) != 0 {
+		t.Errorf("want the disk check to clean up have %d entries", len(entries))
+	}
+
+	s.BootstrapNodes = []string{":4000"}
+	if errs := failed(); !errors.Is(errs["peers"], errNoPeers) {
+		t.Errorf("want a node that hasn't reached its cluster unready have %v", errs)
+	}
+	s.BootstrapNodes = nil
+
+	s.draining.Store(true)
+	if errs := failed(); !errors.Is(errs["draining"], errDecommissioned) {
+		t.Errorf("want a draining node unready have %v", errs)
+	}
+	s.draining.Store(false)
+
+	// a root that can't be created fails the disk check
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	s.store.Root = filepath.Join(file, "root")
+	if errs := failed(); errs["disk"] == nil {
+		t.Error("want an unwritable disk reported")
+	}
+}
@@ -0,0 +1,206 @@
+// Package apitest provides in-memory storage for testing code that talks
+// to the HTTP API, such as the client and dvctl
+package apitest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+)
+
+// Storage is an in-memory api.StorageInterface with the optional
+// interfaces for conditional writes, ranged reads, listing and cluster
+// status. Put honours If-None-Match: * and If-Match.
+//
+// Storages made by NewCluster split the keys between them like the nodes of
+// a cluster, each one serves every key but holds only its share.
+type Storage struct {
+	// Status is what ClusterStatus reports
+	Status api.ClusterStatus
+
+	mu      sync.Mutex
+	objects map[string]object
+	writes  int
+	nodes   []*Storage
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+	opts    api.PutOptions
+}
+
+// NewStorage returns an empty storage that holds every key itself
+func NewStorage() *Storage {
+	return &Storage{objects: make(map[string]object)}
+}
+
+// NewCluster returns n storages that each hold the keys hashed to them
+func NewCluster(n int) []*Storage {
+	nodes := make([]*Storage, n)
+	for i := range nodes {
+		nodes[i] = NewStorage()
+	}
+	for _, node := range nodes {
+		node.nodes = nodes
+	}
+	return nodes
+}
+
+// owner returns the storage that holds key
+func (m *Storage) owner(key string) *Storage {
+	if len(m.nodes) == 0 {
+		return m
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.nodes[h.Sum32()%uint32(len(m.nodes))]
+}
+
+// Holds reports whether key is held by this storage rather than another
+// node of its cluster
+func (m *Storage) Holds(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.objects[key]
+	return ok
+}
+
+// Writes returns how many objects were written to this storage
+func (m *Storage) Writes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.writes
+}
+
+func (m *Storage) StoreData(key string, r io.Reader) error {
+	_, err := m.Put(key, r, api.PutOptions{})
+	return err
+}
+
+func (m *Storage) Put(key string, r io.Reader, opts api.PutOptions) (api.WriteResult, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return api.WriteResult{}, err
+	}
+	o := m.owner(key)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.check(key, opts.Precondition); err != nil {
+		return api.WriteResult{}, err
+	}
+	o.objects[key] = object{data: b, modTime: time.Now(), opts: opts}
+	o.writes++
+	return api.WriteResult{ETag: etag(b)}, nil
+}
+
+// check tests cond against the object under key, the lock must be held
+func (m *Storage) check(key string, cond api.Precondition) error {
+	obj, ok := m.objects[key]
+	if ok && len(cond.IfNoneMatch) > 0 {
+		return api.ErrPreconditionFailed
+	}
+	if len(cond.IfMatch) > 0 && (!ok || !slices.ContainsFunc(cond.IfMatch, func(tag string) bool {
+		return tag == "*" || tag == etag(obj.data)
+	})) {
+		return api.ErrPreconditionFailed
+	}
+	return nil
+}
+
+func (m *Storage) DeleteIf(key string, cond api.Precondition) error {
+	o := m.owner(key)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.check(key, cond); err != nil {
+		return err
+	}
+	delete(o.objects, key)
+	return nil
+}
+
+func (m *Storage) Get(key string) (io.ReadCloser, error) {
+	_, r, err := m.GetRange(key, 0, -1)
+	return r, err
+}
+
+func (m *Storage) GetRange(key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	o := m.owner(key)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	obj, ok := o.objects[key]
+	if !ok {
+		return 0, nil, api.ErrNotFound
+	}
+	end := int64(len(obj.data))
+	if length >= 0 {
+		end = min(end, offset+length)
+	}
+	return int64(len(obj.data)), io.NopCloser(bytes.NewReader(obj.data[offset:end])), nil
+}
+
+func (m *Storage) Delete(id string, key string) error {
+	return m.DeleteIf(key, api.Precondition{})
+}
+
+func (m *Storage) GetID() string { return "mem" }
+
+func (m *Storage) Stat(key string) (api.ObjectInfo, error) {
+	o := m.owner(key)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	obj, ok := o.objects[key]
+	if !ok {
+		return api.ObjectInfo{}, api.ErrNotFound
+	}
+	return obj.info(key), nil
+}
+
+// List returns the objects of the whole cluster whose keys start with
+// prefix, in key order
+func (m *Storage) List(prefix string) ([]api.ObjectInfo, error) {
+	nodes := m.nodes
+	if len(nodes) == 0 {
+		nodes = []*Storage{m}
+	}
+	var infos []api.ObjectInfo
+	for _, node := range nodes {
+		node.mu.Lock()
+		for key, obj := range node.objects {
+			if strings.HasPrefix(key, prefix) {
+				infos = append(infos, obj.info(key))
+			}
+		}
+		node.mu.Unlock()
+	}
+	slices.SortFunc(infos, func(a, b api.ObjectInfo) int { return strings.Compare(a.Key, b.Key) })
+	return infos, nil
+}
+
+func (m *Storage) ClusterStatus() (api.ClusterStatus, error) {
+	return m.Status, nil
+}
+
+func (obj object) info(key string) api.ObjectInfo {
+	return api.ObjectInfo{
+		Key:         key,
+		Size:        int64(len(obj.data)),
+		ETag:        etag(obj.data),
+		ModTime:     obj.modTime,
+		ContentType: obj.opts.ContentType,
+		UserMeta:    obj.opts.UserMeta,
+	}
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const defaultLifecycleInterval = time.Minute
+
+// LifecycleRule acts on the objects under Prefix by their age, counted from
+// their last write. Once older than ExpireAfter they are deleted, once older
+// than TierAfter they move to the erasure-coded tier. A zero duration skips
+// that step.
+type LifecycleRule struct {
+	Prefix      string
+	ExpireAfter time.Duration
+	TierAfter   time.Duration
+}
+
+// expired reports whether obj, stored under key, is due for deletion at now.
+func (s *Server) expired(key string, obj ObjectMeta, now time.Time) bool {
+	if !obj.ExpiresAt.IsZero() && !now.Before(obj.ExpiresAt) {
+		return true
+	}
+	for _, rule := range s.LifecycleRules {
+		if rule.ExpireAfter > 0 && strings.HasPrefix(key, rule.Prefix) && now.Sub(obj.ModTime) >= rule.ExpireAfter {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) lifecycleLoop() {
+	interval := s.LifecycleInterval
+	if interval <= 0 {
+		interval = defaultLifecycleInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := s.runLifecycle(now); err != nil {
+				s.logger.Error("lifecycle sweep failed", "err", err)
+			}
+			if err := s.reapUploads(now); err != nil {
+				s.logger.Error("reaping uploads failed", "err", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// runLifecycle deletes every object expired at now and moves those due to
+// the erasure-coded tier. The first owner of a key does both for all of its
+// owners, expiring through the normal delete path.
+func (s *Server) runLifecycle(now time.Time) error {
+	objects, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	self := s.Transport.Addr()
+	for _, obj := range objects {
+		if isUploadKey(obj.Key) || isShardKey(obj.Key) || strings.Contains(obj.Key, "?sibling=") {
+			continue
+		}
+		if owners := s.owners(obj.Key); len(owners) > 0 && owners[0] != self {
+			continue
+		}
+
+		key, versionID, versioned := strings.Cut(obj.Key, "?version=")
+		live := true
+		if versioned {
+			// only the live version of a key expires, which leaves a delete
+			// marker, older versions can still be tiered
+			latest, err := s.latestVersion(context.Background(), key)
+			live = err == nil && !latest.DeleteMarker && latest.VersionID == versionID
+		}
+		switch {
+		case live && s.expired(key, obj, now):
+			s.logger.Info("lifecycle expiring object", "key", key)
+			if err := s.Delete(key); err != nil {
+				return err
+			}
+		case s.dueForTier(key, obj, now):
+			s.logger.Info("lifecycle moving object to the erasure-coded tier", "key", obj.Key)
+			if err := s.moveToTier(context.Background(), obj); err != nil {
+				s.logger.Error("moving object to the erasure-coded tier failed", "key", obj.Key, "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteObject removes key from this node and from the other owners.
+func (s *Server) deleteObject(key string) error {
+	if s.store.Has(s.ID, key) {
+		if err := s.deleteLocal(key); err != nil {
+			return err
+		}
+	}
+	msg := Message{Payload: MessageDeleteFile{Key: key}}
+	peers := s.replicaPeers(key)
+	defer s.lockSend(peers...)()
+	return s.multicast(context.Background(), peers, &msg)
+}
+
+func (s *Server) handleDeleteFile(from string, msg *MessageDeleteFile) error {
+	if !s.store.Has(s.ID, msg.Key) {
+		return nil
+	}
+	return s.deleteLocal(msg.Key)
+}
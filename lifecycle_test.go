@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycleExpiry(t *testing.T) {
+	s := newTestServer(t, map[string]NamespaceOpts{"docs": {Versioning: true}})
+	s.LifecycleRules = []LifecycleRule{{Prefix: "tmp/", ExpireAfter: time.Hour}}
+
+	put := func(key string, expiresAt time.Time) {
+		t.Helper()
+		if _, err := s.Put(key, bytes.NewReader([]byte(key)), PutOpts{ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("tmp/build.log", time.Time{})
+	put("keep/report.pdf", time.Time{})
+	put("session", time.Now().Add(time.Minute))
+	put("docs/draft.txt", time.Now().Add(time.Minute))
+
+	// nothing is due yet
+	if err := s.runLifecycle(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !s.store.Has(s.ID, "tmp/build.log") || !s.store.Has(s.ID, "session") {
+		t.Fatal("objects expired too early")
+	}
+
+	if err := s.runLifecycle(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tmp/build.log", "session"} {
+		if s.store.Has(s.ID, key) {
+			t.Errorf("expected %s to be expired", key)
+		}
+	}
+	if !s.store.Has(s.ID, "keep/report.pdf") {
+		t.Error("object without ttl or matching rule was deleted")
+	}
+	// versioned keys keep their history behind a delete marker
+	if _, err := s.Get("docs/draft.txt"); err != errDeleteMarker {
+		t.Errorf("want delete marker have %v", err)
+	}
+	if versions, _ := s.ListVersions("docs/draft.txt"); len(versions) != 2 {
+		t.Errorf("want data version and marker have %+v", versions)
+	}
+}
+
+func TestLifecycleTier(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.LifecycleRules = []LifecycleRule{{Prefix: "logs/", TierAfter: time.Hour}}
+	want := strings.Repeat("log line\n", 1000)
+	res, err := s.Put("logs/app.log", strings.NewReader(want), PutOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.runLifecycle(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := s.store.ReadMeta(s.ID, "logs/app.log"); meta.Erasure != nil {
+		t.Fatal("object tiered too early")
+	}
+
+	if err := s.runLifecycle(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.store.ReadMeta(s.ID, "logs/app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Erasure == nil || meta.Erasure.Data != defaultErasureData || meta.Erasure.Parity != defaultErasureParity {
+		t.Fatalf("want object in the erasure-coded tier have %+v", meta.Erasure)
+	}
+	r, err := s.Get("logs/app.log")
+	if got := readAll(t, r, err); got != want {
+		t.Errorf("want the object rebuilt from its shards have %d bytes", len(got))
+	}
+	size, rr, err := s.GetRangeContext(context.Background(), "logs/app.log", 9, 9)
+	if got := readAll(t, rr, err); got != "log line\n" || size != int64(len(want)) {
+		t.Errorf("want a range of the tiered object have %q of %d", got, size)
+	}
+	info, err := s.Stat("logs/app.log")
+	if err != nil || info.Size != int64(len(want)) || info.ETag != res.ETag {
+		t.Errorf("want size and etag kept have %+v %v", info, err)
+	}
+	if objects, _ := s.List("logs/"); len(objects) != 1 {
+		t.Errorf("want shards left out of listings have %+v", objects)
+	}
+
+	// a second run leaves the tiered object alone
+	if err := s.runLifecycle(time.Now().Add(3 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.store.ReadMeta(s.ID, "logs/app.log"); again.Erasure.ID != meta.Erasure.ID {
+		t.Error("want the object tiered once")
+	}
+
+	if err := s.Delete("logs/app.log"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range defaultErasureData + defaultErasureParity {
+		if s.store.Has(s.ID, shardKey("logs/app.log", meta.Erasure.ID, i)) {
+			t.Errorf("want shard %d deleted with the object", i)
+		}
+	}
+}
+
+func TestLifecycleTierAcrossNodes(t *testing.T) {
+	opts := ServerOpts{ReplicationFactor: 2, ErasureData: 2, ErasureParity: 1}
+	nodes := []*Server{startTestNode(t, opts), startTestNode(t, opts), startTestNode(t, opts)}
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			connectNodes(t, a, b)
+		}
+	}
+	for _, s := range nodes {
+		s.LifecycleRules = []LifecycleRule{{TierAfter: time.Hour}}
+	}
+	lead := nodes[0]
+	key := keyOwnedBy(t, lead, "archive")
+	want := strings.Repeat("z", 10<<10)
+	if err := lead.StoreData(key, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	copies := func() int {
+		n := 0
+		for _, s := range nodes {
+			if s.store.Has(s.ID, key) {
+				n++
+			}
+		}
+		return n
+	}
+	eventually(t, "object replicated", func() bool { return copies() == 2 })
+
+	if err := lead.runLifecycle(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := lead.store.ReadMeta(lead.ID, key)
+	if err != nil || meta.Erasure == nil {
+		t.Fatalf("want object in the erasure-coded tier have %+v %v", meta.Erasure, err)
+	}
+	// each shard is on a node of its own
+	for i, s := range nodes {
+		shard := shardKey(key, meta.Erasure.ID, i)
+		holder := lead.owners(shard)[0]
+		for _, n := range nodes {
+			if n.store.Has(n.ID, shard) != (n.Transport.Addr() == holder) {
+				t.Errorf("want shard %d only on %s", i, holder)
+			}
+		}
+		eventually(t, "replica rewritten", func() bool {
+			m, err := s.store.ReadMeta(s.ID, key)
+			return err != nil || m.Erasure != nil
+		})
+	}
+
+	// losing any one shard still leaves enough to rebuild the object
+	lost := shardKey(key, meta.Erasure.ID, 0)
+	for _, s := range nodes {
+		if s.store.Has(s.ID, lost) {
+			if err := s.store.Delete(s.ID, lost); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, s := range nodes {
+		r, err := s.Get(key)
+		if got := readAll(t, r, err); got != want {
+			t.Errorf("%s: want the object rebuilt have %d bytes", s.Transport.Addr(), len(got))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
+)
+
+// AdminState is the state an operator put a backend in
+type AdminState int
+
+const (
+	// AdminEnabled backends take requests while they are healthy
+	AdminEnabled AdminState = iota
+	// AdminDraining backends get no new requests, the ones in flight
+	// finish, and are still health checked so they can be enabled again
+	AdminDraining
+	// AdminDisabled backends get no requests and aren't health checked,
+	// not even when every other backend is down
+	AdminDisabled
+)
+
+func (s AdminState) String() string {
+	switch s {
+	case AdminEnabled:
+		return "enabled"
+	case AdminDraining:
+		return "draining"
+	case AdminDisabled:
+		return "disabled"
+	}
+	return "unknown"
+}
+
+// ErrUnknownBackend is returned for a URL that isn't one of the backends
+var ErrUnknownBackend = errors.New("unknown backend")
+
+// backend returns the backend at rawURL
+func (lb *LoadBalancer) backend(rawURL string) (*Backend, error) {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	for _, b := range lb.backends {
+		if b.URL.String() == rawURL {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownBackend, rawURL)
+}
+
+func (b *Backend) AdminState() AdminState {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.admin
+}
+
+// Weight is the weight an operator gave the backend, 0 if they didn't
+func (b *Backend) Weight() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.weight
+}
+
+func (lb *LoadBalancer) setAdminState(rawURL string, state AdminState) error {
+	b, err := lb.backend(rawURL)
+	if err != nil {
+		return err
+	}
+	b.mux.Lock()
+	b.admin = state
+	b.mux.Unlock()
+	slog.Info("backend admin state changed", "backend", b.URL.String(), "state", state.String())
+	return nil
+}
+
+// Drain stops sending new requests to the backend at rawURL, the requests
+// in flight finish
+func (lb *LoadBalancer) Drain(rawURL string) error {
+	return lb.setAdminState(rawURL, AdminDraining)
+}
+
+// Disable takes the backend at rawURL out of rotation and stops health
+// checking it
+func (lb *LoadBalancer) Disable(rawURL string) error {
+	return lb.setAdminState(rawURL, AdminDisabled)
+}
+
+// Enable puts a drained or disabled backend back in rotation
+func (lb *LoadBalancer) Enable(rawURL string) error {
+	return lb.setAdminState(rawURL, AdminEnabled)
+}
+
+// SetWeight sets the weight weighted round-robin gives the backend at
+// rawURL, overriding the weight the strategy was built with
+func (lb *LoadBalancer) SetWeight(rawURL string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("weight %d is not positive", weight)
+	}
+	b, err := lb.backend(rawURL)
+	if err != nil {
+		return err
+	}
+	b.mux.Lock()
+	b.weight = weight
+	b.mux.Unlock()
+	slog.Info("backend weight changed", "backend", b.URL.String(), "weight", weight)
+	return nil
+}
+
+// adminBackend is a backend as the admin handler reports it
+type adminBackend struct {
+	URL            string     `json:"url"`
+	Alive          bool       `json:"alive"`
+	State          string     `json:"state"`
+	Removed        bool       `json:"removed"`
+	Draining       bool       `json:"draining"`
+	Weight         int        `json:"weight,omitempty"`
+	Connections    int        `json:"connections"`
+	Requests       int64      `json:"requests"`
+	Errors         int64      `json:"errors"`
+	AverageLatency float64    `json:"avg_latency_ms"`
+	EWMALatency    float64    `json:"ewma_latency_ms"`
+	P50Latency     float64    `json:"p50_latency_ms"`
+	P95Latency     float64    `json:"p95_latency_ms"`
+	P99Latency     float64    `json:"p99_latency_ms"`
+	Breaker        string     `json:"breaker"`
+	Ejections      int        `json:"ejections"`
+	EjectedUntil   *time.Time `json:"ejected_until,omitempty"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newAdminBackend(s BackendStats) adminBackend {
+	ab := adminBackend{
+		URL:            s.URL,
+		Alive:          s.Alive,
+		State:          s.State.String(),
+		Removed:        s.Removed,
+		Draining:       s.Draining,
+		Weight:         s.Weight,
+		Connections:    s.Connections,
+		Requests:       s.Requests,
+		Errors:         s.Errors,
+		AverageLatency: milliseconds(s.AverageResponseTime),
+		EWMALatency:    milliseconds(s.EWMAResponseTime),
+		P50Latency:     milliseconds(s.P50ResponseTime),
+		P95Latency:     milliseconds(s.P95ResponseTime),
+		P99Latency:     milliseconds(s.P99ResponseTime),
+		Breaker:        s.Breaker.String(),
+		Ejections:      s.Ejections,
+	}
+	if !s.EjectedUntil.IsZero() {
+		ab.EjectedUntil = &s.EjectedUntil
+	}
+	return ab
+}
+
+// AdminHandler serves the backends and their stats for operators, and lets
+// them drain, disable, enable and re-weight backends, and serves the
+// metrics of the process for Prometheus. It has no authentication of its
+// own, serve it on an address only operators reach.
+//
+//	GET  /metrics
+//	GET  /backends
+//	POST /backends/drain?url=http://10.0.0.1:8081
+//	POST /backends/disable?url=...
+//	POST /backends/enable?url=...
+//	POST /backends/weight?url=...&weight=3
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		backends := []adminBackend{}
+		for _, s := range lb.Stats() {
+			backends = append(backends, newAdminBackend(s))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"backends": backends})
+	})
+	for action, set := range map[string]func(string) error{
+		"drain":   lb.Drain,
+		"disable": lb.Disable,
+		"enable":  lb.Enable,
+	} {
+		mux.HandleFunc("POST /backends/"+action, func(w http.ResponseWriter, r *http.Request) {
+			lb.adminUpdate(w, r, set)
+		})
+	}
+	mux.HandleFunc("POST /backends/weight", func(w http.ResponseWriter, r *http.Request) {
+		weight, err := strconv.Atoi(r.FormValue("weight"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "weight must be a number"})
+			return
+		}
+		lb.adminUpdate(w, r, func(rawURL string) error { return lb.SetWeight(rawURL, weight) })
+	})
+	return mux
+}
+
+// adminUpdate applies set to the backend named by the url parameter and
+// answers with the backend
+func (lb *LoadBalancer) adminUpdate(w http.ResponseWriter, r *http.Request, set func(string) error) {
+	rawURL := r.FormValue("url")
+	if err := set(rawURL); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownBackend) {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	b, err := lb.backend(rawURL)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminBackend(b.stats()))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
+)
+
+func TestAdminHandler(t *testing.T) {
+	first, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("first")) })
+	second, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("second")) })
+	lb, err := NewLoadBalancerWithStrategy([]string{first.URL, second.URL}, NewWeightedRoundRobin(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := lb.AdminHandler()
+
+	call := func(method string, target string) (int, map[string]any) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		var body map[string]any
+		json.NewDecoder(w.Body).Decode(&body)
+		return w.Code, body
+	}
+	serve := func(n int) map[string]int {
+		t.Helper()
+		picks := make(map[string]int)
+		for i := 0; i < n; i++ {
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+			picks[w.Body.String()]++
+		}
+		return picks
+	}
+
+	serve(4)
+	code, body := call(http.MethodGet, "/backends")
+	backends, _ := body["backends"].([]any)
+	if code != http.StatusOK || len(backends) != 2 {
+		t.Fatalf("want both backends listed have %d %v", code, body)
+	}
+	b := backends[0].(map[string]any)
+	if b["url"] != first.URL || b["alive"] != true || b["state"] != "enabled" || b["requests"] != 2.0 || b["breaker"] != "closed" {
+		t.Errorf("want the stats of the first backend have %v", b)
+	}
+	if _, ok := b["p95_latency_ms"]; !ok {
+		t.Errorf("want latency percentiles have %v", b)
+	}
+
+	q := "?url=" + url.QueryEscape(first.URL)
+	if code, body := call(http.MethodPost, "/backends/drain"+q); code != http.StatusOK || body["state"] != "draining" || body["draining"] != true {
+		t.Errorf("want the backend draining have %d %v", code, body)
+	}
+	if picks := serve(4); picks["second"] != 4 {
+		t.Errorf("want no requests on the drained backend have %v", picks)
+	}
+
+	if code, body := call(http.MethodPost, "/backends/disable"+q); code != http.StatusOK || body["state"] != "disabled" {
+		t.Errorf("want the backend disabled have %d %v", code, body)
+	}
+	if code, body := call(http.MethodPost, "/backends/enable"+q); code != http.StatusOK || body["state"] != "enabled" {
+		t.Errorf("want the backend enabled have %d %v", code, body)
+	}
+
+	if code, body := call(http.MethodPost, "/backends/weight"+q+"&weight=3"); code != http.StatusOK || body["weight"] != 3.0 {
+		t.Errorf("want the weight set have %d %v", code, body)
+	}
+	if picks := serve(8); picks["first"] != 6 || picks["second"] != 2 {
+		t.Errorf("want requests split 3:1 have %v", picks)
+	}
+
+	if code, _ := call(http.MethodPost, "/backends/weight"+q+"&weight=0"); code != http.StatusBadRequest {
+		t.Errorf("want 400 for a weight of 0 have %d", code)
+	}
+	if code, _ := call(http.MethodPost, "/backends/drain?url=http://nowhere"); code != http.StatusNotFound {
+		t.Errorf("want 404 for an unknown backend have %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/backends/drain"+q); code != http.StatusMethodNotAllowed {
+		t.Errorf("want 405 for GET have %d", code)
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	backend, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb, err := NewLoadBalancer([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := metrics.NewRegistry()
+	remove := lb.RegisterMetrics(r)
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/get/key", nil))
+
+	var sb strings.Builder
+	r.WriteTo(&sb)
+	for _, want := range []string{
+		`dfs_lb_backend_up{backend="` + backend.URL + `"} 1`,
+		`dfs_lb_backend_requests_total{backend="` + backend.URL + `"} 1`,
+		`dfs_lb_backend_breaker_state{backend="` + backend.URL + `"} 0`,
+		`dfs_lb_backend_response_seconds{backend="` + backend.URL + `",quantile="0.95"}`,
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("want %s have\n%s", want, sb.String())
+		}
+	}
+
+	remove()
+	sb.Reset()
+	r.WriteTo(&sb)
+	if sb.Len() != 0 {
+		t.Errorf("want no metrics once removed have\n%s", sb.String())
+	}
+}
@@ -0,0 +1,236 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Discovery finds the backends of the balancer
+type Discovery interface {
+	// Watch sends the URLs of the backends on updates whenever they
+	// change, starting with the current ones, until ctx is done. Lookup
+	// errors are retried rather than returned.
+	Watch(ctx context.Context, updates chan<- []string) error
+}
+
+// Watch keeps the backends of the balancer in step with d until ctx is
+// done. An empty set of backends is ignored, keeping the last ones beats
+// having none.
+func (lb *LoadBalancer) Watch(ctx context.Context, d Discovery) error {
+	updates := make(chan []string)
+	errc := make(chan error, 1)
+	go func() { errc <- d.Watch(ctx, updates) }()
+	for {
+		select {
+		case urls := <-updates:
+			if len(urls) == 0 {
+				slog.Warn("discovery found no backends, keeping the current ones")
+				continue
+			}
+			if err := lb.SetBackends(urls); err != nil {
+				slog.Error("updating backends from discovery failed", "err", err)
+			}
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+// a watcher waits longer after every failed lookup, within these bounds
+const (
+	discoveryMinBackoff = time.Second
+	discoveryMaxBackoff = 30 * time.Second
+)
+
+// publish sends urls on updates unless they are the ones sent last, it
+// returns false once ctx is done
+func publish(ctx context.Context, updates chan<- []string, last *[]string, urls []string) bool {
+	slices.Sort(urls)
+	urls = slices.Compact(urls)
+	if *last != nil && slices.Equal(*last, urls) {
+		return true
+	}
+	select {
+	case updates <- urls:
+		*last = urls
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleep waits for d or until ctx is done, which it reports
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ConsulDiscovery finds the passing instances of a Consul service with
+// blocking queries, so changes arrive as soon as Consul sees them
+type ConsulDiscovery struct {
+	client  *consulapi.Client
+	service string
+	// Scheme of the backend URLs, http unless set
+	Scheme string
+	// WaitTime is how long a blocking query waits for a change
+	WaitTime time.Duration
+}
+
+// NewConsulDiscovery creates a ConsulDiscovery for service
+func NewConsulDiscovery(client *consulapi.Client, service string) *ConsulDiscovery {
+	return &ConsulDiscovery{client: client, service: service, Scheme: "http", WaitTime: 5 * time.Minute}
+}
+
+func (c *ConsulDiscovery) Watch(ctx context.Context, updates chan<- []string) error {
+	var last []string
+	var index uint64
+	backoff := discoveryMinBackoff
+	for {
+		q := (&consulapi.QueryOptions{WaitIndex: index, WaitTime: c.WaitTime}).WithContext(ctx)
+		entries, meta, err := c.client.Health().Service(c.service, "", true, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("Consul discovery failed", "service", c.service, "err", err)
+			if !sleep(ctx, backoff) {
+				return ctx.Err()
+			}
+			backoff = min(backoff*2, discoveryMaxBackoff)
+			continue
+		}
+		backoff = discoveryMinBackoff
+
+		// an index going backwards means Consul was reset
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+
+		urls := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			addr := entry.Service.Address
+			if addr == "" {
+				addr = entry.Node.Address
+			}
+			urls = append(urls, fmt.Sprintf("%s://%s", c.Scheme, net.JoinHostPort(addr, fmt.Sprint(entry.Service.Port))))
+		}
+		if !publish(ctx, updates, &last, urls) {
+			return ctx.Err()
+		}
+	}
+}
+
+// FileDiscovery reads the backends from a file, one URL per line with #
+// starting a comment, and polls it for changes
+type FileDiscovery struct {
+	path     string
+	Interval time.Duration
+}
+
+// NewFileDiscovery creates a FileDiscovery for the file at path
+func NewFileDiscovery(path string) *FileDiscovery {
+	return &FileDiscovery{path: path, Interval: 5 * time.Second}
+}
+
+func (f *FileDiscovery) Watch(ctx context.Context, updates chan<- []string) error {
+	var last []string
+	for {
+		urls, err := readBackendFile(f.path)
+		if err != nil {
+			slog.Error("file discovery failed", "path", f.path, "err", err)
+		} else if !publish(ctx, updates, &last, urls) {
+			return ctx.Err()
+		}
+		if !sleep(ctx, f.Interval) {
+			return ctx.Err()
+		}
+	}
+}
+
+func readBackendFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+// SRVResolver looks up SRV records, *net.Resolver is one
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSSRVDiscovery finds the backends in the SRV records of
+// _service._proto.name and looks them up again every Interval
+type DNSSRVDiscovery struct {
+	service  string
+	proto    string
+	name     string
+	Resolver SRVResolver
+	// Scheme of the backend URLs, http unless set
+	Scheme   string
+	Interval time.Duration
+}
+
+// NewDNSSRVDiscovery creates a DNSSRVDiscovery for _service._proto.name
+func NewDNSSRVDiscovery(service string, proto string, name string) *DNSSRVDiscovery {
+	return &DNSSRVDiscovery{
+		service:  service,
+		proto:    proto,
+		name:     name,
+		Resolver: net.DefaultResolver,
+		Scheme:   "http",
+		Interval: 30 * time.Second,
+	}
+}
+
+func (d *DNSSRVDiscovery) Watch(ctx context.Context, updates chan<- []string) error {
+	var last []string
+	for {
+		_, records, err := d.Resolver.LookupSRV(ctx, d.service, d.proto, d.name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("DNS discovery failed", "name", d.name, "err", err)
+		} else {
+			urls := make([]string, 0, len(records))
+			for _, srv := range records {
+				host := strings.TrimSuffix(srv.Target, ".")
+				urls = append(urls, fmt.Sprintf("%s://%s", d.Scheme, net.JoinHostPort(host, fmt.Sprint(srv.Port))))
+			}
+			if !publish(ctx, updates, &last, urls) {
+				return ctx.Err()
+			}
+		}
+		if !sleep(ctx, d.Interval) {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func nextUpdate(t *testing.T, updates <-chan []string) []string {
+	t.Helper()
+	select {
+	case urls := <-updates:
+		return urls
+	case <-time.After(5 * time.Second):
+		t.Fatal("want an update")
+	}
+	return nil
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	changed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api-server" || r.URL.Query().Get("passing") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		entry := func(addr string, port int) *consulapi.ServiceEntry {
+			return &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Address: "10.0.0.1"},
+				Service: &consulapi.AgentService{Address: addr, Port: port},
+			}
+		}
+		var entries []*consulapi.ServiceEntry
+		switch r.URL.Query().Get("index") {
+		case "":
+			entries = []*consulapi.ServiceEntry{entry("127.0.0.1", 8081), entry("", 8082)}
+			w.Header().Set("X-Consul-Index", "7")
+		case "7":
+			// a blocking query returns once the service changes
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			entries = []*consulapi.ServiceEntry{entry("127.0.0.1", 8082)}
+			w.Header().Set("X-Consul-Index", "8")
+		default:
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer srv.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []string)
+	go NewConsulDiscovery(client, "api-server").Watch(ctx, updates)
+
+	if urls := nextUpdate(t, updates); !slices.Equal(urls, []string{"http://10.0.0.1:8082", "http://127.0.0.1:8081"}) {
+		t.Errorf("want both instances have %v", urls)
+	}
+	close(changed)
+	if urls := nextUpdate(t, updates); !slices.Equal(urls, []string{"http://127.0.0.1:8082"}) {
+		t.Errorf("want the instance left have %v", urls)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends")
+	os.WriteFile(path, []byte("# api servers\nhttp://127.0.0.1:8081\n\nhttp://127.0.0.1:8082 # canary\n"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []string)
+	d := NewFileDiscovery(path)
+	d.Interval = 10 * time.Millisecond
+	go d.Watch(ctx, updates)
+
+	if urls := nextUpdate(t, updates); !slices.Equal(urls, []string{"http://127.0.0.1:8081", "http://127.0.0.1:8082"}) {
+		t.Errorf("want the backends in the file have %v", urls)
+	}
+	os.WriteFile(path, []byte("http://127.0.0.1:8083\n"), 0644)
+	if urls := nextUpdate(t, updates); !slices.Equal(urls, []string{"http://127.0.0.1:8083"}) {
+		t.Errorf("want the new backends have %v", urls)
+	}
+}
+
+type fakeResolver []*net.SRV
+
+func (f fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != "http" || proto != "tcp" || name != "api.dfs.internal" {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return "_http._tcp.api.dfs.internal.", f, nil
+}
+
+func TestDNSSRVDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []string)
+	d := NewDNSSRVDiscovery("http", "tcp", "api.dfs.internal")
+	d.Resolver = fakeResolver{{Target: "node-2.dfs.internal.", Port: 8080}, {Target: "node-1.dfs.internal.", Port: 8080}}
+	go d.Watch(ctx, updates)
+
+	if urls := nextUpdate(t, updates); !slices.Equal(urls, []string{"http://node-1.dfs.internal:8080", "http://node-2.dfs.internal:8080"}) {
+		t.Errorf("want a backend per record have %v", urls)
+	}
+}
+
+func TestSetBackendsDrains(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("old"))
+	}))
+	defer old.Close()
+	added := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer added.Close()
+
+	lb, err := NewLoadBalancer([]string{old.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		lb.ServeHTTP(inFlight, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+		close(done)
+	}()
+	<-started
+
+	if err := lb.SetBackends([]string{added.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := lb.Stats(); len(stats) != 2 || !stats[0].Draining {
+		t.Fatalf("want the old backend draining have %+v", stats)
+	}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+	if w.Body.String() != "new" {
+		t.Errorf("want new requests on the new backend have %q", w.Body.String())
+	}
+
+	close(release)
+	<-done
+	if inFlight.Body.String() != "old" {
+		t.Errorf("want the request in flight finished have %q", inFlight.Body.String())
+	}
+	if stats := lb.Stats(); len(stats) != 1 || stats[0].URL != added.URL {
+		t.Errorf("want the old backend removed once drained have %+v", stats)
+	}
+}
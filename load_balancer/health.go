@@ -0,0 +1,152 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig is how backends are probed. A backend goes down after
+// Fall failed probes in a row and comes back after Rise passed ones, so a
+// single slow response doesn't take it out of rotation.
+type HealthCheckConfig struct {
+	Path           string
+	Interval       time.Duration
+	Timeout        time.Duration
+	ExpectedStatus int
+	Rise           int
+	Fall           int
+}
+
+// DefaultHealthCheckConfig probes /health every 10 seconds
+var DefaultHealthCheckConfig = HealthCheckConfig{
+	Path:           "/health",
+	Interval:       10 * time.Second,
+	Timeout:        2 * time.Second,
+	ExpectedStatus: http.StatusOK,
+	Rise:           2,
+	Fall:           3,
+}
+
+// UseHealthCheck configures the health checks, zero fields keep their
+// defaults. Call it before StartHealthCheck.
+func (lb *LoadBalancer) UseHealthCheck(cfg HealthCheckConfig) {
+	def := DefaultHealthCheckConfig
+	if cfg.Path == "" {
+		cfg.Path = def.Path
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = def.Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = def.Timeout
+	}
+	if cfg.ExpectedStatus == 0 {
+		cfg.ExpectedStatus = def.ExpectedStatus
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = def.Rise
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = def.Fall
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	lb.healthCheck = cfg
+}
+
+// recordHealthCheck counts a probe result and flips Alive once rise passes
+// or fall failures came in a row, it reports whether Alive changed
+func (b *Backend) recordHealthCheck(passed bool, rise int, fall int) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if passed {
+		b.healthFailures = 0
+		if b.healthPasses < rise {
+			b.healthPasses++
+		}
+		if !b.Alive && b.healthPasses >= rise {
+			b.Alive = true
+			return true
+		}
+		return false
+	}
+	b.healthPasses = 0
+	if b.healthFailures < fall {
+		b.healthFailures++
+	}
+	if b.Alive && b.healthFailures >= fall {
+		b.Alive = false
+		return true
+	}
+	return false
+}
+
+// HealthCheck probes every backend once, concurrently
+func (lb *LoadBalancer) HealthCheck() {
+	lb.mux.RLock()
+	cfg := lb.healthCheck
+	backends := slices.Clone(lb.backends)
+	lb.mux.RUnlock()
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		if b.AdminState() == AdminDisabled {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := probe(client, b, cfg)
+			if b.recordHealthCheck(err == nil, cfg.Rise, cfg.Fall) {
+				if err != nil {
+					slog.Warn("backend is down", "backend", b.URL.String(), "err", err)
+				} else {
+					slog.Info("backend is up", "backend", b.URL.String())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// probe requests the health check path of b and expects cfg.ExpectedStatus
+func probe(client *http.Client, b *Backend, cfg HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	u := b.URL.JoinPath(cfg.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode != cfg.ExpectedStatus {
+		return fmt.Errorf("status %d, want %d", res.StatusCode, cfg.ExpectedStatus)
+	}
+	return nil
+}
+
+// StartHealthCheck probes the backends now and then at every interval
+func (lb *LoadBalancer) StartHealthCheck() {
+	lb.mux.RLock()
+	interval := lb.healthCheck.Interval
+	lb.mux.RUnlock()
+	go func() {
+		lb.HealthCheck()
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			lb.HealthCheck()
+		}
+	}()
+}
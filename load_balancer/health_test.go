@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+
+	lb, err := NewLoadBalancer([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.UseHealthCheck(HealthCheckConfig{Path: "/ready", Rise: 2, Fall: 3})
+	b := lb.backends[0]
+
+	check := func(times int, want bool) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			lb.HealthCheck()
+		}
+		if b.IsAlive() != want {
+			t.Fatalf("want alive %t after %d checks have %t", want, times, b.IsAlive())
+		}
+	}
+
+	// the node answers but isn't ready, it takes three failures to go down
+	status.Store(http.StatusServiceUnavailable)
+	check(2, true)
+	check(1, false)
+
+	// a single pass in between failures doesn't bring it back
+	status.Store(http.StatusOK)
+	check(1, false)
+	status.Store(http.StatusServiceUnavailable)
+	check(1, false)
+	status.Store(http.StatusOK)
+	check(1, false)
+	check(1, true)
+
+	// failures are counted in a row
+	status.Store(http.StatusServiceUnavailable)
+	check(2, true)
+	status.Store(http.StatusOK)
+	check(1, true)
+	status.Store(http.StatusServiceUnavailable)
+	check(2, true)
+
+	// a closed port fails like a bad status
+	srv.Close()
+	check(1, false)
+}
@@ -1,11 +1,14 @@
 package loadbalancer
 
 import (
-	"log"
-	"net"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"sync"
 	"time"
 )
@@ -18,8 +21,29 @@ type Backend struct {
 	mux               sync.RWMutex
 	totalResponseTime time.Duration
 	responseCount     int64
+	ewmaResponseTime  time.Duration
+	// the latest response times, for percentiles
+	samples     [latencySamples]time.Duration
+	sampleCount int
+	// consecutive health check results since the last change of Alive
+	healthPasses   int
+	healthFailures int
+	breaker        *circuitBreaker
+	// removed is set for a backend discovery no longer finds, it drains
+	// and goes once the requests in flight are done
+	removed bool
+	// admin is the state an operator put the backend in
+	admin AdminState
+	// weight set by an operator, 0 leaves it to the strategy
+	weight int
 }
 
+// ewmaWeight is how much a new response time moves the moving average
+const ewmaWeight = 0.3
+
+// latencySamples is how many of the latest response times are kept
+const latencySamples = 256
+
 func (b *Backend) SetAlive(alive bool) {
 	b.mux.Lock()
 	defer b.mux.Unlock()
@@ -32,6 +56,33 @@ func (b *Backend) IsAlive() bool {
 	return b.Alive
 }
 
+// IsDraining reports whether the backend gets no new requests but may
+// still have some in flight, because it was removed or drained
+func (b *Backend) IsDraining() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.removed || b.admin == AdminDraining
+}
+
+// serving reports whether the backend takes new requests
+func (b *Backend) serving() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !b.removed && b.admin == AdminEnabled
+}
+
+func (b *Backend) isRemoved() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.removed
+}
+
+func (b *Backend) setRemoved(removed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.removed = removed
+}
+
 func (b *Backend) AddConnection() {
 	b.mux.Lock()
 	defer b.mux.Unlock()
@@ -51,6 +102,36 @@ func (b *Backend) RecordResponseTime(duration time.Duration) {
 	defer b.mux.Unlock()
 	b.totalResponseTime += duration
 	b.responseCount++
+	if b.ewmaResponseTime == 0 {
+		b.ewmaResponseTime = duration
+	} else {
+		b.ewmaResponseTime += time.Duration(ewmaWeight * float64(duration-b.ewmaResponseTime))
+	}
+	b.samples[b.sampleCount%latencySamples] = duration
+	b.sampleCount++
+}
+
+// ResponseTimePercentile returns the p-th percentile, 0 to 100, of the
+// latest response times and how many response times it is based on
+func (b *Backend) ResponseTimePercentile(p float64) (time.Duration, int) {
+	b.mux.RLock()
+	samples := slices.Clone(b.samples[:min(b.sampleCount, latencySamples)])
+	b.mux.RUnlock()
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	slices.Sort(samples)
+	i := int(math.Ceil(p/100*float64(len(samples)))) - 1
+	return samples[min(max(i, 0), len(samples)-1)], len(samples)
+}
+
+// GetEWMAResponseTime is the exponentially weighted moving average of the
+// response times, which follows a backend slowing down sooner than the
+// average does
+func (b *Backend) GetEWMAResponseTime() time.Duration {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.ewmaResponseTime
 }
 
 func (b *Backend) GetAverageResponseTime() time.Duration {
@@ -69,122 +150,350 @@ func (b *Backend) GetConnections() int {
 }
 
 type LoadBalancer struct {
-	backends []*Backend
-	mux      sync.RWMutex
+	backends    []*Backend
+	strategy    Strategy
+	healthCheck HealthCheckConfig
+	outlier     OutlierConfig
+	retry       RetryConfig
+	budget      *retryBudget
+	mux         sync.RWMutex
 }
 
+// NewLoadBalancer creates a load balancer that sends requests to the
+// backend with the fewest connections
 func NewLoadBalancer(backendURLs []string) (*LoadBalancer, error) {
+	return NewLoadBalancerWithStrategy(backendURLs, LeastConnections{})
+}
+
+// NewLoadBalancerWithStrategy creates a load balancer that picks backends
+// with strategy
+func NewLoadBalancerWithStrategy(backendURLs []string, strategy Strategy) (*LoadBalancer, error) {
 	backends := make([]*Backend, len(backendURLs))
 	for i, rawURL := range backendURLs {
-		url, err := url.Parse(rawURL)
+		b, err := newBackend(rawURL, DefaultOutlierConfig)
 		if err != nil {
 			return nil, err
 		}
-
-		proxy := httputil.NewSingleHostReverseProxy(url)
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Service is unavailable"))
-		}
-
-		backends[i] = &Backend{
-			URL:          url,
-			Alive:        true,
-			ReverseProxy: proxy,
-			Connections:  0,
-		}
+		backends[i] = b
 	}
 
 	return &LoadBalancer{
-		backends: backends,
+		backends:    backends,
+		strategy:    strategy,
+		healthCheck: DefaultHealthCheckConfig,
+		outlier:     DefaultOutlierConfig,
+		retry:       DefaultRetryConfig,
+		budget:      newRetryBudget(DefaultRetryConfig),
 	}, nil
 }
 
-func (lb *LoadBalancer) GetNextBackend() *Backend {
-	lb.mux.RLock()
-	defer lb.mux.RUnlock()
+func newBackend(rawURL string, outlier OutlierConfig) (*Backend, error) {
+	url, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service is unavailable"))
+	}
+
+	return &Backend{
+		URL:          url,
+		Alive:        true,
+		ReverseProxy: proxy,
+		Connections:  0,
+		breaker:      newCircuitBreaker(outlier),
+	}, nil
+}
 
-	var selected *Backend
-	var minConnections int = -1
-	var minResponseTime time.Duration = -1
+// SetBackends makes urls the backends of the balancer. New backends start
+// taking requests right away, backends not in urls drain: they get no new
+// requests and are removed once the requests in flight are done.
+func (lb *LoadBalancer) SetBackends(urls []string) error {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
 
+	existing := make(map[string]*Backend, len(lb.backends))
 	for _, b := range lb.backends {
-		if !b.IsAlive() {
+		existing[b.URL.String()] = b
+	}
+	wanted := make(map[string]bool, len(urls))
+	var added []*Backend
+	for _, rawURL := range urls {
+		b, err := newBackend(rawURL, lb.outlier)
+		if err != nil {
+			return err
+		}
+		key := b.URL.String()
+		if wanted[key] {
 			continue
 		}
+		wanted[key] = true
+		if _, ok := existing[key]; !ok {
+			added = append(added, b)
+		}
+	}
 
-		connections := b.GetConnections()
-		avgResponseTime := b.GetAverageResponseTime()
+	for _, b := range lb.backends {
+		removed := !wanted[b.URL.String()]
+		if removed != b.isRemoved() {
+			b.setRemoved(removed)
+			if removed {
+				slog.Info("draining backend", "backend", b.URL.String())
+			} else {
+				slog.Info("backend is back", "backend", b.URL.String())
+			}
+		}
+	}
+	for _, b := range added {
+		slog.Info("adding backend", "backend", b.URL.String())
+	}
+	lb.backends = append(lb.backends, added...)
+	lb.removeDrained()
+	return nil
+}
 
-		if selected == nil {
-			selected = b
-			minConnections = connections
-			minResponseTime = avgResponseTime
-			continue
+// removeDrained removes the removed backends without requests in flight,
+// lb.mux must be held
+func (lb *LoadBalancer) removeDrained() {
+	lb.backends = slices.DeleteFunc(lb.backends, func(b *Backend) bool {
+		if b.isRemoved() && b.GetConnections() == 0 {
+			slog.Info("removed backend", "backend", b.URL.String())
+			return true
 		}
+		return false
+	})
+}
 
-		if connections < minConnections ||
-			(connections == minConnections && avgResponseTime < minResponseTime) {
-			selected = b
-			minConnections = connections
-			minResponseTime = avgResponseTime
+// release removes b once it has drained
+func (lb *LoadBalancer) release(b *Backend) {
+	if !b.isRemoved() || b.GetConnections() > 0 {
+		return
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	lb.removeDrained()
+}
+
+// BackendStats is a snapshot of a backend
+type BackendStats struct {
+	URL   string
+	Alive bool
+	// State is what an operator set, Removed is set once discovery no
+	// longer finds the backend, and Draining while either keeps new
+	// requests away
+	State    AdminState
+	Removed  bool
+	Draining bool
+	// Weight is what an operator set, 0 if they didn't
+	Weight              int
+	Connections         int
+	AverageResponseTime time.Duration
+	EWMAResponseTime    time.Duration
+	// percentiles of the latest response times
+	P50ResponseTime time.Duration
+	P95ResponseTime time.Duration
+	P99ResponseTime time.Duration
+	// Requests and Errors count the requests the circuit breaker saw and
+	// those of them that failed
+	Requests int64
+	Errors   int64
+	Breaker  BreakerState
+	// Ejections is how many times in a row the backend was ejected,
+	// EjectedUntil is set while it is
+	Ejections    int
+	EjectedUntil time.Time
+}
+
+// Stats returns a snapshot of every backend
+func (lb *LoadBalancer) Stats() []BackendStats {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	stats := make([]BackendStats, 0, len(lb.backends))
+	for _, b := range lb.backends {
+		stats = append(stats, b.stats())
+	}
+	return stats
+}
+
+func (b *Backend) stats() BackendStats {
+	breaker := b.breaker.stats()
+	p50, _ := b.ResponseTimePercentile(50)
+	p95, _ := b.ResponseTimePercentile(95)
+	p99, _ := b.ResponseTimePercentile(99)
+	b.mux.RLock()
+	state, removed, weight := b.admin, b.removed, b.weight
+	b.mux.RUnlock()
+	return BackendStats{
+		URL:                 b.URL.String(),
+		Alive:               b.IsAlive(),
+		State:               state,
+		Removed:             removed,
+		Draining:            b.IsDraining(),
+		Weight:              weight,
+		P50ResponseTime:     p50,
+		P95ResponseTime:     p95,
+		P99ResponseTime:     p99,
+		Connections:         b.GetConnections(),
+		AverageResponseTime: b.GetAverageResponseTime(),
+		EWMAResponseTime:    b.GetEWMAResponseTime(),
+		Requests:            breaker.requests,
+		Errors:              breaker.errors,
+		Breaker:             breaker.state,
+		Ejections:           breaker.ejections,
+		EjectedUntil:        breaker.ejectedUntil,
+	}
+}
+
+// GetNextBackend picks a backend without a request to go by
+func (lb *LoadBalancer) GetNextBackend() *Backend {
+	return lb.NextBackend(nil)
+}
+
+// NextBackend picks the backend for r with the strategy of the balancer
+// among the live ones that aren't ejected
+func (lb *LoadBalancer) NextBackend(r *http.Request) *Backend {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	if candidates := lb.candidates(); len(candidates) > 0 {
+		return lb.strategy.Next(r, candidates)
+	}
+	return lb.fallback(r)
+}
+
+// acquire picks the backend for r like NextBackend and admits the request
+// through the circuit breaker of the backend, admitted is false for a
+// backend picked in spite of its breaker. Backends in tried are avoided
+// while there are others.
+func (lb *LoadBalancer) acquire(r *http.Request, tried []*Backend) (b *Backend, admitted bool) {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	candidates := lb.candidates()
+	if untried := slices.DeleteFunc(slices.Clone(candidates), func(c *Backend) bool {
+		return slices.Contains(tried, c)
+	}); len(untried) > 0 {
+		candidates = untried
+	}
+	for len(candidates) > 0 {
+		b := lb.strategy.Next(r, candidates)
+		if b.breaker.begin() {
+			return b, true
 		}
+		// a half-open breaker lost its trial request to another request
+		candidates = slices.DeleteFunc(candidates, func(c *Backend) bool { return c == b })
 	}
+	return lb.fallback(r), false
+}
 
-	if selected == nil {
-		if len(lb.backends) > 0 {
-			return lb.backends[0]
+// candidates are the live backends whose breaker lets requests through
+func (lb *LoadBalancer) candidates() []*Backend {
+	candidates := make([]*Backend, 0, len(lb.backends))
+	for _, b := range lb.backends {
+		if b.IsAlive() && b.serving() && b.breaker.available() {
+			candidates = append(candidates, b)
 		}
-		return nil
 	}
+	return candidates
+}
 
-	return selected
+// fallback picks a live backend regardless of ejections, or the first
+// serving backend if none is alive, trying one beats failing every request
+func (lb *LoadBalancer) fallback(r *http.Request) *Backend {
+	alive := make([]*Backend, 0, len(lb.backends))
+	for _, b := range lb.backends {
+		if b.IsAlive() && b.serving() {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) > 0 {
+		return lb.strategy.Next(r, alive)
+	}
+	for _, b := range lb.backends {
+		if b.serving() {
+			return b
+		}
+	}
+	return nil
 }
 
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backend := lb.GetNextBackend()
+	// every attempt and hedge of a request shares its ID
+	if r.Header.Get(requestIDHeader) == "" {
+		r.Header.Set(requestIDHeader, newRequestID())
+	}
+	if lb.canRetry(r) {
+		lb.serveWithRetries(w, r)
+		return
+	}
+	backend, admitted := lb.acquire(r, nil)
 	if backend == nil {
 		http.Error(w, "No available backends", http.StatusServiceUnavailable)
 		return
 	}
+	backend.proxy(w, r, admitted)
+	lb.release(backend)
+}
 
-	backend.AddConnection()
-	defer backend.RemoveConnection()
-
+// proxy sends r to b and records how it went
+func (b *Backend) proxy(w http.ResponseWriter, r *http.Request, admitted bool) {
+	b.AddConnection()
+	rec := &statusRecorder{ResponseWriter: w}
 	startTime := time.Now()
-	backend.ReverseProxy.ServeHTTP(w, r)
-	duration := time.Since(startTime)
+	// deferred as the proxy panics when it can't copy the whole body
+	defer func() {
+		b.RemoveConnection()
+		b.RecordResponseTime(time.Since(startTime))
+		if admitted {
+			b.finish(requestOutcome(r, rec.status))
+		}
+	}()
+	b.ReverseProxy.ServeHTTP(rec, r)
+}
 
-	backend.RecordResponseTime(duration)
+// requestOutcome counts 5xx responses and failed proxying, which answers
+// 503, against the backend
+func requestOutcome(r *http.Request, status int) outcome {
+	switch {
+	case r.Context().Err() != nil:
+		return outcomeIgnored
+	case status >= http.StatusInternalServerError:
+		return outcomeFailure
+	}
+	return outcomeSuccess
 }
 
-func (lb *LoadBalancer) HealthCheck() {
-	for _, b := range lb.backends {
-		status := "up"
-		alive := isBackendAlive(b.URL)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
-		}
-		log.Printf("Health check on %s: %s", b.URL, status)
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
 	}
+	w.ResponseWriter.WriteHeader(status)
 }
 
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
-	if err != nil {
-		return false
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
 	}
-	defer conn.Close()
-	return true
+	return w.ResponseWriter.Write(b)
 }
 
-func (lb *LoadBalancer) StartHealthCheck() {
-	go func() {
-		ticker := time.NewTicker(time.Minute)
-		for range ticker.C {
-			lb.HealthCheck()
-		}
-	}()
+// Unwrap lets http.ResponseController reach the flusher of the proxy
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestIDHeader carries the ID the backends log a request under
+const requestIDHeader = "X-Request-Id"
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
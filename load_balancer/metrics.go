@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"github.com/arpbansal/distributed_storage_system/metrics"
+)
+
+// RegisterMetrics reports the stats of every backend in r at each scrape,
+// the returned func stops it
+func (lb *LoadBalancer) RegisterMetrics(r *metrics.Registry) func() {
+	backend := []string{"backend"}
+	gauge := func(name string, help string, value func(BackendStats) float64) func() {
+		return r.GaugeFunc(name, help, backend, lb.collect(value))
+	}
+	counter := func(name string, help string, value func(BackendStats) float64) func() {
+		return r.CounterFunc(name, help, backend, lb.collect(value))
+	}
+	removes := []func(){
+		gauge("dfs_lb_backend_up", "Whether the backend passes its health checks.",
+			func(s BackendStats) float64 { return boolFloat(s.Alive) }),
+		gauge("dfs_lb_backend_serving", "Whether the backend takes new requests, it is healthy, enabled and not removed by discovery.",
+			func(s BackendStats) float64 { return boolFloat(s.Alive && s.State == AdminEnabled && !s.Removed) }),
+		gauge("dfs_lb_backend_connections", "Requests in flight to the backend.",
+			func(s BackendStats) float64 { return float64(s.Connections) }),
+		counter("dfs_lb_backend_requests_total", "Requests the circuit breaker of the backend saw.",
+			func(s BackendStats) float64 { return float64(s.Requests) }),
+		counter("dfs_lb_backend_errors_total", "Requests to the backend that failed.",
+			func(s BackendStats) float64 { return float64(s.Errors) }),
+		gauge("dfs_lb_backend_breaker_state", "Circuit breaker of the backend, 0 closed, 1 open, 2 half-open.",
+			func(s BackendStats) float64 { return float64(s.Breaker) }),
+		gauge("dfs_lb_backend_ejections", "Times in a row the backend was ejected.",
+			func(s BackendStats) float64 { return float64(s.Ejections) }),
+		gauge("dfs_lb_backend_ewma_seconds", "Moving average of the response times of the backend.",
+			func(s BackendStats) float64 { return s.EWMAResponseTime.Seconds() }),
+		r.GaugeFunc("dfs_lb_backend_response_seconds", "Percentiles of the latest response times of the backend.",
+			[]string{"backend", "quantile"}, func(emit func(float64, ...string)) {
+				for _, s := range lb.Stats() {
+					emit(s.P50ResponseTime.Seconds(), s.URL, "0.5")
+					emit(s.P95ResponseTime.Seconds(), s.URL, "0.95")
+					emit(s.P99ResponseTime.Seconds(), s.URL, "0.99")
+				}
+			}),
+	}
+	return func() {
+		for _, remove := range removes {
+			remove()
+		}
+	}
+}
+
+// collect emits value for every backend
+func (lb *LoadBalancer) collect(value func(BackendStats) float64) func(func(float64, ...string)) {
+	return func(emit func(float64, ...string)) {
+		for _, s := range lb.Stats() {
+			emit(value(s), s.URL)
+		}
+	}
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,278 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// OutlierConfig is when a backend that fails requests is ejected. It is
+// ejected after ConsecutiveErrors failures in a row, or once ErrorRate of
+// at least MinRequests requests within Window failed. The first ejection
+// lasts BaseEjection and every further one twice as long, up to
+// MaxEjection, until the backend has served without trouble for
+// MaxEjection.
+type OutlierConfig struct {
+	ConsecutiveErrors int
+	ErrorRate         float64
+	MinRequests       int
+	Window            time.Duration
+	BaseEjection      time.Duration
+	MaxEjection       time.Duration
+}
+
+// DefaultOutlierConfig ejects a backend after 5 errors in a row or half of
+// 20 requests failing
+var DefaultOutlierConfig = OutlierConfig{
+	ConsecutiveErrors: 5,
+	ErrorRate:         0.5,
+	MinRequests:       20,
+	Window:            30 * time.Second,
+	BaseEjection:      30 * time.Second,
+	MaxEjection:       5 * time.Minute,
+}
+
+// UseOutlierDetection configures when backends are ejected, zero fields
+// keep their defaults
+func (lb *LoadBalancer) UseOutlierDetection(cfg OutlierConfig) {
+	def := DefaultOutlierConfig
+	if cfg.ConsecutiveErrors <= 0 {
+		cfg.ConsecutiveErrors = def.ConsecutiveErrors
+	}
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = def.ErrorRate
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = def.MinRequests
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.BaseEjection <= 0 {
+		cfg.BaseEjection = def.BaseEjection
+	}
+	if cfg.MaxEjection < cfg.BaseEjection {
+		cfg.MaxEjection = max(def.MaxEjection, cfg.BaseEjection)
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	lb.outlier = cfg
+	for _, b := range lb.backends {
+		b.breaker.configure(cfg)
+	}
+}
+
+// BreakerState is the state of the circuit breaker of a backend
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen ejects the backend until its ejection time is over
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial request through, which closes
+	// the breaker if it succeeds and opens it again if it fails
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// outcome is how a proxied request went as far as the breaker is concerned
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeIgnored is a request the client gave up on, which says
+	// nothing about the backend
+	outcomeIgnored
+)
+
+// circuitBreaker does the passive outlier detection of a backend
+type circuitBreaker struct {
+	mu           sync.Mutex
+	cfg          OutlierConfig
+	now          func() time.Time
+	state        BreakerState
+	consecutive  int
+	windowStart  time.Time
+	windowTotal  int
+	windowErrors int
+	trial        bool // the half-open trial request is in flight
+	ejections    int
+	ejectedUntil time.Time
+	lastEjection time.Time
+	requests     int64
+	errors       int64
+}
+
+func newCircuitBreaker(cfg OutlierConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, now: time.Now}
+}
+
+func (cb *circuitBreaker) configure(cfg OutlierConfig) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.cfg = cfg
+}
+
+// refresh moves an open breaker whose ejection is over to half-open
+func (cb *circuitBreaker) refresh(now time.Time) {
+	if cb.state == BreakerOpen && !now.Before(cb.ejectedUntil) {
+		cb.state = BreakerHalfOpen
+		cb.trial = false
+	}
+}
+
+// available reports whether a request could be sent through the breaker
+func (cb *circuitBreaker) available() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh(cb.now())
+	return cb.state == BreakerClosed || (cb.state == BreakerHalfOpen && !cb.trial)
+}
+
+// begin admits a request, in half-open only the one trial request. Every
+// admitted request must be finished with done.
+func (cb *circuitBreaker) begin() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh(cb.now())
+	switch cb.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if cb.trial {
+			return false
+		}
+		cb.trial = true
+		return true
+	}
+	return false
+}
+
+// done records the outcome of an admitted request and reports the state of
+// the breaker if the request changed it
+func (cb *circuitBreaker) done(o outcome) (BreakerState, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := cb.now()
+	if o != outcomeIgnored {
+		cb.requests++
+		if o == outcomeFailure {
+			cb.errors++
+		}
+	}
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		switch o {
+		case outcomeIgnored:
+			cb.trial = false
+			return cb.state, false
+		case outcomeSuccess:
+			cb.close(now)
+			return cb.state, true
+		}
+		cb.open(now)
+		return cb.state, true
+	case BreakerOpen:
+		// requests admitted before the breaker opened
+		return cb.state, false
+	}
+
+	if o == outcomeIgnored {
+		return cb.state, false
+	}
+	if now.Sub(cb.windowStart) > cb.cfg.Window {
+		cb.windowStart = now
+		cb.windowTotal = 0
+		cb.windowErrors = 0
+	}
+	cb.windowTotal++
+	if o == outcomeSuccess {
+		cb.consecutive = 0
+		return cb.state, false
+	}
+	cb.consecutive++
+	cb.windowErrors++
+	if cb.consecutive >= cb.cfg.ConsecutiveErrors ||
+		(cb.windowTotal >= cb.cfg.MinRequests && float64(cb.windowErrors) >= cb.cfg.ErrorRate*float64(cb.windowTotal)) {
+		cb.open(now)
+		return cb.state, true
+	}
+	return cb.state, false
+}
+
+// open ejects the backend, twice as long as the time before unless it has
+// been fine for a while
+func (cb *circuitBreaker) open(now time.Time) {
+	if cb.ejections > 0 && now.Sub(cb.lastEjection) > cb.ejectionTime()+cb.cfg.MaxEjection {
+		cb.ejections = 0
+	}
+	cb.ejections++
+	cb.lastEjection = now
+	cb.ejectedUntil = now.Add(cb.ejectionTime())
+	cb.state = BreakerOpen
+	cb.trial = false
+}
+
+func (cb *circuitBreaker) close(now time.Time) {
+	cb.state = BreakerClosed
+	cb.trial = false
+	cb.consecutive = 0
+	cb.windowStart = now
+	cb.windowTotal = 0
+	cb.windowErrors = 0
+}
+
+// ejectionTime is how long the current ejection lasts
+func (cb *circuitBreaker) ejectionTime() time.Duration {
+	d := cb.cfg.BaseEjection
+	for i := 1; i < cb.ejections && d < cb.cfg.MaxEjection; i++ {
+		d *= 2
+	}
+	return min(d, cb.cfg.MaxEjection)
+}
+
+// breakerStats is a snapshot of a breaker
+type breakerStats struct {
+	state        BreakerState
+	ejections    int
+	ejectedUntil time.Time
+	requests     int64
+	errors       int64
+}
+
+func (cb *circuitBreaker) stats() breakerStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh(cb.now())
+	s := breakerStats{state: cb.state, ejections: cb.ejections, requests: cb.requests, errors: cb.errors}
+	if cb.state == BreakerOpen {
+		s.ejectedUntil = cb.ejectedUntil
+	}
+	return s
+}
+
+// BreakerState returns the state of the circuit breaker of the backend
+func (b *Backend) BreakerState() BreakerState {
+	return b.breaker.stats().state
+}
+
+// finish records the outcome of a request proxied to b
+func (b *Backend) finish(o outcome) {
+	if state, changed := b.breaker.done(o); changed {
+		slog.Warn("circuit breaker changed state", "backend", b.URL.String(), "state", state.String())
+	}
+}
@@ -0,0 +1,127 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := newCircuitBreaker(OutlierConfig{
+		ConsecutiveErrors: 3,
+		ErrorRate:         0.5,
+		MinRequests:       10,
+		Window:            time.Minute,
+		BaseEjection:      10 * time.Second,
+		MaxEjection:       30 * time.Second,
+	})
+	cb.now = func() time.Time { return now }
+	request := func(o outcome) {
+		t.Helper()
+		if !cb.begin() {
+			t.Fatalf("want the request admitted in state %s", cb.state)
+		}
+		cb.done(o)
+	}
+
+	request(outcomeFailure)
+	request(outcomeFailure)
+	request(outcomeSuccess)
+	request(outcomeFailure)
+	request(outcomeIgnored)
+	request(outcomeFailure)
+	if cb.state != BreakerClosed {
+		t.Fatalf("want errors counted in a row have %s", cb.state)
+	}
+	request(outcomeFailure)
+	if cb.state != BreakerOpen || cb.begin() {
+		t.Fatalf("want the breaker open after 3 errors in a row have %s", cb.state)
+	}
+
+	// ejections get longer every time the trial request fails
+	for _, ejection := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		now = now.Add(ejection - time.Second)
+		if cb.available() {
+			t.Fatalf("want the backend ejected for %s", ejection)
+		}
+		now = now.Add(time.Second)
+		if !cb.available() || cb.state != BreakerHalfOpen {
+			t.Fatalf("want the breaker half-open after %s have %s", ejection, cb.state)
+		}
+		if !cb.begin() || cb.begin() {
+			t.Fatal("want a single trial request")
+		}
+		cb.done(outcomeFailure)
+	}
+
+	now = now.Add(30 * time.Second)
+	request(outcomeSuccess)
+	if cb.state != BreakerClosed {
+		t.Fatalf("want a successful trial to close the breaker have %s", cb.state)
+	}
+
+	// too many errors trip the breaker even when they aren't in a row
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			request(outcomeSuccess)
+		} else {
+			request(outcomeFailure)
+		}
+	}
+	if cb.state != BreakerOpen {
+		t.Fatalf("want the breaker open at half the requests failing have %s", cb.state)
+	}
+	if cb.ejectedUntil != now.Add(30*time.Second) {
+		t.Errorf("want a recent offender ejected for the longest have %s", cb.ejectedUntil.Sub(now))
+	}
+
+	// a backend that was fine for a while starts over at the base ejection
+	now = now.Add(30 * time.Second)
+	request(outcomeSuccess)
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 3; i++ {
+		request(outcomeFailure)
+	}
+	if cb.ejectedUntil != now.Add(10*time.Second) {
+		t.Errorf("want the ejection time reset have %s", cb.ejectedUntil.Sub(now))
+	}
+}
+
+func TestServeHTTPEjectsFailingBackend(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("good"))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk on fire", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	lb, err := NewLoadBalancerWithStrategy([]string{bad.URL, good.URL}, &RoundRobin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.UseOutlierDetection(OutlierConfig{ConsecutiveErrors: 2})
+
+	failures := 0
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+		if w.Code != http.StatusOK {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Errorf("want the bad backend ejected after 2 errors have %d failures", failures)
+	}
+
+	stats := lb.Stats()
+	if stats[0].Breaker != BreakerOpen || stats[0].Errors != 2 || stats[0].EjectedUntil.IsZero() {
+		t.Errorf("want the ejection in the stats have %+v", stats[0])
+	}
+	if stats[1].Breaker != BreakerClosed || stats[1].Requests != 18 {
+		t.Errorf("want the good backend serving the rest have %+v", stats[1])
+	}
+}
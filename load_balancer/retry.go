@@ -0,0 +1,344 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryConfig is how requests that can be sent again are retried on another
+// backend after a 502, 503 or 504, which is also what a failed proxy
+// attempt answers. Retries come out of a budget every request adds
+// BudgetRatio of a retry to, up to BudgetBurst, so that retries can't
+// multiply the load during an outage. With Hedge set a read that isn't
+// answered after HedgeDelay, or the 95th percentile response time of its
+// backend, goes to a second backend as well and the first answer wins.
+type RetryConfig struct {
+	// Attempts is how many times a request is tried at most, 1 disables
+	// retries and hedging
+	Attempts    int
+	BudgetRatio float64
+	BudgetBurst int
+	Hedge       bool
+	HedgeDelay  time.Duration
+}
+
+// DefaultRetryConfig tries a request 3 times and allows retries for a fifth
+// of the requests, without hedging
+var DefaultRetryConfig = RetryConfig{
+	Attempts:    3,
+	BudgetRatio: 0.2,
+	BudgetBurst: 10,
+}
+
+// hedgeMinSamples is how many response times a backend needs before its
+// percentile is trusted as the hedge delay
+const hedgeMinSamples = 20
+
+// heldBodyLimit is how much of a response held back for a retry is kept,
+// to send it after all if no retry does better
+const heldBodyLimit = 64 << 10
+
+// UseRetries configures retries and hedging, zero fields keep their
+// defaults
+func (lb *LoadBalancer) UseRetries(cfg RetryConfig) {
+	def := DefaultRetryConfig
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = def.Attempts
+	}
+	if cfg.BudgetRatio <= 0 {
+		cfg.BudgetRatio = def.BudgetRatio
+	}
+	if cfg.BudgetBurst <= 0 {
+		cfg.BudgetBurst = def.BudgetBurst
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	lb.retry = cfg
+	lb.budget = newRetryBudget(cfg)
+}
+
+// retryBudget is a token bucket of retries filled by requests
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	burst  float64
+}
+
+func newRetryBudget(cfg RetryConfig) *retryBudget {
+	burst := float64(cfg.BudgetBurst)
+	return &retryBudget{tokens: burst, ratio: cfg.BudgetRatio, burst: burst}
+}
+
+func (rb *retryBudget) deposit() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.tokens = min(rb.tokens+rb.ratio, rb.burst)
+}
+
+func (rb *retryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// canRetry reports whether r may be sent more than once. Only reads are
+// safe to repeat, anything else may already have taken effect on the backend
+// that failed, unless its body can be read again to send it whole.
+func (lb *LoadBalancer) canRetry(r *http.Request) bool {
+	lb.mux.RLock()
+	attempts := lb.retry.Attempts
+	lb.mux.RUnlock()
+	if attempts <= 1 {
+		return false
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.GetBody != nil
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// responseGate hands the client response to the first attempt with an
+// answer worth keeping
+type responseGate struct {
+	w       http.ResponseWriter
+	mu      sync.Mutex
+	winner  *attemptWriter
+	claimed chan struct{}
+}
+
+func (g *responseGate) claim(a *attemptWriter) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.winner == nil {
+		g.winner = a
+		close(g.claimed)
+	}
+	return g.winner == a
+}
+
+func (g *responseGate) isClaimed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.winner != nil
+}
+
+// attemptWriter is the response writer of one attempt. A response that can
+// be retried is held back, others go to the client if the attempt is the
+// first to answer and are dropped if it isn't.
+type attemptWriter struct {
+	gate      *responseGate
+	retryable bool
+	header    http.Header
+	status    int
+	held      bool
+	won       bool
+	body      bytes.Buffer
+}
+
+func (a *attemptWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *attemptWriter) WriteHeader(status int) {
+	if a.status != 0 || status < http.StatusOK {
+		return
+	}
+	a.status = status
+	if a.retryable && retryableStatus(status) {
+		a.held = true
+		return
+	}
+	if !a.gate.claim(a) {
+		return
+	}
+	a.won = true
+	h := a.gate.w.Header()
+	for name, values := range a.header {
+		h[name] = values
+	}
+	a.gate.w.WriteHeader(status)
+}
+
+func (a *attemptWriter) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case a.won:
+		return a.gate.w.Write(b)
+	case a.held && a.body.Len() < heldBodyLimit:
+		a.body.Write(b[:min(len(b), heldBodyLimit-a.body.Len())])
+	}
+	return len(b), nil
+}
+
+func (a *attemptWriter) Flush() {
+	if a.won {
+		http.NewResponseController(a.gate.w).Flush()
+	}
+}
+
+// replay sends the response held back to w
+func (a *attemptWriter) replay(w http.ResponseWriter) {
+	h := w.Header()
+	for name, values := range a.header {
+		h[name] = values
+	}
+	w.WriteHeader(a.status)
+	w.Write(a.body.Bytes())
+}
+
+// attempt is one try of a request on a backend
+type attempt struct {
+	backend *Backend
+	writer  *attemptWriter
+	cancel  context.CancelFunc
+	aborted bool
+}
+
+func (a *attempt) run(lb *LoadBalancer, r *http.Request, admitted bool, done chan<- *attempt) {
+	defer func() {
+		lb.release(a.backend)
+		// the proxy aborts with a panic when copying the body fails
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			a.aborted = true
+		}
+		done <- a
+	}()
+	a.backend.proxy(a.writer, r, admitted)
+}
+
+// serveWithRetries tries r on one backend after another until one answers
+// with something other than a retryable error, hedging reads if configured
+func (lb *LoadBalancer) serveWithRetries(w http.ResponseWriter, r *http.Request) {
+	lb.mux.RLock()
+	cfg := lb.retry
+	budget := lb.budget
+	lb.mux.RUnlock()
+	budget.deposit()
+
+	gate := &responseGate{w: w, claimed: make(chan struct{})}
+	done := make(chan *attempt, cfg.Attempts)
+	var attempts []*attempt
+	var tried []*Backend
+	defer func() {
+		for _, a := range attempts {
+			a.cancel()
+		}
+	}()
+
+	start := func() bool {
+		b, admitted := lb.acquire(r, tried)
+		if b == nil {
+			return false
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		req := r.Clone(ctx)
+		if len(attempts) > 0 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				cancel()
+				if admitted {
+					b.finish(outcomeIgnored)
+				}
+				return false
+			}
+			req.Body = body
+		}
+		tried = append(tried, b)
+		a := &attempt{
+			backend: b,
+			cancel:  cancel,
+			writer: &attemptWriter{
+				gate:      gate,
+				retryable: len(attempts)+1 < cfg.Attempts,
+				header:    make(http.Header),
+			},
+		}
+		attempts = append(attempts, a)
+		go a.run(lb, req, admitted, done)
+		return true
+	}
+	// retry starts another attempt if there are attempts and budget left
+	retry := func() bool {
+		return len(attempts) < cfg.Attempts && !gate.isClaimed() && budget.withdraw() && start()
+	}
+
+	if !start() {
+		http.Error(w, "No available backends", http.StatusServiceUnavailable)
+		return
+	}
+	var hedge <-chan time.Time
+	if cfg.Hedge && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if delay := hedgeDelay(cfg, attempts[0].backend); delay > 0 {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			hedge = t.C
+		}
+	}
+
+	claimed := gate.claimed
+	var held *attemptWriter
+	for running := 1; running > 0; {
+		select {
+		case <-claimed:
+			// the losers of a hedge are cancelled
+			claimed, hedge = nil, nil
+			for _, a := range attempts {
+				if a.writer != gate.winner {
+					a.cancel()
+				}
+			}
+		case <-hedge:
+			hedge = nil
+			if retry() {
+				running++
+			}
+		case a := <-done:
+			running--
+			if a.writer.won {
+				if a.aborted {
+					panic(http.ErrAbortHandler)
+				}
+				return
+			}
+			if a.writer.held {
+				held = a.writer
+				if retry() {
+					running++
+				}
+			}
+		}
+	}
+
+	// no attempt did better than the last one held back
+	if held != nil {
+		held.replay(w)
+		return
+	}
+	http.Error(w, "Service is unavailable", http.StatusServiceUnavailable)
+}
+
+// hedgeDelay is how long a read waits before it is hedged, 0 if it isn't
+func hedgeDelay(cfg RetryConfig, b *Backend) time.Duration {
+	if cfg.HedgeDelay > 0 {
+		return cfg.HedgeDelay
+	}
+	p95, n := b.ResponseTimePercentile(95)
+	if n < hedgeMinSamples {
+		return 0
+	}
+	return p95
+}
@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer answers every request with handler and counts them
+func countingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "draining", http.StatusServiceUnavailable)
+}
+
+func TestRetries(t *testing.T) {
+	down, downRequests := countingServer(t, unavailable)
+	up, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "up")
+		w.Write([]byte("data"))
+	})
+
+	lb, err := NewLoadBalancerWithStrategy([]string{down.URL, up.URL}, &RoundRobin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "data" || w.Header().Get("X-Backend") != "up" {
+		t.Errorf("want the read retried on the other backend have %d %q", w.Code, w.Body.String())
+	}
+	if downRequests.Load() != 1 {
+		t.Errorf("want one attempt on the failing backend have %d", downRequests.Load())
+	}
+
+	// an upload body can only be read once
+	lb, _ = NewLoadBalancerWithStrategy([]string{down.URL, up.URL}, &RoundRobin{})
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("file")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("want the upload not retried have %d", w.Code)
+	}
+
+	// nor is a POST without a body, it may have done its work already
+	lb, _ = NewLoadBalancerWithStrategy([]string{down.URL, up.URL}, &RoundRobin{})
+	downRequests.Store(0)
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decommission", nil))
+	if w.Code != http.StatusServiceUnavailable || downRequests.Load() != 1 {
+		t.Errorf("want the POST sent once have %d after %d attempts", w.Code, downRequests.Load())
+	}
+
+	// with every backend failing the last answer goes to the client
+	lb, _ = NewLoadBalancerWithStrategy([]string{down.URL}, &RoundRobin{})
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "draining") {
+		t.Errorf("want the backend's error have %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	down, downRequests := countingServer(t, unavailable)
+	lb, err := NewLoadBalancer([]string{down.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.UseRetries(RetryConfig{Attempts: 3, BudgetRatio: 0.1, BudgetBurst: 2})
+	lb.UseOutlierDetection(OutlierConfig{ConsecutiveErrors: 1000, MinRequests: 1000})
+
+	for i := 0; i < 5; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/get/key", nil))
+	}
+	// 5 requests and the 2 retries the budget started with
+	if n := downRequests.Load(); n != 7 {
+		t.Errorf("want retries capped by the budget have %d requests", n)
+	}
+}
+
+func TestHedging(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	slow, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	})
+	fast, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	})
+
+	lb, err := NewLoadBalancerWithStrategy([]string{slow.URL, fast.URL}, &RoundRobin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.UseRetries(RetryConfig{Hedge: true, HedgeDelay: 20 * time.Millisecond})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get/key", nil))
+	if w.Body.String() != "fast" || time.Since(start) > 2*time.Second {
+		t.Errorf("want the hedged request to answer have %q after %s", w.Body.String(), time.Since(start))
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("want the slow request cancelled")
+	}
+}
+
+func TestRetriesShareRequestID(t *testing.T) {
+	var ids []string
+	var mu sync.Mutex
+	record := func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, r.Header.Get(requestIDHeader))
+	}
+	down, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) { record(r); unavailable(w, r) })
+	up, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) { record(r) })
+	lb, err := NewLoadBalancerWithStrategy([]string{down.URL, up.URL}, &RoundRobin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/get/key", nil))
+	if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("want both attempts under one new request ID have %q", ids)
+	}
+
+	ids = nil
+	r := httptest.NewRequest(http.MethodGet, "/get/key", nil)
+	r.Header.Set(requestIDHeader, "client-1")
+	lb.ServeHTTP(httptest.NewRecorder(), r)
+	for _, id := range ids {
+		if id != "client-1" {
+			t.Errorf("want the client's request ID kept have %q", ids)
+		}
+	}
+}
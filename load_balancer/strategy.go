@@ -0,0 +1,209 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy picks the backend for a request among the live backends, which
+// it is never called without. r is nil when there is no request to go by.
+type Strategy interface {
+	Next(r *http.Request, backends []*Backend) *Backend
+}
+
+// StrategyByName returns the strategy called name, weighted round-robin
+// weighs every backend the same unless built with NewWeightedRoundRobin
+func StrategyByName(name string) (Strategy, error) {
+	switch name {
+	case "", "least-connections":
+		return LeastConnections{}, nil
+	case "round-robin":
+		return &RoundRobin{}, nil
+	case "weighted-round-robin":
+		return NewWeightedRoundRobin(nil), nil
+	case "power-of-two", "p2c":
+		return PowerOfTwoChoices{}, nil
+	case "ewma":
+		return EWMALatency{}, nil
+	case "consistent-hash":
+		return NewConsistentHash(LeastConnections{}), nil
+	}
+	return nil, fmt.Errorf("unknown load balancing strategy %q", name)
+}
+
+// LeastConnections picks the backend with the fewest requests in flight,
+// the lower average response time breaks ties
+type LeastConnections struct{}
+
+func (LeastConnections) Next(r *http.Request, backends []*Backend) *Backend {
+	var selected *Backend
+	var minConnections int
+	var minResponseTime time.Duration
+	for _, b := range backends {
+		connections := b.GetConnections()
+		avgResponseTime := b.GetAverageResponseTime()
+		if selected == nil || connections < minConnections ||
+			(connections == minConnections && avgResponseTime < minResponseTime) {
+			selected = b
+			minConnections = connections
+			minResponseTime = avgResponseTime
+		}
+	}
+	return selected
+}
+
+// RoundRobin takes the backends in turn
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (rr *RoundRobin) Next(r *http.Request, backends []*Backend) *Backend {
+	return backends[(rr.next.Add(1)-1)%uint64(len(backends))]
+}
+
+// WeightedRoundRobin takes the backends in turn, each as often as its
+// weight, spread out as nginx does rather than in bursts
+type WeightedRoundRobin struct {
+	weights map[string]int
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+// NewWeightedRoundRobin weighs backends by their URL, those not in weights
+// weigh 1. A weight set with LoadBalancer.SetWeight takes precedence.
+func NewWeightedRoundRobin(weights map[string]int) *WeightedRoundRobin {
+	return &WeightedRoundRobin{weights: weights, current: make(map[*Backend]int)}
+}
+
+func (w *WeightedRoundRobin) weight(b *Backend) int {
+	if weight := b.Weight(); weight > 0 {
+		return weight
+	}
+	if weight, ok := w.weights[b.URL.String()]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func (w *WeightedRoundRobin) Next(r *http.Request, backends []*Backend) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var selected *Backend
+	total := 0
+	for _, b := range backends {
+		weight := w.weight(b)
+		w.current[b] += weight
+		total += weight
+		if selected == nil || w.current[b] > w.current[selected] {
+			selected = b
+		}
+	}
+	w.current[selected] -= total
+	// forget backends that are down or were removed
+	if len(w.current) > len(backends) {
+		for b := range w.current {
+			if !slices.Contains(backends, b) {
+				delete(w.current, b)
+			}
+		}
+	}
+	return selected
+}
+
+// PowerOfTwoChoices picks two backends at random and takes the one with
+// fewer requests in flight, which avoids the herding of least connections
+type PowerOfTwoChoices struct{}
+
+func (PowerOfTwoChoices) Next(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.IntN(len(backends))
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := backends[i], backends[j]
+	if b.GetConnections() < a.GetConnections() {
+		return b
+	}
+	return a
+}
+
+// EWMALatency picks the backend with the lowest recent response time,
+// scaled by the requests it has in flight. Backends without a measurement
+// are tried first.
+type EWMALatency struct{}
+
+func (EWMALatency) Next(r *http.Request, backends []*Backend) *Backend {
+	var selected *Backend
+	var minCost float64
+	for _, b := range backends {
+		cost := b.GetEWMAResponseTime().Seconds() * float64(b.GetConnections()+1)
+		if selected == nil || cost < minCost {
+			selected = b
+			minCost = cost
+		}
+	}
+	return selected
+}
+
+// ConsistentHash sends every read of a key to the same backend, so the
+// node that fetched it once serves it from local disk afterwards. Keys are
+// placed by rendezvous hashing, a backend going down only moves its own
+// keys. Requests without a key go to the fallback strategy.
+type ConsistentHash struct {
+	fallback Strategy
+}
+
+// NewConsistentHash creates a ConsistentHash
+func NewConsistentHash(fallback Strategy) *ConsistentHash {
+	return &ConsistentHash{fallback: fallback}
+}
+
+func (c *ConsistentHash) Next(r *http.Request, backends []*Backend) *Backend {
+	key, ok := requestKey(r)
+	if !ok {
+		return c.fallback.Next(r, backends)
+	}
+	var selected *Backend
+	var best uint64
+	for _, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(b.URL.String()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix64(h.Sum64()); selected == nil || score > best {
+			selected = b
+			best = score
+		}
+	}
+	return selected
+}
+
+// mix64 is the splitmix64 finalizer, fnv alone leaves the scores of
+// similar backend URLs correlated
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// requestKey returns the key of a read, taken from a /get/{key} path
+func requestKey(r *http.Request) (string, bool) {
+	if r == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return "", false
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/get/")
+	return key, ok && key != ""
+}
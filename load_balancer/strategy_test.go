@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testBackends(t *testing.T, n int) []*Backend {
+	t.Helper()
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://127.0.0.1:%d", 8081+i)
+	}
+	lb, err := NewLoadBalancer(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb.backends
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := testBackends(t, 3)
+	rr := &RoundRobin{}
+	for i := 0; i < 6; i++ {
+		if b := rr.Next(nil, backends); b != backends[i%3] {
+			t.Errorf("want backend %d on pick %d have %s", i%3, i, b.URL)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	backends := testBackends(t, 3)
+	w := NewWeightedRoundRobin(map[string]int{backends[0].URL.String(): 3})
+	picks := make(map[*Backend]int)
+	var order []*Backend
+	for i := 0; i < 10; i++ {
+		b := w.Next(nil, backends)
+		picks[b]++
+		order = append(order, b)
+	}
+	if picks[backends[0]] != 6 || picks[backends[1]] != 2 || picks[backends[2]] != 2 {
+		t.Errorf("want picks in a 3:1:1 ratio have %d %d %d", picks[backends[0]], picks[backends[1]], picks[backends[2]])
+	}
+	// the heavy backend is interleaved with the others, not picked in a row
+	for i := 2; i < len(order); i++ {
+		if order[i] == order[i-1] && order[i] == order[i-2] {
+			t.Errorf("want picks spread out have three in a row at %d", i)
+		}
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	backends := testBackends(t, 2)
+	backends[0].AddConnection()
+	for i := 0; i < 20; i++ {
+		if b := (PowerOfTwoChoices{}).Next(nil, backends); b != backends[1] {
+			t.Fatalf("want the idle backend of the two have %s", b.URL)
+		}
+	}
+}
+
+func TestEWMALatency(t *testing.T) {
+	backends := testBackends(t, 2)
+	backends[0].RecordResponseTime(10 * time.Millisecond)
+	backends[1].RecordResponseTime(10 * time.Millisecond)
+	// backend 0 slows down, its lifetime average lags but the EWMA doesn't
+	for i := 0; i < 5; i++ {
+		backends[0].RecordResponseTime(200 * time.Millisecond)
+	}
+	for i := 0; i < 50; i++ {
+		backends[1].RecordResponseTime(50 * time.Millisecond)
+	}
+	if b := (EWMALatency{}).Next(nil, backends); b != backends[1] {
+		t.Errorf("want the backend that is faster lately have %s", b.URL)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := testBackends(t, 3)
+	ch := NewConsistentHash(&RoundRobin{})
+
+	picks := make(map[*Backend]int)
+	owner := make(map[string]*Backend)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("photos/%d.jpg", i)
+		b := ch.Next(httptest.NewRequest("GET", "/get/"+key, nil), backends)
+		if again := ch.Next(httptest.NewRequest("HEAD", "/get/"+key, nil), backends); again != b {
+			t.Fatalf("want every read of %s on one backend", key)
+		}
+		owner[key] = b
+		picks[b]++
+	}
+	for _, b := range backends {
+		if picks[b] < 60 {
+			t.Errorf("want keys spread over the backends have %d on %s", picks[b], b.URL)
+		}
+	}
+
+	// losing a backend only moves the keys it had
+	for key, b := range owner {
+		if b == backends[2] {
+			continue
+		}
+		if now := ch.Next(httptest.NewRequest("GET", "/get/"+key, nil), backends[:2]); now != b {
+			t.Errorf("want %s to stay on %s have %s", key, b.URL, now.URL)
+		}
+	}
+
+	// writes have no key to go by
+	first := ch.Next(httptest.NewRequest("POST", "/upload", nil), backends)
+	if second := ch.Next(httptest.NewRequest("POST", "/upload", nil), backends); first == second {
+		t.Error("want requests without a key left to the fallback")
+	}
+}
+
+func TestNextBackendSkipsDead(t *testing.T) {
+	lb, err := NewLoadBalancerWithStrategy([]string{"http://127.0.0.1:8081", "http://127.0.0.1:8082"}, &RoundRobin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.backends[0].SetAlive(false)
+	for i := 0; i < 4; i++ {
+		if b := lb.NextBackend(nil); b != lb.backends[1] {
+			t.Errorf("want the live backend have %s", b.URL)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("dropped")
+	logger.Warn("kept", "key", "a")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("want one JSON record have %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "kept" || record["key"] != "a" {
+		t.Errorf("want the warning only have %v", record)
+	}
+
+	if _, err := newLogger(&buf, "loud", ""); err == nil {
+		t.Error("want an unknown level refused")
+	}
+	if _, err := newLogger(&buf, "", "xml"); err == nil {
+		t.Error("want an unknown format refused")
+	}
+}
+
+func TestServerLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewServer(ServerOpts{
+		ID:                "node-a",
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         peer2peer.NewTCPtransport(peer2peer.TCPtransportOps{ListenAddr: ":0"}),
+		Enckey:            newEncryptionkey(),
+		Logger:            slog.New(slog.NewJSONHandler(&buf, nil)),
+	})
+	if _, err := s.Put("a.txt", strings.NewReader("data"), PutOpts{RequestID: "upload-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("want JSON records have %q: %v", line, err)
+		}
+		if record["msg"] == "stored object" {
+			stored = record
+		}
+	}
+	if stored == nil {
+		t.Fatalf("want the write logged have %s", buf.String())
+	}
+	if stored["node"] != "node-a" || stored["addr"] != ":0" || stored["request_id"] != "upload-1" {
+		t.Errorf("want the node and request ID on the record have %v", stored)
+	}
+}
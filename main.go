@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"time"
+	"io/fs"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/arpbansal/distributed_storage_system/api"
 	loadbalancer "github.com/arpbansal/distributed_storage_system/load_balancer"
-	"github.com/arpbansal/distributed_storage_system/peer2peer"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
@@ -47,35 +51,276 @@ func (a *ServerAdapter) Get(key string) (io.ReadCloser, error) {
 	return ReadCloserWrapper{Reader: reader}, nil
 }
 
+func (a *ServerAdapter) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := a.server.GetContext(withRequestID(ctx, api.RequestID(ctx)), key)
+	if errors.Is(err, errNoSuchKey) || errors.Is(err, errDeleteMarker) || errors.Is(err, errNoSuchVersion) || errors.Is(err, fs.ErrNotExist) {
+		return nil, api.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ReadCloserWrapper{Reader: reader}, nil
+}
+
+func (a *ServerAdapter) ClusterStatus() (api.ClusterStatus, error) {
+	status := a.server.Status()
+	cluster := api.ClusterStatus{
+		NodeID:            status.ID,
+		Addr:              status.Addr,
+		Draining:          status.Draining,
+		ReplicationFactor: status.ReplicationFactor,
+		Ring:              status.Ring,
+	}
+	for _, peer := range status.Peers {
+		cluster.Peers = append(cluster.Peers, api.PeerInfo{
+			Addr:       peer.Addr,
+			RemoteAddr: peer.RemoteAddr,
+			InRing:     peer.Addr != "" && slices.Contains(status.Ring, peer.Addr),
+		})
+	}
+	return cluster, nil
+}
+
+func (a *ServerAdapter) CheckReadiness(ctx context.Context) []api.HealthCheck {
+	var checks []api.HealthCheck
+	for _, check := range a.server.Readiness() {
+		hc := api.HealthCheck{Name: check.Name, OK: check.Err == nil}
+		if check.Err != nil {
+			hc.Error = check.Err.Error()
+		}
+		checks = append(checks, hc)
+	}
+	return checks
+}
+
+func (a *ServerAdapter) GetRange(key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	return a.GetRangeContext(context.Background(), key, offset, length)
+}
+
+func (a *ServerAdapter) GetRangeContext(ctx context.Context, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	size, r, err := a.server.GetRangeContext(withRequestID(ctx, api.RequestID(ctx)), key, offset, length)
+	if errors.Is(err, errNoSuchKey) || errors.Is(err, errDeleteMarker) || errors.Is(err, errNoSuchVersion) {
+		return 0, nil, api.ErrNotFound
+	}
+	return size, r, err
+}
+
 func (a *ServerAdapter) Delete(id string, key string) error {
-	return a.server.store.Delete(id, key)
+	if id != a.server.ID {
+		return a.server.store.Delete(id, key)
+	}
+	return a.server.Delete(key)
 }
 
-func (a *ServerAdapter) GetID() string {
-	return a.server.ID
+func (a *ServerAdapter) Put(key string, r io.Reader, opts api.PutOptions) (api.WriteResult, error) {
+	return a.PutContext(context.Background(), key, r, opts)
 }
 
-func makeServer(listenAddr string, nodes ...string) *Server {
-	tcptransportopts := peer2peer.TCPtransportOps{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: peer2peer.NOPHandshakeFunc,
-		Decoder:       peer2peer.DefaultDecoder{},
+func (a *ServerAdapter) PutContext(ctx context.Context, key string, r io.Reader, opts api.PutOptions) (api.WriteResult, error) {
+	res, err := a.server.PutContext(ctx, key, r, PutOpts{
+		Precondition: Precondition(opts.Precondition),
+		ExpiresAt:    opts.ExpiresAt,
+		Size:         opts.Size,
+		ContentType:  opts.ContentType,
+		UserMeta:     opts.UserMeta,
+		RequestID:    opts.RequestID,
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		return api.WriteResult{}, api.ErrPreconditionFailed
 	}
-	tcpTransport := peer2peer.NewTCPtransport(tcptransportopts)
-	fileserveropts := ServerOpts{
-		StorageRoot:       listenAddr + "_network",
-		PathTransformFunc: CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    nodes,
-		Enckey:            newEncryptionkey(),
-		ID:                generateID(),
+	if errors.Is(err, errObjectTooLarge) {
+		return api.WriteResult{}, api.ErrTooLarge
 	}
-	s := NewServer(fileserveropts)
+	return api.WriteResult(res), err
+}
 
-	tcpTransport.OnPeer = s.OnPeer
+func (a *ServerAdapter) DeleteIf(key string, cond api.Precondition) error {
+	err := a.server.DeleteIf(key, Precondition(cond))
+	if errors.Is(err, errPreconditionFailed) {
+		return api.ErrPreconditionFailed
+	}
+	return err
+}
 
-	return s
+func (a *ServerAdapter) StoreDataVersioned(key string, r io.Reader) (string, error) {
+	return a.server.StoreDataVersioned(key, r)
+}
 
+func (a *ServerAdapter) GetVersion(key string, versionID string) (io.ReadCloser, error) {
+	reader, err := a.server.GetVersion(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return ReadCloserWrapper{Reader: reader}, nil
+}
+
+func (a *ServerAdapter) ListVersions(key string) ([]api.VersionInfo, error) {
+	versions, err := a.server.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]api.VersionInfo, len(versions))
+	for i, v := range versions {
+		infos[i] = api.VersionInfo{
+			VersionID:    v.VersionID,
+			Size:         v.Size,
+			ModTime:      v.ModTime,
+			DeleteMarker: v.DeleteMarker,
+			IsLatest:     i == len(versions)-1,
+		}
+	}
+	return infos, nil
+}
+
+func (a *ServerAdapter) Siblings(key string) ([]api.SiblingInfo, error) {
+	conflicted, err := a.server.Siblings(key)
+	if err != nil {
+		return nil, err
+	}
+	var infos []api.SiblingInfo
+	for _, obj := range conflicted {
+		infos = append(infos, api.SiblingInfo{
+			Key:     obj.Key,
+			Origin:  obj.Origin,
+			Size:    obj.Size,
+			Clock:   obj.Clock,
+			HLC:     obj.HLC.String(),
+			Current: true,
+		})
+		for _, sib := range obj.Siblings {
+			infos = append(infos, api.SiblingInfo{
+				Key:    sib.Key,
+				Origin: sib.Origin,
+				Size:   sib.Size,
+				Clock:  sib.Clock,
+				HLC:    sib.HLC.String(),
+			})
+		}
+	}
+	return infos, nil
+}
+
+func (a *ServerAdapter) DeleteVersion(key string, versionID string) error {
+	return a.server.DeleteVersion(key, versionID)
+}
+
+func (a *ServerAdapter) Stat(key string) (api.ObjectInfo, error) {
+	meta, err := a.server.Stat(key)
+	if errors.Is(err, errNoSuchKey) {
+		return api.ObjectInfo{}, api.ErrNotFound
+	}
+	if err != nil {
+		return api.ObjectInfo{}, err
+	}
+	return objectInfo(meta), nil
+}
+
+func (a *ServerAdapter) List(prefix string) ([]api.ObjectInfo, error) {
+	objects, err := a.server.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]api.ObjectInfo, len(objects))
+	for i, obj := range objects {
+		infos[i] = objectInfo(obj)
+	}
+	return infos, nil
+}
+
+func objectInfo(meta ObjectMeta) api.ObjectInfo {
+	return api.ObjectInfo{
+		Key:     meta.Key,
+		Size:    meta.Size,
+		ETag:    meta.ETag,
+		ModTime: meta.ModTime,
+
+		ContentType: meta.ContentType,
+		UserMeta:    meta.UserMeta,
+	}
+}
+
+func (a *ServerAdapter) InitiateUpload(key string, opts api.PutOptions) (string, error) {
+	uploadID, err := a.server.InitiateUpload(key, PutOpts{
+		Size:        opts.Size,
+		ContentType: opts.ContentType,
+		UserMeta:    opts.UserMeta,
+	})
+	return uploadID, uploadError(err)
+}
+
+func (a *ServerAdapter) UploadPart(uploadID string, number int, r io.Reader) (api.PartInfo, error) {
+	part, err := a.server.UploadPart(uploadID, number, r)
+	if err != nil {
+		return api.PartInfo{}, uploadError(err)
+	}
+	return partInfo(part), nil
+}
+
+func (a *ServerAdapter) GetUpload(uploadID string) (api.UploadInfo, error) {
+	upload, err := a.server.Upload(uploadID)
+	if err != nil {
+		return api.UploadInfo{}, uploadError(err)
+	}
+	info := api.UploadInfo{
+		UploadID:  upload.UploadID,
+		Key:       upload.Key,
+		Size:      upload.Size,
+		Initiated: upload.Initiated,
+		Parts:     make([]api.PartInfo, len(upload.Parts)),
+	}
+	for i, part := range upload.Parts {
+		info.Parts[i] = partInfo(part)
+	}
+	return info, nil
+}
+
+func (a *ServerAdapter) CompleteUpload(uploadID string, parts []api.CompletedPart, opts api.PutOptions) (api.WriteResult, error) {
+	completed := make([]CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = CompletedPart{Number: part.PartNumber, ETag: part.ETag}
+	}
+	res, err := a.server.CompleteUpload(uploadID, completed, PutOpts{
+		Precondition: Precondition(opts.Precondition),
+		ExpiresAt:    opts.ExpiresAt,
+		RequestID:    opts.RequestID,
+	})
+	return api.WriteResult(res), uploadError(err)
+}
+
+func (a *ServerAdapter) AbortUpload(uploadID string) error {
+	return uploadError(a.server.AbortUpload(uploadID))
+}
+
+func partInfo(part UploadPart) api.PartInfo {
+	return api.PartInfo{
+		PartNumber: part.Number,
+		Size:       part.Size,
+		ETag:       part.ETag,
+		ModTime:    part.ModTime,
+	}
+}
+
+// uploadError maps multipart upload errors to their api counterparts
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, errNoSuchUpload):
+		return api.ErrNoSuchUpload
+	case errors.Is(err, errInvalidPart):
+		return api.ErrInvalidPart
+	case errors.Is(err, errObjectTooLarge):
+		return api.ErrTooLarge
+	case errors.Is(err, errPreconditionFailed):
+		return api.ErrPreconditionFailed
+	}
+	return err
+}
+
+func (a *ServerAdapter) GetID() string {
+	return a.server.ID
+}
+
+func (a *ServerAdapter) Decommission() error {
+	return a.server.Decommission()
 }
 
 func registerWithConsul(client *consulapi.Client, serviceID, serviceName, address string, port int) error {
@@ -110,94 +355,63 @@ func getAPIServersFromConsul(client *consulapi.Client, serviceName string) ([]st
 	return servers, nil
 }
 
-func main() {
-	consulConfig := consulapi.DefaultConfig()
-	consulClient, err := consulapi.NewClient(consulConfig)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	time.Sleep(time.Second * 5)
-	s1 := makeServer(":3000", "")
-	s2 := makeServer(":4000", ":3000")
-	s3 := makeServer(":5000", ":3000", ":4000")
+const usage = `usage: dfs <command> [arguments]
 
-	go func() { log.Fatal(s1.Start()) }()
-	time.Sleep(time.Second * 2)
-	go func() { log.Fatal(s2.Start()) }()
-	time.Sleep(time.Second * 2)
-	go s3.Start()
-	time.Sleep(time.Second * 2)
+commands:
+  serve     run a node, see dfs serve -h
+  examples  run three nodes, their APIs and a load balancer on local
+            ports and write some objects, every run starts from scratch
+`
 
-	serverAdapter1 := NewServerAdapter(s1)
-	serverAdapter2 := NewServerAdapter(s2)
-	serverAdapter3 := NewServerAdapter(s3)
+// errUsage marks errors caused by how dfs was invoked
+var errUsage = errors.New("usage")
 
-	apiServer1 := api.NewAPIServer(serverAdapter1, ":8081")
-	apiServer2 := api.NewAPIServer(serverAdapter2, ":8082")
-	apiServer3 := api.NewAPIServer(serverAdapter3, ":8083")
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:]))
+}
 
-	if err := registerWithConsul(consulClient, "api-server-1", "api-server", "127.0.0.1", 8081); err != nil {
-		log.Printf("Failed to register api-server-1: %v", err)
-	}
-	if err := registerWithConsul(consulClient, "api-server-2", "api-server", "127.0.0.1", 8082); err != nil {
-		log.Printf("Failed to register api-server-2: %v", err)
+// run executes the command in args and returns the exit status, 2 for
+// usage errors
+func run(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
 	}
-	if err := registerWithConsul(consulClient, "api-server-3", "api-server", "127.0.0.1", 8083); err != nil {
-		log.Printf("Failed to register api-server-3: %v", err)
-	}
-
-	go func() { log.Fatal(apiServer1.Start()) }()
-	go func() { log.Fatal(apiServer2.Start()) }()
-	go func() { log.Fatal(apiServer3.Start()) }()
-
-	time.Sleep(time.Second * 3)
-
-	backendURLs, err := getAPIServersFromConsul(consulClient, "api-server")
-	if err != nil || len(backendURLs) == 0 {
-		log.Printf("No backends found in Consul, using defaults: %v", err)
-		backendURLs = []string{
-			"http://127.0.0.1:8081",
-			"http://127.0.0.1:8082",
-			"http://127.0.0.1:8083",
+	switch args[0] {
+	case "serve":
+		err := serve(ctx, args[1:], os.Stderr)
+		if errors.Is(err, errUsage) {
+			return 2
 		}
-	}
-
-	lb, err := loadbalancer.NewLoadBalancer(backendURLs)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	lb.StartHealthCheck()
-	log.Println("Load balancer started on :8080")
-	go func() {
-		log.Fatal(http.ListenAndServe(":8080", lb))
-	}()
-
-	time.Sleep(time.Second * 2)
-
-	for i := 0; i < 20; i++ {
-		key := fmt.Sprintf("coolPicture_%d.jpg", i)
-		data := bytes.NewReader([]byte("my big data file here!!"))
-		err := s3.StoreData(key, data)
 		if err != nil {
-			log.Fatal(err)
-		}
-		if err := s3.store.Delete(s3.ID, key); err != nil {
-			log.Fatal(err)
+			fmt.Fprintln(os.Stderr, "dfs serve:", err)
+			return 1
 		}
+		return 0
+	case "examples":
+		runExamples()
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "dfs: unknown command %q\n\n%s", args[0], usage)
+	return 2
+}
 
-		r, err := s3.Get(key)
-		if err != nil {
-			log.Fatal(err)
-		}
-		b, err := io.ReadAll(r)
-		if err != nil {
-			log.Fatal(err)
+// lbStrategy returns the load balancing strategy called name, weights are
+// url=weight pairs separated by commas for weighted round-robin
+func lbStrategy(name string, weights string) (loadbalancer.Strategy, error) {
+	if name != "weighted-round-robin" || weights == "" {
+		return loadbalancer.StrategyByName(name)
+	}
+	w := make(map[string]int)
+	for _, pair := range strings.Split(weights, ",") {
+		url, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(weight)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid backend weight %q", pair)
 		}
-		fmt.Println("data: ", string(b))
+		w[url] = n
 	}
-	time.Sleep(time.Second * 5)
-
-	select {}
+	return loadbalancer.NewWeightedRoundRobin(w), nil
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metaSuffix is appended to an object's path for its metadata sidecar.
+// The CAS path transform can't be reversed, so the sidecar is the only
+// place the original id/key of a file on disk can be recovered from.
+const metaSuffix = ".meta"
+
+// ObjectMeta describes a single object held by a Store.
+type ObjectMeta struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// ETag is the hex md5 of the plaintext, replicas keep the writer's
+	ETag string `json:"etag,omitempty"`
+	// ExpiresAt is when the lifecycle worker may delete the object
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// ContentType and UserMeta are given by the client on upload and
+	// returned as they are on reads
+	ContentType string            `json:"content_type,omitempty"`
+	UserMeta    map[string]string `json:"user_meta,omitempty"`
+
+	// Origin is the node that made the write, Clock and HLC order it
+	// against other writes of the same object
+	Origin   string        `json:"origin,omitempty"`
+	Clock    VectorClock   `json:"clock,omitempty"`
+	HLC      HLCTimestamp  `json:"hlc"`
+	Siblings []SiblingMeta `json:"siblings,omitempty"`
+	// Parts is set on an object assembled from a multipart upload, its
+	// data is that of the parts and Size their total
+	Parts []ObjectPart `json:"parts,omitempty"`
+	// Erasure is set on an object in the erasure-coded tier, its data is
+	// held in shards on other nodes
+	Erasure *ErasureMeta `json:"erasure,omitempty"`
+	// Encrypted marks a copy stored as it came from another node, the iv
+	// followed by the ciphertext, Size is that of the plaintext
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// SiblingMeta is a concurrent write kept next to the object under Key.
+type SiblingMeta struct {
+	Key    string       `json:"key"`
+	Origin string       `json:"origin"`
+	Size   int64        `json:"size"`
+	ETag   string       `json:"etag"`
+	Clock  VectorClock  `json:"clock"`
+	HLC    HLCTimestamp `json:"hlc"`
+}
+
+// setLayout records where the data of an object lives when it isn't in the
+// object's own file, in the parts of an upload or in erasure-coded shards.
+func (meta *ObjectMeta) setLayout(parts []ObjectPart, erasure *ErasureMeta) {
+	meta.Parts = parts
+	meta.Erasure = erasure
+	switch {
+	case parts != nil:
+		meta.Size = partsSize(parts)
+	case erasure != nil:
+		meta.Size = erasure.Size
+	}
+}
+
+func (s *Store) metaPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return s.Root + "/" + id + "/" + pathKey.FullPath() + metaSuffix
+}
+
+func (s *Store) writeMeta(meta ObjectMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.metaPath(meta.ID, meta.Key), b, 0644)
+}
+
+// ReadMeta returns the metadata stored alongside the object.
+func (s *Store) ReadMeta(id string, key string) (ObjectMeta, error) {
+	var meta ObjectMeta
+	b, err := os.ReadFile(s.metaPath(id, key))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// UpdateMeta applies update to the metadata of an object already on disk.
+func (s *Store) UpdateMeta(id string, key string, update func(*ObjectMeta)) error {
+	meta, err := s.ReadMeta(id, key)
+	if err != nil {
+		return err
+	}
+	update(&meta)
+	return s.writeMeta(meta)
+}
+
+// List walks the storage root and returns the metadata of every object on disk.
+func (s *Store) List() ([]ObjectMeta, error) {
+	var objects []ObjectMeta
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta ObjectMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return err
+		}
+		objects = append(objects, meta)
+		return nil
+	})
+	return objects, err
+}
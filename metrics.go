@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	storeBytesWritten = metrics.Default.Counter("dfs_store_written_bytes_total",
+		"Bytes written to disk by the store.", "root")
+	storeBytesRead = metrics.Default.Counter("dfs_store_read_bytes_total",
+		"Bytes read from disk by the store.", "root")
+	storeObjectsWritten = metrics.Default.Counter("dfs_store_objects_written_total",
+		"Objects written to disk by the store.", "root")
+	storeObjectsDeleted = metrics.Default.Counter("dfs_store_objects_deleted_total",
+		"Objects deleted from disk by the store.", "root")
+	storeWriteSeconds = metrics.Default.Histogram("dfs_store_write_seconds",
+		"Time to write an object to disk.", nil, "root")
+	storeReadSeconds = metrics.Default.Histogram("dfs_store_read_seconds",
+		"Time from opening an object on disk to closing it.", nil, "root")
+	storeObjects = metrics.Default.Gauge("dfs_store_objects",
+		"Objects on disk, counting every version.", "root")
+	storeBytes = metrics.Default.Gauge("dfs_store_bytes",
+		"Bytes of the objects on disk.", "root")
+
+	// the replicas don't ack a write, so this is how long it takes to send
+	// rather than how far behind they are
+	replicationSendSeconds = metrics.Default.Histogram("dfs_replication_send_seconds",
+		"Time from writing an object locally to having sent the last byte of it to its replicas.", nil, "node")
+	replicationFailures = metrics.Default.Counter("dfs_replication_failures_total",
+		"Objects that could not be sent to a replica, by operation.", "node", "op")
+	underReplicated = metrics.Default.Counter("dfs_replication_under_replicated_total",
+		"Writes that reached fewer replicas than the replication factor asks for.", "node")
+)
+
+// countObjects sets the object gauges from what is on disk, it walks the
+// root once when the store is opened and writes and deletes keep them up
+// to date from then on
+func (s *Store) countObjects() {
+	s.sizeLock.Lock()
+	defer s.sizeLock.Unlock()
+	var objects, bytes float64
+	filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		if info, err := os.Stat(strings.TrimSuffix(path, metaSuffix)); err == nil {
+			objects++
+			bytes += float64(info.Size())
+		}
+		return nil
+	})
+	storeObjects.Set(objects, s.Root)
+	storeBytes.Set(bytes, s.Root)
+}
+
+// replaceObjectFile renames the size bytes at from over the object file at to
+func (s *Store) replaceObjectFile(from string, to string, size int64) error {
+	s.sizeLock.Lock()
+	defer s.sizeLock.Unlock()
+	info, statErr := os.Stat(to)
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if statErr == nil {
+		storeBytes.Add(float64(size-info.Size()), s.Root)
+		return nil
+	}
+	storeObjects.Inc(s.Root)
+	storeBytes.Add(float64(size), s.Root)
+	return nil
+}
+
+// removeObjectFile removes the object file at path, if there is one
+func (s *Store) removeObjectFile(path string) error {
+	s.sizeLock.Lock()
+	defer s.sizeLock.Unlock()
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	storeObjects.Dec(s.Root)
+	storeBytes.Add(-float64(info.Size()), s.Root)
+	return nil
+}
+
+// meteredFile counts the bytes read from an object file and observes how
+// long it was open. It is still an *os.File for Seek and the like.
+type meteredFile struct {
+	*os.File
+	root   string
+	opened time.Time
+	// span, if set, ends on Close
+	span trace.Span
+	// stream, if set, decrypts what is read
+	stream cipher.Stream
+}
+
+func (f *meteredFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	storeBytesRead.Add(float64(n), f.root)
+	if f.stream != nil {
+		f.stream.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// WriteTo keeps io.Copy from bypassing Read through *os.File.WriteTo
+func (f *meteredFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{f})
+}
+
+func (f *meteredFile) Close() error {
+	storeReadSeconds.ObserveSince(f.opened, f.root)
+	if f.span != nil {
+		f.span.End()
+	}
+	return f.File.Close()
+}
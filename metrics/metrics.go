@@ -0,0 +1,339 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+//
+// Metrics are registered by name, registering a name again returns the
+// metric already registered, so every instance of a component in a process
+// shares its metrics and tells them apart by label.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are histogram buckets for latencies in seconds
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the components of the storage system use
+var Default = NewRegistry()
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// Registry holds metrics by name
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is a metric and its series, one per combination of label values
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+	// collectors are called at every scrape for the values of a
+	// metric owned by something else, keyed so they can be removed
+	collectors map[int]func(emit func(value float64, labelValues ...string))
+	nextID     int
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only, counts[i] is the number of observations in
+	// bucket i, not cumulative
+	counts []uint64
+	count  uint64
+}
+
+func (r *Registry) register(name string, help string, k kind, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || !slices.Equal(f.labels, labels) {
+			panic(fmt.Sprintf("metrics: %s registered again as a different metric", name))
+		}
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       k,
+		labels:     labels,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+		collectors: make(map[int]func(func(float64, ...string))),
+	}
+	r.families[name] = f
+	return f
+}
+
+// with returns the series for labelValues, creating it, f.mu must be held
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, have %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up
+type Counter struct{ f *family }
+
+// Counter registers a counter, its name should end in _total
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, kindCounter, nil, labels)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.f.name + " decreased")
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.with(labelValues).value += v
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct{ f *family }
+
+func (r *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, kindGauge, nil, labels)}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.with(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.with(labelValues).value += v
+}
+
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+// Histogram counts observations in buckets
+type Histogram struct{ f *family }
+
+// Histogram registers a histogram with the upper bounds of its buckets,
+// DefBuckets if nil
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &Histogram{r.register(name, help, kindHistogram, buckets, labels)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.with(labelValues)
+	if i, _ := slices.BinarySearch(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// ObserveSince observes the seconds since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// GaugeFunc registers a gauge whose values collect emits at every scrape,
+// for values kept by something else. Several collectors may share a gauge,
+// remove stops calling this one.
+func (r *Registry) GaugeFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) (remove func()) {
+	return r.register(name, help, kindGauge, nil, labels).addCollector(collect)
+}
+
+// CounterFunc is GaugeFunc for a counter
+func (r *Registry) CounterFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) (remove func()) {
+	return r.register(name, help, kindCounter, nil, labels).addCollector(collect)
+}
+
+func (f *family) addCollector(collect func(func(float64, ...string))) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID
+	f.nextID++
+	f.collectors[id] = collect
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.collectors, id)
+	}
+}
+
+// snapshot copies the series of f and those its collectors emit
+func (f *family) snapshot() []series {
+	f.mu.Lock()
+	out := make([]series, 0, len(f.series))
+	for _, s := range f.series {
+		out = append(out, series{labelValues: s.labelValues, value: s.value, counts: slices.Clone(s.counts), count: s.count})
+	}
+	collectors := make([]func(func(float64, ...string)), 0, len(f.collectors))
+	for _, c := range f.collectors {
+		collectors = append(collectors, c)
+	}
+	f.mu.Unlock()
+
+	// collectors run unlocked, they may take locks of their own
+	for _, collect := range collectors {
+		collect(func(value float64, labelValues ...string) {
+			if len(labelValues) != len(f.labels) {
+				panic(fmt.Sprintf("metrics: %s wants %d label values, have %d", f.name, len(f.labels), len(labelValues)))
+			}
+			out = append(out, series{labelValues: slices.Clone(labelValues), value: value})
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return slices.Compare(out[i].labelValues, out[j].labelValues) < 0
+	})
+	return out
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		all := f.snapshot()
+		if len(all) == 0 {
+			continue
+		}
+		fmt.Fprintf(cw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range all {
+			if f.kind != kindHistogram {
+				fmt.Fprintf(cw, "%s%s %s\n", f.name, labelPairs(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, le := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, labelPairs(f.labels, s.labelValues, "le", formatFloat(le)), cumulative)
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, labelPairs(f.labels, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", f.name, labelPairs(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+			fmt.Fprintf(cw, "%s_count%s %d\n", f.name, labelPairs(f.labels, s.labelValues, "", ""), s.count)
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// Handler serves the metrics for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func labelPairs(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, name, escapeLabel(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, extraName, extraValue)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("http_requests_total", "Requests served.", "method", "code")
+	requests.Inc("GET", "200")
+	requests.Add(2, "GET", "200")
+	requests.Inc("PUT", "500")
+	if again := r.Counter("http_requests_total", "Requests served.", "method", "code"); again.f != requests.f {
+		t.Error("want the registered counter back")
+	}
+
+	r.Gauge("temperature", "Line one\nline two.").Set(-1.5)
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		latency.Observe(v, "read")
+	}
+	remove := r.GaugeFunc("peers", "Peers.", []string{"node"}, func(emit func(float64, ...string)) {
+		emit(2, `:3000 "a"`)
+	})
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",code="200"} 3
+http_requests_total{method="PUT",code="500"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="read",le="0.1"} 2
+latency_seconds_bucket{op="read",le="1"} 3
+latency_seconds_bucket{op="read",le="+Inf"} 4
+latency_seconds_sum{op="read"} 3.65
+latency_seconds_count{op="read"} 4
+# HELP peers Peers.
+# TYPE peers gauge
+peers{node=":3000 \"a\""} 2
+# HELP temperature Line one\nline two.
+# TYPE temperature gauge
+temperature -1.5
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("want\n%s\nhave\n%s", want, got)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("want the text format content type have %q", ct)
+	}
+
+	remove()
+	var sb strings.Builder
+	r.WriteTo(&sb)
+	if strings.Contains(sb.String(), "peers") {
+		t.Error("want a removed collector gone")
+	}
+}
+
+func TestRegistryMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("ops_total", "Ops.", "op")
+	defer func() {
+		if recover() == nil {
+			t.Error("want a panic for a metric registered twice with other labels")
+		}
+	}()
+	r.Gauge("ops_total", "Ops.")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
+)
+
+func TestStoreMetrics(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := generateID()
+
+	data := []byte("some jpg types")
+	if _, err := s.writeStream(id, "foo", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s.Read(id, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	r.(io.Closer).Close()
+	if _, err := s.WriteEncrypt(newEncryptionkey(), id, "bar", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// bar is data and a 16 byte iv
+	wantGauges(t, s.Root, 2, 2*len(data)+16)
+	if _, err := s.writeStream(id, "foo", bytes.NewReader(data[:4])); err != nil {
+		t.Fatal(err)
+	}
+	wantGauges(t, s.Root, 2, len(data)+20)
+	if err := s.Delete(id, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	wantGauges(t, s.Root, 1, len(data)+16)
+	// opened again the store counts what is on disk
+	NewStore(s.StoreOpts)
+	wantGauges(t, s.Root, 1, len(data)+16)
+
+	var sb strings.Builder
+	metrics.Default.WriteTo(&sb)
+	for _, want := range []string{
+		fmt.Sprintf(`dfs_store_written_bytes_total{root=%q} %d`, s.Root, 2*len(data)+20),
+		fmt.Sprintf(`dfs_store_read_bytes_total{root=%q} %d`, s.Root, len(data)),
+		fmt.Sprintf(`dfs_store_objects_written_total{root=%q} 3`, s.Root),
+		fmt.Sprintf(`dfs_store_objects_deleted_total{root=%q} 1`, s.Root),
+		fmt.Sprintf(`dfs_store_write_seconds_count{root=%q} 3`, s.Root),
+		fmt.Sprintf(`dfs_store_read_seconds_count{root=%q} 1`, s.Root),
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("want %s", want)
+		}
+	}
+}
+
+// wantGauges checks the object gauges of the store at root
+func wantGauges(t *testing.T, root string, objects int, bytes int) {
+	t.Helper()
+	var sb strings.Builder
+	metrics.Default.WriteTo(&sb)
+	for _, want := range []string{
+		fmt.Sprintf(`dfs_store_objects{root=%q} %d`, root, objects),
+		fmt.Sprintf(`dfs_store_bytes{root=%q} %d`, root, bytes),
+	} {
+		if !strings.Contains(sb.String(), want+"\n") {
+			t.Errorf("want %s", want)
+		}
+	}
+}
+
+func TestPeerMetricsByNode(t *testing.T) {
+	a := startTestNode(t, ServerOpts{ReplicationFactor: 2})
+	b := startTestNode(t, ServerOpts{ReplicationFactor: 2})
+	// b accepts the connection, its side only learns a's address from the
+	// announce
+	connectNodes(t, a, b)
+	if err := a.StoreData("counted", strings.NewReader("some bytes")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "object replicated", func() bool { return b.store.Has(b.ID, "counted") })
+
+	var sb strings.Builder
+	metrics.Default.WriteTo(&sb)
+	for _, want := range []string{
+		fmt.Sprintf(`dfs_peer_sent_bytes_total{node=%q,peer=%q}`, a.Transport.Addr(), b.Transport.Addr()),
+		fmt.Sprintf(`dfs_peer_received_bytes_total{node=%q,peer=%q}`, b.Transport.Addr(), a.Transport.Addr()),
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("want %s", want)
+		}
+	}
+}
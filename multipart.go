@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUploadExpiry = 24 * time.Hour
+	maxUploadParts      = 10000
+)
+
+var (
+	errNoSuchUpload = errors.New("no such upload")
+	errInvalidPart  = errors.New("invalid part")
+)
+
+// MultipartUpload is an upload in progress. Its record and its parts are
+// objects placed on the ring like any other, so every node can take parts
+// of it until it is completed, aborted or reaped.
+type MultipartUpload struct {
+	UploadID  string    `json:"upload_id"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size,omitempty"` // declared total size, 0 if unknown
+	Initiated time.Time `json:"initiated"`
+	// ContentType and UserMeta are given on initiate and go to the object
+	ContentType string            `json:"content_type,omitempty"`
+	UserMeta    map[string]string `json:"user_meta,omitempty"`
+	// Updated and Parts come from the parts found in the cluster
+	Updated time.Time    `json:"-"`
+	Parts   []UploadPart `json:"-"`
+}
+
+// UploadPart is one uploaded part of a MultipartUpload.
+type UploadPart struct {
+	Number  int       `json:"number"`
+	Size    int64     `json:"size"`
+	ETag    string    `json:"etag"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// CompletedPart picks a part for the assembled object, an empty ETag
+// accepts whatever was uploaded under Number.
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+// ObjectPart is one part of an object assembled from an upload, its data
+// stays under Key.
+type ObjectPart struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// Offset is the number of bytes uploaded so far.
+func (u *MultipartUpload) Offset() int64 {
+	var n int64
+	for _, part := range u.Parts {
+		n += part.Size
+	}
+	return n
+}
+
+// uploadKey is where the record of an upload is stored.
+func uploadKey(uploadID string) string {
+	return "?upload=" + uploadID
+}
+
+// partPrefix starts the keys of the parts of an upload of key, which are
+// placed on the same nodes as key.
+func partPrefix(key string, uploadID string) string {
+	return key + "?upload=" + uploadID + "&part="
+}
+
+func partKey(key string, uploadID string, number int) string {
+	return fmt.Sprintf("%s%05d", partPrefix(key, uploadID), number)
+}
+
+// isUploadKey reports whether key is the record or a part of an upload.
+func isUploadKey(key string) bool {
+	return strings.Contains(key, "?upload=")
+}
+
+func partsSize(parts []ObjectPart) int64 {
+	var n int64
+	for _, part := range parts {
+		n += part.Size
+	}
+	return n
+}
+
+// partsETag is the ETag of an object assembled from parts, the md5 of the
+// md5s of the parts followed by their count, as S3 has it.
+func partsETag(parts []ObjectPart) string {
+	h := md5.New()
+	for _, part := range parts {
+		sum, _ := hex.DecodeString(part.ETag)
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(parts))
+}
+
+// validUploadID keeps client supplied ids from naming other keys.
+func validUploadID(uploadID string) bool {
+	if len(uploadID) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(uploadID)
+	return err == nil
+}
+
+// uploadRecord reads the record of an upload, without its parts.
+func (s *Server) uploadRecord(ctx context.Context, uploadID string) (*MultipartUpload, error) {
+	if !validUploadID(uploadID) {
+		return nil, errNoSuchUpload
+	}
+	r, err := s.fetchContext(ctx, uploadKey(uploadID))
+	if errors.Is(err, errNoSuchKey) || errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSuchUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	var upload MultipartUpload
+	err = json.NewDecoder(r).Decode(&upload)
+	return &upload, err
+}
+
+// InitiateUpload starts a multipart upload of key and returns its id.
+// opts.Size is the total the client intends to upload, 0 if it doesn't
+// know, and opts.ContentType and opts.UserMeta are kept for the object.
+func (s *Server) InitiateUpload(key string, opts PutOpts) (string, error) {
+	if s.draining.Load() {
+		return "", errDecommissioned
+	}
+	if limit := s.namespaceOpts(key).MaxObjectSize; limit > 0 && opts.Size > limit {
+		return "", errObjectTooLarge
+	}
+	upload := &MultipartUpload{
+		UploadID:    generateID()[:32],
+		Key:         key,
+		Size:        opts.Size,
+		Initiated:   time.Now(),
+		ContentType: opts.ContentType,
+		UserMeta:    opts.UserMeta,
+	}
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return "", err
+	}
+	_, err = s.storeOnOwner(context.Background(), uploadKey(upload.UploadID), bytes.NewReader(b))
+	return upload.UploadID, err
+}
+
+// UploadPart stores part number of an upload, replacing any earlier
+// upload of the same part.
+func (s *Server) UploadPart(uploadID string, number int, r io.Reader) (UploadPart, error) {
+	if number < 1 || number > maxUploadParts {
+		return UploadPart{}, errInvalidPart
+	}
+	ctx := context.Background()
+	upload, err := s.uploadRecord(ctx, uploadID)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	if limit := s.namespaceOpts(upload.Key).MaxObjectSize; limit > 0 {
+		r = &sizeLimitedReader{r: r, n: limit}
+	}
+
+	key := partKey(upload.Key, uploadID, number)
+	counter := &countingReader{r: r}
+	etag, err := s.storeOnOwner(ctx, key, counter)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	// the upload may have been aborted while the part streamed in
+	if _, err := s.uploadRecord(ctx, uploadID); err != nil {
+		s.deleteObject(key)
+		return UploadPart{}, err
+	}
+	return UploadPart{Number: number, Size: counter.n, ETag: etag, ModTime: time.Now()}, nil
+}
+
+// Upload returns an upload in progress with the parts uploaded so far.
+func (s *Server) Upload(uploadID string) (*MultipartUpload, error) {
+	ctx := context.Background()
+	upload, err := s.uploadRecord(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	prefix := partPrefix(upload.Key, uploadID)
+	objects, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	upload.Updated = upload.Initiated
+	for _, obj := range objects {
+		number, err := strconv.Atoi(strings.TrimPrefix(obj.Key, prefix))
+		if err != nil {
+			continue
+		}
+		upload.Parts = append(upload.Parts, UploadPart{Number: number, Size: obj.Size, ETag: obj.ETag, ModTime: obj.ModTime})
+		if obj.ModTime.After(upload.Updated) {
+			upload.Updated = obj.ModTime
+		}
+	}
+	return upload, nil
+}
+
+// CompleteUpload makes the chosen parts, in order, the object the upload
+// was started for and removes the upload. With no parts given every
+// uploaded part is used. The parts aren't copied, the object only lists
+// them and reads go to their data. Its ETag is derived from those of the
+// parts as S3 does it, and opts apply as they do to Put. The content type
+// and user metadata given on initiate are kept unless opts replace them.
+func (s *Server) CompleteUpload(uploadID string, parts []CompletedPart, opts PutOpts) (WriteResult, error) {
+	upload, err := s.Upload(uploadID)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	uploaded := make(map[int]UploadPart, len(upload.Parts))
+	for _, part := range upload.Parts {
+		uploaded[part.Number] = part
+	}
+	if len(parts) == 0 {
+		for _, part := range upload.Parts {
+			parts = append(parts, CompletedPart{Number: part.Number})
+		}
+	}
+	if len(parts) == 0 {
+		return WriteResult{}, errInvalidPart
+	}
+
+	opts.parts = nil
+	for i, part := range parts {
+		got, ok := uploaded[part.Number]
+		if !ok || (part.ETag != "" && part.ETag != got.ETag) || (i > 0 && part.Number <= parts[i-1].Number) {
+			return WriteResult{}, errInvalidPart
+		}
+		opts.parts = append(opts.parts, ObjectPart{
+			Key:  partKey(upload.Key, uploadID, part.Number),
+			Size: got.Size,
+			ETag: got.ETag,
+		})
+	}
+	opts.Size = partsSize(opts.parts)
+	opts.ContentType = cmp.Or(opts.ContentType, upload.ContentType)
+	if opts.UserMeta == nil {
+		opts.UserMeta = upload.UserMeta
+	}
+
+	res, err := s.Put(upload.Key, bytes.NewReader(nil), opts)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	// the chosen parts belong to the object now, the rest go with the upload
+	upload.Parts = slices.DeleteFunc(upload.Parts, func(p UploadPart) bool {
+		return slices.ContainsFunc(parts, func(c CompletedPart) bool { return c.Number == p.Number })
+	})
+	return res, s.removeUpload(upload)
+}
+
+// AbortUpload discards an upload and the parts uploaded so far.
+func (s *Server) AbortUpload(uploadID string) error {
+	upload, err := s.Upload(uploadID)
+	if err != nil {
+		return err
+	}
+	return s.removeUpload(upload)
+}
+
+// removeUpload deletes the parts of upload and its record from their owners.
+func (s *Server) removeUpload(upload *MultipartUpload) error {
+	for _, part := range upload.Parts {
+		if err := s.deleteObject(partKey(upload.Key, upload.UploadID, part.Number)); err != nil {
+			return err
+		}
+	}
+	return s.deleteObject(uploadKey(upload.UploadID))
+}
+
+// reapUploads removes uploads nobody has added a part to within
+// UploadExpiry. Each upload is reaped by the first owner of its record.
+func (s *Server) reapUploads(now time.Time) error {
+	expiry := s.UploadExpiry
+	if expiry <= 0 {
+		expiry = defaultUploadExpiry
+	}
+	objects, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	self := s.Transport.Addr()
+	for _, obj := range objects {
+		uploadID, ok := strings.CutPrefix(obj.Key, uploadKey(""))
+		if !ok || obj.ID != s.ID {
+			continue
+		}
+		if owners := s.owners(obj.Key); len(owners) > 0 && owners[0] != self {
+			continue
+		}
+		upload, err := s.Upload(uploadID)
+		if errors.Is(err, errNoSuchUpload) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if now.Sub(upload.Updated) < expiry {
+			continue
+		}
+		s.logger.Info("reaping abandoned upload", "upload_id", upload.UploadID, "key", upload.Key)
+		if err := s.removeUpload(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteLocal removes the local copy of key along with the local copies of
+// the parts it was assembled from or, from the first owner, its shards.
+func (s *Server) deleteLocal(key string) error {
+	meta, _ := s.store.ReadMeta(s.ID, key)
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	s.dropParts(meta.Parts, nil)
+	s.dropShards(key, meta.Erasure, nil)
+	return nil
+}
+
+// dropParts deletes the local copies of the parts an assembled object no
+// longer uses, those in kept stay.
+func (s *Server) dropParts(parts []ObjectPart, kept []ObjectPart) {
+	for _, part := range parts {
+		if slices.ContainsFunc(kept, func(p ObjectPart) bool { return p.Key == part.Key }) {
+			continue
+		}
+		if s.store.Has(s.ID, part.Key) {
+			s.store.Delete(s.ID, part.Key)
+		}
+	}
+}
+
+// readParts reads a range of an assembled object from the local copies of
+// its parts, which live on the same nodes as the object.
+func (s *Store) readParts(id string, meta ObjectMeta, offset int64, length int64) (int64, io.ReadCloser, error) {
+	r := &partsReader{store: s, id: id}
+	var pos int64
+	for _, part := range meta.Parts {
+		start := pos
+		pos += part.Size
+		if pos <= offset || (length >= 0 && start >= offset+length) {
+			continue
+		}
+		if !s.Has(id, part.Key) {
+			return 0, nil, fmt.Errorf("part (%s) of (%s): %w", part.Key, meta.Key, os.ErrNotExist)
+		}
+		if len(r.parts) == 0 {
+			r.skip = offset - start
+		}
+		r.parts = append(r.parts, part)
+	}
+	if length < 0 {
+		return meta.Size, r, nil
+	}
+	return meta.Size, readCloser{io.LimitReader(r, length), r}, nil
+}
+
+// partsReader reads parts one after the other, each is opened once the
+// one before it is done.
+type partsReader struct {
+	store *Store
+	id    string
+	parts []ObjectPart
+	skip  int64 // into the first part
+	cur   *meteredFile
+}
+
+func (r *partsReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			_, f, err := r.store.readStream(r.id, r.parts[0].Key, r.skip)
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.parts, r.skip = f, r.parts[1:], 0
+		}
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	s := newTestServer(t, nil)
+	key := "videos/big.mp4"
+
+	uploadID, err := s.InitiateUpload(key, PutOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// parts may arrive out of order and be retried
+	for _, part := range []struct {
+		number int
+		data   string
+	}{{2, "world"}, {1, "hullo "}, {1, "hello "}} {
+		if _, err := s.UploadPart(uploadID, part.number, bytes.NewReader([]byte(part.data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upload, err := s.Upload(uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upload.Parts) != 2 || upload.Parts[0].Number != 1 || upload.Offset() != int64(len("hello world")) {
+		t.Fatalf("want two parts in order have %+v", upload.Parts)
+	}
+
+	if _, err := s.CompleteUpload(uploadID, []CompletedPart{{Number: 1, ETag: "stale"}}, PutOpts{}); err != errInvalidPart {
+		t.Errorf("want a mismatched part etag rejected have %v", err)
+	}
+	res, err := s.CompleteUpload(uploadID, nil, PutOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := partsETag([]ObjectPart{{ETag: hashKeymd5("hello ")}, {ETag: hashKeymd5("world")}}); res.ETag != want || !strings.HasSuffix(want, "-2") {
+		t.Errorf("want etag %s derived from the parts have %s", want, res.ETag)
+	}
+	if meta, err := s.Stat(key); err != nil || meta.Size != int64(len("hello world")) || meta.ETag != res.ETag {
+		t.Errorf("want the size of the parts and the upload's etag have %+v %v", meta, err)
+	}
+	size, rc, err := s.GetRange(key, 4, 4)
+	if got := readAll(t, rc, err); got != "o wo" || size != int64(len("hello world")) {
+		t.Errorf("want a range across both parts have %q of %d", got, size)
+	}
+	r, err := s.Get(key)
+	if got := readAll(t, r, err); got != "hello world" {
+		t.Errorf("want assembled object have %s", got)
+	}
+
+	if _, err := s.Upload(uploadID); err != errNoSuchUpload {
+		t.Errorf("want completed upload removed have %v", err)
+	}
+	objects, _ := s.List("")
+	if len(objects) != 1 {
+		t.Errorf("want only the assembled object left have %+v", objects)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if s.store.Has(s.ID, partKey(key, uploadID, 1)) || s.store.Has(s.ID, partKey(key, uploadID, 2)) {
+		t.Error("want the parts deleted with the object")
+	}
+}
+
+func TestMultipartUploadAcrossNodes(t *testing.T) {
+	a := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	b := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	connectNodes(t, a, b)
+	// the object, and with it its parts, is placed on b
+	key := keyOwnedBy(t, b, "big")
+
+	uploadID, err := a.InitiateUpload(key, PutOpts{ContentType: "video/mp4", UserMeta: map[string]string{"camera": "front"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UploadPart(uploadID, 1, strings.NewReader("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.UploadPart(uploadID, 2, strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := a.Upload(uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upload.Parts) != 2 || upload.Offset() != int64(len("hello world")) {
+		t.Fatalf("want both parts seen from a have %+v", upload.Parts)
+	}
+	if !b.store.Has(b.ID, partKey(key, uploadID, 1)) || a.store.Has(a.ID, partKey(key, uploadID, 2)) {
+		t.Error("want the parts placed on b")
+	}
+
+	if _, err := a.CompleteUpload(uploadID, nil, PutOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "object stored on b", func() bool { return b.store.Has(b.ID, key) })
+	if meta, err := b.store.ReadMeta(b.ID, key); err != nil || meta.ContentType != "video/mp4" || meta.UserMeta["camera"] != "front" {
+		t.Errorf("want the metadata given on initiate kept with the object have %+v %v", meta, err)
+	}
+	for _, s := range []*Server{a, b} {
+		r, err := s.Get(key)
+		if got := readAll(t, r, err); got != "hello world" {
+			t.Errorf("%s: want assembled object have %q", s.Transport.Addr(), got)
+		}
+	}
+	if _, err := b.Upload(uploadID); err != errNoSuchUpload {
+		t.Errorf("want completed upload removed have %v", err)
+	}
+
+	if err := a.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "parts deleted with the object", func() bool {
+		return !b.store.Has(b.ID, partKey(key, uploadID, 1)) && !b.store.Has(b.ID, partKey(key, uploadID, 2))
+	})
+}
+
+func TestReapUploads(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.UploadExpiry = time.Hour
+
+	stale, _ := s.InitiateUpload("a", PutOpts{})
+	s.UploadPart(stale, 1, bytes.NewReader([]byte("part")))
+	if err := s.reapUploads(time.Now().Add(30 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Upload(stale); err != nil {
+		t.Errorf("want active upload kept have %v", err)
+	}
+	if err := s.reapUploads(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Upload(stale); err != errNoSuchUpload {
+		t.Errorf("want abandoned upload reaped have %v", err)
+	}
+	if s.store.Has(s.ID, partKey("a", stale, 1)) {
+		t.Error("want parts of the reaped upload deleted")
+	}
+	if _, err := s.Upload("../../etc"); err != errNoSuchUpload {
+		t.Errorf("want malformed upload id rejected have %v", err)
+	}
+}
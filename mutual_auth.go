@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"encoding/pem"
 	"log"
+	"log/slog"
 	"math/big"
 	"os"
 	"time"
@@ -20,7 +21,7 @@ func create_certPool(caCertPath string, caCertPool *x509.CertPool) *x509.CertPoo
 	// Load CA cert
 	caCert, err := os.ReadFile(caCertPath)
 	if err != nil {
-		log.Printf("Error loading certificate: %s", err)
+		slog.Error("loading CA certificate failed", "path", caCertPath, "err", err)
 	}
 
 	if caCertPool == nil {
@@ -37,7 +38,7 @@ func create_certPool(caCertPath string, caCertPool *x509.CertPool) *x509.CertPoo
 func (s *Server) VerifyServerCert(caCertPool *x509.CertPool) error {
 	cert, err := tls.LoadX509KeyPair(s.crtPath, s.keyPath)
 	if err != nil {
-		log.Printf("Error loading certificate: %s", err)
+		slog.Error("loading certificate failed", "err", err)
 		return err
 	}
 	opts := x509.VerifyOptions{
@@ -46,11 +47,11 @@ func (s *Server) VerifyServerCert(caCertPool *x509.CertPool) error {
 	for _, cert := range cert.Certificate {
 		x509Cert, err := x509.ParseCertificate(cert)
 		if err != nil {
-			log.Printf("Error parsing certificate: %s", err)
+			slog.Error("parsing certificate failed", "err", err)
 			return err
 		}
 		if _, err := x509Cert.Verify(opts); err != nil {
-			log.Printf("Error verifying certificate: %s", err)
+			slog.Error("verifying certificate failed", "err", err)
 			return err
 		}
 	}
@@ -125,7 +126,7 @@ func (s *Server) CreateServerCert(caKey *rsa.PrivateKey, caCert *x509.Certificat
 func createCACert(caKeyPath, caCertPath string, detail pkix.Name) {
 	caKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
-		log.Printf("Failed to generate CA private key: %v", err)
+		slog.Error("generating CA private key failed", "err", err)
 	}
 	caCertTemplate := &x509.Certificate{
 		SerialNumber:          big.NewInt(1),
@@ -140,18 +141,18 @@ func createCACert(caKeyPath, caCertPath string, detail pkix.Name) {
 	// Create CA certificate
 	caCertDER, err := x509.CreateCertificate(rand.Reader, caCertTemplate, caCertTemplate, &caKey.PublicKey, caKey)
 	if err != nil {
-		log.Printf("Failed to create CA certificate: %v", err)
+		slog.Error("creating CA certificate failed", "err", err)
 	}
 	caKeyFile, err := os.Create(caKeyPath)
 	if err != nil {
-		log.Printf("Failed to open CA key file: %v", err)
+		slog.Error("opening CA key file failed", "path", caKeyPath, "err", err)
 	}
 	defer caKeyFile.Close()
 	pem.Encode(caKeyFile, &pem.Block{Type: "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(caKey)})
 	caCertFile, err := os.Create(caCertPath)
 	if err != nil {
-		log.Printf("Failed to open CA cert file: %v", err)
+		slog.Error("opening CA cert file failed", "path", caCertPath, "err", err)
 	}
 	defer caCertFile.Close()
 
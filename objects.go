@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+)
+
+// listPageSize is how many objects a peer sends per MessageFileList, which
+// keeps each reply well under the message size limit.
+const listPageSize = 500
+
+var errNoSuchKey = errors.New("no such key")
+
+// Stat returns the metadata of the live object behind key, in a versioned
+// namespace that is its latest version. Keys this node holds no copy of
+// are looked up on their owners.
+func (s *Server) Stat(key string) (ObjectMeta, error) {
+	ctx := context.Background()
+	if !s.namespaceOpts(key).Versioning {
+		return s.statCopy(ctx, key)
+	}
+
+	latest, err := s.latestVersion(ctx, key)
+	if errors.Is(err, errNoSuchVersion) || (err == nil && latest.DeleteMarker) {
+		return ObjectMeta{}, errNoSuchKey
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	meta, err := s.statCopy(ctx, versionKey(key, latest.VersionID))
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	meta.Key = key
+	return meta, nil
+}
+
+// statCopy returns the metadata of the local copy of key or, without one,
+// the latest of the owners' copies.
+func (s *Server) statCopy(ctx context.Context, key string) (ObjectMeta, error) {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if !errors.Is(err, os.ErrNotExist) {
+		return meta, err
+	}
+	metas := s.ownerCopies(ctx, key)
+	if len(metas) == 0 {
+		return ObjectMeta{}, errNoSuchKey
+	}
+	latest := metas[0]
+	for _, meta := range metas[1:] {
+		if latest.HLC.Less(meta.HLC) {
+			latest = meta
+		}
+	}
+	return latest, nil
+}
+
+// List returns the live objects in the cluster whose keys start with
+// prefix, sorted by key. Siblings and old versions are left out.
+func (s *Server) List(prefix string) ([]ObjectMeta, error) {
+	live, err := s.localList(prefix)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]ObjectMeta, len(live))
+	for _, obj := range live {
+		byKey[obj.Key] = obj
+	}
+
+	s.peerLock.Lock()
+	peers := make([]peer2peer.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.peerLock.Unlock()
+	for _, peer := range peers {
+		objects, err := s.listPeer(context.Background(), peer, prefix)
+		if err != nil {
+			return nil, err
+		}
+		// owners that missed a write still list the copy it replaced
+		for _, obj := range objects {
+			if have, ok := byKey[obj.Key]; !ok || have.HLC.Less(obj.HLC) {
+				byKey[obj.Key] = obj
+			}
+		}
+	}
+
+	live = live[:0]
+	for _, obj := range byKey {
+		live = append(live, obj)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Key < live[j].Key })
+	return live, nil
+}
+
+// listPeer returns the live objects peer holds under prefix, a page at a time.
+func (s *Server) listPeer(ctx context.Context, peer peer2peer.Peer, prefix string) ([]ObjectMeta, error) {
+	var objects []ObjectMeta
+	startAfter := ""
+	for {
+		reply, err := s.call(ctx, peer, &Message{Payload: MessageListFiles{Prefix: prefix, StartAfter: startAfter}})
+		if err != nil {
+			return nil, err
+		}
+		page, _ := reply.(MessageFileList)
+		objects = append(objects, page.Objects...)
+		if !page.More || len(page.Objects) == 0 {
+			return objects, nil
+		}
+		startAfter = page.Objects[len(page.Objects)-1].Key
+	}
+}
+
+func (s *Server) handleListFiles(ctx context.Context, from string, call *Message, msg *MessageListFiles) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+	live, err := s.localList(msg.Prefix)
+	if err != nil {
+		s.reply(ctx, peer, call, MessageFileList{})
+		return err
+	}
+	start := sort.Search(len(live), func(i int) bool { return live[i].Key > msg.StartAfter })
+	page := live[start:]
+	more := len(page) > listPageSize
+	if more {
+		page = page[:listPageSize]
+	}
+	s.reply(ctx, peer, call, MessageFileList{Objects: page, More: more})
+	return nil
+}
+
+// localList returns the live objects this node holds whose keys start with
+// prefix, sorted by key. Upload records and parts are only listed when
+// prefix is itself an upload key.
+func (s *Server) localList(prefix string) ([]ObjectMeta, error) {
+	objects, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var live []ObjectMeta
+	for _, obj := range objects {
+		if obj.ID != s.ID || strings.Contains(obj.Key, "?sibling=") || isShardKey(obj.Key) {
+			continue
+		}
+		if isUploadKey(obj.Key) {
+			if isUploadKey(prefix) && strings.HasPrefix(obj.Key, prefix) {
+				live = append(live, obj)
+			}
+			continue
+		}
+		key, versionID, isVersion := strings.Cut(obj.Key, "?version=")
+		if !strings.HasPrefix(key, prefix) || isVersion != s.namespaceOpts(key).Versioning {
+			continue
+		}
+		if isVersion {
+			latest, err := s.store.LatestVersion(s.ID, key)
+			if err != nil || latest.DeleteMarker || latest.VersionID != versionID {
+				continue
+			}
+			obj.Key = key
+		}
+		live = append(live, obj)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Key < live[j].Key })
+	return live, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+	"github.com/arpbansal/distributed_storage_system/client"
+)
+
+func TestServerList(t *testing.T) {
+	s := newTestServer(t, map[string]NamespaceOpts{"docs": {Versioning: true}})
+
+	for _, key := range []string{"media/b.txt", "media/a.txt", "docs/x.txt", "docs/y.txt", "other.txt"} {
+		if err := s.StoreData(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StoreData("docs/x.txt", bytes.NewReader([]byte("second"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("docs/y.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List("media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "media/a.txt" || objects[1].Key != "media/b.txt" {
+		t.Errorf("want media keys in order have %+v", objects)
+	}
+
+	objects, err = s.List("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "docs/x.txt" || objects[0].Size != int64(len("second")) {
+		t.Errorf("want only the latest version of docs/x.txt have %+v", objects)
+	}
+
+	meta, err := s.Stat("docs/x.txt")
+	if err != nil || meta.Key != "docs/x.txt" || meta.ETag == "" {
+		t.Errorf("want stat of the latest version have %+v %v", meta, err)
+	}
+	if _, err := s.Stat("docs/y.txt"); err != errNoSuchKey {
+		t.Errorf("want deleted key missing have %v", err)
+	}
+}
+
+func TestStatUserMeta(t *testing.T) {
+	s := newTestServer(t, map[string]NamespaceOpts{"docs": {Versioning: true}})
+
+	for _, key := range []string{"media/cat.jpg", "docs/cat.jpg"} {
+		_, err := s.Put(key, bytes.NewReader([]byte("meow")), PutOpts{
+			ContentType: "image/jpeg",
+			UserMeta:    map[string]string{"owner": "alice"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := s.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.ContentType != "image/jpeg" || meta.UserMeta["owner"] != "alice" {
+			t.Errorf("want content type and user metadata of %s kept have %+v", key, meta)
+		}
+	}
+
+	// an overwrite replaces the metadata along with the data
+	if err := s.StoreData("media/cat.jpg", bytes.NewReader([]byte("purr"))); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Stat("media/cat.jpg")
+	if err != nil || meta.ContentType != "" || len(meta.UserMeta) != 0 {
+		t.Errorf("want metadata cleared by an overwrite have %+v %v", meta, err)
+	}
+}
+
+func TestClusterWideListing(t *testing.T) {
+	a := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	b := startTestNode(t, ServerOpts{ReplicationFactor: 1})
+	connectNodes(t, a, b)
+
+	var endpoints []string
+	for _, s := range []*Server{a, b} {
+		ts := httptest.NewServer(api.NewAPIServer(NewServerAdapter(s), "").Handler())
+		t.Cleanup(ts.Close)
+		endpoints = append(endpoints, ts.URL)
+	}
+
+	// both keys go in through a, only one of them stays there
+	local := keyOwnedBy(t, a, "listing/a")
+	remote := keyOwnedBy(t, b, "listing/b")
+	writer, err := client.New(endpoints[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{local, remote} {
+		if _, err := writer.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, endpoint := range endpoints {
+		cl, err := client.New([]string{endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{local, remote} {
+			info, err := cl.Stat(ctx, key)
+			if err != nil {
+				t.Fatalf("node %d: stat %s: %v", i, key, err)
+			}
+			if info.Size != int64(len(key)) {
+				t.Errorf("node %d: want size %d for %s have %d", i, len(key), key, info.Size)
+			}
+		}
+		objects, err := cl.List(ctx, "listing/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, o := range objects {
+			keys = append(keys, o.Key)
+		}
+		want := []string{local, remote}
+		slices.Sort(want)
+		if !slices.Equal(keys, want) {
+			t.Errorf("node %d: want %v have %v", i, want, keys)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package peer2peer
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
+// maxMessageSize bounds a single framed message, streams are not framed
+const maxMessageSize = 1 << 20
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
@@ -31,12 +36,30 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 2048)
-	n, err := r.Read(buf)
-	if err != nil {
+	// messages are length prefixed, see Frame, so several of them
+	// arriving back to back are not read as one
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds limit", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 	return nil
 
 }
+
+// Frame wraps a message payload in the layout DefaultDecoder reads:
+// the IncomingMessage marker followed by the payload length.
+func Frame(payload []byte) []byte {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	return buf
+}
@@ -11,3 +11,23 @@ type RPC struct {
 	Payload []byte
 	Stream  bool
 }
+
+// Header carries metadata alongside a message, such as the trace context
+// of the request it serves, it is a propagation.TextMapCarrier
+type Header map[string]string
+
+func (h Header) Get(key string) string {
+	return h[key]
+}
+
+func (h Header) Set(key string, value string) {
+	h[key] = value
+}
+
+func (h Header) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,69 @@
+package peer2peer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/arpbansal/distributed_storage_system/metrics"
+)
+
+var (
+	peersConnected = metrics.Default.Gauge("dfs_peers",
+		"Peers connected to the transport.", "node")
+	// peers are labelled by their listen address, the remote address of
+	// an accepted connection has an ephemeral port and would make a series
+	// per connection
+	peerSentBytes = metrics.Default.Counter("dfs_peer_sent_bytes_total",
+		"Bytes sent to a peer.", "node", "peer")
+	peerReceivedBytes = metrics.Default.Counter("dfs_peer_received_bytes_total",
+		"Bytes received from a peer.", "node", "peer")
+	peerErrors = metrics.Default.Counter("dfs_peer_errors_total",
+		"Failed reads, writes and handshakes on a peer connection.", "node", "peer")
+)
+
+// unannounced is the peer label of an accepted connection until the node
+// at its other end announces its listen address
+const unannounced = "unannounced"
+
+// meteredConn counts the bytes and errors on a peer connection
+type meteredConn struct {
+	net.Conn
+	node string
+	peer atomic.Pointer[string]
+}
+
+// newMeteredConn labels a dialed connection with the address it was dialed
+// at, an accepted one waits for SetNodeAddr
+func newMeteredConn(conn net.Conn, node string, outbound bool) *meteredConn {
+	c := &meteredConn{Conn: conn, node: node}
+	peer := unannounced
+	if outbound {
+		peer = conn.RemoteAddr().String()
+	}
+	c.peer.Store(&peer)
+	return c
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	peerReceivedBytes.Add(float64(n), c.node, *c.peer.Load())
+	c.countError(err)
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	peerSentBytes.Add(float64(n), c.node, *c.peer.Load())
+	c.countError(err)
+	return n, err
+}
+
+// countError counts err unless it is the connection ending
+func (c *meteredConn) countError(err error) {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	peerErrors.Inc(c.node, *c.peer.Load())
+}
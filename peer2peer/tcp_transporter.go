@@ -2,10 +2,8 @@ package peer2peer
 
 import (
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"sync"
 )
 
 // represent remote node over a TCP established connection.
@@ -16,14 +14,20 @@ type TCPpeer struct {
 	// if we dial and retrieve a connection => outbound==true
 	// if we accept and retrieve a connection => outbound==false
 	outbound bool
-	wg       *sync.WaitGroup
+
+	// the read loop hands the connection over to whoever reads the stream
+	// through streamch, and takes it back once CloseStream signals donech
+	streamch  chan struct{}
+	donech    chan struct{}
+	streaming bool
 }
 
 func NewTCPpeer(conn net.Conn, outbound bool) *TCPpeer {
 	return &TCPpeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{}, // made private
+		streamch: make(chan struct{}, 1),
+		donech:   make(chan struct{}, 1),
 	}
 }
 
@@ -32,8 +36,27 @@ func (p *TCPpeer) Send(b []byte) error {
 	return err
 }
 
+// Read blocks until the read loop has consumed the IncomingStream marker,
+// so stream readers never race it for the first bytes.
+func (p *TCPpeer) Read(b []byte) (int, error) {
+	if !p.streaming {
+		<-p.streamch
+		p.streaming = true
+	}
+	return p.Conn.Read(b)
+}
+
+// SetNodeAddr labels the metrics of the peer with addr, the listen address
+// the node at the other end announced.
+func (p *TCPpeer) SetNodeAddr(addr string) {
+	if c, ok := p.Conn.(*meteredConn); ok {
+		c.peer.Store(&addr)
+	}
+}
+
 func (p *TCPpeer) CloseStream() {
-	p.wg.Done()
+	p.streaming = false
+	p.donech <- struct{}{}
 }
 
 /*
@@ -55,6 +78,10 @@ type TCPtransportOps struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once a peer accepted by OnPeer drops
+	OnPeerDisconnect func(Peer)
+	// Logger is where the transport logs, slog.Default() when nil
+	Logger *slog.Logger
 }
 
 type TCPtransport struct {
@@ -68,6 +95,9 @@ type TCPtransport struct {
 }
 
 func NewTCPtransport(ops TCPtransportOps) *TCPtransport {
+	if ops.Logger == nil {
+		ops.Logger = slog.Default()
+	}
 	return &TCPtransport{
 		TCPtransportOps: ops,
 		rpcch:           make(chan RPC),
@@ -108,7 +138,7 @@ func (t *TCPtransport) ListenAndAccept() error {
 	}
 
 	go t.StartAcceptLoop()
-	log.Printf("TCP transpot listening on port: %s\n", t.ListenAddr)
+	t.Logger.Info("TCP transport listening", "addr", t.ListenAddr)
 	return nil
 }
 
@@ -119,7 +149,8 @@ func (t *TCPtransport) StartAcceptLoop() {
 			return
 		}
 		if err != nil {
-			fmt.Printf("TCP accept error: %s\n", err)
+			t.Logger.Error("TCP accept failed", "err", err)
+			continue
 		}
 		go t.HandleConn(conn, false)
 	}
@@ -127,13 +158,16 @@ func (t *TCPtransport) StartAcceptLoop() {
 
 func (t *TCPtransport) HandleConn(conn net.Conn, outbound bool) {
 	var err error
+	log := t.Logger.With("peer", conn.RemoteAddr().String(), "outbound", outbound)
 	defer func() {
-		fmt.Printf("dropping peer connection: %s", err)
+		log.Info("dropping peer connection", "reason", err)
 		conn.Close()
 	}()
+	metered := newMeteredConn(conn, t.ListenAddr, outbound)
+	conn = metered
 	peer := NewTCPpeer(conn, outbound)
-	if err := t.HandshakeFunc(peer); err != nil {
-		conn.Close()
+	if err = t.HandshakeFunc(peer); err != nil {
+		peerErrors.Inc(t.ListenAddr, *metered.peer.Load())
 		return
 	}
 	if t.OnPeer != nil {
@@ -141,23 +175,25 @@ func (t *TCPtransport) HandleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	peersConnected.Inc(t.ListenAddr)
+	defer peersConnected.Dec(t.ListenAddr)
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
 
 	//read loop
 	for {
 		rpc := RPC{}
-		err := t.Decoder.Decode(conn, &rpc)
-
-		if err != nil {
-			fmt.Printf("TCP read error: %s\n", err)
+		if err = t.Decoder.Decode(conn, &rpc); err != nil {
 			return // working for general err, need to implement for specific error
 		}
 
 		rpc.From = conn.RemoteAddr().String() // to_check_1
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s]incoming stream, waiting till stream is done", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Println("stream done continuing read loop")
+			peer.streamch <- struct{}{}
+			log.Debug("incoming stream, waiting till it is done")
+			<-peer.donech
+			log.Debug("stream done, continuing read loop")
 			continue
 		}
 		t.rpcch <- rpc
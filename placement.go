@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultVirtualNodes = 64
+
+// HashRing is a consistent hash ring over node listen addresses, used to
+// decide which nodes own the replicas of a key.
+type HashRing struct {
+	mu      sync.RWMutex
+	vnodes  int
+	hashes  []uint64
+	points  map[uint64]string
+	members map[string]struct{}
+}
+
+func NewHashRing(vnodes int) *HashRing {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	return &HashRing{
+		vnodes:  vnodes,
+		points:  make(map[uint64]string),
+		members: make(map[string]struct{}),
+	}
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add places a member on the ring, returns false if it was already there.
+func (r *HashRing) Add(member string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[member]; ok {
+		return false
+	}
+	r.members[member] = struct{}{}
+	for i := 0; i < r.vnodes; i++ {
+		h := ringHash(member + "#" + strconv.Itoa(i))
+		r.points[h] = member
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return true
+}
+
+// Remove takes a member off the ring, returns false if it wasn't there.
+func (r *HashRing) Remove(member string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[member]; !ok {
+		return false
+	}
+	delete(r.members, member)
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.points[h] == member {
+			delete(r.points, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+	return true
+}
+
+func (r *HashRing) Has(member string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.members[member]
+	return ok
+}
+
+func (r *HashRing) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	members := make([]string, 0, len(r.members))
+	for m := range r.members {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Clone returns an independent copy, used to compare placement before and
+// after a membership change.
+func (r *HashRing) Clone() *HashRing {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := &HashRing{
+		vnodes:  r.vnodes,
+		hashes:  append([]uint64(nil), r.hashes...),
+		points:  make(map[uint64]string, len(r.points)),
+		members: make(map[string]struct{}, len(r.members)),
+	}
+	for h, m := range r.points {
+		c.points[h] = m
+	}
+	for m := range r.members {
+		c.members[m] = struct{}{}
+	}
+	return c
+}
+
+// Owners returns the n distinct members responsible for key, walking the
+// ring clockwise from the key's hash. n <= 0 means every member.
+func (r *HashRing) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n <= 0 || n > len(r.members) {
+		n = len(r.members)
+	}
+	if n == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; len(owners) < n && i < len(r.hashes); i++ {
+		m := r.points[r.hashes[(start+i)%len(r.hashes)]]
+		if _, ok := seen[m]; ok {
+			continue
+		}
+		seen[m] = struct{}{}
+		owners = append(owners, m)
+	}
+	return owners
+}
+
+// placementKey is the key that decides where key is placed, versions,
+// siblings and upload parts of an object live on the same nodes as the
+// object itself.
+func placementKey(key string) string {
+	key, _, _ = strings.Cut(key, "?sibling=")
+	key, _, _ = strings.Cut(key, "?version=")
+	if base, _, found := strings.Cut(key, "?upload="); found && base != "" {
+		key = base
+	}
+	return key
+}
+
+// ringKey is where key falls on the ring.
+func ringKey(key string) string {
+	return hashKeymd5(placementKey(key))
+}
+
+// owners returns the listen addresses of the nodes that hold copies of key.
+func (s *Server) owners(key string) []string {
+	return s.ownersOn(s.ring, key)
+}
+
+// ownersOn returns the members of ring that hold copies of key. A shard of
+// an erasure-coded object has a single owner, the shards of an object go to
+// consecutive members from the object's place on the ring.
+func (s *Server) ownersOn(ring *HashRing, key string) []string {
+	if base, i, ok := shardOf(key); ok {
+		members := ring.Owners(ringKey(base), 0)
+		if len(members) == 0 {
+			return nil
+		}
+		return []string{members[i%len(members)]}
+	}
+	return ring.Owners(ringKey(key), s.ReplicationFactor)
+}
+
+// ownsKey reports whether this node is one of the owners of key.
+func (s *Server) ownsKey(key string) bool {
+	return slices.Contains(s.owners(key), s.Transport.Addr())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	r := NewHashRing(0)
+	for _, addr := range []string{":3000", ":4000", ":5000"} {
+		r.Add(addr)
+	}
+
+	owners := r.Owners("somekey", 2)
+	if len(owners) != 2 || owners[0] == owners[1] {
+		t.Errorf("want 2 distinct owners have %v", owners)
+	}
+	if all := r.Owners("somekey", 0); len(all) != 3 {
+		t.Errorf("want every member as owner have %v", all)
+	}
+	if got := r.Owners("somekey", 2); fmt.Sprint(got) != fmt.Sprint(owners) {
+		t.Errorf("owners not stable: %v != %v", got, owners)
+	}
+}
+
+func TestHashRingJoinMovesFewKeys(t *testing.T) {
+	r := NewHashRing(0)
+	for _, addr := range []string{":3000", ":4000", ":5000"} {
+		r.Add(addr)
+	}
+	before := r.Clone()
+	r.Add(":6000")
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := hashKeymd5(fmt.Sprintf("foo_%d", i))
+		if before.Owners(key, 1)[0] != r.Owners(key, 1)[0] {
+			if r.Owners(key, 1)[0] != ":6000" {
+				t.Fatalf("key %s moved between existing nodes", key)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Errorf("unexpected number of moved keys: %d", moved)
+	}
+
+	r.Remove(":6000")
+	for i := 0; i < 1000; i++ {
+		key := hashKeymd5(fmt.Sprintf("foo_%d", i))
+		if before.Owners(key, 1)[0] != r.Owners(key, 1)[0] {
+			t.Fatalf("placement of %s not restored after removal", key)
+		}
+	}
+}
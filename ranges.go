@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GetRange returns length bytes of key starting at offset along with the
+// full size of the object, a negative length reads to the end. Only the
+// requested bytes are read from disk or transferred from a replica.
+func (s *Server) GetRange(key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	return s.GetRangeContext(context.Background(), key, offset, length)
+}
+
+// GetRangeContext is GetRange that gives up once ctx is done, no replica is
+// asked for the range after that.
+func (s *Server) GetRangeContext(ctx context.Context, key string, offset int64, length int64) (size int64, r io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "Server.GetRange", trace.WithAttributes(
+		attribute.String("dfs.key", key),
+		attribute.String("dfs.node", s.Transport.Addr()),
+		attribute.Int64("dfs.offset", offset),
+		attribute.Int64("dfs.length", length),
+	))
+	defer func() { tracing.End(span, err) }()
+	key, err = s.liveKey(ctx, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if s.store.Has(s.ID, key) {
+		if meta, err := s.store.ReadMeta(s.ID, key); err == nil && meta.Erasure != nil {
+			return s.readTiered(ctx, key, meta.Erasure, offset, length)
+		}
+		return s.store.ReadRange(s.ID, key, offset, length)
+	}
+	return s.fetchRange(ctx, key, offset, length)
+}
+
+// fetchRange asks the owners of key in turn for part of it. The data isn't
+// kept on local disk, it is decrypted as it streams in.
+func (s *Server) fetchRange(ctx context.Context, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	log := s.requestLogger(requestID(ctx))
+	log.Info("object not on local disk, fetching it from its owners", "key", key, "offset", offset, "length", length)
+
+	for _, peer := range s.replicaPeers(key) {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		// the range only follows the reply, a stream the peer sends ahead
+		// of it belongs to some other message
+		id, replies := s.expectReply()
+		msg := &Message{
+			Payload: MessageGetFile{
+				Key:    key,
+				Offset: offset,
+				Length: length,
+			},
+			RequestID: requestID(ctx),
+			CallID:    id,
+		}
+		unlock := s.lockSend(peer)
+		err := s.send(ctx, peer, msg)
+		unlock()
+		var reply any
+		if err == nil {
+			reply, err = s.awaitReply(ctx, replies)
+		}
+		s.dropReply(id)
+		if err != nil {
+			// a reply that came in before the call was dropped still has
+			// its range to be read off the connection
+			select {
+			case reply := <-replies:
+				discardRange(peer, reply)
+			default:
+			}
+			if ctx.Err() != nil {
+				return 0, nil, ctx.Err()
+			}
+			log.Warn("asking owner for the object failed", "key", key, "peer", peer.RemoteAddr(), "err", err)
+			continue
+		}
+		found, ok := reply.(MessageFileRange)
+		if !ok || !found.Found {
+			continue
+		}
+		if found.Erasure != nil {
+			return s.readTiered(ctx, key, found.Erasure, offset, length)
+		}
+		size := found.Size
+		payload := io.LimitReader(peer, found.Length)
+
+		_, span := tracing.StartChild(ctx, "peer2peer.Stream", trace.WithAttributes(
+			attribute.String("peer.address", peer.RemoteAddr().String()),
+			attribute.String("dfs.direction", "receive"),
+		))
+		// the range comes as an iv and the ciphertext from offset on,
+		// decrypted by advancing the counter to offset
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(payload, iv); err != nil {
+			tracing.End(span, err)
+			io.Copy(io.Discard, payload)
+			peer.CloseStream()
+			return 0, nil, err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			m, err := decryptCopyAt(s.Enckey, iv, min(max(offset, 0), size), payload, pw)
+			span.SetAttributes(attribute.Int64("dfs.bytes", int64(m)))
+			tracing.End(span, err)
+			// whatever the reader left unread still has to leave the stream
+			io.Copy(io.Discard, payload)
+			peer.CloseStream()
+			pw.CloseWithError(err)
+		}()
+		return size, pr, nil
+	}
+	return 0, nil, errNoSuchKey
+}
+
+// discardRange reads the range following reply, if any, off the connection.
+func discardRange(peer peer2peer.Peer, reply any) {
+	if found, ok := reply.(MessageFileRange); ok && found.Found && found.Erasure == nil {
+		io.Copy(io.Discard, io.LimitReader(peer, found.Length))
+		peer.CloseStream()
+	}
+}
+
+// sendRange answers call with part of the local copy of an object, caller
+// holds the send lock of peer. An encrypted copy goes out as it is on disk, one in the
+// clear is encrypted on the way out with the keystream advanced to the
+// offset, so either decrypts the same way.
+func (s *Server) sendRange(ctx context.Context, peer peer2peer.Peer, call *Message, msg *MessageGetFile) error {
+	reply := &Message{RequestID: call.RequestID, ReplyTo: call.CallID}
+	meta, err := s.store.ReadMeta(s.ID, msg.Key)
+	if err == nil && meta.Erasure != nil {
+		// the shards are on other nodes, the caller rebuilds the range itself
+		reply.Payload = MessageFileRange{Found: true, Size: meta.Size, Erasure: meta.Erasure}
+		return s.send(ctx, peer, reply)
+	}
+	offset := min(max(msg.Offset, 0), meta.Size)
+	n := meta.Size - offset
+	if msg.Length >= 0 {
+		n = min(n, msg.Length)
+	}
+	var (
+		iv []byte
+		r  io.ReadCloser
+	)
+	if err == nil && meta.Encrypted && meta.Parts == nil {
+		iv, r, err = s.store.ReadCiphertext(s.ID, msg.Key, offset, n)
+	} else if err == nil {
+		_, r, err = s.store.ReadRange(s.ID, msg.Key, offset, n)
+	}
+	if err != nil {
+		reply.Payload = MessageFileRange{}
+		s.send(ctx, peer, reply)
+		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+	}
+	defer r.Close()
+
+	s.requestLogger(requestID(ctx)).Info("sending object to peer", "key", msg.Key, "bytes", n, "peer", peer.RemoteAddr())
+	reply.Payload = MessageFileRange{Found: true, Size: meta.Size, Length: aes.BlockSize + n}
+	if err := s.send(ctx, peer, reply); err != nil {
+		return err
+	}
+	time.Sleep(time.Millisecond * 5)
+	peer.Send([]byte{peer2peer.IncomingStream})
+	if iv == nil {
+		_, err = encryptCopyAt(s.Enckey, offset, r, peer)
+		return err
+	}
+	if _, err := peer.Write(iv); err != nil {
+		return err
+	}
+	_, err = io.Copy(peer, r)
+	return err
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+)
+
+var errDecommissioned = errors.New("node is decommissioned")
+
+func (s *Server) handleAnnounce(from string, msg *MessageAnnounce) error {
+	s.peerLock.Lock()
+	s.nodes[from] = msg.Addr
+	peer := s.peers[from]
+	s.peerLock.Unlock()
+	// the transport counts the traffic of the peer under its listen address
+	if p, ok := peer.(interface{ SetNodeAddr(string) }); ok {
+		p.SetNodeAddr(msg.Addr)
+	}
+
+	s.logger.Info("node joined", "joined", msg.Addr, "peer", from)
+	s.changeMembership((*HashRing).Add, msg.Addr)
+	return nil
+}
+
+func (s *Server) handleDecommission(from string, msg *MessageDecommission) error {
+	s.logger.Info("node is decommissioning", "leaving", msg.Addr)
+	s.changeMembership((*HashRing).Remove, msg.Addr)
+	return nil
+}
+
+// changeMembership applies change to the ring and, if placement moved,
+// starts rebalancing against the previous layout in the background.
+func (s *Server) changeMembership(change func(*HashRing, string) bool, addr string) {
+	s.membershipLock.Lock()
+	before := s.ring.Clone()
+	if !change(s.ring, addr) {
+		s.membershipLock.Unlock()
+		return
+	}
+	after := s.ring.Clone()
+	s.membershipLock.Unlock()
+
+	go func() {
+		if err := s.rebalance(before, after); err != nil {
+			s.logger.Error("rebalance failed", "err", err)
+		}
+	}()
+}
+
+// Decommission drains this node before it leaves the cluster. Peers are told
+// to take it off their rings, then every local object is streamed to its new
+// owners and deleted once they acknowledge it. The node is safe to shut down
+// when Decommission returns without error.
+func (s *Server) Decommission() error {
+	self := s.Transport.Addr()
+
+	s.membershipLock.Lock()
+	before := s.ring.Clone()
+	s.ring.Remove(self)
+	after := s.ring.Clone()
+	s.draining.Store(true)
+	s.membershipLock.Unlock()
+
+	if err := s.broadcast(context.Background(), &Message{Payload: MessageDecommission{Addr: self}}); err != nil {
+		return err
+	}
+	return s.rebalance(before, after)
+}
+
+// rebalance moves local objects whose owners differ between two ring layouts.
+// Copies this node stops owning are removed only after every new owner acked.
+func (s *Server) rebalance(before, after *HashRing) error {
+	s.rebalanceLock.Lock()
+	defer s.rebalanceLock.Unlock()
+
+	objects, err := s.store.List()
+	if err != nil {
+		return err
+	}
+
+	self := s.Transport.Addr()
+	failed := 0
+	// versioned keys whose index has to follow their versions
+	indexes := make(map[string]*movedIndex)
+	for _, obj := range objects {
+		oldOwners := s.ownersOn(before, obj.Key)
+		newOwners := s.ownersOn(after, obj.Key)
+		keep := slices.Contains(newOwners, self)
+
+		var targets []string
+		for _, owner := range newOwners {
+			if owner == self || (keep && slices.Contains(oldOwners, owner)) {
+				continue
+			}
+			targets = append(targets, owner)
+		}
+		if len(targets) == 0 {
+			if !keep {
+				// nobody left to hand this copy to
+				failed++
+			}
+			continue
+		}
+
+		if key, _, versioned := strings.Cut(obj.Key, "?version="); versioned {
+			moved, ok := indexes[key]
+			if !ok {
+				moved = &movedIndex{keep: keep}
+				indexes[key] = moved
+			}
+			for _, addr := range targets {
+				if !slices.Contains(moved.targets, addr) {
+					moved.targets = append(moved.targets, addr)
+				}
+			}
+		}
+
+		if err := s.transferObject(obj, targets); err != nil {
+			s.logger.Error("moving object to its new owners failed", "stored_key", obj.Key, "err", err)
+			failed++
+			continue
+		}
+		if !keep {
+			if err := s.store.Delete(obj.ID, obj.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, moved := range indexes {
+		if err := s.transferVersions(key, moved.targets); err != nil {
+			s.logger.Error("moving version index to its new owners failed", "key", key, "err", err)
+			failed++
+			continue
+		}
+		if !moved.keep {
+			if err := s.store.removeVersions(s.ID, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be moved to their new owners", failed)
+	}
+	return nil
+}
+
+type movedIndex struct {
+	targets []string
+	keep    bool
+}
+
+// transferVersions merges the local version index of key into that of
+// every node in targets.
+func (s *Server) transferVersions(key string, targets []string) error {
+	versions, err := s.store.Versions(s.ID, key)
+	if err != nil {
+		return err
+	}
+	for _, addr := range targets {
+		s.peerLock.Lock()
+		_, peer, ok := s.peerForNode(addr)
+		s.peerLock.Unlock()
+		if !ok {
+			return fmt.Errorf("no connection to node (%s)", addr)
+		}
+		reply, err := s.call(context.Background(), peer, &Message{Payload: MessageVersions{Key: key, Add: versions}})
+		if err != nil {
+			return err
+		}
+		if ack, _ := reply.(MessageStoreAck); ack.err() != nil {
+			return ack.err()
+		}
+	}
+	return nil
+}
+
+func (s *Server) transferObject(obj ObjectMeta, targets []string) error {
+	for _, addr := range targets {
+		if err := s.sendObject(obj, addr); err != nil {
+			replicationFailures.Inc(s.Transport.Addr(), "rebalance")
+			return err
+		}
+	}
+	return nil
+}
+
+// sendObject streams one object to the node at addr and waits for its ack.
+// A sibling is sent as a write of the object it belongs to, which the node
+// resolves against its own copy like any other.
+func (s *Server) sendObject(obj ObjectMeta, addr string) error {
+	s.peerLock.Lock()
+	_, peer, ok := s.peerForNode(addr)
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("no connection to node (%s)", addr)
+	}
+
+	size, r, err := s.store.Read(obj.ID, obj.Key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	key, _, _ := strings.Cut(obj.Key, "?sibling=")
+
+	id, replies := s.expectReply()
+	defer s.dropReply(id)
+
+	// only this peer waits behind the throttled stream
+	unlock := s.lockSend(peer)
+	err = s.send(context.Background(), peer, &Message{
+		Payload: MessageStoreFile{
+			Key:         key,
+			Size:        size + 16, // Add 16 bytes due to encryption
+			Origin:      obj.Origin,
+			Clock:       obj.Clock,
+			HLC:         obj.HLC,
+			ETag:        obj.ETag,
+			ExpiresAt:   obj.ExpiresAt,
+			ContentType: obj.ContentType,
+			UserMeta:    obj.UserMeta,
+			ModTime:     obj.ModTime,
+			Parts:       obj.Parts,
+			Erasure:     obj.Erasure,
+		},
+		CallID: id,
+	})
+	if err == nil {
+		w := newRateLimitedWriter(peer, s.RebalanceRate)
+		peer.Send([]byte{peer2peer.IncomingStream})
+		_, err = EncryptCopy(s.Enckey, r, w)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	reply, err := s.awaitReply(context.Background(), replies)
+	if err != nil {
+		return fmt.Errorf("node (%s) did not acknowledge (%s): %w", addr, key, err)
+	}
+	ack, _ := reply.(MessageStoreAck)
+	return ack.err()
+}
+
+// rateLimitedWriter throttles writes to roughly rate bytes per second.
+type rateLimitedWriter struct {
+	w       io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newRateLimitedWriter(w io.Writer, rate int64) *rateLimitedWriter {
+	return &rateLimitedWriter{w: w, rate: rate, start: time.Now()}
+}
+
+func (w *rateLimitedWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+	if w.rate > 0 {
+		due := time.Duration(float64(w.written) / float64(w.rate) * float64(time.Second))
+		if wait := due - time.Since(w.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
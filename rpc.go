@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+)
+
+// callTimeout bounds how long a call waits for the peer to reply.
+const callTimeout = 30 * time.Second
+
+var errNoReply = errors.New("peer did not reply")
+
+// expectReply registers a call, the reply to it arrives on the returned channel.
+func (s *Server) expectReply() (string, <-chan any) {
+	id := generateID()[:16]
+	ch := make(chan any, 1)
+	s.replyLock.Lock()
+	s.replies[id] = ch
+	s.replyLock.Unlock()
+	return id, ch
+}
+
+func (s *Server) dropReply(id string) {
+	s.replyLock.Lock()
+	delete(s.replies, id)
+	s.replyLock.Unlock()
+}
+
+// awaitReply waits for the reply of a call registered with expectReply.
+func (s *Server) awaitReply(ctx context.Context, replies <-chan any) (any, error) {
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(callTimeout):
+		return nil, errNoReply
+	}
+}
+
+// call sends msg to peer and waits for its reply.
+func (s *Server) call(ctx context.Context, peer peer2peer.Peer, msg *Message) (any, error) {
+	id, replies := s.expectReply()
+	defer s.dropReply(id)
+	msg.CallID = id
+	msg.RequestID = requestID(ctx)
+
+	unlock := s.lockSend(peer)
+	err := s.send(ctx, peer, msg)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.awaitReply(ctx, replies)
+}
+
+// reply answers call, the message from peer, with payload. It is sent off
+// the loop so the loop isn't held up behind an outgoing stream.
+func (s *Server) reply(ctx context.Context, peer peer2peer.Peer, call *Message, payload any) {
+	go func() {
+		defer s.lockSend(peer)()
+		msg := &Message{Payload: payload, RequestID: call.RequestID, ReplyTo: call.CallID}
+		if err := s.send(ctx, peer, msg); err != nil {
+			s.requestLogger(call.RequestID).Error("replying to peer failed", "peer", peer.RemoteAddr(), "err", err)
+		}
+	}()
+}
+
+func (s *Server) handleReply(from string, msg *Message) error {
+	// delivered under the lock, so a reply either reaches the channel
+	// before dropReply or finds the call gone
+	s.replyLock.Lock()
+	ch, ok := s.replies[msg.ReplyTo]
+	if ok {
+		select {
+		case ch <- msg.Payload:
+		default:
+		}
+	}
+	s.replyLock.Unlock()
+	if ok {
+		return nil
+	}
+	if peer, err := s.peer(from); err == nil {
+		discardRange(peer, msg.Payload)
+	}
+	return fmt.Errorf("unexpected reply (%s) from (%s)", msg.ReplyTo, from)
+}
+
+// peer returns the connection a message came in on.
+func (s *Server) peer(from string) (peer2peer.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[from]
+	if !ok {
+		return nil, fmt.Errorf("peer (%s) not found in peer map", from)
+	}
+	return peer, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/arpbansal/distributed_storage_system/api"
+	loadbalancer "github.com/arpbansal/distributed_storage_system/load_balancer"
+	"github.com/arpbansal/distributed_storage_system/metrics"
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const serveUsage = `usage: dfs serve [-config file] [flags]
+
+Runs a node as the YAML config file says, DFS_CONFIG names it when -config
+is missing. Environment variables override the file and flags override both.
+`
+
+// serve runs a node until ctx is done or one of its servers fails
+func serve(ctx context.Context, args []string, stderr io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, serveUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", os.Getenv("DFS_CONFIG"), "YAML config file")
+	id := fs.String("id", "", "node ID")
+	listen := fs.String("listen", "", "address peers connect to")
+	root := fs.String("storage-root", "", "directory the objects are stored in")
+	bootstrap := fs.String("bootstrap", "", "comma separated addresses of nodes to join")
+	apiListen := fs.String("api", "", "HTTP API address")
+	lbListen := fs.String("lb", "", "load balancer address")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			cfg.Node.ID = *id
+		case "listen":
+			cfg.Node.Listen = *listen
+		case "storage-root":
+			cfg.Node.StorageRoot = *root
+		case "bootstrap":
+			cfg.Node.Bootstrap = splitList(*bootstrap)
+		case "api":
+			cfg.API.Listen = *apiListen
+		case "lb":
+			cfg.LoadBalancer.Listen = *lbListen
+		}
+	})
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	logger, err := newLogger(stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	shutdownTracing, err := tracing.Setup(ctx, "distvault")
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	s, err := newNode(cfg)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 5)
+	go func() { errc <- s.Start() }()
+	defer s.Stop()
+
+	if err := startAPI(cfg, s, errc); err != nil {
+		return err
+	}
+
+	var consulClient *consulapi.Client
+	if cfg.Consul.Address != "" {
+		consulConfig := consulapi.DefaultConfig()
+		consulConfig.Address = cfg.Consul.Address
+		if consulClient, err = consulapi.NewClient(consulConfig); err != nil {
+			return err
+		}
+		serviceID := cfg.Consul.Service + "-" + s.ID
+		if err := registerAPI(consulClient, serviceID, cfg); err != nil {
+			slog.Error("registering with Consul failed", "service", serviceID, "err", err)
+		} else {
+			defer consulClient.Agent().ServiceDeregister(serviceID)
+		}
+	}
+
+	if cfg.LoadBalancer.Listen != "" {
+		if err := startLoadBalancer(ctx, cfg, consulClient, errc); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// newNode builds the server cfg describes, keeping its ID and encryption
+// key on disk so it comes back as the same node
+func newNode(cfg Config) (*Server, error) {
+	id, err := cfg.nodeID()
+	if err != nil {
+		return nil, err
+	}
+	key, err := cfg.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := cfg.conflictPolicy()
+	if err != nil {
+		return nil, err
+	}
+	transport := peer2peer.NewTCPtransport(peer2peer.TCPtransportOps{
+		ListenAddr:    cfg.Node.Listen,
+		HandshakeFunc: peer2peer.NOPHandshakeFunc,
+		Decoder:       peer2peer.DefaultDecoder{},
+		Logger:        slog.Default().With("node", id, "addr", cfg.Node.Listen),
+	})
+	s := NewServer(ServerOpts{
+		keyPath:           cfg.TLS.Key,
+		crtPath:           cfg.TLS.Cert,
+		ID:                id,
+		StorageRoot:       cfg.Node.StorageRoot,
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         transport,
+		BootstrapNodes:    cfg.Node.Bootstrap,
+		Enckey:            key,
+		ReplicationFactor: cfg.Replication.Factor,
+		RebalanceRate:     cfg.Replication.RebalanceRate,
+		ConflictPolicy:    policy,
+		Namespaces:        cfg.namespaces(),
+		LifecycleRules:    cfg.lifecycleRules(),
+		LifecycleInterval: cfg.Lifecycle.Interval,
+		UploadExpiry:      cfg.Lifecycle.UploadExpiry,
+		ErasureData:       cfg.Lifecycle.ErasureData,
+		ErasureParity:     cfg.Lifecycle.ErasureParity,
+	})
+	transport.OnPeer = s.OnPeer
+	transport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	if cfg.TLS.CA != "" {
+		if err := s.VerifyServerCert(create_certPool(cfg.TLS.CA, nil)); err != nil {
+			return nil, fmt.Errorf("verifying %s: %w", cfg.TLS.Cert, err)
+		}
+	}
+	return s, nil
+}
+
+// startAPI starts the HTTP API, and the gRPC and S3 servers if configured,
+// in front of s
+func startAPI(cfg Config, s *Server, errc chan<- error) error {
+	adapter := NewServerAdapter(s)
+	apiServer := api.NewAPIServer(adapter, cfg.API.Listen)
+	apiServer.UseLogger(s.logger)
+	var grpcServer *api.GRPCServer
+	if cfg.API.GRPCListen != "" {
+		grpcServer = api.NewGRPCServer(adapter, cfg.API.GRPCListen)
+		grpcServer.UseLogger(s.logger)
+	}
+
+	// with a credential file every API request needs an API key or signature
+	if cfg.API.Credentials != "" {
+		audit := io.Writer(os.Stderr)
+		if cfg.API.AuditLog != "" {
+			f, err := os.OpenFile(cfg.API.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			audit = f
+		}
+		auth, err := api.LoadAuthenticator(cfg.API.Credentials, audit)
+		if err != nil {
+			return err
+		}
+		apiServer.UseAuthenticator(auth)
+		if grpcServer != nil {
+			grpcServer.UseAuthenticator(auth)
+		}
+	}
+	// presigned URLs verify on any node, so every node shares the key
+	if cfg.API.PresignKey != "" {
+		apiServer.UsePresignKey([]byte(cfg.API.PresignKey))
+	}
+	if cfg.TLS.Cert != "" {
+		apiServer.UseTLS(cfg.TLS.Cert, cfg.TLS.Key)
+		if grpcServer != nil {
+			if err := grpcServer.UseTLS(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	go func() { errc <- apiServer.Start() }()
+	if grpcServer != nil {
+		go func() { errc <- grpcServer.Start() }()
+	}
+	if cfg.S3.AccessKeyID != "" {
+		s3Gateway := api.NewS3Gateway(adapter, cfg.S3.Listen, cfg.S3.Region, map[string]string{
+			cfg.S3.AccessKeyID: cfg.S3.SecretAccessKey,
+		})
+		s3Gateway.UseLogger(s.logger)
+		if cfg.TLS.Cert != "" {
+			s3Gateway.UseTLS(cfg.TLS.Cert, cfg.TLS.Key)
+		}
+		go func() { errc <- s3Gateway.Start() }()
+	}
+	return nil
+}
+
+// registerAPI registers the HTTP API of the node with Consul
+func registerAPI(client *consulapi.Client, serviceID string, cfg Config) error {
+	_, portStr, err := net.SplitHostPort(cfg.API.Listen)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	return registerWithConsul(client, serviceID, cfg.Consul.Service, cfg.Consul.Advertise, port)
+}
+
+// startLoadBalancer starts the load balancer and its admin handler
+func startLoadBalancer(ctx context.Context, cfg Config, consulClient *consulapi.Client, errc chan<- error) error {
+	lbCfg := cfg.LoadBalancer
+	strategy, err := lbStrategy(lbCfg.Strategy, lbCfg.Weights)
+	if err != nil {
+		return err
+	}
+	lb, err := loadbalancer.NewLoadBalancerWithStrategy(lbCfg.Backends, strategy)
+	if err != nil {
+		return err
+	}
+
+	var discovery loadbalancer.Discovery
+	switch {
+	case lbCfg.DiscoveryFile != "":
+		discovery = loadbalancer.NewFileDiscovery(lbCfg.DiscoveryFile)
+	case lbCfg.DiscoverySRV != "":
+		discovery = loadbalancer.NewDNSSRVDiscovery("http", "tcp", lbCfg.DiscoverySRV)
+	case consulClient != nil:
+		discovery = loadbalancer.NewConsulDiscovery(consulClient, cfg.Consul.Service)
+	}
+	if discovery != nil {
+		go lb.Watch(ctx, discovery)
+	}
+
+	lb.StartHealthCheck()
+	lb.RegisterMetrics(metrics.Default)
+	slog.Info("load balancer started", "addr", lbCfg.Listen)
+	go func() { errc <- http.ListenAndServe(lbCfg.Listen, lb) }()
+
+	// the admin handler has no authentication, keep it on loopback
+	if lbCfg.AdminListen != "" {
+		slog.Info("load balancer admin started", "addr", lbCfg.AdminListen)
+		go func() { errc <- http.ListenAndServe(lbCfg.AdminListen, lb.AdminHandler()) }()
+	}
+	return nil
+}
@@ -2,17 +2,24 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/arpbansal/distributed_storage_system/peer2peer"
+	"github.com/arpbansal/distributed_storage_system/tracing"
 	"github.com/hashicorp/raft"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	// certificatemanager "cloud.google.com/go/certificatemanager/apiv1" // May use this
 	// "google.golang.org/grpc/credentials/tls/certprovider" // May not use
 )
@@ -27,138 +34,460 @@ type ServerOpts struct {
 	BootstrapNodes    []string
 	Enckey            []byte
 	raft              *raft.Raft
+	// ReplicationFactor is how many nodes on the ring own each key,
+	// 0 replicates to every known node.
+	ReplicationFactor int
+	// RebalanceRate caps the bytes/sec streamed while rebalancing, 0 is unlimited.
+	RebalanceRate  int64
+	Namespaces     map[string]NamespaceOpts
+	ConflictPolicy ConflictPolicy
+	LifecycleRules []LifecycleRule
+	// LifecycleInterval is how often expired objects are swept, defaults to a minute
+	LifecycleInterval time.Duration
+	// UploadExpiry is how long a multipart upload may sit idle before its
+	// parts are reaped, defaults to a day
+	UploadExpiry time.Duration
+	// ErasureData and ErasureParity are the shards an object moved to the
+	// erasure-coded tier is split into, 4 and 2 by default
+	ErasureData   int
+	ErasureParity int
+	// Logger is where the server logs, slog.Default() when nil. Every
+	// record gets the node ID and address.
+	Logger *slog.Logger
 }
 
 type Server struct {
 	ServerOpts
 	peerLock sync.Mutex
 	peers    map[string]peer2peer.Peer
+	nodes    map[string]string // peer remote addr => announced listen addr
 	store    *Store
 	quitch   chan struct{}
+	// logger is Logger with the node ID and address
+	logger *slog.Logger
+
+	// sendLocks keep a message and the stream following it together on
+	// the wire, one per connection so a slow stream holds up only its peer
+	sendLocksMu    sync.Mutex
+	sendLocks      map[string]*sync.Mutex
+	membershipLock sync.Mutex
+	ring           *HashRing
+	rebalanceLock  sync.Mutex
+	replyLock      sync.Mutex
+	replies        map[string]chan any
+	draining       atomic.Bool
+	versionLock    sync.Mutex
+	hlc            hybridClock
+	keyLocks       [64]sync.Mutex
 }
 
 func NewServer(opts ServerOpts) *Server {
 	storeopts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		EncKey:            opts.Enckey,
 	}
 	if opts.ID == "" {
 		opts.ID = generateID()
 	}
+	ring := NewHashRing(defaultVirtualNodes)
+	var addr string
+	if opts.Transport != nil {
+		addr = opts.Transport.Addr()
+		ring.Add(addr)
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	logger := opts.Logger.With("node", opts.ID, "addr", addr)
+	storeopts.Logger = logger
 	return &Server{
 		ServerOpts: opts,
+		logger:     logger,
 		store:      NewStore(storeopts),
 		quitch:     make(chan struct{}),
 		peers:      make(map[string]peer2peer.Peer),
+		nodes:      make(map[string]string),
+		ring:       ring,
+		replies:    make(map[string]chan any),
+		sendLocks:  make(map[string]*sync.Mutex),
 	}
 }
 
 type Message struct {
 	Payload any
+	// RequestID is the ID of the client request the message serves, if
+	// any, so its path through the cluster can be followed in the logs
+	RequestID string
+	// Header carries the trace context of the sender
+	Header peer2peer.Header
+	// CallID is set on a message that expects a reply, the reply carries
+	// it back in ReplyTo
+	CallID  string
+	ReplyTo string
 }
 
+// MessageStoreFile is followed by the object encrypted with EncryptCopy,
+// the receiver keeps its copy in the clear under Key.
 type MessageStoreFile struct {
-	ID   string
 	Key  string
 	Size int64
+
+	Origin      string
+	Clock       VectorClock
+	HLC         HLCTimestamp
+	ETag        string
+	ExpiresAt   time.Time
+	ContentType string
+	UserMeta    map[string]string
+	// ModTime, when set, is kept instead of the time the copy is stored
+	ModTime time.Time
+	Parts   []ObjectPart
+	Erasure *ErasureMeta
 }
 
+type MessageDeleteFile struct {
+	Key string
+}
+
+// MessageGetFile asks for Length bytes of Key from Offset, a negative
+// Length reads to the end. It is sent as a call and answered with
+// MessageFileRange.
 type MessageGetFile struct {
+	Key    string
+	Offset int64
+	Length int64
+}
+
+// MessageFileRange answers MessageGetFile. If Found it is followed by
+// Length bytes, the range encrypted with EncryptCopy, and Size is that of
+// the whole object. An object in the erasure-coded tier is answered with
+// its Erasure and no range, the caller reads the shards.
+type MessageFileRange struct {
+	Found   bool
+	Size    int64
+	Length  int64
+	Erasure *ErasureMeta
+}
+
+// MessageStoreAck answers a MessageStoreFile or MessagePutFile sent as a
+// call once the write is done.
+type MessageStoreAck struct {
 	Key string
-	ID  string
+	// ETag and VersionID describe the object a forwarded write produced
+	ETag      string
+	VersionID string
+	// Err is why the write was refused, empty if it went through
+	Err string
+}
+
+// err returns the error the ack reports, errors the caller checks for
+// come back as themselves.
+func (ack MessageStoreAck) err() error {
+	switch ack.Err {
+	case "":
+		return nil
+	case errPreconditionFailed.Error():
+		return errPreconditionFailed
+	case errObjectTooLarge.Error():
+		return errObjectTooLarge
+	}
+	return errors.New(ack.Err)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// MessagePutFile hands a conditional write to the first owner of Key,
+// which checks Precondition against its own copy. It is followed by the
+// data encrypted with EncryptCopy and answered with MessageStoreAck.
+type MessagePutFile struct {
+	Key          string
+	Size         int64
+	Precondition Precondition
+	ExpiresAt    time.Time
+	ContentType  string
+	UserMeta     map[string]string
+	Parts        []ObjectPart
+}
+
+// MessageDeleteIf hands a conditional delete to the first owner of Key,
+// it is answered with MessageStoreAck.
+type MessageDeleteIf struct {
+	Key          string
+	Precondition Precondition
+}
+
+// MessageVersions changes the version index of Key on an owner, the
+// versions in Add are recorded and those in Remove dropped with their
+// data. Sent as a call it is answered with MessageStoreAck.
+type MessageVersions struct {
+	Key    string
+	Add    []VersionMeta
+	Remove []string
+}
+
+// MessageGetVersions asks an owner for the version index of Key, it is
+// answered with MessageVersionList.
+type MessageGetVersions struct {
+	Key string
+}
+
+type MessageVersionList struct {
+	Versions []VersionMeta
+}
+
+// MessageListFiles asks a peer for the live objects it holds under Prefix
+// whose keys sort after StartAfter, answered with MessageFileList.
+type MessageListFiles struct {
+	Prefix     string
+	StartAfter string
+}
+
+// MessageFileList is a page of objects, More is set when others follow.
+type MessageFileList struct {
+	Objects []ObjectMeta
+	More    bool
+}
+
+// MessageStatFile asks a peer for the metadata of its copy of Key.
+type MessageStatFile struct {
+	Key string
+}
+
+// MessageFileStat answers MessageStatFile, Found is false if the peer
+// holds no copy.
+type MessageFileStat struct {
+	Meta  ObjectMeta
+	Found bool
+}
+
+// MessageAnnounce tells a freshly connected peer which address this node
+// listens on, that address is its identity on the hash ring.
+type MessageAnnounce struct {
+	ID   string
+	Addr string
+}
+
+type MessageDecommission struct {
+	Addr string
 }
 
 func init() {
 	// Register the type with gob
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageFileRange{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessagePutFile{})
+	gob.Register(MessageDeleteIf{})
+	gob.Register(MessageAnnounce{})
+	gob.Register(MessageDecommission{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageVersions{})
+	gob.Register(MessageGetVersions{})
+	gob.Register(MessageVersionList{})
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageFileList{})
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageFileStat{})
 }
 
+// Get returns the data of key, in a versioned namespace that is the latest version.
 func (s *Server) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
-		log.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
-		// changes-1.01
-		// n, err = decryptCopy(s.Enckey, s.ID, key)
-		return r, err
-	}
-
-	fmt.Printf("[%s]don't have file (%s) locally, fetching from network\n", s.Transport.Addr(), key)
+	return s.GetContext(context.Background(), key)
+}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			Key: hashKeymd5(key),
-			ID:  s.ID,
-		},
-	}
-	if err := s.broadcast(&msg); err != nil {
+// GetContext is Get that gives up once ctx is done, including while the
+// object is being fetched from its replicas.
+func (s *Server) GetContext(ctx context.Context, key string) (r io.Reader, err error) {
+	ctx, span := tracing.Start(ctx, "Server.Get", trace.WithAttributes(
+		attribute.String("dfs.key", key),
+		attribute.String("dfs.node", s.Transport.Addr()),
+	))
+	defer func() { tracing.End(span, err) }()
+	key, err = s.liveKey(ctx, key)
+	if err != nil {
 		return nil, err
 	}
-	time.Sleep(500 * time.Millisecond)
-	for _, peer := range s.peers {
-		var filesize int64
-		binary.Read(peer, binary.LittleEndian, &filesize)
+	return s.fetchContext(ctx, key)
+}
 
-		n, err := s.store.WriteDecrypt(s.Enckey, s.ID, key, io.LimitReader(peer, filesize))
-		if err != nil {
-			return nil, err
-		}
+// liveKey returns the key the live data of key is stored under.
+func (s *Server) liveKey(ctx context.Context, key string) (string, error) {
+	if !s.namespaceOpts(key).Versioning {
+		return key, nil
+	}
+	latest, err := s.latestVersion(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if latest.DeleteMarker {
+		return "", errDeleteMarker
+	}
+	return versionKey(key, latest.VersionID), nil
+}
 
-		fmt.Printf("[%s] recieved (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
+// fetch reads key from local disk, falling back to its owners.
+func (s *Server) fetch(key string) (io.Reader, error) {
+	return s.fetchContext(context.Background(), key)
+}
 
-		peer.CloseStream()
+// fetchContext is fetch that returns ctx.Err() once ctx is done, no owner
+// is asked after that.
+func (s *Server) fetchContext(ctx context.Context, key string) (io.Reader, error) {
+	if s.store.Has(s.ID, key) {
+		s.requestLogger(requestID(ctx)).Debug("serving object from local disk", "key", key)
+		if meta, err := s.store.ReadMeta(s.ID, key); err == nil && meta.Erasure != nil {
+			_, r, err := s.readTiered(ctx, key, meta.Erasure, 0, -1)
+			return r, err
+		} else if err == nil && meta.Parts != nil {
+			_, r, err := s.store.ReadRange(s.ID, key, 0, -1)
+			return r, err
+		}
+		_, r, err := s.store.ReadContext(ctx, s.ID, key)
+		return r, err
 	}
-
-	_, r, err := s.store.Read(s.ID, key)
+	_, r, err := s.fetchRange(ctx, key, 0, -1)
 	return r, err
 }
 
 // store this file to disk and broadcast to all known peers
 func (s *Server) StoreData(key string, r io.Reader) error {
-	fileBuffer := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuffer)
+	_, err := s.StoreDataVersioned(key, r)
+	return err
+}
 
-	// changes-1.01
-	// Encrypt and write to disk
-	// encryptedBuffer := new(bytes.Buffer)
-	// if _, err := EncryptCopy(s.Enckey, tee, encryptedBuffer); err != nil {
-	// 	return err
-	// }
+// storeData writes key locally and to its replicas, returning its ETag.
+func (s *Server) storeData(ctx context.Context, key string, r io.Reader, attrs writeAttrs) (string, error) {
+	if s.draining.Load() {
+		return "", errDecommissioned
+	}
+	hashed := newETagReader(r)
 
-	size, err := s.store.Write(s.ID, key, tee) // replace tee
+	// every write descends from the copies of key already held, the local
+	// one with its siblings or, on a node that isn't an owner, those of
+	// the owners
+	prev, err := s.store.ReadMeta(s.ID, key)
+	held := []ObjectMeta{prev}
 	if err != nil {
-		return err
+		held = nil
+		if !s.ownsKey(key) {
+			held = s.ownerCopies(ctx, key)
+		}
 	}
+	var clock VectorClock
+	for _, meta := range held {
+		clock = clock.Merge(meta.Clock)
+		for _, sib := range meta.Siblings {
+			clock = clock.Merge(sib.Clock)
+		}
+	}
+	clock = clock.Increment(s.ID)
+	hlc := s.hlc.Now()
+
+	size, err := s.store.WriteContext(ctx, s.ID, key, hashed)
+	if err != nil {
+		return "", err
+	}
+	etag := hashed.ETag()
+	if attrs.ETag != "" {
+		etag = attrs.ETag
+	}
+	err = s.store.UpdateMeta(s.ID, key, func(meta *ObjectMeta) {
+		meta.Origin = s.ID
+		meta.Clock = clock
+		meta.HLC = hlc
+		meta.ETag = etag
+		meta.ExpiresAt = attrs.ExpiresAt
+		meta.ContentType = attrs.ContentType
+		meta.UserMeta = attrs.UserMeta
+		if !attrs.ModTime.IsZero() {
+			meta.ModTime = attrs.ModTime
+		}
+		meta.setLayout(attrs.Parts, attrs.Erasure)
+	})
+	if err != nil {
+		return "", err
+	}
+	// the write supersedes every local sibling and the parts or shards of
+	// the copy it replaced
+	s.pruneSiblings(clock, prev.Siblings)
+	s.dropParts(prev.Parts, attrs.Parts)
+	s.dropShards(key, prev.Erasure, attrs.Erasure)
+
+	// replicas are streamed from the copy on disk rather than from memory
+	_, local, err := s.store.ReadContext(ctx, s.ID, key)
+	if err != nil {
+		return "", err
+	}
+	defer local.(io.Closer).Close()
 
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKeymd5(key),
-			Size: size + 16, // Add 16 bytes due to encryption
+			Key:         key,
+			Size:        size + 16, // Add 16 bytes due to encryption
+			Origin:      s.ID,
+			Clock:       clock,
+			HLC:         hlc,
+			ETag:        etag,
+			ExpiresAt:   attrs.ExpiresAt,
+			ContentType: attrs.ContentType,
+			UserMeta:    attrs.UserMeta,
+			ModTime:     attrs.ModTime,
+			Parts:       attrs.Parts,
+			Erasure:     attrs.Erasure,
 		},
+		RequestID: attrs.RequestID,
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	peers := s.replicaPeers(key)
+	defer s.lockSend(peers...)()
+
+	replicated := time.Now()
+	if s.ReplicationFactor > 0 && len(peers) < s.ReplicationFactor-1 {
+		underReplicated.Inc(s.Transport.Addr())
+	}
+	if err := s.multicast(ctx, peers, &msg); err != nil {
+		replicationFailures.Inc(s.Transport.Addr(), "write")
+		return "", err
 	}
 
 	time.Sleep(time.Millisecond * 5)
 
 	// using a multiwriter here
 	var writers []io.Writer
-	for _, peer := range s.peers {
+	for _, peer := range peers {
 		writers = append(writers, peer)
 	}
 	mw := io.MultiWriter(writers...)
+	_, span := tracing.StartChild(ctx, "peer2peer.Stream", trace.WithAttributes(
+		attribute.Int("dfs.peers", len(peers)),
+		attribute.String("dfs.direction", "send"),
+	))
 	mw.Write([]byte{peer2peer.IncomingStream})
-	n, err := EncryptCopy(s.Enckey, fileBuffer, mw)
+	n, err := EncryptCopy(s.Enckey, local, mw)
+	span.SetAttributes(attribute.Int64("dfs.bytes", int64(n)))
+	tracing.End(span, err)
 	if err != nil {
-		return err
+		replicationFailures.Inc(s.Transport.Addr(), "write")
+		return "", err
+	}
+	replicationSendSeconds.ObserveSince(replicated, s.Transport.Addr())
+	if len(peers) > 0 && !s.ownsKey(key) {
+		// a node that doesn't own key only held it to pass it on
+		if err := s.store.Delete(s.ID, key); err != nil {
+			return "", err
+		}
 	}
 
-	fmt.Printf("[%s] recieved and written bytes to disk: %d", s.Transport.Addr(), n)
+	s.requestLogger(attrs.RequestID).Info("stored object", "key", key, "bytes", size, "replicas", len(peers), "sent_bytes", n)
 
-	return nil
+	return etag, nil
 }
 
 // To Be Removed
@@ -173,18 +502,98 @@ func (s *Server) stream(msg *Message) error {
 	return gob.NewEncoder(mw).Encode(msg)
 }
 
-func (s *Server) broadcast(msg *Message) error {
+func (s *Server) broadcast(ctx context.Context, msg *Message) error {
+	s.peerLock.Lock()
+	peers := make([]peer2peer.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.peerLock.Unlock()
+	return s.multicast(ctx, peers, msg)
+}
+
+func (s *Server) multicast(ctx context.Context, peers []peer2peer.Peer, msg *Message) error {
+	for _, peer := range peers {
+		if err := s.send(ctx, peer, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends msg to peer, with the trace context of ctx in its header so
+// the peer handles it as part of the same trace
+func (s *Server) send(ctx context.Context, peer peer2peer.Peer, msg *Message) (err error) {
+	ctx, span := tracing.StartChild(ctx, "peer2peer.Send", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("peer.address", peer.RemoteAddr().String()),
+		attribute.String("dfs.message", fmt.Sprintf("%T", msg.Payload)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	msg.Header = peer2peer.Header{}
+	tracing.Inject(ctx, msg.Header)
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
-	for _, peer := range s.peers {
-		peer.Send([]byte{peer2peer.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+	return peer.Send(peer2peer.Frame(buf.Bytes()))
+}
+
+// lockSend takes the send locks of peers and returns what releases them.
+// They are taken in address order, so callers locking overlapping sets of
+// peers can't deadlock.
+func (s *Server) lockSend(peers ...peer2peer.Peer) func() {
+	s.sendLocksMu.Lock()
+	locks := make(map[string]*sync.Mutex, len(peers))
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		if s.sendLocks[addr] == nil {
+			s.sendLocks[addr] = new(sync.Mutex)
 		}
+		locks[addr] = s.sendLocks[addr]
 	}
-	return nil
+	s.sendLocksMu.Unlock()
+
+	addrs := slices.Sorted(maps.Keys(locks))
+	for _, addr := range addrs {
+		locks[addr].Lock()
+	}
+	return func() {
+		for _, addr := range addrs {
+			locks[addr].Unlock()
+		}
+	}
+}
+
+// replicaPeers returns the connected peers that own key on the ring.
+func (s *Server) replicaPeers(key string) []peer2peer.Peer {
+	owners := s.owners(key)
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	var peers []peer2peer.Peer
+	for _, addr := range owners {
+		if addr == s.Transport.Addr() {
+			continue
+		}
+		if _, peer, ok := s.peerForNode(addr); ok {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// peerForNode looks up the connection to the node listening on addr,
+// caller must hold peerLock.
+func (s *Server) peerForNode(addr string) (string, peer2peer.Peer, bool) {
+	for from, nodeAddr := range s.nodes {
+		if nodeAddr != addr {
+			continue
+		}
+		if peer, ok := s.peers[from]; ok {
+			return from, peer, true
+		}
+	}
+	return "", nil, false
 }
 
 // store this file to disk
@@ -192,10 +601,33 @@ func (s *Server) broadcast(msg *Message) error {
 
 func (s *Server) OnPeer(p peer2peer.Peer) error {
 	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
 	s.peers[p.RemoteAddr().String()] = p
-	log.Printf("connected with remote peer: %s", p.RemoteAddr())
-	return nil
+	s.peerLock.Unlock()
+	s.logger.Info("connected to peer", "peer", p.RemoteAddr())
+
+	return s.send(context.Background(), p, &Message{
+		Payload: MessageAnnounce{
+			ID:   s.ID,
+			Addr: s.Transport.Addr(),
+		},
+	})
+}
+
+func (s *Server) OnPeerDisconnect(p peer2peer.Peer) {
+	from := p.RemoteAddr().String()
+	s.peerLock.Lock()
+	delete(s.peers, from)
+	addr, ok := s.nodes[from]
+	delete(s.nodes, from)
+	s.peerLock.Unlock()
+	s.sendLocksMu.Lock()
+	delete(s.sendLocks, from)
+	s.sendLocksMu.Unlock()
+
+	if ok {
+		s.logger.Warn("lost node, rebalancing", "lost", addr)
+		s.changeMembership((*HashRing).Remove, addr)
+	}
 }
 
 func (s *Server) Stop() {
@@ -204,23 +636,23 @@ func (s *Server) Stop() {
 
 func (s *Server) loop() {
 	defer func() {
-		log.Printf("file server stopped.")
+		s.logger.Info("file server stopped")
 		s.Transport.Close()
 	}()
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
 			if len(rpc.Payload) == 0 {
-				fmt.Println("Empty payload received at loop()")
+				s.logger.Warn("empty payload received", "from", rpc.From)
 				continue
 			}
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Println("decoding error:", err)
+				s.logger.Error("decoding message failed", "from", rpc.From, "err", err)
 				return
 			}
 			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handle message error: ", err)
+				s.requestLogger(msg.RequestID).Error("handling message failed", "from", rpc.From, "type", fmt.Sprintf("%T", msg.Payload), "err", err)
 			}
 		case <-s.quitch:
 			return
@@ -234,9 +666,9 @@ func (s *Server) bootstrapNewtowrk() error {
 			continue
 		}
 		go func(addr string) {
-			fmt.Printf("[%s] trying to connect with (%s)\n", s.Transport.Addr(), addr)
+			s.logger.Info("connecting to bootstrap node", "bootstrap", addr)
 			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
+				s.logger.Error("dialing bootstrap node failed", "bootstrap", addr, "err", err)
 			}
 		}(addr)
 	}
@@ -246,64 +678,162 @@ func (s *Server) bootstrapNewtowrk() error {
 // if write err don't get resolved, then might check pointer in handleMessage and handleStoreFile
 
 func (s *Server) handleMessage(from string, msg *Message) error {
+	ctx := withRequestID(context.Background(), msg.RequestID)
+	ctx = tracing.Extract(ctx, msg.Header)
+	if msg.ReplyTo != "" {
+		return s.handleReply(from, msg)
+	}
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleStoreFile(from, &v)
+		return s.handleStoreFile(ctx, from, msg, &v)
+
+	case MessagePutFile:
+		return s.handlePutFile(ctx, from, msg, &v)
+
+	case MessageDeleteIf:
+		return s.handleDeleteIf(ctx, from, msg, &v)
 
 	case MessageGetFile:
-		return s.handleMessageGetfile(from, &v)
+		return s.handleMessageGetfile(ctx, from, msg, &v)
+
+	case MessageAnnounce:
+		return s.handleAnnounce(from, &v)
+
+	case MessageDecommission:
+		return s.handleDecommission(from, &v)
+
+	case MessageDeleteFile:
+		return s.handleDeleteFile(from, &v)
+
+	case MessageVersions:
+		return s.handleVersions(ctx, from, msg, &v)
+
+	case MessageGetVersions:
+		return s.handleGetVersions(ctx, from, msg, &v)
+
+	case MessageListFiles:
+		return s.handleListFiles(ctx, from, msg, &v)
+
+	case MessageStatFile:
+		return s.handleStatFile(ctx, from, msg, &v)
 	}
 	return fmt.Errorf("unknown message type: %T", msg.Payload)
 }
 
-func (s *Server) handleMessageGetfile(from string, msg *MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
-	}
-	fmt.Printf("[%s] sending file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-	filesize, r, err := s.store.Read(msg.ID, msg.Key)
+func (s *Server) handleMessageGetfile(ctx context.Context, from string, call *Message, msg *MessageGetFile) error {
+	peer, err := s.peer(from)
 	if err != nil {
 		return err
 	}
+	// the range is sent off the loop, which would otherwise wait behind
+	// any other stream going out to the peer
+	go func() {
+		ctx, span := tracing.StartChild(ctx, "Server.handleGetFile", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+			attribute.String("dfs.key", msg.Key),
+			attribute.String("dfs.node", s.Transport.Addr()),
+		))
+		unlock := s.lockSend(peer)
+		err := s.sendRange(ctx, peer, call, msg)
+		unlock()
+		tracing.End(span, err)
+		if err != nil {
+			s.requestLogger(call.RequestID).Error("sending range to peer failed", "key", msg.Key, "peer", from, "err", err)
+		}
+	}()
+	return nil
+}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readCloser")
-		defer rc.Close()
+func (s *Server) handleStoreFile(ctx context.Context, from string, call *Message, msg *MessageStoreFile) (err error) {
+	ctx, span := tracing.StartChild(ctx, "Server.handleStoreFile", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("dfs.key", msg.Key),
+		attribute.String("dfs.node", s.Transport.Addr()),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
 	}
+	log := s.requestLogger(requestID(ctx)).With("key", msg.Key, "peer", from)
+	stream := io.LimitReader(peer, msg.Size)
+	// the read loop of the peer waits for the stream, so it is drained and
+	// handed back however the write went
+	defer func() {
+		io.Copy(io.Discard, stream)
+		peer.CloseStream()
+	}()
+	s.hlc.Update(msg.HLC)
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) not found in peer map", from)
+	res := resolveOverwrite
+	existing, err := s.store.ReadMeta(s.ID, msg.Key)
+	if err == nil {
+		res = resolveWrite(existing, *msg, s.ConflictPolicy)
 	}
 
-	// First send the "incomingstream" byte to the peer and then we can send
-	// file size as an int64
-	peer.Send([]byte{peer2peer.IncomingStream}) // TODO: why you couldn't figure out this
-	binary.Write(peer, binary.LittleEndian, filesize)
-	n, err := io.Copy(peer, r)
-	if err != nil {
-		return err
+	var n int64
+	switch res {
+	case resolveDiscard:
+		log.Info("discarded stale write")
+	case resolveSibling:
+		n, err = s.storeSibling(msg, stream)
+		log.Info("kept concurrent write as a sibling", "bytes", n)
+	default:
+		// the copy stays encrypted on disk, as it came in
+		n, err = s.store.WriteCiphertext(ctx, s.ID, msg.Key, stream)
+		if err == nil {
+			err = s.store.UpdateMeta(s.ID, msg.Key, func(meta *ObjectMeta) {
+				meta.Origin = msg.Origin
+				meta.Clock = msg.Clock.Merge(existing.Clock)
+				meta.HLC = msg.HLC
+				meta.ETag = msg.ETag
+				meta.ExpiresAt = msg.ExpiresAt
+				meta.ContentType = msg.ContentType
+				meta.UserMeta = msg.UserMeta
+				meta.Siblings = s.pruneSiblings(msg.Clock, existing.Siblings)
+				if !msg.ModTime.IsZero() {
+					meta.ModTime = msg.ModTime
+				}
+				meta.setLayout(msg.Parts, msg.Erasure)
+			})
+		}
+		if err == nil {
+			s.dropParts(existing.Parts, msg.Parts)
+			s.dropShards(msg.Key, existing.Erasure, msg.Erasure)
+		}
+		log.Info("stored replica", "bytes", n)
 	}
-	fmt.Printf("[%s] written %d bytes to peer %s\n", s.Transport.Addr(), n, from)
-	return nil
+	if call.CallID != "" {
+		s.reply(ctx, peer, call, MessageStoreAck{Key: msg.Key, Err: errString(err)})
+	}
+	return err
 }
 
-func (s *Server) handleStoreFile(from string, msg *MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) not found in peer map", from)
-	}
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size)) // check msg.ID or s.ID
+// handleStatFile replies with the metadata of the local copy of a key.
+func (s *Server) handleStatFile(ctx context.Context, from string, call *Message, msg *MessageStatFile) error {
+	peer, err := s.peer(from)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
-
-	// peer.(*peer2peer.TCPpeer).Wg.Done() deprecated Wg made private
-	peer.CloseStream()
-
+	meta, err := s.store.ReadMeta(s.ID, msg.Key)
+	s.reply(ctx, peer, call, MessageFileStat{Meta: meta, Found: err == nil})
 	return nil
+}
 
+// ownerCopies asks the owners of key for the metadata of their copies,
+// owners that can't be reached are left out.
+func (s *Server) ownerCopies(ctx context.Context, key string) []ObjectMeta {
+	var metas []ObjectMeta
+	for _, peer := range s.replicaPeers(key) {
+		reply, err := s.call(ctx, peer, &Message{Payload: MessageStatFile{Key: key}})
+		if err != nil {
+			s.requestLogger(requestID(ctx)).Warn("asking owner for its copy failed", "key", key, "peer", peer.RemoteAddr(), "err", err)
+			continue
+		}
+		if stat, ok := reply.(MessageFileStat); ok && stat.Found {
+			metas = append(metas, stat.Meta)
+		}
+	}
+	return metas
 }
 
 func (s *Server) Start() error {
@@ -313,6 +843,7 @@ func (s *Server) Start() error {
 	if len(s.BootstrapNodes) != 0 {
 	}
 	s.bootstrapNewtowrk()
+	go s.lifecycleLoop()
 	s.loop()
 	return nil
 }
@@ -321,18 +852,18 @@ func (s *Server) ServerlAlive() {
 	for {
 		addr := s.Transport.Addr()
 		if addr == "" {
-			log.Printf("Server Addr not available")
+			s.logger.Error("server address not available")
 			return
 		}
 		conn, err := net.Dial("tcp", addr)
 		if err != nil {
 			if opError, ok := err.(*net.OpError); ok && opError.Op == "dial" && opError.Err.Error() == "connect: connection refused" {
-				log.Printf("\nServer is not alive at %s", addr)
+				s.logger.Warn("server is not alive")
 			} else {
-				log.Printf("\nError connecting: %v", err)
+				s.logger.Error("connecting to server failed", "err", err)
 			}
 		} else {
-			log.Printf("Server is alive at %s", addr)
+			s.logger.Info("server is alive")
 			conn.Close()
 		}
 		time.Sleep(2 * time.Second)
@@ -0,0 +1,38 @@
+package main
+
+import "sort"
+
+// NodeStatus is what a node knows of itself and of the cluster.
+type NodeStatus struct {
+	ID                string
+	Addr              string
+	Draining          bool
+	ReplicationFactor int
+	Ring              []string
+	Peers             []PeerStatus
+}
+
+// PeerStatus is a connected peer, Addr stays empty until it announced the
+// address it listens on.
+type PeerStatus struct {
+	RemoteAddr string
+	Addr       string
+}
+
+// Status returns a snapshot of the node, its ring and its peers.
+func (s *Server) Status() NodeStatus {
+	status := NodeStatus{
+		ID:                s.ID,
+		Addr:              s.Transport.Addr(),
+		Draining:          s.draining.Load(),
+		ReplicationFactor: s.ReplicationFactor,
+		Ring:              s.ring.Members(),
+	}
+	s.peerLock.Lock()
+	for from := range s.peers {
+		status.Peers = append(status.Peers, PeerStatus{RemoteAddr: from, Addr: s.nodes[from]})
+	}
+	s.peerLock.Unlock()
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].RemoteAddr < status.Peers[j].RemoteAddr })
+	return status
+}
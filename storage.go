@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/aes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-/* TODO : sync whole folder to server
-when writing and reading specify the id*/
+/* TODO : when writing and reading specify the id
+(syncing a whole folder to the cluster is done by dvctl sync)*/
 
 const DefaultRootfolderName = "ggnetwork"
 
@@ -55,6 +64,10 @@ type StoreOpts struct {
 	// Root is folder name of root containg all of the folder/files of your system
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// Logger is where the store logs, slog.Default() when nil
+	Logger *slog.Logger
+	// EncKey decrypts the copies written with WriteCiphertext as they are read
+	EncKey []byte
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -66,6 +79,9 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+	// sizeLock keeps the object gauges in step with the files replaced
+	// and removed under it
+	sizeLock sync.Mutex
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -75,10 +91,15 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = DefaultRootfolderName
 	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
 
-	return &Store{
+	s := &Store{
 		StoreOpts: opts,
 	}
+	s.countObjects()
+	return s
 
 }
 
@@ -89,19 +110,48 @@ func (s *Store) Has(id string, key string) bool {
 }
 
 func (s *Store) Clear() error {
+	s.sizeLock.Lock()
+	defer s.sizeLock.Unlock()
+	storeObjects.Set(0, s.Root)
+	storeBytes.Set(0, s.Root)
 	return os.RemoveAll(s.Root)
 }
 
+// Delete removes the object and its sidecars, then the directories left
+// empty. Other keys can share a directory, so nothing else is touched.
 func (s *Store) Delete(id string, key string) error {
 	pathkey := s.PathTransformFunc(key)
-	defer func() {
-		log.Printf("deleted [%s] from disk", pathkey.Filename)
-	}()
-	return os.RemoveAll(s.Root + "/" + id + "/" + pathkey.FirstPathName())
-
+	path := s.Root + "/" + id + "/" + pathkey.FullPath()
+	if err := s.removeObjectFile(path); err != nil {
+		return err
+	}
+	for _, name := range []string{path + metaSuffix, path + versionsSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	top := filepath.Clean(s.Root + "/" + id)
+	for dir := filepath.Dir(path); len(dir) > len(top); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	storeObjectsDeleted.Inc(s.Root)
+	s.Logger.Debug("deleted object from disk", "path", pathkey.Filename)
+	return nil
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
+	return s.WriteContext(context.Background(), id, key, r)
+}
+
+// WriteContext is Write for the request in ctx, traced as a span of it
+func (s *Store) WriteContext(ctx context.Context, id string, key string, r io.Reader) (n int64, err error) {
+	_, span := tracing.StartChild(ctx, "Store.Write", trace.WithAttributes(attribute.String("dfs.stored_key", key)))
+	defer func() {
+		span.SetAttributes(attribute.Int64("dfs.bytes", n))
+		tracing.End(span, err)
+	}()
 	return s.writeStream(id, key, r)
 }
 
@@ -110,46 +160,166 @@ func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 // -Maybe just return file from readstream
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
+	return s.ReadContext(context.Background(), id, key)
 
 	// TODO: maybe implement cache
 }
 
-func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
+// ReadContext is Read for the request in ctx, traced as a span of it that
+// lasts until the reader is closed
+func (s *Store) ReadContext(ctx context.Context, id string, key string) (int64, io.Reader, error) {
+	_, span := tracing.StartChild(ctx, "Store.Read", trace.WithAttributes(attribute.String("dfs.stored_key", key)))
+	size, file, err := s.readStream(id, key, 0)
+	if err != nil {
+		tracing.End(span, err)
+		return 0, nil, err
+	}
+	span.SetAttributes(attribute.Int64("dfs.bytes", size))
+	file.span = span
+	return size, file, nil
+}
+
+// openCopy opens the file of an object, positioned at the start of its
+// data, and returns the size of the data. A copy written with
+// WriteCiphertext also has its iv returned, nil for a copy in the clear.
+func (s *Store) openCopy(id string, key string) (*os.File, int64, []byte, error) {
 	pathKey := s.PathTransformFunc(key)
 	fullPathwithroot := s.Root + "/" + id + "/" + pathKey.FullPath()
 	file, err := os.Open(fullPathwithroot)
 	if err != nil {
-		return 0, nil, err
+		return nil, 0, nil, err
 	}
 	fi, err := file.Stat()
 	if err != nil {
-		return 0, nil, err
+		file.Close()
+		return nil, 0, nil, err
 	}
-	return fi.Size(), file, nil
+	if meta, err := s.ReadMeta(id, key); err != nil || !meta.Encrypted {
+		return file, fi.Size(), nil, nil
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(file, iv); err != nil {
+		file.Close()
+		return nil, 0, nil, fmt.Errorf("copy (%s) is too short to hold an iv: %w", key, err)
+	}
+	return file, fi.Size() - aes.BlockSize, iv, nil
+}
 
+// readStream opens the object at byte offset of its data. An encrypted
+// copy is decrypted as it is read, from the keystream advanced to offset.
+func (s *Store) readStream(id string, key string, offset int64) (int64, *meteredFile, error) {
+	opened := time.Now()
+	file, size, iv, err := s.openCopy(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	f := &meteredFile{File: file, root: s.Root, opened: opened}
+	if iv != nil {
+		block, err := aes.NewCipher(s.EncKey)
+		if err != nil {
+			file.Close()
+			return 0, nil, err
+		}
+		f.stream = newCTRAt(block, iv, offset)
+	}
+	if _, err := file.Seek(int64(len(iv))+offset, io.SeekStart); err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	return size, f, nil
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openfileforwriting(id, key)
+// ReadRange returns length bytes of the object starting at offset, along
+// with the full size of the object. A negative length reads to the end.
+// An object assembled from an upload is read from its parts.
+func (s *Store) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	if meta, err := s.ReadMeta(id, key); err == nil && meta.Parts != nil {
+		return s.readParts(id, meta, offset, length)
+	}
+	size, file, err := s.readStream(id, key, offset)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
+	}
+	if length < 0 {
+		return size, file, nil
 	}
+	return size, readCloser{io.LimitReader(file, length), file}, nil
+}
 
-	n, err := decryptCopy(encKey, r, f)
+// ReadCiphertext returns the iv of an encrypted copy and length bytes of
+// its ciphertext from byte offset of the plaintext on, to be passed on as
+// they are and decrypted with decryptCopyAt. A negative length reads to
+// the end.
+func (s *Store) ReadCiphertext(id string, key string, offset int64, length int64) ([]byte, io.ReadCloser, error) {
+	opened := time.Now()
+	file, _, iv, err := s.openCopy(id, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if iv == nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("copy (%s) is not encrypted", key)
+	}
+	if _, err := file.Seek(aes.BlockSize+offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	f := &meteredFile{File: file, root: s.Root, opened: opened}
+	if length < 0 {
+		return iv, f, nil
+	}
+	return iv, readCloser{io.LimitReader(f, length), f}, nil
+}
 
-	return int64(n), err
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
-func (s *Store) WriteEncrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openfileforwriting(id, key)
+// WriteCiphertext stores r, an object encrypted with EncryptCopy, as it is
+// and marks the copy encrypted so reads decrypt it with EncKey. It returns
+// the size of the plaintext.
+func (s *Store) WriteCiphertext(ctx context.Context, id string, key string, r io.Reader) (int64, error) {
+	n, err := s.WriteContext(ctx, id, key, r)
 	if err != nil {
 		return 0, err
 	}
+	if n < aes.BlockSize {
+		return 0, fmt.Errorf("copy (%s) is too short to hold an iv", key)
+	}
+	err = s.UpdateMeta(id, key, func(meta *ObjectMeta) {
+		meta.Encrypted = true
+		meta.Size = n - aes.BlockSize
+	})
+	return n - aes.BlockSize, err
+}
 
-	n, err := EncryptCopy(encKey, r, f)
+func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+	return s.writeCopy(id, key, r, func(dst io.Writer, src io.Reader) (int, error) {
+		return decryptCopy(encKey, src, dst)
+	})
+}
 
-	return int64(n), err
+func (s *Store) WriteEncrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+	return s.writeCopy(id, key, r, func(dst io.Writer, src io.Reader) (int, error) {
+		return EncryptCopy(encKey, src, dst)
+	})
+}
+
+// writeCopy writes what copy makes of r through writeStream
+func (s *Store) writeCopy(id string, key string, r io.Reader, copy func(io.Writer, io.Reader) (int, error)) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := copy(pw, r)
+		pw.CloseWithError(err)
+	}()
+	n, err := s.writeStream(id, key, pr)
+	// r is left alone once this returns, whatever is still unread of it
+	pr.Close()
+	<-done
+	return n, err
 }
 
 // changes-1.01
@@ -179,10 +349,34 @@ func (s *Store) openfileforwriting(id string, key string) (*os.File, error) {
 
 }
 
+// writeStream writes to a temporary file renamed over the object once r is
+// fully read, so a failed write leaves the previous copy in place.
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openfileforwriting(id, key)
+	defer storeWriteSeconds.ObserveSince(time.Now(), s.Root)
+	pathKey := s.PathTransformFunc(key)
+	dir := s.Root + "/" + id + "/" + pathKey.PathName
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, pathKey.Filename+".tmp-*")
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	storeBytesWritten.Add(float64(n), s.Root)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := s.replaceObjectFile(f.Name(), s.Root+"/"+id+"/"+pathKey.FullPath(), n); err != nil {
+		return n, err
+	}
+	storeObjectsWritten.Inc(s.Root)
+	return n, s.writeMeta(ObjectMeta{ID: id, Key: key, Size: n, ModTime: time.Now()})
 }
@@ -67,6 +67,79 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	// both keys land in the same directory
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: func(key string) PathKey {
+		return PathKey{PathName: "shared/dir", Filename: key}
+	}})
+	id := generateID()
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "a") || !s.Has(id, "b") {
+		t.Error("want only a deleted")
+	}
+	if _, err := s.ReadMeta(id, "b"); err != nil {
+		t.Errorf("want the metadata of b kept have %v", err)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	keys := map[string]bool{"foo": true, "bar": true, "baz": true}
+	for key := range keys {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key+" data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(keys) {
+		t.Fatalf("want %d objects have %d", len(keys), len(objects))
+	}
+	for _, obj := range objects {
+		if !keys[obj.Key] || obj.ID != id || obj.Size != int64(len(obj.Key+" data")) {
+			t.Errorf("unexpected object %+v", obj)
+		}
+	}
+}
+
+func TestStoreReadRange(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	data := "0123456789"
+	if _, err := s.Write(id, "digits", bytes.NewReader([]byte(data))); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		offset, length int64
+		want           string
+	}{{0, 3, "012"}, {4, 2, "45"}, {7, -1, "789"}, {8, 10, "89"}} {
+		size, r, err := s.ReadRange(id, "digits", test.offset, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if size != int64(len(data)) || string(b) != test.want {
+			t.Errorf("want %s of %d have %s of %d", test.want, len(data), b, size)
+		}
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arpbansal/distributed_storage_system/erasure"
+)
+
+const (
+	defaultErasureData   = 4
+	defaultErasureParity = 2
+)
+
+// ErasureMeta describes an object in the erasure-coded tier. Its owners
+// keep only the metadata, the data is split into Data shards plus Parity
+// shards spread over the ring, and any Data of them rebuild it.
+type ErasureMeta struct {
+	// ID names the shards of this encoding of the object
+	ID     string `json:"id"`
+	Data   int    `json:"data"`
+	Parity int    `json:"parity"`
+	Size   int64  `json:"size"`
+}
+
+// shardKey is where shard i of the encoding id of key is stored.
+func shardKey(key string, id string, i int) string {
+	return fmt.Sprintf("%s?shard=%s.%d", key, id, i)
+}
+
+// shardOf returns the key a shard belongs to and the shard's index.
+func shardOf(key string) (string, int, bool) {
+	base, shard, found := strings.Cut(key, "?shard=")
+	if !found {
+		return "", 0, false
+	}
+	_, index, found := strings.Cut(shard, ".")
+	i, err := strconv.Atoi(index)
+	if !found || err != nil || i < 0 {
+		return "", 0, false
+	}
+	return base, i, true
+}
+
+func isShardKey(key string) bool {
+	_, _, ok := shardOf(key)
+	return ok
+}
+
+func (s *Server) erasureCode() (*erasure.Code, error) {
+	data, parity := s.ErasureData, s.ErasureParity
+	if data <= 0 {
+		data = defaultErasureData
+	}
+	if parity <= 0 {
+		parity = defaultErasureParity
+	}
+	return erasure.New(data, parity)
+}
+
+// dueForTier reports whether obj, stored under key, is due to move to the
+// erasure-coded tier at now.
+func (s *Server) dueForTier(key string, obj ObjectMeta, now time.Time) bool {
+	if obj.Erasure != nil || len(obj.Siblings) > 0 {
+		return false
+	}
+	for _, rule := range s.LifecycleRules {
+		if rule.TierAfter > 0 && strings.HasPrefix(key, rule.Prefix) && now.Sub(obj.ModTime) >= rule.TierAfter {
+			return true
+		}
+	}
+	return false
+}
+
+// moveToTier splits the local copy of obj into shards, stores each on its
+// owner and then replaces the copies of every owner of obj with its
+// metadata. The object keeps its ETag and modification time.
+func (s *Server) moveToTier(ctx context.Context, obj ObjectMeta) error {
+	code, err := s.erasureCode()
+	if err != nil {
+		return err
+	}
+	_, r, err := s.store.ReadRange(s.ID, obj.Key, 0, -1)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	em := &ErasureMeta{ID: generateID()[:16], Data: code.Data, Parity: code.Parity, Size: int64(len(data))}
+	for i, shard := range code.Split(data) {
+		if _, err := s.storeOnOwner(ctx, shardKey(obj.Key, em.ID, i), bytes.NewReader(shard)); err != nil {
+			s.dropShards(obj.Key, em, nil)
+			return err
+		}
+	}
+
+	// the shards are stored without the key lock, a write that came in
+	// meanwhile wins over them
+	base, _, _ := strings.Cut(obj.Key, "?version=")
+	unlock := s.lockKey(base)
+	defer unlock()
+	if meta, err := s.store.ReadMeta(s.ID, obj.Key); err != nil || meta.HLC != obj.HLC {
+		s.dropShards(obj.Key, em, nil)
+		return err
+	}
+	_, err = s.storeData(ctx, obj.Key, bytes.NewReader(nil), writeAttrs{
+		ExpiresAt:   obj.ExpiresAt,
+		ContentType: obj.ContentType,
+		UserMeta:    obj.UserMeta,
+		ETag:        obj.ETag,
+		ModTime:     obj.ModTime,
+		Erasure:     em,
+	})
+	return err
+}
+
+// readTiered reads a range of key from the erasure-coded tier. Shards are
+// fetched one at a time until enough are in to rebuild the data, which is
+// done in memory.
+func (s *Server) readTiered(ctx context.Context, key string, em *ErasureMeta, offset int64, length int64) (int64, io.ReadCloser, error) {
+	code, err := erasure.New(em.Data, em.Parity)
+	if err != nil {
+		return 0, nil, err
+	}
+	log := s.requestLogger(requestID(ctx))
+	shards := make([][]byte, em.Data+em.Parity)
+	found := 0
+	for i := range shards {
+		if found == em.Data {
+			break
+		}
+		shard, err := s.readShard(ctx, shardKey(key, em.ID, i))
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, nil, ctx.Err()
+			}
+			log.Warn("reading shard failed", "key", key, "shard", i, "err", err)
+			continue
+		}
+		shards[i] = shard
+		found++
+	}
+	data, err := code.Join(shards, em.Size)
+	if err != nil {
+		return 0, nil, fmt.Errorf("rebuilding (%s) from its shards: %w", key, err)
+	}
+	offset = min(max(offset, 0), em.Size)
+	end := em.Size
+	if length >= 0 {
+		end = min(end, offset+length)
+	}
+	return em.Size, io.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (s *Server) readShard(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.fetchContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return io.ReadAll(r)
+}
+
+// dropShards deletes the shards of an erasure-coded copy of key that was
+// replaced or deleted, unless kept is the same encoding. The first owner
+// of key does it for all of the owners.
+func (s *Server) dropShards(key string, em *ErasureMeta, kept *ErasureMeta) {
+	if em == nil || (kept != nil && kept.ID == em.ID) {
+		return
+	}
+	if owners := s.owners(key); len(owners) > 0 && owners[0] != s.Transport.Addr() {
+		return
+	}
+	for i := range em.Data + em.Parity {
+		if err := s.deleteObject(shardKey(key, em.ID, i)); err != nil {
+			s.logger.Warn("deleting shard failed", "key", key, "shard", i, "err", err)
+		}
+	}
+}
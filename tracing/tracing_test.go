@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+	"github.com/arpbansal/distributed_storage_system/tracing/tracingtest"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPropagation(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	ctx, span := Start(context.Background(), "sender")
+	header := peer2peer.Header{}
+	Inject(ctx, header)
+	span.End()
+	if header.Get("traceparent") == "" {
+		t.Fatalf("want a traceparent have %v", header)
+	}
+
+	_, child := StartChild(Extract(context.Background(), header), "receiver")
+	End(child, errors.New("failed"))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans have %d", len(spans))
+	}
+	receiver := spans[1]
+	if receiver.Parent.SpanID() != span.SpanContext().SpanID() || !receiver.Parent.IsRemote() {
+		t.Error("want the receiver a child of the remote sender")
+	}
+	if receiver.Status.Code != codes.Error || len(receiver.Events) != 1 {
+		t.Errorf("want the error recorded have %v", receiver.Status)
+	}
+}
+
+func TestStartChildWithoutParent(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	ctx, span := StartChild(context.Background(), "orphan")
+	span.End()
+	if span.IsRecording() || trace.SpanContextFromContext(ctx).IsValid() {
+		t.Error("want no span outside a trace")
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("want nothing exported have %d spans", len(spans))
+	}
+}
@@ -0,0 +1,24 @@
+// Package tracingtest records the spans of the storage system in memory for
+// tests to assert on.
+package tracingtest
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// NewInMemory installs a provider that keeps every span in memory as it
+// ends. The returned func puts the previous provider back.
+func NewInMemory() (*tracetest.InMemoryExporter, func()) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	return exporter, func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previous)
+	}
+}
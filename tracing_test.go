@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/tracing"
+	"github.com/arpbansal/distributed_storage_system/tracing/tracingtest"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanNamed returns the first span called name
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("want a %s span", name)
+	return tracetest.SpanStub{}
+}
+
+func TestPutAndGetTraced(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	s := newTestServer(t, nil)
+	ctx, parent := tracing.Start(context.Background(), "request")
+	if _, err := s.PutContext(ctx, "a.txt", strings.NewReader("data"), PutOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	request := spanNamed(t, spans, "request")
+	store := spanNamed(t, spans, "Server.StoreData")
+	if store.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Error("want Server.StoreData a child of the request")
+	}
+	for _, name := range []string{"Store.Write", "Store.Read"} {
+		if span := spanNamed(t, spans, name); span.Parent.SpanID() != store.SpanContext.SpanID() {
+			t.Errorf("want %s a child of Server.StoreData", name)
+		}
+	}
+
+	exporter.Reset()
+	r, err := s.GetContext(context.Background(), "a.txt")
+	if got := readAll(t, r, err); got != "data" {
+		t.Fatalf("want data have %q", got)
+	}
+	spans = exporter.GetSpans()
+	get := spanNamed(t, spans, "Server.Get")
+	if get.Parent.IsValid() {
+		t.Error("want Server.Get to start a trace")
+	}
+	if read := spanNamed(t, spans, "Store.Read"); read.Parent.SpanID() != get.SpanContext.SpanID() {
+		t.Error("want Store.Read a child of Server.Get")
+	}
+}
+
+func TestGetRangeTraced(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	s := newTestServer(t, nil)
+	if _, err := s.Put("a.txt", strings.NewReader("some data"), PutOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, parent := tracing.Start(context.Background(), "request")
+	_, r, err := s.GetRangeContext(ctx, "a.txt", 5, 4)
+	if got := readAll(t, r, err); got != "data" {
+		t.Fatalf("want data have %q", got)
+	}
+	parent.End()
+	if get := spanNamed(t, exporter.GetSpans(), "Server.GetRange"); get.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("want Server.GetRange a child of the request")
+	}
+}
+
+func TestStoreUntracedWithoutParent(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	s := newTestServer(t, nil)
+	if _, err := s.store.Write(s.ID, "a.txt", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("want no spans for disk I/O outside a trace have %d", len(spans))
+	}
+}
+
+// framePeer keeps the frames sent to it
+type framePeer struct {
+	net.Conn
+	frames [][]byte
+}
+
+func (p *framePeer) Send(b []byte) error {
+	p.frames = append(p.frames, b)
+	return nil
+}
+
+func (p *framePeer) RemoteAddr() net.Addr { return &net.TCPAddr{Port: 4000} }
+func (p *framePeer) CloseStream()         {}
+
+func TestSendPropagatesTrace(t *testing.T) {
+	exporter, restore := tracingtest.NewInMemory()
+	defer restore()
+
+	s := newTestServer(t, nil)
+	peer := &framePeer{}
+	ctx, parent := tracing.Start(context.Background(), "request")
+	if err := s.send(ctx, peer, &Message{Payload: MessageGetFile{Key: "k"}}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	if len(peer.frames) != 1 {
+		t.Fatalf("want one frame have %d", len(peer.frames))
+	}
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(peer.frames[0][5:])).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	send := spanNamed(t, exporter.GetSpans(), "peer2peer.Send")
+	if send.SpanKind != trace.SpanKindProducer {
+		t.Errorf("want a producer span have %v", send.SpanKind)
+	}
+	remote := trace.SpanContextFromContext(tracing.Extract(context.Background(), msg.Header))
+	if remote.TraceID() != parent.SpanContext().TraceID() || remote.SpanID() != send.SpanContext.SpanID() {
+		t.Errorf("want the header to carry the send span have %v", msg.Header)
+	}
+}
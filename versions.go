@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const versionsSuffix = ".versions"
+
+var (
+	errNoSuchVersion = errors.New("no such version")
+	errDeleteMarker  = errors.New("latest version is a delete marker")
+)
+
+// NamespaceOpts configures every key sharing the namespace, which is the
+// part of a key before its first "/" ("" for keys without one).
+type NamespaceOpts struct {
+	// Versioning keeps every write of a key instead of overwriting it
+	Versioning bool
+	// MaxObjectSize rejects writes larger than this many bytes, 0 is no limit
+	MaxObjectSize int64
+}
+
+func namespaceOf(key string) string {
+	ns, _, found := strings.Cut(key, "/")
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+func (s *Server) namespaceOpts(key string) NamespaceOpts {
+	return s.Namespaces[namespaceOf(key)]
+}
+
+// VersionMeta describes one version of a key in a versioned namespace.
+type VersionMeta struct {
+	VersionID    string    `json:"version_id"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	ETag         string    `json:"etag,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	DeleteMarker bool      `json:"delete_marker,omitempty"`
+}
+
+// version ids sort by creation time, the random tail breaks ties
+func newVersionID() string {
+	tail := make([]byte, 4)
+	rand.Read(tail)
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(tail))
+}
+
+// versionKey is the key a single version's data is stored under.
+func versionKey(key string, versionID string) string {
+	return key + "?version=" + versionID
+}
+
+func (s *Store) versionsPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return s.Root + "/" + id + "/" + pathKey.FullPath() + versionsSuffix
+}
+
+// Versions returns the version history of key, oldest first.
+func (s *Store) Versions(id string, key string) ([]VersionMeta, error) {
+	b, err := os.ReadFile(s.versionsPath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []VersionMeta
+	err = json.Unmarshal(b, &versions)
+	return versions, err
+}
+
+func (s *Store) writeVersions(id string, key string, versions []VersionMeta) error {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].VersionID < versions[j].VersionID })
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+id+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(s.versionsPath(id, key), b, 0644)
+}
+
+// removeVersions drops the version index of key.
+func (s *Store) removeVersions(id string, key string) error {
+	err := os.Remove(s.versionsPath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// LatestVersion returns the newest version of key, which may be a delete marker.
+func (s *Store) LatestVersion(id string, key string) (VersionMeta, error) {
+	versions, err := s.Versions(id, key)
+	if err != nil {
+		return VersionMeta{}, err
+	}
+	if len(versions) == 0 {
+		return VersionMeta{}, errNoSuchVersion
+	}
+	return versions[len(versions)-1], nil
+}
+
+// versions returns the version history of key, asking an owner for it if
+// this node isn't one.
+func (s *Server) versions(ctx context.Context, key string) ([]VersionMeta, error) {
+	if s.ownsKey(key) {
+		return s.store.Versions(s.ID, key)
+	}
+	var lastErr error
+	for _, peer := range s.replicaPeers(key) {
+		reply, err := s.call(ctx, peer, &Message{Payload: MessageGetVersions{Key: key}})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if list, ok := reply.(MessageVersionList); ok {
+			return list.Versions, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return s.store.Versions(s.ID, key)
+}
+
+// latestVersion returns the newest version of key, which may be a delete marker.
+func (s *Server) latestVersion(ctx context.Context, key string) (VersionMeta, error) {
+	versions, err := s.versions(ctx, key)
+	if err != nil {
+		return VersionMeta{}, err
+	}
+	if len(versions) == 0 {
+		return VersionMeta{}, errNoSuchVersion
+	}
+	return versions[len(versions)-1], nil
+}
+
+// changeVersions records the versions in add and drops those in remove
+// from the history of key, on this node if it owns key and on the other
+// owners.
+func (s *Server) changeVersions(ctx context.Context, key string, add []VersionMeta, remove []string) error {
+	peers := s.replicaPeers(key)
+	if s.ownsKey(key) || len(peers) == 0 {
+		if err := s.applyVersions(key, add, remove); err != nil {
+			return err
+		}
+	}
+	msg := Message{
+		Payload:   MessageVersions{Key: key, Add: add, Remove: remove},
+		RequestID: requestID(ctx),
+	}
+	defer s.lockSend(peers...)()
+	return s.multicast(ctx, peers, &msg)
+}
+
+// applyVersions changes the local history of key, the data of removed
+// versions goes with them.
+func (s *Server) applyVersions(key string, add []VersionMeta, remove []string) error {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+	versions, err := s.store.Versions(s.ID, key)
+	if err != nil {
+		return err
+	}
+	kept := versions[:0]
+	for _, v := range versions {
+		if slices.Contains(remove, v.VersionID) {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	for _, v := range add {
+		if !slices.ContainsFunc(kept, func(have VersionMeta) bool { return have.VersionID == v.VersionID }) {
+			kept = append(kept, v)
+		}
+	}
+	for _, versionID := range remove {
+		if s.store.Has(s.ID, versionKey(key, versionID)) {
+			if err := s.deleteLocal(versionKey(key, versionID)); err != nil {
+				return err
+			}
+		}
+	}
+	return s.store.writeVersions(s.ID, key, kept)
+}
+
+func (s *Server) handleVersions(ctx context.Context, from string, call *Message, msg *MessageVersions) error {
+	err := s.applyVersions(msg.Key, msg.Add, msg.Remove)
+	if call.CallID != "" {
+		peer, perr := s.peer(from)
+		if perr != nil {
+			return perr
+		}
+		s.reply(ctx, peer, call, MessageStoreAck{Key: msg.Key, Err: errString(err)})
+	}
+	return err
+}
+
+func (s *Server) handleGetVersions(ctx context.Context, from string, call *Message, msg *MessageGetVersions) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+	versions, err := s.store.Versions(s.ID, msg.Key)
+	s.reply(ctx, peer, call, MessageVersionList{Versions: versions})
+	return err
+}
+
+// StoreDataVersioned stores key like StoreData and returns the id of the
+// version written, which is empty when the namespace isn't versioned.
+func (s *Server) StoreDataVersioned(key string, r io.Reader) (string, error) {
+	res, err := s.Put(key, r, PutOpts{})
+	return res.VersionID, err
+}
+
+// storeVersion writes r as a new version of key, caller holds the key lock.
+func (s *Server) storeVersion(ctx context.Context, key string, r io.Reader, attrs writeAttrs) (string, string, error) {
+	versionID := newVersionID()
+	counter := &countingReader{r: r}
+	etag, err := s.storeData(ctx, versionKey(key, versionID), counter, attrs)
+	if err != nil {
+		return "", "", err
+	}
+	size := counter.n
+	if attrs.Parts != nil {
+		size = partsSize(attrs.Parts)
+	}
+	err = s.changeVersions(ctx, key, []VersionMeta{{
+		VersionID: versionID,
+		Size:      size,
+		ModTime:   time.Now(),
+		ETag:      etag,
+		ExpiresAt: attrs.ExpiresAt,
+	}}, nil)
+	return versionID, etag, err
+}
+
+// GetVersion returns the data of a single version of key.
+func (s *Server) GetVersion(key string, versionID string) (io.Reader, error) {
+	versions, err := s.versions(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.VersionID != versionID {
+			continue
+		}
+		if v.DeleteMarker {
+			return nil, errDeleteMarker
+		}
+		return s.fetch(versionKey(key, versionID))
+	}
+	return nil, errNoSuchVersion
+}
+
+func (s *Server) ListVersions(key string) ([]VersionMeta, error) {
+	return s.versions(context.Background(), key)
+}
+
+// Delete removes key from this node. In a versioned namespace the history is
+// kept and a delete marker becomes the latest version instead.
+func (s *Server) Delete(key string) error {
+	return s.DeleteIf(key, Precondition{})
+}
+
+// delete is Delete without the key lock.
+func (s *Server) delete(key string) error {
+	if !s.namespaceOpts(key).Versioning {
+		return s.deleteObject(key)
+	}
+	return s.changeVersions(context.Background(), key, []VersionMeta{{
+		VersionID:    newVersionID(),
+		ModTime:      time.Now(),
+		DeleteMarker: true,
+	}}, nil)
+}
+
+// DeleteVersion permanently removes one version from the history of key.
+func (s *Server) DeleteVersion(key string, versionID string) error {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	ctx := context.Background()
+	versions, err := s.versions(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if v.VersionID == versionID {
+			return s.changeVersions(ctx, key, nil, []string{versionID})
+		}
+	}
+	return errNoSuchVersion
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
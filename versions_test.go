@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/arpbansal/distributed_storage_system/peer2peer"
+)
+
+func newTestServer(t *testing.T, namespaces map[string]NamespaceOpts) *Server {
+	return NewServer(ServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         peer2peer.NewTCPtransport(peer2peer.TCPtransportOps{ListenAddr: ":0"}),
+		Enckey:            newEncryptionkey(),
+		Namespaces:        namespaces,
+	})
+}
+
+func readAll(t *testing.T, r io.Reader, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	return string(b)
+}
+
+func TestVersionedNamespace(t *testing.T) {
+	s := newTestServer(t, map[string]NamespaceOpts{"docs": {Versioning: true}})
+	key := "docs/readme.txt"
+
+	v1, err := s.StoreDataVersioned(key, bytes.NewReader([]byte("first")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := s.StoreDataVersioned(key, bytes.NewReader([]byte("second")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1 == "" || v1 == v2 {
+		t.Fatalf("want distinct version ids have %q and %q", v1, v2)
+	}
+
+	r, err := s.Get(key)
+	if got := readAll(t, r, err); got != "second" {
+		t.Errorf("want latest version have %s", got)
+	}
+	r, err = s.GetVersion(key, v1)
+	if got := readAll(t, r, err); got != "first" {
+		t.Errorf("want first version have %s", got)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(key); err != errDeleteMarker {
+		t.Errorf("want delete marker error have %v", err)
+	}
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || !versions[2].DeleteMarker || versions[0].Size != 5 {
+		t.Errorf("unexpected history %+v", versions)
+	}
+
+	// removing the marker brings the previous version back
+	if err := s.DeleteVersion(key, versions[2].VersionID); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s.Get(key)
+	if got := readAll(t, r, err); got != "second" {
+		t.Errorf("want second version after removing marker have %s", got)
+	}
+}
+
+func TestUnversionedNamespace(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	v, err := s.StoreDataVersioned("plain", bytes.NewReader([]byte("data")))
+	if err != nil || v != "" {
+		t.Fatalf("want no version id have %q, %v", v, err)
+	}
+	if err := s.Delete("plain"); err != nil {
+		t.Fatal(err)
+	}
+	if s.store.Has(s.ID, "plain") {
+		t.Error("expected key to be removed")
+	}
+}
+
+// TestVersionIndexFollowsOwners writes a versioned key through a node that
+// doesn't own it, then has a new node take it over.
+func TestVersionIndexFollowsOwners(t *testing.T) {
+	opts := ServerOpts{ReplicationFactor: 1, Namespaces: map[string]NamespaceOpts{"docs": {Versioning: true}}}
+	a := startTestNode(t, opts)
+	b := startTestNode(t, opts)
+	c := startTestNode(t, opts)
+	connectNodes(t, a, b)
+
+	// a key b owns now and c takes over once it joins
+	joined := NewHashRing(defaultVirtualNodes)
+	for _, s := range []*Server{a, b, c} {
+		joined.Add(s.Transport.Addr())
+	}
+	key := ""
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("docs/%d.txt", i)
+		if b.owners(candidate)[0] == b.Transport.Addr() && joined.Owners(ringKey(candidate), 1)[0] == c.Transport.Addr() {
+			key = candidate
+		}
+	}
+
+	for _, data := range []string{"first", "second"} {
+		if _, err := a.StoreDataVersioned(key, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if versions, _ := a.store.Versions(a.ID, key); len(versions) != 0 {
+		t.Errorf("a doesn't own the key but kept its index %+v", versions)
+	}
+	for _, s := range []*Server{a, b} {
+		versions, err := s.ListVersions(key)
+		if err != nil || len(versions) != 2 {
+			t.Fatalf("want both versions listed have %+v, %v", versions, err)
+		}
+	}
+
+	connectNodes(t, c, a)
+	connectNodes(t, c, b)
+	eventually(t, "c to take over the index", func() bool {
+		versions, _ := c.store.Versions(c.ID, key)
+		held, _ := b.store.Versions(b.ID, key)
+		return len(versions) == 2 && len(held) == 0
+	})
+	r, err := c.Get(key)
+	if got := readAll(t, r, err); got != "second" {
+		t.Errorf("want latest version from the new owner have %s", got)
+	}
+	r, err = a.Get(key)
+	if got := readAll(t, r, err); got != "second" {
+		t.Errorf("want latest version through a have %s", got)
+	}
+}